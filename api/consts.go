@@ -51,6 +51,19 @@ const (
 	LUA_OPLE        // <=
 )
 
+/* garbage-collection options */
+const (
+	LUA_GCSTOP = iota
+	LUA_GCRESTART
+	LUA_GCCOLLECT
+	LUA_GCCOUNT
+	LUA_GCCOUNTB
+	LUA_GCSTEP
+	LUA_GCSETPAUSE
+	LUA_GCSETSTEPMUL
+	LUA_GCISRUNNING = 9
+)
+
 /* thread status */
 const (
 	LUA_OK = iota
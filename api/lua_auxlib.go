@@ -15,6 +15,8 @@ type AuxLib interface {
 	CheckInteger(arg int) int64
 	CheckNumber(arg int) float64
 	CheckString(arg int) string
+	CheckUserData(arg int, tname string) interface{}
+	TestUserData(arg int, tname string) interface{}
 	OptInteger(arg int, d int64) int64
 	OptNumber(arg int, d float64) float64
 	OptString(arg int, d string) string
@@ -25,11 +27,16 @@ type AuxLib interface {
 	LoadFileX(filename, mode string) int
 	LoadString(s string) int
 	/* Other functions */
+	Where(lvl int)
+	Traceback(l1 LuaState, msg string, level int)
 	TypeName2(idx int) string
 	ToString2(idx int) string
 	Len2(idx int) int64
 	GetSubTable(idx int, fname string) bool
 	GetMetafield(obj int, e string) LuaType
+	NewMetatable(tname string) bool
+	GetMetatable2(tname string) LuaType
+	SetMetatable2(tname string)
 	CallMeta(obj int, e string) bool
 	OpenLibs()
 	RequireF(modname string, openf GoFunction, glb bool)
@@ -1,5 +1,7 @@
 package api
 
+import "io"
+
 type LuaType = int
 type ArithOp = int
 type CompareOp = int
@@ -41,6 +43,7 @@ type BasicAPI interface {
 	IsString(idx int) bool
 	IsTable(idx int) bool
 	IsThread(idx int) bool
+	IsUserData(idx int) bool
 	IsFunction(idx int) bool
 	IsGoFunction(idx int) bool
 	ToBoolean(idx int) bool
@@ -52,6 +55,7 @@ type BasicAPI interface {
 	ToStringX(idx int) (string, bool)
 	ToGoFunction(idx int) GoFunction
 	ToThread(idx int) LuaState
+	ToUserData(idx int) interface{}
 	ToPointer(idx int) interface{}
 	RawLen(idx int) uint
 	/* push functions (Go -> stack) */
@@ -72,6 +76,7 @@ type BasicAPI interface {
 	/* get functions (Lua -> stack) */
 	NewTable()
 	CreateTable(nArr, nRec int)
+	NewUserData(data interface{})
 	GetTable(idx int) LuaType
 	GetField(idx int, k string) LuaType
 	GetI(idx int, i int64) LuaType
@@ -90,8 +95,11 @@ type BasicAPI interface {
 	Register(name string, f GoFunction)
 	/* 'load' and 'call' functions (load and run Lua code) */
 	Load(chunk []byte, chunkName, mode string) int
+	LoadReader(r io.Reader, chunkName, mode string) int
 	Call(nArgs, nResults int)
 	PCall(nArgs, nResults, msgh int) int
+	/* garbage-collection function */
+	GC(what, data int) int
 	/* miscellaneous functions */
 	Len(idx int)
 	Concat(n int)
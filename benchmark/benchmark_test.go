@@ -0,0 +1,43 @@
+package benchmark
+
+import (
+	"io/ioutil"
+	"lxa/api"
+	"lxa/binchunk"
+	"lxa/compiler"
+	"lxa/state"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runs each script in this directory on the golua vm, compiled once and
+// with print silenced: go test -bench . ./benchmark
+func BenchmarkScripts(b *testing.B) {
+	files, err := filepath.Glob("*.lxa")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, filename := range files {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			b.Fatal(err)
+		}
+		proto, err := compiler.TryCompile(string(src), filename)
+		if err != nil {
+			b.Fatal(err)
+		}
+		chunk := binchunk.Dump(proto)
+		b.Run(strings.TrimSuffix(filename, ".lxa"), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ls := state.New()
+				ls.OpenLibs()
+				ls.Register("print", func(api.LuaState) int { return 0 })
+				if ls.Load(chunk, filename, "b") != api.LUA_OK ||
+					ls.PCall(0, 0, 0) != api.LUA_OK {
+					b.Fatal(ls.ToString(-1))
+				}
+			}
+		})
+	}
+}
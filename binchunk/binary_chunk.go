@@ -1,5 +1,7 @@
 package binchunk
 
+import "fmt"
+
 const (
 	LUA_SIGNATURE    = "\x1bLua"
 	LUAC_VERSION     = 0x53
@@ -12,6 +14,7 @@ const (
 	LUA_NUMBER_SIZE  = 8
 	LUAC_INT         = 0x5678
 	LUAC_NUM         = 370.5
+	LUAC_VERSION_54  = 0x54
 )
 
 const (
@@ -23,6 +26,19 @@ const (
 	TAG_LONG_STR  = 0x14
 )
 
+/* constant tags of Lua 5.4, where booleans are two types */
+const (
+	TAG54_NIL       = 0x00
+	TAG54_FALSE     = 0x01
+	TAG54_TRUE      = 0x11
+	TAG54_INTEGER   = 0x03
+	TAG54_NUMBER    = 0x13
+	TAG54_SHORT_STR = 0x04
+	TAG54_LONG_STR  = 0x14
+)
+
+const LUAI_MAXSHORTLEN_54 = 40
+
 type binaryChunk struct {
 	header
 	sizeUpvalues byte // ?
@@ -76,6 +92,14 @@ func IsBinaryChunk(data []byte) bool {
 		string(data[:4]) == LUA_SIGNATURE
 }
 
+// returns the Lua version a precompiled chunk is for, 0x53 or 0x54
+func Version(data []byte) byte {
+	if len(data) > 4 {
+		return data[4]
+	}
+	return 0
+}
+
 func Undump(data []byte) *Prototype {
 	reader := &reader{data}
 	reader.checkHeader()
@@ -83,6 +107,18 @@ func Undump(data []byte) *Prototype {
 	return reader.readProto("")
 }
 
+// TryUndump is Undump returning an error instead of panicking on a
+// malformed chunk
+// lua-5.3.4/src/lundump.c#luaU_undump()
+func TryUndump(data []byte) (proto *Prototype, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return Undump(data), nil
+}
+
 func Dump(proto *Prototype) []byte {
 	writer := &writer{}
 	writer.writeHeader()
@@ -90,3 +126,20 @@ func Dump(proto *Prototype) []byte {
 	writer.writeProto(proto)
 	return writer.data
 }
+
+// reads a Lua 5.4 chunk, whose code only the disassembler understands
+func Undump54(data []byte) *Prototype {
+	reader := &reader{data}
+	reader.checkHeader54()
+	reader.readByte() // size_upvalues
+	return reader.readProto54("")
+}
+
+// writes a prototype whose code was generated for Lua 5.4
+func Dump54(proto *Prototype) []byte {
+	writer := &writer{}
+	writer.writeHeader54()
+	writer.writeByte(byte(len(proto.Upvalues))) // size_upvalues
+	writer.writeProto54(proto, "")
+	return writer.data
+}
@@ -7,30 +7,49 @@ type reader struct {
 	data []byte
 }
 
+// lua-5.3.4/src/lundump.c#error()
+func (self *reader) need(n uint64) {
+	if uint64(len(self.data)) < n {
+		panic("truncated precompiled chunk")
+	}
+}
+
 func (self *reader) readByte() byte {
+	self.need(1)
 	b := self.data[0]
 	self.data = self.data[1:]
 	return b
 }
 
 func (self *reader) readBytes(n uint) []byte {
+	self.need(uint64(n))
 	bytes := self.data[:n]
 	self.data = self.data[n:]
 	return bytes
 }
 
 func (self *reader) readUint32() uint32 {
+	self.need(4)
 	i := binary.LittleEndian.Uint32(self.data)
 	self.data = self.data[4:]
 	return i
 }
 
 func (self *reader) readUint64() uint64 {
+	self.need(8)
 	i := binary.LittleEndian.Uint64(self.data)
 	self.data = self.data[8:]
 	return i
 }
 
+// reads the size of a vector whose elements take at least
+// 'minSize' bytes, before anything is allocated for it
+func (self *reader) readSize(minSize uint64) int {
+	n := self.readUint32()
+	self.need(uint64(n) * minSize)
+	return int(n)
+}
+
 func (self *reader) readLuaInteger() int64 {
 	return int64(self.readUint64())
 }
@@ -110,7 +129,7 @@ func (self *reader) readProto(parentSource string) *Prototype {
 }
 
 func (self *reader) readCode() []uint32 {
-	code := make([]uint32, self.readUint32())
+	code := make([]uint32, self.readSize(4))
 	for i := range code {
 		code[i] = self.readUint32()
 	}
@@ -118,7 +137,7 @@ func (self *reader) readCode() []uint32 {
 }
 
 func (self *reader) readConstants() []interface{} {
-	constants := make([]interface{}, self.readUint32())
+	constants := make([]interface{}, self.readSize(1))
 	for i := range constants {
 		constants[i] = self.readConstant()
 	}
@@ -143,7 +162,7 @@ func (self *reader) readConstant() interface{} {
 }
 
 func (self *reader) readUpvalues() []Upvalue {
-	upvalues := make([]Upvalue, self.readUint32())
+	upvalues := make([]Upvalue, self.readSize(2))
 	for i := range upvalues {
 		upvalues[i] = Upvalue{
 			Instack: self.readByte(),
@@ -154,7 +173,7 @@ func (self *reader) readUpvalues() []Upvalue {
 }
 
 func (self *reader) readProtos(parentSource string) []*Prototype {
-	protos := make([]*Prototype, self.readUint32())
+	protos := make([]*Prototype, self.readSize(1))
 	for i := range protos {
 		protos[i] = self.readProto(parentSource)
 	}
@@ -162,7 +181,7 @@ func (self *reader) readProtos(parentSource string) []*Prototype {
 }
 
 func (self *reader) readLineInfo() []uint32 {
-	lineInfo := make([]uint32, self.readUint32())
+	lineInfo := make([]uint32, self.readSize(4))
 	for i := range lineInfo {
 		lineInfo[i] = self.readUint32()
 	}
@@ -170,7 +189,7 @@ func (self *reader) readLineInfo() []uint32 {
 }
 
 func (self *reader) readLocVars() []LocVar {
-	locVars := make([]LocVar, self.readUint32())
+	locVars := make([]LocVar, self.readSize(9))
 	for i := range locVars {
 		locVars[i] = LocVar{
 			VarName: self.readString(),
@@ -182,7 +201,7 @@ func (self *reader) readLocVars() []LocVar {
 }
 
 func (self *reader) readUpvalueNames() []string {
-	names := make([]string, self.readUint32())
+	names := make([]string, self.readSize(1))
 	for i := range names {
 		names[i] = self.readString()
 	}
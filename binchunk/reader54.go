@@ -0,0 +1,164 @@
+package binchunk
+
+// lua-5.4.6/src/lundump.c#loadUnsigned()
+func (self *reader) readSize54() uint64 {
+	x := uint64(0)
+	for {
+		b := self.readByte()
+		if x >= ^uint64(0)>>7 {
+			panic("integer overflow")
+		}
+		x = x<<7 | uint64(b&0x7F)
+		if b&0x80 != 0 {
+			return x
+		}
+	}
+}
+
+func (self *reader) readInt54() int {
+	x := self.readSize54()
+	if x > 1<<31-1 {
+		panic("integer overflow")
+	}
+	return int(x)
+}
+
+// reads the size of a vector whose elements take at least
+// 'minSize' bytes, before anything is allocated for it
+func (self *reader) readVectorSize54(minSize uint64) int {
+	n := self.readInt54()
+	self.need(uint64(n) * minSize)
+	return n
+}
+
+// lua-5.4.6/src/lundump.c#loadStringN()
+func (self *reader) readString54() string {
+	size := self.readSize54()
+	if size == 0 {
+		return ""
+	}
+	self.need(size - 1)
+	return string(self.readBytes(uint(size - 1)))
+}
+
+func (self *reader) checkHeader54() {
+	if string(self.readBytes(4)) != LUA_SIGNATURE {
+		panic("not a precompiled chunk!")
+	}
+	if self.readByte() != LUAC_VERSION_54 {
+		panic("version mismatch!")
+	}
+	if self.readByte() != LUAC_FORMAT {
+		panic("format mismatch!")
+	}
+	if string(self.readBytes(6)) != LUAC_DATA {
+		panic("corrupted!")
+	}
+	if self.readByte() != INSTRUCTION_SIZE {
+		panic("instruction size mismatch!")
+	}
+	if self.readByte() != LUA_INTEGER_SIZE {
+		panic("lua_Integer size mismatch!")
+	}
+	if self.readByte() != LUA_NUMBER_SIZE {
+		panic("lua_Number size mismatch!")
+	}
+	if self.readLuaInteger() != LUAC_INT {
+		panic("endianness mismatch!")
+	}
+	if self.readLuaNumber() != LUAC_NUM {
+		panic("float format mismatch!")
+	}
+}
+
+// lua-5.4.6/src/lundump.c#loadFunction()
+func (self *reader) readProto54(parentSource string) *Prototype {
+	proto := &Prototype{}
+	proto.Source = self.readString54()
+	if proto.Source == "" {
+		proto.Source = parentSource
+	}
+	proto.LineDefined = uint32(self.readInt54())
+	proto.LastLineDefined = uint32(self.readInt54())
+	proto.NumParams = self.readByte()
+	proto.IsVararg = self.readByte()
+	proto.MaxStackSize = self.readByte()
+	proto.Code = make([]uint32, self.readVectorSize54(4))
+	for i := range proto.Code {
+		proto.Code[i] = self.readUint32()
+	}
+	proto.Constants = make([]interface{}, self.readVectorSize54(1))
+	for i := range proto.Constants {
+		proto.Constants[i] = self.readConstant54()
+	}
+	proto.Upvalues = make([]Upvalue, self.readVectorSize54(3))
+	for i := range proto.Upvalues {
+		proto.Upvalues[i] = Upvalue{
+			Instack: self.readByte(),
+			Idx:     self.readByte(),
+		}
+		self.readByte() // kind
+	}
+	proto.Protos = make([]*Prototype, self.readVectorSize54(1))
+	for i := range proto.Protos {
+		proto.Protos[i] = self.readProto54(proto.Source)
+	}
+	proto.LineInfo = self.readLineInfo54(proto.LineDefined)
+	proto.LocVars = make([]LocVar, self.readVectorSize54(3))
+	for i := range proto.LocVars {
+		proto.LocVars[i] = LocVar{
+			VarName: self.readString54(),
+			StartPC: uint32(self.readInt54()),
+			EndPC:   uint32(self.readInt54()),
+		}
+	}
+	proto.UpvalueNames = make([]string, self.readVectorSize54(1))
+	for i := range proto.UpvalueNames {
+		proto.UpvalueNames[i] = self.readString54()
+	}
+	return proto
+}
+
+func (self *reader) readConstant54() interface{} {
+	switch self.readByte() {
+	case TAG54_NIL:
+		return nil
+	case TAG54_FALSE:
+		return false
+	case TAG54_TRUE:
+		return true
+	case TAG54_INTEGER:
+		return self.readLuaInteger()
+	case TAG54_NUMBER:
+		return self.readLuaNumber()
+	case TAG54_SHORT_STR, TAG54_LONG_STR:
+		return self.readString54()
+	default:
+		panic("corrupted!")
+	}
+}
+
+// decodes the line differences back to the absolute line of each
+// instruction
+// lua-5.4.6/src/ldebug.c#luaG_getfuncline()
+func (self *reader) readLineInfo54(lineDefined uint32) []uint32 {
+	diffs := self.readBytes(uint(self.readVectorSize54(1)))
+	nAbs := self.readVectorSize54(2)
+	absLines := make(map[int]int, nAbs)
+	for i := 0; i < nAbs; i++ {
+		pc := self.readInt54()
+		absLines[pc] = self.readInt54()
+	}
+
+	lineInfo := make([]uint32, len(diffs))
+	line := int(lineDefined)
+	for pc, dif := range diffs {
+		if int8(dif) == ABSLINEINFO {
+			line = absLines[pc]
+		} else {
+			line += int(int8(dif))
+		}
+		lineInfo[pc] = uint32(line)
+	}
+	return lineInfo
+}
@@ -43,10 +43,6 @@ func (self *writer) writeLuaNumber(f float64) {
 
 func (self *writer) writeLuaString(s string) {
 	size := len(s)
-	if size == 0 {
-		self.writeByte(0x00)
-		return
-	}
 	if size < 254 {
 		self.writeByte(byte(size + 1))
 	} else {
@@ -118,9 +114,9 @@ func (self *writer) writeConstant(constant interface{}) {
 		self.writeByte(TAG_NUMBER)
 		self.writeLuaNumber(cst)
 	case string:
-		if len(cst) > 0 && len(cst) < 254 {
+		if len(cst) < 254 {
 			self.writeByte(TAG_SHORT_STR)
-		} else if len(cst) >= 254 {
+		} else {
 			self.writeByte(TAG_LONG_STR)
 		}
 		self.writeLuaString(cst)
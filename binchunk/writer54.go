@@ -0,0 +1,151 @@
+package binchunk
+
+/*
+** Lua 5.4 writes sizes and ints as varints and keeps line info as a
+** byte of difference per instruction, plus an absolute line every
+** MAXIWTHABS instructions or when the difference doesn't fit a byte.
+ */
+const (
+	ABSLINEINFO = -0x80
+	LIMLINEDIFF = 0x80
+	MAXIWTHABS  = 128
+)
+
+// lua-5.4.6/src/ldump.c#dumpSize()
+func (self *writer) writeSize54(x uint64) {
+	var buff [10]byte
+	n := 0
+	for {
+		n++
+		buff[len(buff)-n] = byte(x & 0x7F) /* fill buffer in reverse order */
+		x >>= 7
+		if x == 0 {
+			break
+		}
+	}
+	buff[len(buff)-1] |= 0x80 /* mark last byte */
+	self.writeBytes(buff[len(buff)-n:])
+}
+
+func (self *writer) writeInt54(i int) {
+	self.writeSize54(uint64(i))
+}
+
+// lua-5.4.6/src/ldump.c#dumpString()
+func (self *writer) writeLuaString54(s string) {
+	self.writeSize54(uint64(len(s)) + 1)
+	self.writeString(s)
+}
+
+func (self *writer) writeHeader54() {
+	self.writeString(LUA_SIGNATURE)
+	self.writeByte(LUAC_VERSION_54)
+	self.writeByte(LUAC_FORMAT)
+	self.writeString(LUAC_DATA)
+	self.writeByte(INSTRUCTION_SIZE)
+	self.writeByte(LUA_INTEGER_SIZE)
+	self.writeByte(LUA_NUMBER_SIZE)
+	self.writeLuaInteger(LUAC_INT)
+	self.writeLuaNumber(LUAC_NUM)
+}
+
+// lua-5.4.6/src/ldump.c#dumpFunction()
+func (self *writer) writeProto54(proto *Prototype, parentSource string) {
+	if proto.Source == parentSource {
+		self.writeSize54(0) // same source as its parent
+	} else {
+		self.writeLuaString54(proto.Source)
+	}
+	self.writeInt54(int(proto.LineDefined))
+	self.writeInt54(int(proto.LastLineDefined))
+	self.writeByte(proto.NumParams)
+	self.writeByte(proto.IsVararg)
+	self.writeByte(proto.MaxStackSize)
+	self.writeInt54(len(proto.Code))
+	for _, i := range proto.Code {
+		self.writeUint32(i)
+	}
+	self.writeInt54(len(proto.Constants))
+	for _, k := range proto.Constants {
+		self.writeConstant54(k)
+	}
+	self.writeInt54(len(proto.Upvalues))
+	for _, v := range proto.Upvalues {
+		self.writeByte(v.Instack)
+		self.writeByte(v.Idx)
+		self.writeByte(0) // kind: a regular variable
+	}
+	self.writeInt54(len(proto.Protos))
+	for _, p := range proto.Protos {
+		self.writeProto54(p, proto.Source)
+	}
+	self.writeLineInfo54(proto.LineDefined, proto.LineInfo)
+	self.writeInt54(len(proto.LocVars))
+	for _, v := range proto.LocVars {
+		self.writeLuaString54(v.VarName)
+		self.writeInt54(int(v.StartPC))
+		self.writeInt54(int(v.EndPC))
+	}
+	self.writeInt54(len(proto.UpvalueNames))
+	for _, name := range proto.UpvalueNames {
+		self.writeLuaString54(name)
+	}
+}
+
+func (self *writer) writeConstant54(constant interface{}) {
+	switch cst := constant.(type) {
+	case nil:
+		self.writeByte(TAG54_NIL)
+	case bool:
+		if cst {
+			self.writeByte(TAG54_TRUE)
+		} else {
+			self.writeByte(TAG54_FALSE)
+		}
+	case int64:
+		self.writeByte(TAG54_INTEGER)
+		self.writeLuaInteger(cst)
+	case float64:
+		self.writeByte(TAG54_NUMBER)
+		self.writeLuaNumber(cst)
+	case string:
+		if len(cst) <= LUAI_MAXSHORTLEN_54 {
+			self.writeByte(TAG54_SHORT_STR)
+		} else {
+			self.writeByte(TAG54_LONG_STR)
+		}
+		self.writeLuaString54(cst)
+	default:
+		panic("unsupported constant value type!")
+	}
+}
+
+// encodes the absolute line of each instruction the way the 5.4
+// code generator saves it
+// lua-5.4.6/src/lcode.c#savelineinfo()
+func (self *writer) writeLineInfo54(lineDefined uint32, lineInfo []uint32) {
+	type absLineInfo struct{ pc, line int }
+	var absLines []absLineInfo
+	diffs := make([]byte, len(lineInfo))
+	prevLine := int(lineDefined)
+	iwthabs := 0 /* instructions without absolute line info */
+	for pc, line := range lineInfo {
+		lineDif := int(line) - prevLine
+		if lineDif <= -LIMLINEDIFF || lineDif >= LIMLINEDIFF || iwthabs >= MAXIWTHABS {
+			absLines = append(absLines, absLineInfo{pc, int(line)})
+			lineDif = ABSLINEINFO /* signal that there is absolute information */
+			iwthabs = 0
+		}
+		iwthabs++
+		diffs[pc] = byte(int8(lineDif))
+		prevLine = int(line)
+	}
+
+	self.writeInt54(len(diffs))
+	self.writeBytes(diffs)
+	self.writeInt54(len(absLines))
+	for _, abs := range absLines {
+		self.writeInt54(abs.pc)
+		self.writeInt54(abs.line)
+	}
+}
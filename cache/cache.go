@@ -0,0 +1,126 @@
+// Package cache keeps the binary chunks lxa sources compile to on disk,
+// in $XDG_CACHE_HOME/lxa (or the system's user cache directory), so
+// that unchanged files aren't lexed, parsed and generated again. A chunk
+// is keyed by a hash of its source and name, the compiler version and
+// the lxa binary that compiled it.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"lxa/binchunk"
+	"lxa/compiler"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Disabled makes Binary compile every time, without reading or writing
+// the cache, as --no-cache asks
+var Disabled = false
+
+var (
+	stampOnce sync.Once
+	stamp     string
+)
+
+// Dir is where the chunks are kept, "" if there is nowhere to
+func Dir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "lxa")
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "lxa")
+	}
+	return ""
+}
+
+// Clean removes the cache directory with all the chunks in it
+func Clean() error {
+	dir := Dir()
+	if dir == "" {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+// Binary is the binary chunk the source compiles to, from the cache if
+// it was compiled before. A binary chunk is returned as it is, and
+// compile errors are returned as compiler.TryCompile returns them.
+func Binary(src []byte, chunkName string) ([]byte, error) {
+	if binchunk.IsBinaryChunk(src) {
+		return src, nil
+	}
+	dir := Dir()
+	if Disabled || dir == "" {
+		return compile(src, chunkName)
+	}
+	filename := filepath.Join(dir, key(src, chunkName)+".luac")
+	if data, err := ioutil.ReadFile(filename); err == nil && binchunk.IsBinaryChunk(data) {
+		return data, nil
+	}
+	data, err := compile(src, chunkName)
+	if err == nil {
+		store(dir, filename, data)
+	}
+	return data, err
+}
+
+func compile(src []byte, chunkName string) ([]byte, error) {
+	proto, err := compiler.TryCompile(string(src), chunkName)
+	if err != nil {
+		return nil, err
+	}
+	return binchunk.Dump(proto), nil
+}
+
+// writes the chunk next to where it goes and renames it there, so that
+// no one reads it half written. The cache is only a cache: if it can't
+// be written, the chunk is compiled again next time.
+func store(dir, filename string, data []byte) {
+	if os.MkdirAll(dir, 0777) != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// the hash of the source and name, with the compiler version, the lua
+// version of the bytecode and the stamp of the lxa binary, so that a
+// rebuilt lxa doesn't read what an older one compiled
+func key(src []byte, chunkName string) string {
+	stampOnce.Do(func() {
+		stamp = binaryStamp()
+	})
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%x\x00%s\x00%s\x00", compiler.Version, binchunk.LUAC_VERSION, stamp, chunkName)
+	h.Write(src)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// the size and time of the running binary
+func binaryStamp() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s %d %d", exe, info.Size(), info.ModTime().UnixNano())
+}
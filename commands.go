@@ -0,0 +1,445 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"lxa/binchunk"
+	"lxa/cache"
+	"lxa/compiler"
+	"lxa/compiler/assembler"
+	"lxa/compiler/decompiler"
+	"lxa/compiler/formatter"
+	"lxa/compiler/transpiler"
+	"lxa/runner"
+	"lxa/vm"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// lua versions of the source written for a -target
+var sourceTargets = map[string]int{
+	"lua51": transpiler.LUA51,
+	"lua53": transpiler.LUA53,
+	"lua54": transpiler.LUA54,
+}
+
+type target struct {
+	name     string
+	version  int // of the lua source, if isSource
+	isSource bool
+}
+
+func parseTarget(name string) (target, bool) {
+	version, isSource := sourceTargets[name]
+	if name != "5.3" && name != "5.4" && !isSource {
+		fmt.Fprintf(os.Stderr, "%s: unsupported target '%s' (5.3, 5.4, lua51, lua53 or lua54)\n", PROGNAME, name)
+		return target{}, false
+	}
+	return target{name, version, isSource}, true
+}
+
+type runOptions struct {
+	debug       bool
+	golua       bool
+	clua        bool
+	interactive bool
+}
+
+func (opts *runOptions) flags(fs *flag.FlagSet) {
+	fs.BoolVar(&opts.debug, "g", false, "enable verbose logging and tracing (golua vm only)")
+	fs.BoolVar(&opts.golua, "golua", false, "use inner golua vm for excuting")
+	fs.BoolVar(&opts.clua, "clua", false, "use inner official clua 5.3.5 vm for excuting (default vm, if built with -tags clua)")
+	fs.BoolVar(&opts.interactive, "i", false, "enter interactive mode after running the script (golua vm)")
+	fs.Var(codeFlag{}, "e", "execute string 'stat'")
+	fs.Var(moduleFlag{}, "l", "require library 'name' into global 'name'")
+	fs.BoolVar(&cache.Disabled, "no-cache", false, "compile the script and the modules it requires again, without the chunk cache")
+}
+
+func cmdRun(args []string) int {
+	opts := &runOptions{}
+	fs := newFlagSet("run")
+	opts.flags(fs)
+	fs.Parse(args)
+	return opts.run(fs)
+}
+
+// runs the -e and -l options, then the script with the arguments after
+// it, like the lua command does
+func (opts *runOptions) run(fs *flag.FlagSet) int {
+	chunks := PRELUDE
+	script := 0 // index of the script in os.Args, the interpreter if none
+	interactive := opts.interactive
+	if fs.NArg() > 0 {
+		script = len(os.Args) - fs.NArg()
+		chunks = append(chunks, openScript(fs.Arg(0), fs.Args()[1:]))
+	} else if !HASCODE && !interactive { // lua without a script, nor any -e
+		if runner.StdinIsTerminal() {
+			interactive = true
+		} else {
+			chunks = append(chunks, openScript("-", nil))
+		}
+	}
+	// the repl only runs on the golua vm, which is the default without clua,
+	// and CRun tells when -clua asks for it without it
+	if !opts.debug && !interactive && (opts.clua || !opts.golua && runner.HasClua) {
+		return runner.CRun(chunks, os.Args, script)
+	}
+	return runner.GoRun(chunks, os.Args, script, opts.debug, interactive)
+}
+
+// the script, "-" for stdin
+func openScript(filename string, args []string) *runner.Chunk {
+	if filename == "-" {
+		return &runner.Chunk{Name: "stdin", Reader: os.Stdin, Args: args}
+	}
+	c := &runner.Chunk{Name: filename, Args: args, Cached: true}
+	if file, err := os.Open(filename); err == nil { // left open until the program ends
+		c.Reader = file
+	}
+	return c
+}
+
+func cmdBuild(args []string) int {
+	var out, name string
+	fs := newFlagSet("build")
+	fs.StringVar(&out, "o", "", "output file, - for stdout (default file.luac, or file.lua for lua source)")
+	fs.StringVar(&name, "target", "5.3", "lua version of the bytecode (5.3 or 5.4), or lua51, lua53, lua54 for lua source")
+	fs.Parse(args)
+	t, ok := parseTarget(name)
+	if !ok {
+		return 1
+	}
+	if out != "" && out != "-" && fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "%s build: -o takes a single file\n", PROGNAME)
+		return 1
+	}
+	return build(fs.Args(), out, t)
+}
+
+// compiles or transpiles each file into out, next to the file if out is
+// "", returning 1 if any of them failed
+func build(filenames []string, out string, t target) int {
+	status := 0
+	for _, filename := range filenames {
+		chunk, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading %s: %s\n", filename, err)
+			status = 1
+			continue
+		}
+		var data []byte
+		ext := ".luac"
+		if t.isSource { // lua source
+			if binchunk.IsBinaryChunk(chunk) {
+				fmt.Fprintf(os.Stderr, "transpiling %s: %s\n", filename, "is a lua bytecode file")
+				status = 1
+				continue
+			}
+			data = []byte(compiler.Transpile(string(chunk), filename, t.version))
+			ext = ".lua"
+		} else if binchunk.IsBinaryChunk(chunk) {
+			data = chunk
+		} else if t.name == "5.4" {
+			data = binchunk.Dump54(compiler.Compile54(string(chunk), filename))
+		} else {
+			data = binchunk.Dump(compiler.Compile(string(chunk), filename))
+		}
+		switch out {
+		case "-":
+			_, err = os.Stdout.Write(data)
+		case "":
+			err = ioutil.WriteFile(filename+ext, data, 0666)
+		default:
+			err = ioutil.WriteFile(out, data, 0666)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "writing %s: %s\n", filename, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func cmdDisasm(args []string) int {
+	var name string
+	var asJSON bool
+	fs := newFlagSet("disasm")
+	fs.StringVar(&name, "target", "5.3", "lua version of the bytecode sources compile to (5.3 or 5.4)")
+	fs.BoolVar(&asJSON, "json", false, "list as json, for tools")
+	fs.Parse(args)
+	t, ok := parseTarget(name)
+	if !ok {
+		return 1
+	}
+	if t.isSource {
+		fmt.Fprintf(os.Stderr, "%s disasm: target %s is lua source, not bytecode\n", PROGNAME, name)
+		return 1
+	}
+	return disasm(fs.Args(), t, asJSON)
+}
+
+// lists binary chunks, or what sources compile to
+func disasm(filenames []string, t target, asJSON bool) int {
+	status := 0
+	for _, filename := range filenames {
+		chunk, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading %s: %s\n", filename, err)
+			status = 1
+			continue
+		}
+		if !binchunk.IsBinaryChunk(chunk) {
+			if t.name == "5.4" {
+				chunk = binchunk.Dump54(compiler.Compile54(string(chunk), filename))
+			} else {
+				chunk = binchunk.Dump(compiler.Compile(string(chunk), filename))
+			}
+		}
+		if asJSON {
+			runner.ParseBinaryJSON(chunk)
+		} else {
+			runner.ParseBinary(chunk)
+		}
+	}
+	return status
+}
+
+func cmdAsm(args []string) int {
+	var out string
+	fs := newFlagSet("asm")
+	fs.StringVar(&out, "o", "", "output file, - for stdout (default file.luac)")
+	fs.Parse(args)
+	if out != "" && out != "-" && fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "%s asm: -o takes a single file\n", PROGNAME)
+		return 1
+	}
+	status := 0
+	for _, filename := range fs.Args() {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading %s: %s\n", filename, err)
+			status = 1
+			continue
+		}
+		proto, err := assembler.Assemble(string(src), filename)
+		if err == nil {
+			err = vm.Verify(proto)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		data := binchunk.Dump(proto)
+		switch out {
+		case "-":
+			_, err = os.Stdout.Write(data)
+		case "":
+			err = ioutil.WriteFile(strings.TrimSuffix(filename, filepath.Ext(filename))+".luac", data, 0666)
+		default:
+			err = ioutil.WriteFile(out, data, 0666)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "writing %s: %s\n", filename, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func cmdDecompile(args []string) int {
+	var out string
+	fs := newFlagSet("decompile")
+	fs.StringVar(&out, "o", "", "output file (default stdout)")
+	fs.Parse(args)
+	if out != "" && out != "-" && fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "%s decompile: -o takes a single file\n", PROGNAME)
+		return 1
+	}
+	status := 0
+	for _, filename := range fs.Args() {
+		src, err := decompile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			status = 1
+			continue
+		}
+		if out == "" || out == "-" {
+			_, err = os.Stdout.WriteString(src)
+		} else {
+			err = ioutil.WriteFile(out, []byte(src), 0666)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "writing %s: %s\n", filename, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// the source of a binary chunk, or of what a source compiles to
+func decompile(filename string) (src string, err error) {
+	chunk, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	var proto *binchunk.Prototype
+	if !binchunk.IsBinaryChunk(chunk) {
+		proto, err = compiler.TryCompile(string(chunk), filename)
+	} else if binchunk.Version(chunk) != 0x53 {
+		err = fmt.Errorf("only lua 5.3 bytecode can be decompiled")
+	} else {
+		proto, err = binchunk.TryUndump(chunk)
+	}
+	if err != nil {
+		return "", err
+	}
+	return decompiler.Decompile(proto)
+}
+
+func cmdCheck(args []string) int {
+	fs := newFlagSet("check")
+	fs.Parse(args)
+	status := 0
+	for _, filename := range fs.Args() {
+		if err := check(filename); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func check(filename string) (err error) {
+	chunk, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if binchunk.IsBinaryChunk(chunk) {
+		fmt.Fprintf(os.Stderr, "%s: is a lua bytecode file, not checked\n", filename)
+		return nil
+	}
+	_, err = compiler.TryCompile(string(chunk), filename)
+	return err
+}
+
+// only the indentation and blank lines change, see formatter.Indent
+func cmdFmt(args []string) int {
+	var write, list bool
+	fs := newFlagSet("fmt")
+	fs.BoolVar(&write, "w", false, "write the result back to the file instead of stdout")
+	fs.BoolVar(&list, "l", false, "list the files whose indentation differs")
+	fs.Parse(args)
+	status := 0
+	for _, filename := range fs.Args() {
+		chunk, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading %s: %s\n", filename, err)
+			status = 1
+			continue
+		}
+		if _, err := compiler.TryParse(string(chunk), filename); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		src := formatter.Indent(string(chunk))
+		changed := src != string(chunk)
+		if list && changed {
+			fmt.Println(filename)
+		}
+		if write {
+			if changed {
+				if err := ioutil.WriteFile(filename, []byte(src), 0666); err != nil {
+					fmt.Fprintf(os.Stderr, "writing %s: %s\n", filename, err)
+					status = 1
+				}
+			}
+		} else if !list {
+			fmt.Print(src)
+		}
+	}
+	return status
+}
+
+func cmdTest(args []string) int {
+	var verbose bool
+	fs := newFlagSet("test")
+	fs.BoolVar(&verbose, "v", false, "tell about every test, not only those that fail")
+	fs.Parse(args)
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(p, "_test.lxa") {
+				files = append(files, p)
+			}
+			return nil
+		})
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "%s test: no *_test.lxa files\n", PROGNAME)
+		return 1
+	}
+	return runner.GoRunTests(files, verbose)
+}
+
+func cmdDifftest(args []string) int {
+	fs := newFlagSet("difftest")
+	fs.Parse(args)
+	if !runner.HasClua {
+		fmt.Fprintf(os.Stderr, "%s difftest: the clua vm is not compiled in (build lxa with -tags clua)\n", PROGNAME)
+		return 1
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s difftest: %s\n", PROGNAME, err)
+		return 1
+	}
+	var files []string
+	for _, path := range fs.Args() {
+		found, err := runner.DiffFiles(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		files = append(files, found...)
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "%s difftest: no .lxa files\n", PROGNAME)
+		return 1
+	}
+	return runner.DiffTest(exe, files)
+}
+
+func cmdCache(args []string) int {
+	fs := newFlagSet("cache")
+	fs.Parse(args)
+	switch fs.Arg(0) {
+	case "clean":
+		if err := cache.Clean(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s cache: %s\n", PROGNAME, err)
+			return 1
+		}
+	case "dir":
+		fmt.Println(cache.Dir())
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
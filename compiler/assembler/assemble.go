@@ -0,0 +1,617 @@
+package assembler
+
+import (
+	"fmt"
+	"lxa/binchunk"
+	"lxa/vm"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+** The assembly is what `lxa disasm` lists, so a listing assembles back
+** to the same chunk:
+**
+**   main <fib.lxa:0,0> (3 instructions at 0x1234)
+**   0+ params, 2 slots, 1 upvalue, 0 locals, 1 constant, 1 function
+**   	1	[1]	CLOSURE  	0 0	; 0x5678
+**   ...
+**   constants (1) for 0x1234:
+**   	1	"fib"
+**   locals (0) for 0x1234:
+**   upvalues (1) for 0x1234:
+**   	0	_ENV	1	0
+**
+**   function <fib.lxa:1,6> (...)
+**   ...
+**
+** A function's nested functions follow it, as many as its second line
+** says. The pc, the [line] and everything after a ';' are optional, and
+** so is that second line (then a function has no params, is vararg if
+** it is the main one, and gets 255 slots), as well as the main header
+** itself. Writing it by hand, there is more:
+**
+**   .const name value   names a constant (nil, true, false, a number
+**                       or a "string"), to use where a constant can go
+**   "str"               a string constant right where it is used
+**   loop:               a label, to use as the target of JMP, FORPREP,
+**                       FORLOOP and TFORLOOP instead of the offset
+**
+** The main function gets the _ENV upvalue if it lists none.
+ */
+
+type function struct {
+	proto    *binchunk.Prototype
+	line     int // of its header
+	nFuncs   int // nested functions following it
+	slots    int // -1 if not given
+	insts    []*instruction
+	consts   map[int]interface{} // listed under constants, by index
+	named    map[string]interface{}
+	order    []string // of the named constants
+	labels   map[string]int
+	trailing []string // labels after its last instruction
+	isEmpty  bool     // nothing written for it yet
+}
+
+type instruction struct {
+	line    int // in the assembly
+	srcLine int // [line]
+	op      int
+	args    []string
+	comment string
+	labels  []string
+}
+
+type assembler struct {
+	chunkName string
+	line      int
+	funcs     []*function
+	fn        *function
+	section   string // "code", "constants", "locals" or "upvalues"
+	pending   []string
+}
+
+type asmError struct {
+	msg string
+}
+
+// Assemble turns a listing back into the function prototype of a chunk
+func Assemble(src, chunkName string) (proto *binchunk.Prototype, err error) {
+	a := &assembler{chunkName: chunkName}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(asmError)
+			if !ok {
+				panic(r)
+			}
+			proto, err = nil, fmt.Errorf("%s:%d: %s", chunkName, a.line, e.msg)
+		}
+	}()
+
+	a.newFunction(true, 0)
+	a.fn.isEmpty = true
+	for i, line := range strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n") {
+		a.line = i + 1
+		a.parseLine(line)
+	}
+	a.fn.trailing, a.pending = a.pending, nil
+	for _, fn := range a.funcs {
+		a.line = fn.line
+		a.finish(fn)
+	}
+	next := 0
+	proto = a.nest(&next)
+	if next < len(a.funcs) {
+		a.line = a.funcs[next].line
+		a.error("function is not nested in any other (the function counts say %d in all)", next)
+	}
+	return proto, nil
+}
+
+func (a *assembler) error(f string, args ...interface{}) {
+	panic(asmError{fmt.Sprintf(f, args...)})
+}
+
+func (a *assembler) newFunction(isMain bool, lineDefined int) {
+	fn := &function{
+		proto:  &binchunk.Prototype{LineDefined: uint32(lineDefined)},
+		line:   a.line,
+		slots:  -1,
+		consts: map[int]interface{}{},
+		named:  map[string]interface{}{},
+		labels: map[string]int{},
+	}
+	if isMain {
+		fn.proto.IsVararg = 1
+	}
+	if a.fn != nil {
+		a.fn.trailing, a.pending = a.pending, nil
+	}
+	a.funcs = append(a.funcs, fn)
+	a.fn = fn
+	a.section = "code"
+}
+
+// builds the tree of functions out of the list, each followed by the
+// functions nested in it
+func (a *assembler) nest(next *int) *binchunk.Prototype {
+	fn := a.funcs[*next]
+	*next++
+	for i := 0; i < fn.nFuncs; i++ {
+		if *next >= len(a.funcs) {
+			a.line = fn.line
+			a.error("function has %d functions, but only %d follow", fn.nFuncs, i)
+		}
+		fn.proto.Protos = append(fn.proto.Protos, a.nest(next))
+	}
+	return fn.proto
+}
+
+var (
+	reHeader    = regexp.MustCompile(`^(main|function)(?:\s*<(.*):(\d+),(\d+)>.*|\s*)$`)
+	reParams    = regexp.MustCompile(`^(\d+)(\+?) params?\b`)
+	reSlots     = regexp.MustCompile(`(\d+) slots?\b`)
+	reFunctions = regexp.MustCompile(`(\d+) functions?\b`)
+	reSection   = regexp.MustCompile(`^(constants|locals|upvalues) \(\d+\)`)
+	reLabel     = regexp.MustCompile(`^([A-Za-z_]\w*):(.*)$`)
+	reName      = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+)
+
+func (a *assembler) parseLine(line string) {
+	line, comment := splitComment(line)
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	if m := reHeader.FindStringSubmatch(line); m != nil {
+		lineDefined, _ := strconv.Atoi(m[3])
+		if a.fn.isEmpty && len(a.funcs) == 1 { // the main header
+			a.funcs = nil
+		}
+		a.newFunction(m[1] == "main", lineDefined)
+		if m[2] != "" {
+			a.fn.proto.Source = "@" + m[2]
+			lastLine, _ := strconv.Atoi(m[4])
+			a.fn.proto.LastLineDefined = uint32(lastLine)
+		}
+		return
+	}
+	a.fn.isEmpty = false
+	if m := reParams.FindStringSubmatch(line); m != nil {
+		params, _ := strconv.Atoi(m[1])
+		a.fn.proto.NumParams = byte(params)
+		a.fn.proto.IsVararg = 0
+		if m[2] == "+" {
+			a.fn.proto.IsVararg = 1
+		}
+		if m := reSlots.FindStringSubmatch(line); m != nil {
+			a.fn.slots, _ = strconv.Atoi(m[1])
+		}
+		if m := reFunctions.FindStringSubmatch(line); m != nil {
+			a.fn.nFuncs, _ = strconv.Atoi(m[1])
+		}
+		return
+	}
+	if m := reSection.FindStringSubmatch(line); m != nil {
+		a.section = m[1]
+		return
+	}
+	if strings.HasPrefix(line, ".const") {
+		a.constDirective(line)
+		return
+	}
+
+	switch a.section {
+	case "code":
+		a.parseInstruction(line, comment)
+	case "constants":
+		fields := strings.Fields(line)
+		idx := a.integer(fields[0])
+		value := strings.TrimSpace(line[len(fields[0]):])
+		if _, ok := a.fn.consts[idx-1]; ok || idx < 1 {
+			a.error("constant %d given twice", idx)
+		}
+		a.fn.consts[idx-1] = a.constant(value)
+	case "locals": // idx name startpc endpc, the name may have spaces
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			a.error("a local needs an index, a name, and the pcs it starts and ends at")
+		}
+		n := len(fields)
+		a.fn.proto.LocVars = append(a.fn.proto.LocVars, binchunk.LocVar{
+			VarName: strings.Join(fields[1:n-2], " "),
+			StartPC: uint32(a.integer(fields[n-2]) - 1),
+			EndPC:   uint32(a.integer(fields[n-1]) - 1),
+		})
+	case "upvalues": // idx name instack idx
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			a.error("an upvalue needs an index, a name, instack and idx")
+		}
+		name := fields[1]
+		if name == "-" {
+			name = ""
+		}
+		a.fn.proto.Upvalues = append(a.fn.proto.Upvalues, binchunk.Upvalue{
+			Instack: byte(a.integer(fields[2])),
+			Idx:     byte(a.integer(fields[3])),
+		})
+		a.fn.proto.UpvalueNames = append(a.fn.proto.UpvalueNames, name)
+	}
+}
+
+// [pc] [[line]] OPCODE args, after any labels
+func (a *assembler) parseInstruction(line, comment string) {
+	for {
+		m := reLabel.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		a.pending = append(a.pending, m[1])
+		line = strings.TrimSpace(m[2])
+		if line == "" {
+			return
+		}
+	}
+
+	fields := tokens(line)
+	inst := &instruction{line: a.line, comment: comment, labels: a.pending}
+	a.pending = nil
+	if _, err := strconv.Atoi(fields[0]); err == nil { // the pc
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "[") {
+		if l := strings.Trim(fields[0], "[]"); l != "-" {
+			inst.srcLine = a.integer(l)
+		}
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		a.error("missing opcode")
+	}
+	op, ok := vm.OpcodeByName(fields[0])
+	if !ok {
+		a.error("unknown opcode '%s'", fields[0])
+	}
+	inst.op, inst.args = op, fields[1:]
+	a.fn.insts = append(a.fn.insts, inst)
+}
+
+// .const name value
+func (a *assembler) constDirective(line string) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !reName.MatchString(fields[1]) {
+		a.error("usage: .const name value")
+	}
+	name := fields[1]
+	if _, ok := a.fn.named[name]; ok {
+		a.error("constant '%s' named twice", name)
+	}
+	// the value is the rest of the line after the name, spaces in
+	// strings and all
+	value := strings.TrimSpace(line)
+	value = strings.TrimSpace(value[len(fields[0]):])
+	value = strings.TrimSpace(value[len(name):])
+	a.fn.named[name] = a.constant(value)
+	a.fn.order = append(a.fn.order, name)
+}
+
+// lays out the constants and the code of a function
+func (a *assembler) finish(fn *function) {
+	proto := fn.proto
+	proto.Constants = make([]interface{}, len(fn.consts))
+	for i, k := range fn.consts {
+		if i >= len(fn.consts) {
+			a.error("constant %d given, but not all those before it", i+1)
+		}
+		proto.Constants[i] = k
+	}
+	for _, name := range fn.order {
+		a.addConstant(fn, fn.named[name])
+	}
+	if fn == a.funcs[0] && len(proto.Upvalues) == 0 {
+		proto.Upvalues = []binchunk.Upvalue{{Instack: 1, Idx: 0}}
+		proto.UpvalueNames = []string{"_ENV"}
+	}
+
+	// where each instruction goes, SETLIST with C == 0 takes two words
+	pcs := make([]int, len(fn.insts))
+	pc := 0
+	for i, inst := range fn.insts {
+		pcs[i] = pc
+		for _, label := range inst.labels {
+			if _, ok := fn.labels[label]; ok {
+				a.line = inst.line
+				a.error("label '%s' defined twice", label)
+			}
+			fn.labels[label] = pc
+		}
+		pc++
+		if inst.op == vm.OP_SETLIST && len(inst.args) == 3 && inst.args[2] == "0" {
+			pc++
+		}
+	}
+	for _, label := range fn.trailing {
+		fn.labels[label] = pc
+	}
+
+	for i, inst := range fn.insts {
+		a.line = inst.line
+		a.encode(fn, inst, pcs[i])
+	}
+	if fn.slots >= 0 {
+		proto.MaxStackSize = byte(fn.slots)
+	} else {
+		proto.MaxStackSize = 255
+	}
+}
+
+func (a *assembler) encode(fn *function, inst *instruction, pc int) {
+	proto := fn.proto
+	i := vm.Instruction(inst.op)
+	args := inst.args
+	want := 0
+	switch i.OpMode() {
+	case vm.IABC:
+		want = 1
+		if i.BMode() != vm.OpArgN {
+			want++
+		}
+		if i.CMode() != vm.OpArgN {
+			want++
+		}
+	case vm.IABx, vm.IAsBx:
+		want = 2
+	case vm.IAx:
+		want = 1
+	}
+	if len(args) != want {
+		a.error("%s takes %d arguments, not %d", strings.TrimSpace(i.OpName()), want, len(args))
+	}
+
+	var code int
+	switch i.OpMode() {
+	case vm.IABC:
+		x, b, c := a.register(args[0], 0xFF), 0, 0
+		n := 1
+		if mode := i.BMode(); mode != vm.OpArgN {
+			b = a.arg(fn, args[n], mode)
+			n++
+		}
+		if mode := i.CMode(); mode != vm.OpArgN {
+			c = a.arg(fn, args[n], mode)
+		}
+		code = b<<23 | c<<14 | x<<6 | inst.op
+	case vm.IABx:
+		x, bx := a.register(args[0], 0xFF), 0
+		if i.BMode() == vm.OpArgK {
+			bx = a.constantIndex(fn, args[1], vm.MAXARG_Bx)
+		} else {
+			bx = a.register(args[1], vm.MAXARG_Bx)
+		}
+		code = bx<<14 | x<<6 | inst.op
+	case vm.IAsBx:
+		x, sbx := a.register(args[0], 0xFF), 0
+		if target, ok := fn.labels[args[1]]; ok {
+			sbx = target - (pc + 1)
+		} else if reName.MatchString(args[1]) {
+			a.error("no label '%s'", args[1])
+		} else {
+			sbx = a.integer(args[1])
+		}
+		if sbx < -vm.MAXARG_sBx || sbx > vm.MAXARG_Bx-vm.MAXARG_sBx {
+			a.error("jump too far")
+		}
+		code = (sbx+vm.MAXARG_sBx)<<14 | x<<6 | inst.op
+	case vm.IAx:
+		code = a.constantIndex(fn, args[0], 1<<26-1)<<6 | inst.op
+	}
+	proto.Code = append(proto.Code, uint32(code))
+	proto.LineInfo = append(proto.LineInfo, uint32(inst.srcLine))
+
+	if inst.op == vm.OP_SETLIST && args[2] == "0" { // the count is the next word
+		n, err := strconv.ParseUint(strings.TrimSpace(inst.comment), 10, 32)
+		if err != nil {
+			a.error("SETLIST with C = 0 needs the count after ';'")
+		}
+		proto.Code = append(proto.Code, uint32(n))
+		proto.LineInfo = append(proto.LineInfo, uint32(inst.srcLine))
+	}
+}
+
+// a B or C argument
+func (a *assembler) arg(fn *function, s string, mode byte) int {
+	if mode != vm.OpArgK {
+		return a.register(s, 0x1FF)
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 { // a register
+		return a.register(s, 0xFF)
+	}
+	idx := a.constantIndex(fn, s, 0xFF)
+	return idx | 0x100
+}
+
+func (a *assembler) register(s string, max int) int {
+	n := a.integer(s)
+	if n < 0 || n > max {
+		a.error("argument %d out of range", n)
+	}
+	return n
+}
+
+// -1-index as listed, a named constant or a string
+func (a *assembler) constantIndex(fn *function, s string, max int) int {
+	var idx int
+	switch {
+	case strings.HasPrefix(s, `"`):
+		idx = a.addConstant(fn, a.constant(s))
+	case reName.MatchString(s):
+		k, ok := fn.named[s]
+		if !ok {
+			a.error("no constant named '%s'", s)
+		}
+		idx = a.addConstant(fn, k)
+	default:
+		n := a.integer(s)
+		if n >= 0 {
+			a.error("%d is not a constant, constants are -1, -2, ...", n)
+		}
+		idx = -1 - n
+		if idx >= len(fn.proto.Constants) {
+			a.error("no constant %d", n)
+		}
+	}
+	if idx > max {
+		a.error("constant %d out of range", idx+1)
+	}
+	return idx
+}
+
+// the index of the constant, added if it isn't there
+func (a *assembler) addConstant(fn *function, k interface{}) int {
+	for i, c := range fn.proto.Constants {
+		if c == k {
+			return i
+		}
+	}
+	fn.proto.Constants = append(fn.proto.Constants, k)
+	return len(fn.proto.Constants) - 1
+}
+
+func (a *assembler) integer(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		a.error("'%s' is not a number", s)
+	}
+	return n
+}
+
+// nil, true, false, an integer, a float or a "string"
+func (a *assembler) constant(s string) interface{} {
+	switch s {
+	case "nil":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	case "inf":
+		return math.Inf(1)
+	case "-inf":
+		return math.Inf(-1)
+	case "nan", "-nan":
+		return math.NaN()
+	}
+	if strings.HasPrefix(s, `"`) {
+		return a.unquote(s)
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	a.error("bad constant '%s'", s)
+	return nil
+}
+
+// the escapes the disassembler writes
+func (a *assembler) unquote(s string) string {
+	if len(s) < 2 || s[len(s)-1] != '"' {
+		a.error("unfinished string %s", s)
+	}
+	s = s[1 : len(s)-1]
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			a.error("unfinished escape")
+		}
+		switch c := s[i]; c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '"', '\\', '\'':
+			b.WriteByte(c)
+		default:
+			j := i
+			for j < len(s) && j < i+3 && '0' <= s[j] && s[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(s[i:j])
+			if err != nil || n > 0xFF {
+				a.error("bad escape in string")
+			}
+			b.WriteByte(byte(n))
+			i = j - 1
+		}
+	}
+	return b.String()
+}
+
+// the line before the ';' that starts a comment, and the comment
+func splitComment(line string) (string, string) {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inString {
+				i++
+			}
+		case '"':
+			inString = !inString
+		case ';':
+			if !inString {
+				return line[:i], line[i+1:]
+			}
+		}
+	}
+	return line, ""
+}
+
+// the fields of a line, a "string" being one even with spaces in it
+func tokens(line string) []string {
+	var list []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return list
+		}
+		end := strings.IndexAny(line, " \t")
+		if line[0] == '"' {
+			end = len(line)
+			for i := 1; i < len(line); i++ {
+				if line[i] == '\\' {
+					i++
+				} else if line[i] == '"' {
+					end = i + 1
+					break
+				}
+			}
+		}
+		if end < 0 {
+			end = len(line)
+		}
+		list = append(list, line[:end])
+		line = line[end:]
+	}
+}
@@ -30,6 +30,21 @@ type LoopStat struct {
 	Block    *Block
 }
 
+// for Name ':=' Integer ';' Name ('<' | '<=' | '>' | '>=') exp ';' Name step '{' block '}'
+// step ::= '++' | '--' | '+=' Integer | '-=' Integer
+// a LoopStat whose counter, limit and step fit a numeric for
+type ForNumStat struct {
+	LineOfFor int
+	LineOfDo  int
+	VarName   string
+	InitExp   Expression
+	LimitExp  Expression
+	StepExp   Expression
+	Block     *Block
+	Guard     Expression // tested once before the loop, or nil
+	LoopStat  *LoopStat  // fallback
+}
+
 type BlockStat struct {
 	Block *Block
 }
@@ -68,11 +83,14 @@ type AssignmentStat struct {
 	ExpList  []Expression
 }
 
-// namelist ':=' explist | local namelist [':=' explist]
+// namelist ':=' explist | local attnamelist ['=' explist]
 // namelist ::= Name {',' Name}
+// attnamelist ::= Name attrib {',' Name attrib}
+// attrib ::= ['<' Name '>']
 // explist ::= exp {',' exp}
 type LocVarDeclStat struct {
-	LastLine int
-	NameList []string
-	ExpList  []Expression
+	LastLine   int
+	NameList   []string
+	AttribList []string // "" or "close" for each name, nil if none
+	ExpList    []Expression
 }
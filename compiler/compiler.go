@@ -1,22 +1,156 @@
 package compiler
 
 import (
+	"fmt"
 	"lxa/binchunk"
+	. "lxa/compiler/ast"
 	"lxa/compiler/generator"
+	"lxa/compiler/lexer"
 	"lxa/compiler/parser"
+	"lxa/compiler/transpiler"
+	"os"
 )
 
+// Version of the compiler, part of what cached chunks are keyed by
+const Version = "0.2.6"
+
+// syntax errors end the program
 func Compile(chunk, chunkName string) *binchunk.Prototype {
+	defer exitOnError(chunkName)
 	p := parser.New(chunk, chunkName)
 	ast := p.Parse()
 	proto := generator.GenerateProto(ast)
-	setSource(proto, "@"+chunkName)
+	setSource(proto, source(chunkName))
 	return proto
 }
 
+// a chunk name is a file name, unless it starts with '@' or '=' as the
+// source of a loaded chunk already does
+func source(chunkName string) string {
+	if chunkName != "" && (chunkName[0] == '@' || chunkName[0] == '=') {
+		return chunkName
+	}
+	return "@" + chunkName
+}
+
 func setSource(proto *binchunk.Prototype, chunkName string) {
 	proto.Source = chunkName
 	for _, f := range proto.Protos {
 		setSource(f, chunkName)
 	}
 }
+
+// compiles to Lua 5.4 bytecode, to be dumped with binchunk.Dump54
+func Compile54(chunk, chunkName string) *binchunk.Prototype {
+	defer exitOnError(chunkName)
+	p := parser.New(chunk, chunkName)
+	ast := p.Parse()
+	proto := generator.GenerateProto54(ast)
+	setSource(proto, source(chunkName))
+	return proto
+}
+
+// translates to Lua source, version is one of transpiler.LUA51,
+// LUA53 or LUA54
+func Transpile(chunk, chunkName string, version int) string {
+	defer exitOnError(chunkName)
+	p := parser.New(chunk, chunkName)
+	ast := p.Parse()
+	return transpiler.Transpile(ast, chunkName, version)
+}
+
+// the error a panic while compiling stands for: the lexer and the
+// parser panic with a *lexer.SyntaxError, the generator with its own
+// errors, which have no line
+func compileError(chunkName string, r interface{}) error {
+	if err, ok := r.(*lexer.SyntaxError); ok {
+		return err
+	}
+	if chunkName != "" && (chunkName[0] == '@' || chunkName[0] == '=') {
+		chunkName = chunkName[1:]
+	}
+	return fmt.Errorf("%s: %v", chunkName, r)
+}
+
+func exitOnError(chunkName string) {
+	if r := recover(); r != nil {
+		fmt.Fprintln(os.Stderr, "Syntax Error Occurred:")
+		fmt.Fprintln(os.Stderr, "Error @", compileError(chunkName, r))
+		os.Exit(1)
+	}
+}
+
+func recoverError(chunkName string, err *error) {
+	if r := recover(); r != nil {
+		*err = compileError(chunkName, r)
+	}
+}
+
+// TryCompile is Compile returning the error instead of ending the
+// program: a *lexer.SyntaxError, or what the generator found
+func TryCompile(chunk, chunkName string) (proto *binchunk.Prototype, err error) {
+	defer recoverError(chunkName, &err)
+	p := parser.New(chunk, chunkName)
+	ast := p.Parse()
+	proto = generator.GenerateProto(ast)
+	setSource(proto, source(chunkName))
+	return proto, nil
+}
+
+// TryParse only parses the chunk, returning a *lexer.SyntaxError if it
+// can't
+func TryParse(chunk, chunkName string) (block *Block, err error) {
+	defer recoverError(chunkName, &err)
+	p := parser.New(chunk, chunkName)
+	return p.Parse(), nil
+}
+
+// TryTranspile is Transpile returning the error instead of ending the
+// program
+func TryTranspile(chunk, chunkName string, version int) (src string, err error) {
+	defer recoverError(chunkName, &err)
+	p := parser.New(chunk, chunkName)
+	ast := p.Parse()
+	return transpiler.Transpile(ast, chunkName, version), nil
+}
+
+// CompileLine compiles a line typed into the REPL, like TryCompile.
+// Its top level locals become globals, so that the lines after it can
+// still use them.
+func CompileLine(chunk, chunkName string) (proto *binchunk.Prototype, err error) {
+	defer recoverError(chunkName, &err)
+	p := parser.New(chunk, chunkName)
+	ast := p.Parse()
+	for i, stat := range ast.Statements {
+		ast.Statements[i] = globalize(stat)
+	}
+	proto = generator.GenerateProto(ast)
+	setSource(proto, source(chunkName))
+	return proto, nil
+}
+
+// x, y := 1, 2 => x, y = 1, 2
+func globalize(stat Statement) Statement {
+	switch x := stat.(type) {
+	case *LocVarDeclStat:
+		if x.AttribList != nil { // to-be-closed, it has to stay local
+			return stat
+		}
+		vars := make([]Expression, len(x.NameList))
+		for i, name := range x.NameList {
+			vars[i] = &NameExp{Line: x.LastLine, Name: name}
+		}
+		exps := x.ExpList
+		if len(exps) == 0 {
+			exps = []Expression{&NilExp{Line: x.LastLine}}
+		}
+		return &AssignmentStat{LastLine: x.LastLine, VarList: vars, ExpList: exps}
+	case *AssignmentStat: // the second half of `local func f() {}`
+		for i, v := range x.VarList {
+			if name, ok := v.(NameExp); ok {
+				x.VarList[i] = &name
+			}
+		}
+	}
+	return stat
+}
@@ -0,0 +1,1143 @@
+package decompiler
+
+import (
+	"fmt"
+	"lxa/binchunk"
+	. "lxa/compiler/ast"
+	. "lxa/compiler/token"
+	. "lxa/vm"
+	"strings"
+)
+
+/*
+** The decompiler reads the code the generator writes, and so expects
+** its shapes: every statement leaves the registers above its locals
+** free, conditions are tested with TEST and a JMP, comparisons are
+** turned into booleans with LOADBOOL, and the jumps of an if, a loop,
+** a break or a continue go where generate_statement.go sends them:
+**
+**   if:     [cond] TEST JMP>next  [block] JMP>end  next: ...  end:
+**   while:  top: [cond] TEST JMP>end  [block] [step] JMP>top  end:
+**   for:    [init limit step] FORPREP>loop  [block]  loop: FORLOOP
+**   for in: [explist] JMP>call  [block]  call: TFORCALL TFORLOOP
+**
+** The registers hold the expressions evaluated into them until some
+** statement takes them, the locals and upvalues take their names from
+** the debug info, and the scope of a local that ends before its block
+** does becomes a { block } of its own.
+ */
+
+type decompileError struct {
+	msg string
+}
+
+// a jump that no statement explains, which may be the continue of
+// an enclosing loop
+type jumpError struct {
+	f          *function
+	pc, target int
+}
+
+// Decompile writes the function prototype of a chunk back as lxa
+// source
+func Decompile(proto *binchunk.Prototype) (src string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case decompileError:
+				src, err = "", fmt.Errorf("%s", e.msg)
+			case jumpError:
+				src, err = "", e.f.error(e.pc, "cannot tell what the jump to %d is", e.target+1)
+			default:
+				panic(r)
+			}
+		}
+	}()
+	f := newFunction(proto, nil, 0)
+	return source(f.block(0, len(f.code), nil)), nil
+}
+
+type function struct {
+	proto     *binchunk.Prototype
+	parent    *function
+	closurePC int // of the CLOSURE in the parent
+	code      []Instruction
+	locals    []*local
+	regs      []Expression // what the registers that are no locals hold
+	top       int          // past the last of an open list of values
+	multi     map[Expression]bool
+	taken     map[*TableConstructorExp]int // values SETTABLE put before the SETLIST
+}
+
+type local struct {
+	name     string
+	attrib   string // "close" or ""
+	reg      int
+	startPC  int
+	endPC    int
+	declared bool
+}
+
+// the registers left by a call or a vararg giving more than one value,
+// after the first
+type tailExp struct {
+	NoBoolExpression
+}
+
+// what SELF leaves for the CALL after it
+type methodExp struct {
+	NoBoolExpression
+	obj  Expression
+	name *StringExp
+}
+
+type loop struct {
+	brk, cont int // where break and continue jump to
+	continued bool
+}
+
+type blockState struct {
+	to     int // end of the block
+	stats  []Statement
+	ret    []Expression
+	hasRet bool
+	scopes []scope
+	chain  bool // the rest of an if, the locals of its last sub ending with it
+}
+
+// the statements from idx on are in a scope ending at end
+type scope struct {
+	idx int
+	end int
+}
+
+func newFunction(proto *binchunk.Prototype, parent *function, pc int) *function {
+	f := &function{
+		proto:     proto,
+		parent:    parent,
+		closurePC: pc,
+		code:      make([]Instruction, len(proto.Code)),
+		regs:      make([]Expression, 256),
+		multi:     map[Expression]bool{},
+		taken:     map[*TableConstructorExp]int{},
+	}
+	for i, inst := range proto.Code {
+		f.code[i] = Instruction(inst)
+	}
+
+	// a local is in the register after those of the locals still
+	// alive when it starts
+	var alive []*local
+	attrib := ""
+	for _, v := range proto.LocVars {
+		if v.VarName == "(close)" && v.StartPC == v.EndPC { // marks the to-be-closed local after it
+			attrib = "close"
+			continue
+		}
+		for len(alive) > 0 && alive[len(alive)-1].endPC <= int(v.StartPC) {
+			alive = alive[:len(alive)-1]
+		}
+		l := &local{
+			name:    v.VarName,
+			attrib:  attrib,
+			reg:     len(alive),
+			startPC: int(v.StartPC),
+			endPC:   int(v.EndPC),
+		}
+		attrib = ""
+		alive = append(alive, l)
+		f.locals = append(f.locals, l)
+	}
+	for i := 0; i < int(proto.NumParams) && i < len(f.locals); i++ {
+		f.locals[i].declared = true
+	}
+	return f
+}
+
+func (f *function) error(pc int, format string, a ...interface{}) error {
+	where := "main function"
+	if f.parent != nil {
+		where = fmt.Sprintf("function at line %d", f.proto.LineDefined)
+	}
+	return fmt.Errorf("%s, pc %d: %s", where, pc+1, fmt.Sprintf(format, a...))
+}
+
+func (f *function) errorf(pc int, format string, a ...interface{}) {
+	panic(decompileError{f.error(pc, format, a...).Error()})
+}
+
+func (f *function) funcDef() *FuncDefExp {
+	fd := &FuncDefExp{
+		Line:     int(f.proto.LineDefined),
+		LastLine: int(f.proto.LastLineDefined),
+		IsVararg: f.proto.IsVararg != 0,
+	}
+	for i := 0; i < int(f.proto.NumParams); i++ {
+		if i < len(f.locals) {
+			fd.ParList = append(fd.ParList, f.locals[i].name)
+		} else {
+			fd.ParList = append(fd.ParList, fmt.Sprintf("_p%d", i))
+		}
+	}
+	fd.Block = f.block(0, len(f.code), nil)
+	return fd
+}
+
+/* registers */
+
+// the local in register r at pc
+func (f *function) localAt(r, pc int) *local {
+	for i := len(f.locals) - 1; i >= 0; i-- {
+		l := f.locals[i]
+		if l.declared && l.reg == r && l.startPC <= pc && pc < l.endPC {
+			return l
+		}
+	}
+	return nil
+}
+
+// whether a name means a local or an upvalue at pc, rather than a
+// global
+func (f *function) visible(name string, pc int) bool {
+	for _, l := range f.locals {
+		if l.declared && l.name == name && l.startPC <= pc && pc < l.endPC {
+			return true
+		}
+	}
+	for _, n := range f.proto.UpvalueNames {
+		if n == name {
+			return true
+		}
+	}
+	return f.parent != nil && f.parent.visible(name, f.closurePC)
+}
+
+// the value of register r: the name of its local, or what was
+// evaluated into it, which is taken
+func (f *function) get(r, pc int) Expression {
+	if l := f.localAt(r, pc); l != nil {
+		return &NameExp{Line: f.line(pc), Name: l.name}
+	}
+	exp := f.regs[r]
+	if exp == nil {
+		f.errorf(pc, "register %d is read before it is set", r)
+	}
+	if _, ok := exp.(*tailExp); ok {
+		f.errorf(pc, "register %d holds the second value of a call", r)
+	}
+	f.regs[r] = nil
+	return exp
+}
+
+// a register, or a constant if x has its 0x100 bit
+func (f *function) rk(x, pc int) Expression {
+	if x > 0xFF {
+		return f.constant(x&0xFF, pc)
+	}
+	return f.get(x, pc)
+}
+
+// evaluates exp into register r, assigning it if r is a local
+func (f *function) set(r int, exp Expression, pc int, b *blockState) {
+	if l := f.localAt(r, pc); l != nil {
+		b.add(&AssignmentStat{
+			LastLine: f.line(pc),
+			VarList:  []Expression{&NameExp{Line: f.line(pc), Name: l.name}},
+			ExpList:  []Expression{exp},
+		})
+		return
+	}
+	f.regs[r] = exp
+}
+
+// whether no register holds anything, as between statements
+func (f *function) idle() bool {
+	for _, exp := range f.regs {
+		if exp != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// takes n values from register r on, all up to the top if n < 0, the
+// last of them being open. A call or a vararg giving one value is kept
+// from giving more in parentheses.
+func (f *function) list(r, n, pc int) []Expression {
+	if n < 0 {
+		n = f.top - r
+	}
+	var exps []Expression
+	for i := r; i < r+n; i++ {
+		if _, ok := f.regs[i].(*tailExp); ok {
+			f.regs[i] = nil
+			continue
+		}
+		exps = append(exps, f.get(i, pc))
+	}
+	if k := len(exps) - 1; k >= 0 && isVarargOrFuncCall(exps[k]) && !f.multi[exps[k]] {
+		exps[k] = &ParensExp{Exp: exps[k]}
+	}
+	return exps
+}
+
+// leaves the values of a call or a vararg from register r on, n of
+// them, all up to the top if n < 0
+func (f *function) results(r, n int, exp Expression, pc int, b *blockState) {
+	f.set(r, exp, pc, b)
+	if n < 0 {
+		f.multi[exp] = true
+		f.top = r + 1
+		return
+	}
+	for i := 1; i < n; i++ {
+		f.regs[r+i] = &tailExp{}
+	}
+	if n > 1 {
+		f.multi[exp] = true
+	}
+}
+
+func (f *function) constant(idx, pc int) Expression {
+	if idx >= len(f.proto.Constants) {
+		f.errorf(pc, "no constant %d", idx)
+	}
+	line := f.line(pc)
+	switch k := f.proto.Constants[idx].(type) {
+	case nil:
+		return &NilExp{Line: line}
+	case bool:
+		if k {
+			return &TrueExp{Line: line}
+		}
+		return &FalseExp{Line: line}
+	case int64:
+		return &IntegerExp{Line: line, Val: k}
+	case float64:
+		return &FloatExp{Line: line, Val: k}
+	case string:
+		return &StringExp{Line: line, Str: k}
+	}
+	panic("unreachable!")
+}
+
+func (f *function) upvalName(idx int) string {
+	if idx < len(f.proto.UpvalueNames) && f.proto.UpvalueNames[idx] != "" {
+		return f.proto.UpvalueNames[idx]
+	}
+	return fmt.Sprintf("_u%d", idx)
+}
+
+// t[key], or the name of a global if t is _ENV
+func (f *function) index(t, key Expression, pc int) Expression {
+	if name, ok := t.(*NameExp); ok && name.Name == "_ENV" {
+		if s, ok := key.(*StringExp); ok && isName(s.Str) && !f.visible(s.Str, pc) {
+			return &NameExp{Line: f.line(pc), Name: s.Str}
+		}
+	}
+	return &TableAccessExp{LastLine: f.line(pc), PrefixExp: t, KeyExp: key}
+}
+
+func (f *function) line(pc int) int {
+	if pc < len(f.proto.LineInfo) {
+		return int(f.proto.LineInfo[pc])
+	}
+	return 0
+}
+
+// where a jump at pc goes
+func (f *function) target(pc int) int {
+	_, sBx := f.code[pc].AsBx()
+	return pc + 1 + sBx
+}
+
+// a jump that only closes upvalues
+func (f *function) isClose(pc int) bool {
+	if pc >= len(f.code) || f.code[pc].Opcode() != OP_JMP {
+		return false
+	}
+	a, sBx := f.code[pc].AsBx()
+	return sBx == 0 && a > 0
+}
+
+// where a jump to pc ends up, past the jumps closing upvalues
+func (f *function) follow(pc int) int {
+	for f.isClose(pc) {
+		pc++
+	}
+	return pc
+}
+
+func (f *function) isJmp(pc int) bool {
+	return pc >= 0 && pc < len(f.code) && f.code[pc].Opcode() == OP_JMP
+}
+
+/* blocks */
+
+func (b *blockState) add(stat Statement) {
+	b.stats = append(b.stats, stat)
+}
+
+// gives the locals of the scopes that end at pc a { block }
+func (b *blockState) closeScopes(pc int) {
+	for n := len(b.scopes); n > 0 && b.scopes[n-1].end <= pc; n-- {
+		s := b.scopes[n-1]
+		block := &Block{Statements: append([]Statement{}, b.stats[s.idx:]...)}
+		if b.hasRet { // the return was the last thing in it
+			block.ReturnExps, b.ret, b.hasRet = b.ret, nil, false
+		}
+		b.stats = append(b.stats[:s.idx], &BlockStat{Block: block})
+		b.scopes = b.scopes[:n-1]
+	}
+}
+
+// takes the statements of the scopes ending by end, which belong to the
+// loop or the if starting there
+func (b *blockState) claim(end int) []Statement {
+	for i, s := range b.scopes {
+		if s.end <= end {
+			stats := append([]Statement{}, b.stats[s.idx:]...)
+			b.stats = b.stats[:s.idx]
+			b.scopes = b.scopes[:i]
+			return stats
+		}
+	}
+	return nil
+}
+
+func (b *blockState) block() *Block {
+	block := &Block{Statements: b.stats}
+	if b.hasRet {
+		block.ReturnExps = b.ret
+		if block.ReturnExps == nil {
+			block.ReturnExps = []Expression{}
+		}
+	}
+	return block
+}
+
+// decompiles the code from one pc up to another
+func (f *function) block(from, to int, lp *loop) *Block {
+	return f.decode(&blockState{to: to}, from, lp)
+}
+
+func (f *function) decode(b *blockState, from int, lp *loop) *Block {
+	to := b.to
+	start := from // of the statement being decompiled
+	pc := from
+	for {
+		f.declare(pc, b)
+		b.closeScopes(pc)
+		if pc >= to || b.hasRet { // after a return, nothing can run
+			break
+		}
+		if f.idle() {
+			start = pc
+		}
+		pc = f.instruction(pc, start, b, lp)
+	}
+	if pc > to {
+		f.errorf(to, "a statement runs past the end of its block")
+	}
+	b.closeScopes(to)
+	return b.block()
+}
+
+// declares the locals starting at pc, from the values left in their
+// registers. The hidden locals of a for are left to it.
+func (f *function) declare(pc int, b *blockState) {
+	var group []*local
+	for _, l := range f.locals {
+		if !l.declared && l.startPC == pc && !strings.HasPrefix(l.name, "(") {
+			group = append(group, l)
+		}
+	}
+	if len(group) == 0 {
+		return
+	}
+	stat := &LocVarDeclStat{LastLine: f.line(pc - 1)}
+	end := group[0].endPC
+	for _, l := range group {
+		exp := f.regs[l.reg]
+		f.regs[l.reg] = nil
+		if exp == nil {
+			f.errorf(pc, "local %s has no value", l.name)
+		}
+		if _, ok := exp.(*tailExp); !ok {
+			stat.ExpList = append(stat.ExpList, exp)
+		}
+		stat.NameList = append(stat.NameList, l.name)
+		if l.attrib != "" && stat.AttribList == nil {
+			stat.AttribList = make([]string, len(group))
+		}
+		if l.endPC < end {
+			end = l.endPC
+		}
+		l.declared = true
+	}
+	if stat.AttribList != nil {
+		for i, l := range group {
+			stat.AttribList[i] = l.attrib
+		}
+	}
+	stat.ExpList = f.trimNils(stat.ExpList, len(stat.NameList))
+	b.add(stat)
+	if end < b.to || b.chain && end == b.to {
+		b.scopes = append(b.scopes, scope{len(b.stats) - 1, end})
+	}
+}
+
+// nils at the end of the values of n variables go without saying, as
+// long as the value before them doesn't then give more than one
+func (f *function) trimNils(exps []Expression, n int) []Expression {
+	k := len(exps)
+	for k > 0 {
+		if _, ok := exps[k-1].(*NilExp); !ok {
+			break
+		}
+		k--
+	}
+	exps = exps[:k]
+	if k > 0 && k < n && isVarargOrFuncCall(exps[k-1]) && !f.multi[exps[k-1]] {
+		exps[k-1] = &ParensExp{Exp: exps[k-1]}
+	}
+	return exps
+}
+
+/* instructions */
+
+// decompiles the instruction at pc, or the statement starting there,
+// returning the pc after it
+func (f *function) instruction(pc, start int, b *blockState, lp *loop) int {
+	i := f.code[pc]
+	line := f.line(pc)
+	switch op := i.Opcode(); op {
+	case OP_MOVE:
+		a, rb, _ := i.ABC()
+		if f.localAt(a, pc) != nil {
+			return f.assignment(pc, b)
+		}
+		f.set(a, f.get(rb, pc), pc, b)
+	case OP_LOADK:
+		a, bx := i.ABx()
+		f.set(a, f.constant(bx, pc), pc, b)
+	case OP_LOADKX:
+		a, _ := i.ABx()
+		if pc+1 >= b.to || f.code[pc+1].Opcode() != OP_EXTRAARG {
+			f.errorf(pc, "LOADKX without EXTRAARG")
+		}
+		f.set(a, f.constant(f.code[pc+1].Ax(), pc), pc, b)
+		return pc + 2
+	case OP_LOADBOOL:
+		a, rb, c := i.ABC()
+		if c != 0 {
+			f.errorf(pc, "LOADBOOL skipping the next instruction")
+		}
+		if rb != 0 {
+			f.set(a, &TrueExp{Line: line}, pc, b)
+		} else {
+			f.set(a, &FalseExp{Line: line}, pc, b)
+		}
+	case OP_LOADNIL:
+		a, rb, _ := i.ABC()
+		for r := a; r <= a+rb; r++ {
+			f.set(r, &NilExp{Line: line}, pc, b)
+		}
+	case OP_GETUPVAL:
+		a, rb, _ := i.ABC()
+		f.set(a, &NameExp{Line: line, Name: f.upvalName(rb)}, pc, b)
+	case OP_GETTABUP:
+		a, rb, c := i.ABC()
+		t := &NameExp{Line: line, Name: f.upvalName(rb)}
+		f.set(a, f.index(t, f.rk(c, pc), pc), pc, b)
+	case OP_GETTABLE:
+		a, rb, c := i.ABC()
+		t := f.get(rb, pc)
+		f.set(a, f.index(t, f.rk(c, pc), pc), pc, b)
+	case OP_SETTABUP, OP_SETUPVAL:
+		return f.assignment(pc, b)
+	case OP_SETTABLE:
+		a, rb, c := i.ABC()
+		if t, ok := f.regs[a].(*TableConstructorExp); ok && f.localAt(a, pc) == nil {
+			f.field(a, t, rb, c, pc)
+		} else {
+			return f.assignment(pc, b)
+		}
+	case OP_NEWTABLE:
+		a, _, _ := i.ABC()
+		f.set(a, &TableConstructorExp{Line: line, LastLine: line}, pc, b)
+	case OP_SELF:
+		a, rb, c := i.ABC()
+		obj := f.get(rb, pc)
+		name, ok := f.rk(c, pc).(*StringExp)
+		if !ok || !isName(name.Str) {
+			f.errorf(pc, "SELF with a key that is no name")
+		}
+		f.regs[a] = &methodExp{obj: obj, name: name}
+		f.regs[a+1] = &tailExp{}
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		a, rb, c := i.ABC()
+		x := f.rk(rb, pc)
+		y := f.rk(c, pc)
+		f.set(a, &BinopExp{Op: binops[op].token(line), Exp1: x, Exp2: y}, pc, b)
+	case OP_UNM, OP_BNOT, OP_NOT, OP_LEN:
+		a, rb, _ := i.ABC()
+		f.set(a, &UnopExp{Op: unops[op].token(line), Exp: f.get(rb, pc)}, pc, b)
+	case OP_CONCAT:
+		a, rb, c := i.ABC()
+		exp := &ConcatExp{Line: line}
+		for r := rb; r <= c; r++ {
+			exp.ExpList = append(exp.ExpList, f.get(r, pc))
+		}
+		f.set(a, exp, pc, b)
+	case OP_JMP:
+		return f.jump(pc, b, lp)
+	case OP_EQ, OP_LT, OP_LE:
+		return f.compare(pc, b)
+	case OP_TEST:
+		return f.test(pc, start, b, lp)
+	case OP_TESTSET:
+		return f.logical(pc, b, lp)
+	case OP_CALL:
+		a, rb, c := i.ABC()
+		call := f.call(a, rb, pc)
+		if c == 1 {
+			b.add(call)
+		} else {
+			f.results(a, c-1, call, pc, b)
+		}
+	case OP_TAILCALL:
+		a, rb, _ := i.ABC()
+		call := f.call(a, rb, pc)
+		f.multi[call] = true
+		b.ret, b.hasRet = []Expression{call}, true
+		if pc+1 < len(f.code) && f.code[pc+1].Opcode() == OP_RETURN {
+			return pc + 2
+		}
+	case OP_RETURN:
+		a, rb, _ := i.ABC()
+		if pc == len(f.code)-1 && rb == 1 { // the one ending every function
+			return pc + 1
+		}
+		b.ret, b.hasRet = f.list(a, rb-1, pc), true
+		if b.ret == nil {
+			b.ret = []Expression{}
+		}
+	case OP_FORPREP:
+		return f.forNum(pc, b)
+	case OP_SETLIST:
+		a, rb, c := i.ABC()
+		t, ok := f.regs[a].(*TableConstructorExp)
+		if !ok {
+			f.errorf(pc, "SETLIST without a table")
+		}
+		n := rb
+		if rb == 0 {
+			n = f.top - a - 1
+		}
+		f.positional(a, t, a+1+n, pc)
+		f.taken[t] = 0
+		if c == 0 {
+			return pc + 2
+		}
+	case OP_CLOSURE:
+		a, bx := i.ABx()
+		if bx >= len(f.proto.Protos) {
+			f.errorf(pc, "no function %d", bx)
+		}
+		fd := newFunction(f.proto.Protos[bx], f, pc).funcDef()
+		f.set(a, fd, pc, b)
+	case OP_VARARG:
+		a, rb, _ := i.ABC()
+		f.results(a, rb-1, &VarargExp{Line: line}, pc, b)
+	default:
+		f.errorf(pc, "unexpected %s", i.OpName())
+	}
+	return pc + 1
+}
+
+// the registers of a table being built up to last, which SETTABLE
+// and SETLIST set, are its positional values
+func (f *function) positional(a int, t *TableConstructorExp, last, pc int) {
+	first := a + 1 + f.taken[t]
+	var exps []Expression
+	for r := first; r < last; r++ {
+		if _, ok := f.regs[r].(*tailExp); ok {
+			f.regs[r] = nil
+			continue
+		}
+		exp := f.get(r, pc)
+		if isVarargOrFuncCall(exp) && !f.multi[exp] {
+			exp = &ParensExp{Exp: exp}
+		}
+		exps = append(exps, exp)
+	}
+	for _, exp := range exps {
+		t.KeyExps = append(t.KeyExps, nil)
+		t.ValExps = append(t.ValExps, exp)
+	}
+	f.taken[t] += last - first
+}
+
+// t[key] = val in a table constructor
+func (f *function) field(a int, t *TableConstructorExp, key, val, pc int) {
+	last := key
+	if key > 0xFF {
+		last = val
+	}
+	if last > 0xFF {
+		for last = a + 1 + f.taken[t]; f.regs[last] != nil; last++ {
+		}
+	}
+	f.positional(a, t, last, pc)
+	k := f.rk(key, pc)
+	t.KeyExps = append(t.KeyExps, k)
+	t.ValExps = append(t.ValExps, f.rk(val, pc))
+	t.LastLine = f.line(pc)
+}
+
+func (f *function) call(a, b, pc int) *FuncCallExp {
+	call := &FuncCallExp{Line: f.line(pc), LastLine: f.line(pc)}
+	if m, ok := f.regs[a].(*methodExp); ok {
+		f.regs[a], f.regs[a+1] = nil, nil
+		call.PrefixExp, call.NameExp = m.obj, m.name
+		if b > 0 {
+			b--
+		}
+		call.Args = f.list(a+2, b-1, pc)
+	} else {
+		call.PrefixExp = f.get(a, pc)
+		call.Args = f.list(a+1, b-1, pc)
+	}
+	return call
+}
+
+// the value operand of a store: MOVE to a local, SETUPVAL, SETTABUP or
+// SETTABLE to no table being built
+func (f *function) storeValue(pc int) (int, bool) {
+	i := f.code[pc]
+	a, b, c := i.ABC()
+	switch i.Opcode() {
+	case OP_MOVE:
+		return b, f.localAt(a, pc) != nil
+	case OP_SETUPVAL:
+		return a, true
+	case OP_SETTABUP:
+		return c, true
+	case OP_SETTABLE:
+		_, isTable := f.regs[a].(*TableConstructorExp)
+		return c, !isTable || f.localAt(a, pc) != nil
+	}
+	return 0, false
+}
+
+// stores one after the other, their values in consecutive registers,
+// are one assignment: all the values are evaluated before any store
+func (f *function) assignment(pc int, b *blockState) int {
+	stat := &AssignmentStat{LastLine: f.line(pc)}
+	var vals []int
+	for ; pc < b.to; pc++ {
+		v, ok := f.storeValue(pc)
+		if !ok {
+			break
+		}
+		if n := len(vals); n > 0 {
+			prev := vals[n-1]
+			if prev > 0xFF || v != prev+1 || f.localAt(v, pc) != nil {
+				break
+			}
+		}
+		vals = append(vals, v)
+
+		i := f.code[pc]
+		a, rb, _ := i.ABC()
+		line := f.line(pc)
+		var target Expression
+		switch i.Opcode() {
+		case OP_MOVE:
+			target = &NameExp{Line: line, Name: f.localAt(a, pc).name}
+		case OP_SETUPVAL:
+			target = &NameExp{Line: line, Name: f.upvalName(rb)}
+		case OP_SETTABUP:
+			t := &NameExp{Line: line, Name: f.upvalName(a)}
+			target = f.index(t, f.rk(rb, pc), pc)
+		case OP_SETTABLE:
+			t := f.get(a, pc)
+			target = f.index(t, f.rk(rb, pc), pc)
+		}
+		stat.VarList = append(stat.VarList, target)
+	}
+	for _, v := range vals {
+		if _, ok := f.regs[v].(*tailExp); ok && v <= 0xFF {
+			f.regs[v] = nil
+			continue
+		}
+		stat.ExpList = append(stat.ExpList, f.rk(v, pc-1))
+	}
+	if last := vals[len(vals)-1]; last <= 0xFF { // values beyond the variables
+		for r := last + 1; r < len(f.regs) && f.regs[r] != nil; r++ {
+			if _, ok := f.regs[r].(*tailExp); !ok {
+				stat.ExpList = append(stat.ExpList, f.regs[r])
+			}
+			f.regs[r] = nil
+		}
+	}
+	stat.ExpList = f.trimNils(stat.ExpList, len(stat.VarList))
+	if len(stat.ExpList) == 0 {
+		stat.ExpList = []Expression{&NilExp{Line: stat.LastLine}}
+	}
+	b.add(stat)
+	return pc
+}
+
+// EQ, LT or LE, JMP, LOADBOOL false, LOADBOOL true: a comparison made
+// a boolean
+func (f *function) compare(pc int, b *blockState) int {
+	i := f.code[pc]
+	op := i.Opcode()
+	a, rb, c := i.ABC()
+	if pc+3 >= b.to || f.code[pc+1].Opcode() != OP_JMP || f.target(pc+1) != pc+3 ||
+		f.code[pc+2].Opcode() != OP_LOADBOOL || f.code[pc+3].Opcode() != OP_LOADBOOL {
+		f.errorf(pc, "%s not made a boolean", i.OpName())
+	}
+	r, _, _ := f.code[pc+2].ABC()
+	line := f.line(pc)
+
+	var exp Expression
+	if op == OP_EQ && a == 0 && c == 0 && rb <= 0xFF && f.localAt(0, pc) == nil { // x?
+		exp = &UnopExp{Op: &Token{Line: line, Type: TOKEN_OP_QST, Literal: "?"}, Exp: f.get(rb, pc)}
+	} else {
+		// x > y is y < x, told apart by the order x and y were
+		// evaluated into registers or made constants. A constant on
+		// the left was most likely on the right.
+		swapped := rb > c && (c > 0xFF || rb <= 0xFF && f.localAt(rb, pc) == nil && f.localAt(c, pc) == nil) ||
+			rb > 0xFF && c <= 0xFF
+		x := f.rk(rb, pc)
+		y := f.rk(c, pc)
+		var t TokenType
+		switch {
+		case op == OP_EQ && a == 0:
+			t = TOKEN_OP_NE
+		case op == OP_EQ:
+			t = TOKEN_OP_EQ
+		case op == OP_LT && swapped:
+			t, x, y = TOKEN_OP_GT, y, x
+		case op == OP_LT:
+			t = TOKEN_OP_LT
+		case swapped:
+			t, x, y = TOKEN_OP_GE, y, x
+		default:
+			t = TOKEN_OP_LE
+		}
+		exp = &BinopExp{Op: tokens[t].token(line), Exp1: x, Exp2: y}
+		if op != OP_EQ && a == 0 {
+			exp = &UnopExp{Op: tokens[TOKEN_OP_NOT].token(line), Exp: &ParensExp{Exp: exp}}
+		}
+	}
+	f.set(r, exp, pc, b)
+	return pc + 4
+}
+
+// TESTSET, JMP to end, the operand after: and or or
+func (f *function) logical(pc int, b *blockState, lp *loop) int {
+	a, rb, c := f.code[pc].ABC()
+	if !f.isJmp(pc + 1) {
+		f.errorf(pc, "TESTSET without a JMP")
+	}
+	end := f.target(pc + 1)
+	if end <= pc+2 || end > b.to {
+		f.errorf(pc, "TESTSET jumping out of its expression")
+	}
+	x := f.get(rb, pc)
+	y := f.value(pc+2, end, a, lp)
+	t := TOKEN_OP_AND
+	if c != 0 {
+		t = TOKEN_OP_OR
+	}
+	exp := &LogicalExp{Op: tokens[t].token(f.line(pc)), ExpList: []Expression{x, y}}
+	if l, ok := y.(*LogicalExp); ok && l.Op.Type == t { // x or (y or z) is x or y or z
+		exp.ExpList = append([]Expression{x}, l.ExpList...)
+	}
+	f.set(a, exp, pc, b)
+	return end
+}
+
+// decompiles code evaluating an expression into register r. No local
+// starts within it: one starting at to is declared from what it gives.
+func (f *function) value(from, to, r int, lp *loop) Expression {
+	b := &blockState{to: to}
+	for pc := from; pc < to; {
+		pc = f.instruction(pc, from, b, lp)
+		if pc > to {
+			f.errorf(to, "an expression runs past where its jumps land")
+		}
+	}
+	if len(b.stats) > 0 || b.hasRet {
+		f.errorf(from, "a statement within an expression")
+	}
+	return f.get(r, to-1)
+}
+
+/* statements */
+
+func (f *function) jump(pc int, b *blockState, lp *loop) int {
+	a, sBx := f.code[pc].AsBx()
+	target := pc + 1 + sBx
+	if target > pc && target+1 < len(f.code) && f.code[target].Opcode() == OP_TFORCALL &&
+		f.code[target+1].Opcode() == OP_TFORLOOP && f.target(target+1) == pc+1 {
+		return f.forIn(pc, b)
+	}
+	if sBx == 0 && (a != 0 || lp == nil) { // closes upvalues
+		return pc + 1
+	}
+	if lp != nil {
+		switch f.follow(target) {
+		case f.follow(lp.brk):
+			b.add(&BreakStat{Line: f.line(pc)})
+			return pc + 1
+		case f.follow(lp.cont): // also one with nothing left to skip
+			lp.continued = true
+			b.add(&ContinueStat{Line: f.line(pc)})
+			return pc + 1
+		}
+	}
+	if sBx == 0 {
+		return pc + 1
+	}
+	panic(jumpError{f, pc, target})
+}
+
+// TEST, JMP: an if, or a while if the code it jumps over ends by
+// jumping back to the start of the condition
+func (f *function) test(pc, start int, b *blockState, lp *loop) int {
+	a, _, c := f.code[pc].ABC()
+	if !f.isJmp(pc + 1) {
+		f.errorf(pc, "TEST without a JMP")
+	}
+	next := f.target(pc + 1)
+	if next <= pc+1 || next > b.to {
+		f.errorf(pc, "TEST jumping out of its block")
+	}
+	cond := f.get(a, pc)
+	if c != 0 {
+		cond = &UnopExp{Op: tokens[TOKEN_OP_NOT].token(f.line(pc)), Exp: cond}
+	}
+	if back := next - 1; back > pc+1 && f.isJmp(back) && f.target(back) == start {
+		return f.while(pc, cond, next, b)
+	}
+	return f.ifStat(pc, cond, next, b, lp)
+}
+
+func (f *function) ifStat(pc int, cond Expression, next int, b *blockState, lp *loop) int {
+	sub := &SubIfStat{InitList: b.claim(next), Exp: cond}
+	stat := &IfStat{SubList: []*SubIfStat{sub}}
+	b.add(stat)
+
+	// the jump closing the block goes past an else, which is always
+	// one if: else { } is else if true { }. Otherwise it is a continue
+	// that looked like one.
+	if j := next - 1; j > pc+1 && f.isJmp(j) {
+		a, _ := f.code[j].AsBx()
+		if end := f.target(j); a == 0 && end > next && end <= b.to {
+			sub.Block = f.block(pc+2, j, lp)
+			els, err := f.tryBlock(&blockState{to: end, chain: true}, next, lp)
+			if err == nil && len(els.Statements) == 1 && els.ReturnExps == nil {
+				if x, ok := els.Statements[0].(*IfStat); ok {
+					stat.SubList = append(stat.SubList, x.SubList...)
+					return end
+				}
+			}
+			f.undo(pc+2, end)
+		}
+	}
+	sub.Block = f.block(pc+2, next, lp)
+	return next
+}
+
+func (f *function) while(pc int, cond Expression, end int, b *blockState) int {
+	stat := &LoopStat{InitList: b.claim(end), Exp: cond}
+	b.add(stat)
+	lp, body, step := f.loopBody(pc+2, end-1, end)
+	stat.Block, stat.StepStat = body, step
+
+	// without a continue, the last statement may as well be the step,
+	// if it assigns what the loop declares
+	if step == nil && !lp.continued && len(stat.InitList) == 1 && len(body.Statements) > 0 &&
+		body.ReturnExps == nil {
+		decl, ok1 := stat.InitList[0].(*LocVarDeclStat)
+		last, ok2 := body.Statements[len(body.Statements)-1].(*AssignmentStat)
+		if ok1 && ok2 && len(decl.NameList) == 1 && len(last.VarList) == 1 {
+			if name, ok := last.VarList[0].(*NameExp); ok && name.Name == decl.NameList[0] {
+				stat.StepStat = last
+				body.Statements = body.Statements[:len(body.Statements)-1]
+			}
+		}
+	}
+	return end
+}
+
+// the block of a loop from one pc to another, and its step: the code a
+// continue jumps to, found as the jump the block could not explain
+func (f *function) loopBody(from, to, brk int) (*loop, *Block, Statement) {
+	cont := to
+	for {
+		lp := &loop{brk: brk, cont: cont}
+		body, err := f.tryBlock(&blockState{to: cont}, from, lp)
+		if err == nil {
+			if cont == to {
+				return lp, body, nil
+			}
+			step := f.block(cont, to, nil)
+			if len(step.Statements) != 1 || step.ReturnExps != nil {
+				f.errorf(cont, "the step of a loop is not one statement")
+			}
+			return lp, body, step.Statements[0]
+		}
+		if err.target <= from || err.target >= cont {
+			panic(*err)
+		}
+		f.undo(from, to)
+		cont = err.target
+	}
+}
+
+func (f *function) tryBlock(b *blockState, from int, lp *loop) (block *Block, err *jumpError) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(jumpError)
+			if !ok || e.f != f {
+				panic(r)
+			}
+			block, err = nil, &e
+		}
+	}()
+	return f.decode(b, from, lp), nil
+}
+
+// forgets what decompiling the code from one pc to another did
+func (f *function) undo(from, to int) {
+	for _, l := range f.locals {
+		if l.startPC >= from && l.startPC <= to {
+			l.declared = false
+		}
+	}
+	for r := range f.regs {
+		f.regs[r] = nil
+	}
+}
+
+// [init limit step] FORPREP [block] FORLOOP
+func (f *function) forNum(pc int, b *blockState) int {
+	a, sBx := f.code[pc].AsBx()
+	loopPC := pc + 1 + sBx
+	if loopPC >= b.to || f.code[loopPC].Opcode() != OP_FORLOOP || f.target(loopPC) != pc+1 {
+		f.errorf(pc, "FORPREP without its FORLOOP")
+	}
+	stat := &ForNumStat{
+		LineOfFor: f.line(loopPC),
+		LineOfDo:  f.line(pc),
+		InitExp:   f.get(a, pc),
+		LimitExp:  f.get(a+1, pc),
+		StepExp:   f.get(a+2, pc),
+	}
+	stat.VarName = f.loopVars(a+3, 1, pc+1)[0]
+	b.add(stat)
+	stat.Block = f.block(pc+1, loopPC, &loop{brk: loopPC + 1, cont: loopPC})
+	return loopPC + 1
+}
+
+// JMP [block] TFORCALL TFORLOOP
+func (f *function) forIn(pc int, b *blockState) int {
+	call := f.target(pc)
+	a, _, c := f.code[call].ABC()
+	if call+1 >= b.to || f.code[call+1].Opcode() != OP_TFORLOOP || f.target(call+1) != pc+1 {
+		f.errorf(pc, "TFORCALL without its TFORLOOP")
+	}
+	var exps []Expression
+	for r := a; r < a+3; r++ {
+		if _, ok := f.regs[r].(*tailExp); ok {
+			f.regs[r] = nil
+			continue
+		}
+		exps = append(exps, f.get(r, pc))
+	}
+	stat := &ForInStat{
+		LineBlock: f.line(pc),
+		NameList:  f.loopVars(a+3, c, pc+1),
+		ExpList:   f.trimNils(exps, 3),
+	}
+	b.add(stat)
+	stat.Block = f.block(pc+1, call, &loop{brk: call + 2, cont: call})
+	return call + 2
+}
+
+// declares the n variables of a for from register r on
+func (f *function) loopVars(r, n, pc int) []string {
+	names := make([]string, n)
+	for _, l := range f.locals {
+		if !l.declared && l.startPC == pc && l.reg >= r && l.reg < r+n {
+			names[l.reg-r] = l.name
+			l.declared = true
+		}
+	}
+	for i, name := range names {
+		if name == "" {
+			f.errorf(pc, "no name for the variable %d of a for", i+1)
+		}
+	}
+	return names
+}
+
+/* tokens */
+
+type opToken struct {
+	t       TokenType
+	literal string
+}
+
+func (o opToken) token(line int) *Token {
+	return &Token{Line: line, Type: o.t, Literal: o.literal}
+}
+
+var binops = map[int]opToken{
+	OP_ADD:  {TOKEN_OP_ADD, "+"},
+	OP_SUB:  {TOKEN_OP_SUB, "-"},
+	OP_MUL:  {TOKEN_OP_MUL, "*"},
+	OP_MOD:  {TOKEN_OP_MOD, "%"},
+	OP_POW:  {TOKEN_OP_POW, "**"},
+	OP_DIV:  {TOKEN_OP_DIV, "/"},
+	OP_IDIV: {TOKEN_OP_IDIV, "~/"},
+	OP_BAND: {TOKEN_OP_BAND, "&"},
+	OP_BOR:  {TOKEN_OP_BOR, "|"},
+	OP_BXOR: {TOKEN_OP_BXOR, "^"},
+	OP_SHL:  {TOKEN_OP_SHL, "<<"},
+	OP_SHR:  {TOKEN_OP_SHR, ">>"},
+}
+
+var unops = map[int]opToken{
+	OP_UNM:  {TOKEN_OP_UNM, "-"},
+	OP_BNOT: {TOKEN_OP_BNOT, "~"},
+	OP_NOT:  {TOKEN_OP_NOT, "!"},
+	OP_LEN:  {TOKEN_OP_LEN, "#"},
+}
+
+var tokens = map[TokenType]opToken{
+	TOKEN_OP_EQ:  {TOKEN_OP_EQ, "=="},
+	TOKEN_OP_NE:  {TOKEN_OP_NE, "!="},
+	TOKEN_OP_LT:  {TOKEN_OP_LT, "<"},
+	TOKEN_OP_LE:  {TOKEN_OP_LE, "<="},
+	TOKEN_OP_GT:  {TOKEN_OP_GT, ">"},
+	TOKEN_OP_GE:  {TOKEN_OP_GE, ">="},
+	TOKEN_OP_AND: {TOKEN_OP_AND, "and"},
+	TOKEN_OP_OR:  {TOKEN_OP_OR, "or"},
+	TOKEN_OP_NOT: {TOKEN_OP_NOT, "!"},
+}
+
+func isVarargOrFuncCall(exp Expression) bool {
+	switch exp.(type) {
+	case *VarargExp, *FuncCallExp:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package decompiler_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"lxa/binchunk"
+	"lxa/compiler"
+	"lxa/compiler/decompiler"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// and and or giving locals, which start where their jumps land
+var roundTrips = map[string]string{
+	"or":      "x := a or b\nprint(x)\n",
+	"and":     "func f(a, b) {\n\tx := a and b\n\treturn x\n}\n",
+	"compare": "func f(a, c) {\n\tz := a != nil and #c > 0\n\treturn z\n}\n",
+	"locals":  "a, b := 1, 2\nx := a or b\ny := a and b or x\nprint(x, y)\n",
+}
+
+// what a source compiles to is what its decompiled source compiles to
+func TestRoundTrip(t *testing.T) {
+	files, err := filepath.Glob("../../testdata/difftest/*.lxa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range files {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrips[filepath.Base(filename)] = string(src)
+	}
+	for name, src := range roundTrips {
+		proto, err := compiler.TryCompile(src, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		out, err := decompiler.Decompile(proto)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		again, err := compiler.TryCompile(out, name)
+		if err != nil {
+			t.Errorf("%s: the decompiled source doesn't compile: %v\n%s", name, err, out)
+			continue
+		}
+		if where := diffCode(proto, again, "main function"); where != "" {
+			t.Errorf("%s: the decompiled source compiles differently, in the %s:\n%s", name, where, out)
+		}
+	}
+}
+
+// where the code or the constants of two functions differ, if they do
+func diffCode(p, q *binchunk.Prototype, where string) string {
+	if !reflect.DeepEqual(p.Code, q.Code) || !reflect.DeepEqual(p.Constants, q.Constants) ||
+		len(p.Protos) != len(q.Protos) {
+		return where
+	}
+	for i := range p.Protos {
+		if where := diffCode(p.Protos[i], q.Protos[i], fmt.Sprintf("function at line %d", p.Protos[i].LineDefined)); where != "" {
+			return where
+		}
+	}
+	return ""
+}
@@ -0,0 +1,617 @@
+package decompiler
+
+import (
+	"fmt"
+	. "lxa/compiler/ast"
+	. "lxa/compiler/token"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// lxa operator precedence, from lower to higher
+const (
+	precQst = iota + 1 // x?
+	precOr
+	precAnd
+	precCompare // < > <= >= != ==
+	precConcat  // ..
+	precBor     // |
+	precBxor    // ^
+	precBand    // &
+	precShift   // << >>
+	precAdd     // + -
+	precMul     // * / ~/ %
+	precUnary   // - ! # ~
+	precPow     // ** (right associative)
+	precPrimary
+)
+
+var operators = map[TokenType]struct {
+	op   string
+	prec int
+}{
+	TOKEN_OP_EQ:   {"==", precCompare},
+	TOKEN_OP_NE:   {"!=", precCompare},
+	TOKEN_OP_LT:   {"<", precCompare},
+	TOKEN_OP_LE:   {"<=", precCompare},
+	TOKEN_OP_GT:   {">", precCompare},
+	TOKEN_OP_GE:   {">=", precCompare},
+	TOKEN_OP_BOR:  {"|", precBor},
+	TOKEN_OP_BXOR: {"^", precBxor},
+	TOKEN_OP_BAND: {"&", precBand},
+	TOKEN_OP_SHL:  {"<<", precShift},
+	TOKEN_OP_SHR:  {">>", precShift},
+	TOKEN_OP_ADD:  {"+", precAdd},
+	TOKEN_OP_SUB:  {"-", precAdd},
+	TOKEN_OP_MUL:  {"*", precMul},
+	TOKEN_OP_DIV:  {"/", precMul},
+	TOKEN_OP_IDIV: {"~/", precMul},
+	TOKEN_OP_MOD:  {"%", precMul},
+	TOKEN_OP_POW:  {"**", precPow},
+}
+
+// words the lexer never takes for a name
+var keywords = map[string]bool{
+	"and": true, "break": true, "continue": true, "else": true, "false": true,
+	"for": true, "func": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "return": true, "true": true,
+	"while": true,
+}
+
+type printer struct {
+	indent int
+	guard  bool // the next leaf goes in parentheses
+}
+
+// the source of a block, a statement a line
+func source(block *Block) string {
+	p := &printer{}
+	return p.block(block)
+}
+
+func (p *printer) tabs() string {
+	return strings.Repeat("\t", p.indent)
+}
+
+func (p *printer) block(block *Block) string {
+	var b strings.Builder
+	for _, stat := range block.Statements {
+		if s := p.stat(stat); s != "" {
+			b.WriteString(p.tabs() + s + "\n")
+		}
+	}
+	if block.ReturnExps != nil {
+		s := "return"
+		if len(block.ReturnExps) > 0 {
+			s += " " + p.expList(block.ReturnExps)
+		}
+		b.WriteString(p.tabs() + s + "\n")
+	}
+	return b.String()
+}
+
+// a block between braces, opened on the current line
+func (p *printer) body(block *Block) string {
+	p.indent++
+	s := p.block(block)
+	p.indent--
+	if s == "" {
+		return "{}"
+	}
+	return "{\n" + s + p.tabs() + "}"
+}
+
+/* statements */
+
+// the source of a statement, its first line not indented and its last
+// one not ended
+func (p *printer) stat(node Statement) string {
+	switch stat := node.(type) {
+	case *EmptyStat:
+		return ""
+	case *BreakStat:
+		return "break"
+	case *ContinueStat:
+		return "continue"
+	case *BlockStat:
+		return p.body(stat.Block)
+	case *LoopStat:
+		return p.loopStat(stat)
+	case *ForNumStat:
+		return p.forNumStat(stat)
+	case *ForInStat:
+		names := strings.Join(stat.NameList, ", ")
+		return fmt.Sprintf("for %s in %s %s", names, p.expList(stat.ExpList), p.body(stat.Block))
+	case *IfStat:
+		return p.ifStat(stat.SubList)
+	case *FuncCallExp:
+		return p.exp(stat, 0)
+	case *AssignmentStat:
+		return p.assignmentStat(stat)
+	case *LocVarDeclStat:
+		return p.locVarDeclStat(stat)
+	default:
+		panic("unreachable!")
+	}
+}
+
+// statements before the condition of an if or a while, which can only
+// be written there if they have no braces
+func (p *printer) inits(stats []Statement) (string, bool) {
+	var list []string
+	for _, stat := range stats {
+		s := p.stat(stat)
+		if hasBrace(s) {
+			return "", false
+		}
+		list = append(list, s+"; ")
+	}
+	return strings.Join(list, ""), true
+}
+
+// the statements, then the one after them, in a block of their own
+func (p *printer) scoped(stats []Statement, last func() string) string {
+	p.indent++
+	var b strings.Builder
+	for _, stat := range stats {
+		if s := p.stat(stat); s != "" {
+			b.WriteString(p.tabs() + s + "\n")
+		}
+	}
+	b.WriteString(p.tabs() + last() + "\n")
+	p.indent--
+	return "{\n" + b.String() + p.tabs() + "}"
+}
+
+func (p *printer) loopStat(stat *LoopStat) string {
+	if stat.StepStat == nil {
+		if inits, ok := p.inits(stat.InitList); ok {
+			return fmt.Sprintf("while %s%s %s", inits, p.exp(stat.Exp, 0), p.body(stat.Block))
+		}
+		return p.scoped(stat.InitList, func() string {
+			return p.loopStat(&LoopStat{Exp: stat.Exp, Block: stat.Block})
+		})
+	}
+
+	// for init; cond; step, its init the last of them
+	pre, init := stat.InitList, ""
+	if n := len(pre); n > 0 {
+		if s := p.stat(pre[n-1]); !hasBrace(s) {
+			pre, init = pre[:n-1], s
+		}
+	}
+	loop := func() string {
+		return fmt.Sprintf("for %s; %s; %s %s", init, p.exp(stat.Exp, 0), p.stat(stat.StepStat), p.body(stat.Block))
+	}
+	if len(pre) > 0 {
+		return p.scoped(pre, loop)
+	}
+	return loop()
+}
+
+func (p *printer) forNumStat(stat *ForNumStat) string {
+	v := stat.VarName
+	cmp, step := "<=", v+" += "+p.exp(stat.StepExp, 0)
+	if k, ok := stat.StepExp.(*IntegerExp); ok {
+		switch {
+		case k.Val == 1:
+			step = v + "++"
+		case k.Val == -1:
+			cmp, step = ">=", v+"--"
+		case k.Val < 0 && k.Val != math.MinInt64:
+			cmp, step = ">=", fmt.Sprintf("%s -= %d", v, -k.Val)
+		}
+	}
+	return fmt.Sprintf("for %s := %s; %s %s %s; %s %s", v, p.exp(stat.InitExp, 0),
+		v, cmp, p.exp(stat.LimitExp, precCompare+1), step, p.body(stat.Block))
+}
+
+func (p *printer) ifStat(subs []*SubIfStat) string {
+	var b strings.Builder
+	for i, sub := range subs {
+		if i > 0 {
+			b.WriteString(" else ")
+		}
+		if _, ok := sub.Exp.(*TrueExp); ok && i > 0 && i == len(subs)-1 && len(sub.InitList) == 0 {
+			b.WriteString(p.body(sub.Block))
+			break
+		}
+		inits, ok := p.inits(sub.InitList)
+		if !ok { // the rest within a block, after the statements
+			rest := append([]*SubIfStat{{Exp: sub.Exp, Block: sub.Block}}, subs[i+1:]...)
+			b.WriteString(p.scoped(sub.InitList, func() string {
+				return p.ifStat(rest)
+			}))
+			break
+		}
+		fmt.Fprintf(&b, "if %s%s %s", inits, p.exp(sub.Exp, 0), p.body(sub.Block))
+	}
+	return b.String()
+}
+
+var compounds = map[TokenType]bool{
+	TOKEN_OP_ADD: true, TOKEN_OP_SUB: true, TOKEN_OP_MUL: true, TOKEN_OP_DIV: true,
+	TOKEN_OP_IDIV: true, TOKEN_OP_MOD: true, TOKEN_OP_BAND: true, TOKEN_OP_BOR: true,
+	TOKEN_OP_BXOR: true, TOKEN_OP_POW: true, TOKEN_OP_SHL: true, TOKEN_OP_SHR: true,
+}
+
+func (p *printer) assignmentStat(stat *AssignmentStat) string {
+	if len(stat.VarList) == 1 && len(stat.ExpList) == 1 {
+		if fd, ok := stat.ExpList[0].(*FuncDefExp); ok { // func a.b.c() {}
+			if name, ok := funcName(stat.VarList[0]); ok {
+				if t, ok := stat.VarList[0].(*TableAccessExp); ok && len(fd.ParList) > 0 && fd.ParList[0] == "self" {
+					if prefix, ok := funcName(t.PrefixExp); ok {
+						name = prefix + ":" + t.KeyExp.(*StringExp).Str
+						return "func " + name + p.funcBody(fd, fd.ParList[1:])
+					}
+				}
+				return "func " + name + p.funcBody(fd, fd.ParList)
+			}
+		}
+		// x += y
+		v, ok1 := stat.VarList[0].(*NameExp)
+		binop, ok2 := stat.ExpList[0].(*BinopExp)
+		if ok1 && ok2 && compounds[binop.Op.Type] {
+			if x, ok := binop.Exp1.(*NameExp); ok && x.Name == v.Name {
+				op := operators[binop.Op.Type].op
+				if k, ok := binop.Exp2.(*IntegerExp); ok && k.Val == 1 && (op == "+" || op == "-") {
+					return v.Name + op + op
+				}
+				return fmt.Sprintf("%s %s= %s", v.Name, op, p.exp(binop.Exp2, 0))
+			}
+		}
+	}
+	return p.expList(stat.VarList) + " = " + p.expList(stat.ExpList)
+}
+
+// a.b.c, if the variable is one a func statement can name
+func funcName(exp Expression) (string, bool) {
+	switch x := exp.(type) {
+	case *NameExp:
+		return x.Name, isName(x.Name)
+	case *TableAccessExp:
+		key, ok := x.KeyExp.(*StringExp)
+		if !ok || !isName(key.Str) {
+			return "", false
+		}
+		prefix, ok := funcName(x.PrefixExp)
+		return prefix + "." + key.Str, ok
+	}
+	return "", false
+}
+
+func (p *printer) locVarDeclStat(stat *LocVarDeclStat) string {
+	if stat.AttribList == nil && len(stat.ExpList) > 0 {
+		return strings.Join(stat.NameList, ", ") + " := " + p.expList(stat.ExpList)
+	}
+	names := make([]string, len(stat.NameList))
+	for i, name := range stat.NameList {
+		names[i] = name
+		if stat.AttribList != nil && stat.AttribList[i] != "" {
+			names[i] += " <" + stat.AttribList[i] + ">"
+		}
+	}
+	s := "local " + strings.Join(names, ", ")
+	if len(stat.ExpList) > 0 {
+		s += " = " + p.expList(stat.ExpList)
+	}
+	return s
+}
+
+/* expressions */
+
+func (p *printer) expList(exps []Expression) string {
+	list := make([]string, len(exps))
+	for i, exp := range exps {
+		list[i] = p.exp(exp, 0)
+	}
+	return strings.Join(list, ", ")
+}
+
+// the source of an expression, in parentheses if it binds weaker than
+// minPrec
+func (p *printer) exp(node Expression, minPrec int) string {
+	switch exp := node.(type) {
+	case *ParensExp:
+		return p.parens(exp.Exp)
+	case *FuncDefExp:
+		p.guard = false // its parameters can't be helped
+		return "func" + p.funcBody(exp, exp.ParList)
+	}
+	s, prec := p.text(node)
+	if prec < minPrec {
+		return p.parens(node)
+	}
+	return s
+}
+
+// an expression in parentheses. A comma before the first ) makes the
+// parser take them for the parameters of a lambda, so then the first
+// leaf of the expression gets parentheses of its own.
+func (p *printer) parens(node Expression) string {
+	p.guard = false // taken by the (
+	s, _ := p.text(node)
+	if commaFirst(s) {
+		p.guard = true
+		s, _ = p.text(node)
+		p.guard = false
+	}
+	return "(" + s + ")"
+}
+
+// a leaf of an expression
+func (p *printer) leaf(s string) (string, int) {
+	if p.guard {
+		p.guard = false
+		return "(" + s + ")", precPrimary
+	}
+	return s, precPrimary
+}
+
+// the source of an expression and the precedence it binds with
+func (p *printer) text(node Expression) (string, int) {
+	switch exp := node.(type) {
+	case *NilExp:
+		return p.leaf("nil")
+	case *FalseExp:
+		return p.leaf("false")
+	case *TrueExp:
+		return p.leaf("true")
+	case *IntegerExp:
+		s, prec := integer(exp.Val)
+		if prec == precPrimary {
+			return p.leaf(s)
+		}
+		return s, prec
+	case *FloatExp:
+		s, prec := float(exp.Val)
+		if prec == precPrimary {
+			return p.leaf(s)
+		}
+		return s, prec
+	case *StringExp:
+		return p.leaf(quote(exp.Str))
+	case *VarargExp:
+		return p.leaf("...")
+	case *NameExp:
+		return p.leaf(exp.Name)
+	case *ParensExp, *FuncDefExp:
+		return p.exp(exp, 0), precPrimary
+	case *ConcatExp:
+		list := make([]string, len(exp.ExpList))
+		for i, e := range exp.ExpList {
+			list[i] = p.exp(e, precConcat+1)
+		}
+		return strings.Join(list, " .. "), precConcat
+	case *TableConstructorExp:
+		return p.tableConstructorExp(exp), precPrimary
+	case *UnopExp:
+		return p.unopExp(exp)
+	case *LogicalExp:
+		return p.logicalExp(exp)
+	case *BinopExp:
+		bin := operators[exp.Op.Type]
+		if exp.Op.Type == TOKEN_OP_POW { // right associative, and a unary operator binds weaker on its left
+			x := p.exp(exp.Exp1, precPrimary)
+			return x + " ** " + p.exp(exp.Exp2, precUnary), precPow
+		}
+		x := p.exp(exp.Exp1, bin.prec)
+		return x + " " + bin.op + " " + p.exp(exp.Exp2, bin.prec+1), bin.prec
+	case *TableAccessExp:
+		prefix := p.prefixExp(exp.PrefixExp)
+		if key, ok := exp.KeyExp.(*StringExp); ok && isName(key.Str) {
+			return prefix + "." + key.Str, precPrimary
+		}
+		return prefix + "[" + p.exp(exp.KeyExp, 0) + "]", precPrimary
+	case *FuncCallExp:
+		prefix := p.prefixExp(exp.PrefixExp)
+		if exp.NameExp != nil {
+			prefix += ":" + exp.NameExp.Str
+		}
+		return prefix + "(" + p.expList(exp.Args) + ")", precPrimary
+	default:
+		panic("unreachable!")
+	}
+}
+
+func integer(i int64) (string, int) {
+	switch {
+	case i == math.MinInt64: // has no literal
+		return "-9223372036854775807 - 1", precAdd
+	case i < 0:
+		return strconv.FormatInt(i, 10), precUnary
+	default:
+		return strconv.FormatInt(i, 10), precPrimary
+	}
+}
+
+func float(f float64) (string, int) {
+	switch {
+	case math.IsInf(f, 1):
+		return "1 / 0", precMul
+	case math.IsInf(f, -1):
+		return "-1 / 0", precMul
+	case math.IsNaN(f):
+		return "0 / 0", precMul
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") { // keep it a float
+		s += ".0"
+	}
+	if math.Signbit(f) {
+		return s, precUnary
+	}
+	return s, precPrimary
+}
+
+func (p *printer) unopExp(node *UnopExp) (string, int) {
+	if node.Op.Type == TOKEN_OP_QST {
+		return p.exp(node.Exp, precOr) + "?", precQst
+	}
+	op := "-"
+	switch node.Op.Type {
+	case TOKEN_OP_NOT:
+		op = "!"
+	case TOKEN_OP_LEN:
+		op = "#"
+	case TOKEN_OP_BNOT:
+		op = "~"
+	}
+	x := p.exp(node.Exp, precUnary)
+	if strings.HasPrefix(x, "-") && op == "-" { // not --
+		return "-(" + x + ")", precUnary
+	}
+	return op + x, precUnary
+}
+
+func (p *printer) logicalExp(node *LogicalExp) (string, int) {
+	op, prec := " or ", precOr
+	if node.Op.Type == TOKEN_OP_AND {
+		op, prec = " and ", precAnd
+	}
+	list := make([]string, len(node.ExpList))
+	for i, exp := range node.ExpList {
+		list[i] = p.exp(exp, prec+1)
+	}
+	return strings.Join(list, op), prec
+}
+
+// fields on one line, as the parser wants them
+func (p *printer) tableConstructorExp(node *TableConstructorExp) string {
+	guard := p.guard
+	p.guard = false
+	fields := make([]string, len(node.ValExps))
+	for i, keyExp := range node.KeyExps {
+		p.guard = guard && i == 0
+		val := node.ValExps[i]
+		if parens, ok := val.(*ParensExp); ok && i < len(node.ValExps)-1 { // only one value either way
+			val = parens.Exp
+		}
+		if keyExp == nil {
+			fields[i] = p.exp(val, 0)
+		} else if key, ok := keyExp.(*StringExp); ok && isName(key.Str) {
+			fields[i] = key.Str + " = " + p.exp(val, 0)
+		} else {
+			key := p.exp(keyExp, 0)
+			fields[i] = "[" + key + "] = " + p.exp(val, 0)
+		}
+	}
+	p.guard = false
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// an expression that can be indexed or called without parentheses. The
+// parser ends a prefix expression at a call.
+func (p *printer) prefixExp(node Expression) string {
+	switch exp := node.(type) {
+	case *NameExp, *TableAccessExp:
+		return p.exp(exp, 0)
+	}
+	return p.parens(node)
+}
+
+// (params) { block }
+func (p *printer) funcBody(node *FuncDefExp, params []string) string {
+	params = append([]string{}, params...)
+	if node.IsVararg {
+		params = append(params, "...")
+	}
+	return "(" + strings.Join(params, ", ") + ") " + p.body(node.Block)
+}
+
+/* text */
+
+// whether the lexer reads it as one name
+func isName(s string) bool {
+	if s == "" || keywords[s] {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == utf8.RuneError || r > 0xFFFF:
+			return false
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9':
+			if i == 0 {
+				return false
+			}
+		case r >= 0x80:
+			if i == 0 && !unicode.IsLetter(r) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// a string literal the lexer reads back the same
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < 0x20 || r == 0x7F || r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\%03d`, s[i])
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// skips over the string literal starting at s[i], returning the index
+// of its closing quote
+func skipString(s string, i int) int {
+	for i++; i < len(s) && s[i] != '"'; i++ {
+		if s[i] == '\\' {
+			i++
+		}
+	}
+	return i
+}
+
+// whether there is a comma before the first ) of the source
+func commaFirst(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			i = skipString(s, i)
+		case ',':
+			return true
+		case ')':
+			return false
+		}
+	}
+	return false
+}
+
+// whether the source has a { outside its strings
+func hasBrace(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			i = skipString(s, i)
+		case '{':
+			return true
+		}
+	}
+	return false
+}
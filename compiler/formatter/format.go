@@ -0,0 +1,115 @@
+package formatter
+
+import (
+	"strings"
+)
+
+// where a line leaves the scanner
+const (
+	inCode = iota
+	inShortString
+	inLongString
+	inComment
+)
+
+// Indent re-indents lxa source the way the examples are: one tab of
+// indentation per open bracket, no trailing whitespace, no more than
+// one blank line in a row, and a newline at the end. Only whitespace
+// outside strings and comments changes, so the program still means the
+// same; a file using "\r\n" keeps it. Nothing else is laid out again:
+// spaces inside a line and line breaks are left as they are.
+func Indent(src string) string {
+	crlf := strings.Contains(src, "\r\n")
+	src = strings.Replace(src, "\r\n", "\n", -1)
+
+	var out []string
+	depth, state, blanks := 0, inCode, 0
+	var quote byte
+	for _, line := range strings.Split(src, "\n") {
+		start, startDepth := state, depth
+		closing := 0 // closing brackets the line starts with
+		leading := true
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch state {
+			case inCode:
+				switch c {
+				case '"', '\'':
+					state, quote = inShortString, c
+				case '`':
+					state = inLongString
+				case '/':
+					if i+1 < len(line) && line[i+1] == '/' {
+						i = len(line) // the rest is a comment
+					} else if i+1 < len(line) && line[i+1] == '*' {
+						state = inComment
+						i++
+					}
+				case '{', '(', '[':
+					depth++
+				case '}', ')', ']':
+					depth--
+					if leading {
+						closing++
+					}
+				}
+				if c != '}' && c != ')' && c != ']' && c != ' ' && c != '\t' {
+					leading = false
+				}
+			case inShortString:
+				if c == '\\' {
+					i++ // a "\" at the end continues the string
+				} else if c == quote {
+					state = inCode
+				}
+			case inLongString:
+				if c == '`' {
+					state = inCode
+				}
+			case inComment:
+				if c == '*' && i+1 < len(line) && line[i+1] == '/' {
+					state = inCode
+					i++
+				}
+			}
+		}
+		if state == inShortString && !strings.HasSuffix(line, "\\") {
+			state = inCode // unfinished, the parser says so
+		}
+
+		if start != inCode { // inside a string or comment, as it is
+			if state != inLongString {
+				line = strings.TrimRight(line, " \t\r\f\v")
+			}
+			out = append(out, line)
+			blanks = 0
+			continue
+		}
+		text := strings.TrimLeft(line, " \t\r\f\v")
+		if state != inLongString {
+			text = strings.TrimRight(text, " \t\r\f\v")
+		}
+		if text == "" {
+			blanks++
+			continue
+		}
+		if blanks > 0 && len(out) > 0 {
+			out = append(out, "")
+		}
+		blanks = 0
+		indent := startDepth - closing
+		if indent < 0 {
+			indent = 0
+		}
+		out = append(out, strings.Repeat("\t", indent)+text)
+	}
+
+	newline := "\n"
+	if crlf {
+		newline = "\r\n"
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, newline) + newline
+}
@@ -9,7 +9,10 @@ func (fi *funcInfo) toProto() *Prototype {
 	for _, fi := range fi.subFuncs {
 		protos = append(protos, fi.toProto())
 	}
+	return fi.newProto(protos)
+}
 
+func (fi *funcInfo) newProto(protos []*Prototype) *Prototype {
 	proto := &Prototype{
 		LineDefined:     uint32(fi.line),
 		LastLineDefined: uint32(fi.lastLine),
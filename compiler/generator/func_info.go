@@ -44,6 +44,10 @@ type funcInfo struct {
 	lastLine  int
 	numParams int
 	isVararg  bool
+	lua54     bool // generating for Lua 5.4, see lower54.go
+
+	closeBody *FuncDefExp  // the rest of a block with a to-be-closed variable, see generate_close.go
+	exits     map[int]bool // taken out of it, if this function is one
 
 	block *Block
 }
@@ -56,6 +60,7 @@ type locVarInfo struct {
 	startPC  int
 	endPC    int
 	captured bool
+	close    bool // to-be-closed
 }
 
 type upvalInfo struct {
@@ -65,6 +70,7 @@ type upvalInfo struct {
 }
 
 func newFuncInfo(parent *funcInfo, fd *FuncDefExp) *funcInfo {
+	lua54 := parent != nil && parent.lua54
 	return &funcInfo{
 		parent:    parent,
 		subFuncs:  []*funcInfo{},
@@ -80,6 +86,7 @@ func newFuncInfo(parent *funcInfo, fd *FuncDefExp) *funcInfo {
 		lastLine:  fd.LastLine,
 		numParams: len(fd.ParList),
 		isVararg:  fd.IsVararg,
+		lua54:     lua54,
 		block:     fd.Block,
 	}
 }
@@ -166,14 +173,19 @@ func (fi *funcInfo) enterScope(loopScope bool) {
 	}
 }
 
-func (fi *funcInfo) exitScope(endPC int) { // Unchanged continue method
+func (fi *funcInfo) exitScope(endPC int) {
 	pendingBreakJmps := fi.breaks[len(fi.breaks)-1]
 	fi.breaks = fi.breaks[:len(fi.breaks)-1]
+	fi.continues = fi.continues[:len(fi.continues)-1]
 
 	a := fi.getJmpArgA()
 	for _, pc := range pendingBreakJmps {
 		sBx := fi.pc() - pc
-		i := (sBx+MAXARG_sBx)<<14 | a<<6 | OP_JMP
+		b := a
+		if a0 := int(fi.insts[pc]>>6) & 0xFF; a0 > 0 && (b == 0 || a0 < b) {
+			b = a0 // set by getLoopJmpArgA
+		}
+		i := (sBx+MAXARG_sBx)<<14 | b<<6 | OP_JMP
 		fi.insts[pc] = uint32(i)
 	}
 
@@ -213,6 +225,36 @@ func (fi *funcInfo) addLocVar(name string, startPC int) int {
 	return newVar.slot
 }
 
+/*
+** For Lua 5.4 each to-be-closed variable is marked by an empty "(close)"
+** entry right before it in the debug info, from which lower54.go places
+** the TBC instructions: debuggers never see an empty entry as active.
+** Lua 5.3 has no such instruction, see generate_close.go instead.
+ */
+func (fi *funcInfo) setCloseVar(name string) {
+	locVar := fi.locNames[name]
+	locVar.close = true
+
+	mark := &locVarInfo{
+		name:    "(close)",
+		startPC: locVar.startPC,
+		endPC:   locVar.startPC,
+	}
+	n := len(fi.locVars)
+	fi.locVars = append(fi.locVars[:n-1], mark, locVar)
+}
+
+func (fi *funcInfo) hasCloseVars() bool {
+	for _, locVar := range fi.locNames {
+		for v := locVar; v != nil; v = v.prev {
+			if v.close || v.name == forClosingVar {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (fi *funcInfo) slotOfLocVar(name string) int {
 	if locVar, ok := fi.locNames[name]; ok {
 		return locVar.slot
@@ -242,9 +284,11 @@ func (fi *funcInfo) addContinueJmp(pc int) {
 	panic("<continue> at line ? not inside a loop!")
 }
 
+// jumps of the pending continues of the innermost scope go to the
+// current pc; the scope itself is removed by exitScope
 func (fi *funcInfo) setContinueJmp() {
 	continueJmps := fi.continues[len(fi.continues)-1]
-	fi.continues = fi.continues[:len(fi.continues)-1]
+	fi.continues[len(fi.continues)-1] = []int{}
 
 	for _, pc := range continueJmps {
 		sBx := fi.pc() - pc
@@ -287,7 +331,7 @@ func (fi *funcInfo) getJmpArgA() int {
 	for _, locVar := range fi.locNames {
 		if locVar.scopeLv == fi.scopeLv {
 			for v := locVar; v != nil && v.scopeLv == fi.scopeLv; v = v.prev {
-				if v.captured {
+				if v.captured || v.close {
 					hasCapturedLocVars = true
 				}
 				if v.slot < minSlotOfLocVars && v.name[0] != '(' {
@@ -302,3 +346,21 @@ func (fi *funcInfo) getJmpArgA() int {
 		return 0
 	}
 }
+
+// A of a jump leaving the innermost loop, which closes the
+// to-be-closed variables of all the scopes it leaves
+func (fi *funcInfo) getLoopJmpArgA() int {
+	loopLv := fi.scopeLv
+	for loopLv >= 0 && fi.breaks[loopLv] == nil {
+		loopLv--
+	}
+	a := 0
+	for _, locVar := range fi.locNames {
+		for v := locVar; v != nil && v.scopeLv >= loopLv; v = v.prev {
+			if v.close && (a == 0 || v.slot+1 < a) {
+				a = v.slot + 1
+			}
+		}
+	}
+	return a
+}
@@ -6,6 +6,15 @@ import (
 )
 
 func GenerateProto(chunk *Block) *Prototype {
+	return generateMainFunc(chunk, false).toProto()
+}
+
+// generates the main function with Lua 5.4 instructions
+func GenerateProto54(chunk *Block) *Prototype {
+	return generateMainFunc(chunk, true).toProto54()
+}
+
+func generateMainFunc(chunk *Block, lua54 bool) *funcInfo {
 	fd := &FuncDefExp{
 		LastLine: chunk.LastLine,
 		IsVararg: true,
@@ -13,7 +22,8 @@ func GenerateProto(chunk *Block) *Prototype {
 	}
 
 	fi := newFuncInfo(nil, fd)
+	fi.lua54 = lua54
 	fi.addLocVar("_ENV", 0)
 	fi.generateFuncDefExp(fd, 0)
-	return fi.subFuncs[0].toProto()
+	return fi.subFuncs[0]
 }
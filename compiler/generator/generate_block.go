@@ -5,12 +5,24 @@ import (
 )
 
 func (fi *funcInfo) generateBlock(node *Block) {
-	for _, stat := range node.Statements {
+	for i, stat := range node.Statements {
+		if decl, ok := stat.(*LocVarDeclStat); ok && decl.AttribList != nil && !fi.lua54 {
+			fi.generateCloseScope(decl, &Block{
+				LastLine:   node.LastLine,
+				Statements: node.Statements[i+1:],
+				ReturnExps: node.ReturnExps,
+			})
+			return
+		}
 		fi.generateStatement(stat)
 	}
 
 	if node.ReturnExps != nil {
-		fi.generateReturnStat(node.ReturnExps, node.LastLine)
+		exps := node.ReturnExps
+		if fi.exits != nil {
+			exps = fi.exitReturnExps(exps, node.LastLine)
+		}
+		fi.generateReturnStat(exps, node.LastLine)
 	}
 }
 
@@ -28,7 +40,7 @@ func (fi *funcInfo) generateReturnStat(exp []Expression, lastLine int) {
 				return
 			}
 		}
-		if fcExp, ok := exp[0].(*FuncCallExp); ok {
+		if fcExp, ok := exp[0].(*FuncCallExp); ok && !fi.hasCloseVars() {
 			r := fi.preAllocReg()
 			fi.generateTailCallExp(fcExp, r)
 			fi.emitReturn(lastLine, r, -1)
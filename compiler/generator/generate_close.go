@@ -0,0 +1,243 @@
+package generator
+
+import (
+	. "lxa/compiler/ast"
+	. "lxa/compiler/token"
+)
+
+/*
+** Lua 5.3 bytecode has no instruction to close a variable, so for 5.3
+** the rest of the block after a to-be-closed variable becomes a
+** function run by pcall, and the variable is closed once it returns
+** or fails, which both VMs can run:
+**
+**	local x <close> = v        local x = v
+**	rest                       if __lxa_mt := getmetatable(x); x && !(__lxa_mt && __lxa_mt.__close) {
+**	                               error("variable 'x' got a non-closable value")
+**	                           }
+**	                           local __lxa_ok, __lxa_exit, __lxa_res = pcall(func(...) { rest }, ...)
+**	                           if !__lxa_ok {
+**	                               if x { getmetatable(x).__close(x, __lxa_exit) }
+**	                               error(__lxa_exit, 0)
+**	                           }
+**	                           if x { getmetatable(x).__close(x, nil) }
+**	                           if __lxa_exit == 1 { break }
+**	                           else if __lxa_exit == 2 { continue }
+**	                           else if __lxa_exit == 3 { return table.unpack(__lxa_res, 1, __lxa_res.n) }
+**
+** In the function, a break or continue of a loop around it returns
+** 1 or 2, and a return returns 3 and table.pack of its values, so that
+** the same is done once x is closed; only the exits it takes are
+** dispatched. The globals are read from _ENV. With -target 5.4 the
+** TBC instruction does all this instead, see lower54.go.
+ */
+
+const (
+	exitBreak    = 1
+	exitContinue = 2
+	exitReturn   = 3
+)
+
+func (fi *funcInfo) generateCloseScope(decl *LocVarDeclStat, rest *Block) {
+	var name string
+	for i, attrib := range decl.AttribList {
+		if attrib == "close" {
+			name = decl.NameList[i]
+		}
+	}
+	fi.generateLocVarDeclStat(&LocVarDeclStat{
+		LastLine: decl.LastLine,
+		NameList: decl.NameList,
+		ExpList:  decl.ExpList,
+	})
+
+	line, lastLine := decl.LastLine, rest.LastLine
+	x := &NameExp{Line: line, Name: name}
+	mt := &NameExp{Line: line, Name: "__lxa_mt"}
+	ok := &NameExp{Line: lastLine, Name: "__lxa_ok"}
+	exit := &NameExp{Line: lastLine, Name: "__lxa_exit"}
+	res := &NameExp{Line: lastLine, Name: "__lxa_res"}
+
+	fi.generateIfStat(&IfStat{SubList: []*SubIfStat{{
+		InitList: []Statement{&LocVarDeclStat{
+			LastLine: line,
+			NameList: []string{mt.Name},
+			ExpList:  []Expression{callGlobal(line, "getmetatable", x)},
+		}},
+		Exp: and(line, x, not(line, and(line, mt, field(line, mt, "__close")))),
+		Block: &Block{
+			LastLine: line,
+			Statements: []Statement{callGlobal(line, "error",
+				&StringExp{Line: line, Str: "variable '" + name + "' got a non-closable value"})},
+		},
+	}}})
+
+	body := &FuncDefExp{
+		Line:     line,
+		LastLine: lastLine,
+		IsVararg: fi.isVararg,
+		Block:    rest,
+	}
+	args := []Expression{body}
+	if fi.isVararg {
+		args = append(args, &VarargExp{Line: line})
+	}
+	fi.closeBody = body
+	fi.generateLocVarDeclStat(&LocVarDeclStat{
+		LastLine: line,
+		NameList: []string{ok.Name, exit.Name, res.Name},
+		ExpList:  []Expression{callGlobal(line, "pcall", args...)},
+	})
+	exits := fi.subFuncs[len(fi.subFuncs)-1].exits
+
+	closeX := func(err Expression) Statement {
+		return &IfStat{SubList: []*SubIfStat{{
+			Exp: x,
+			Block: &Block{
+				LastLine: lastLine,
+				Statements: []Statement{&FuncCallExp{
+					Line:      lastLine,
+					LastLine:  lastLine,
+					PrefixExp: field(lastLine, callGlobal(lastLine, "getmetatable", x), "__close"),
+					Args:      []Expression{x, err},
+				}},
+			},
+		}}}
+	}
+	fi.generateIfStat(&IfStat{SubList: []*SubIfStat{{
+		Exp: not(lastLine, ok),
+		Block: &Block{
+			LastLine: lastLine,
+			Statements: []Statement{
+				closeX(exit),
+				callGlobal(lastLine, "error", exit, &IntegerExp{Line: lastLine, Val: 0}),
+			},
+		},
+	}}})
+	fi.generateStatement(closeX(&NilExp{Line: lastLine}))
+
+	var subs []*SubIfStat
+	for code := exitBreak; code <= exitReturn; code++ {
+		if !exits[code] {
+			continue
+		}
+		block := &Block{LastLine: lastLine}
+		switch code {
+		case exitBreak:
+			block.Statements = []Statement{&BreakStat{Line: lastLine}}
+		case exitContinue:
+			block.Statements = []Statement{&ContinueStat{Line: lastLine}}
+		case exitReturn:
+			unpack := field(lastLine, envField(lastLine, "table"), "unpack")
+			block.ReturnExps = []Expression{&FuncCallExp{
+				Line:      lastLine,
+				LastLine:  lastLine,
+				PrefixExp: unpack,
+				Args:      []Expression{res, &IntegerExp{Line: lastLine, Val: 1}, field(lastLine, res, "n")},
+			}}
+		}
+		subs = append(subs, &SubIfStat{
+			Exp: &BinopExp{
+				Op:   &Token{Line: lastLine, Type: TOKEN_OP_EQ, Literal: "=="},
+				Exp1: exit,
+				Exp2: &IntegerExp{Line: lastLine, Val: int64(code)},
+			},
+			Block: block,
+		})
+	}
+	if subs != nil {
+		fi.generateIfStat(&IfStat{SubList: subs})
+	}
+}
+
+// a break or continue leaving the function made of the rest of a block
+// with a to-be-closed variable, which has no loop of its own around it
+func (fi *funcInfo) generateExit(code, line int) {
+	fi.exits[code] = true
+	fi.generateReturnStat([]Expression{&IntegerExp{Line: line, Val: int64(code)}}, line)
+}
+
+// what a return in that function returns instead: 3 and the values
+// packed by table.pack
+func (fi *funcInfo) exitReturnExps(exps []Expression, line int) []Expression {
+	fi.exits[exitReturn] = true
+	return []Expression{&IntegerExp{Line: line, Val: exitReturn}, &FuncCallExp{
+		Line:      line,
+		LastLine:  line,
+		PrefixExp: field(line, envField(line, "table"), "pack"),
+		Args:      exps,
+	}}
+}
+
+// reports whether a loop is around the code being generated
+func (fi *funcInfo) inLoop() bool {
+	for _, breaks := range fi.breaks {
+		if breaks != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func declaresCloseVar(stats []Statement) bool {
+	for _, stat := range stats {
+		if decl, ok := stat.(*LocVarDeclStat); ok && decl.AttribList != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// _ENV.name(args)
+func callGlobal(line int, name string, args ...Expression) *FuncCallExp {
+	return &FuncCallExp{
+		Line:      line,
+		LastLine:  line,
+		PrefixExp: envField(line, name),
+		Args:      args,
+	}
+}
+
+// _ENV.name
+func envField(line int, name string) *TableAccessExp {
+	return field(line, &NameExp{Line: line, Name: "_ENV"}, name)
+}
+
+// exp.name
+func field(line int, exp Expression, name string) *TableAccessExp {
+	return &TableAccessExp{
+		LastLine:  line,
+		PrefixExp: exp,
+		KeyExp:    &StringExp{Line: line, Str: name},
+	}
+}
+
+func and(line int, exps ...Expression) *LogicalExp {
+	return &LogicalExp{Op: &Token{Line: line, Type: TOKEN_OP_AND, Literal: "&&"}, ExpList: exps}
+}
+
+func not(line int, exp Expression) *UnopExp {
+	return &UnopExp{Op: &Token{Line: line, Type: TOKEN_OP_NOT, Literal: "!"}, Exp: exp}
+}
+
+// if a {} else if local x <close> = v; b {} else {} => if a {} else { { local x <close> = v; if b {} else {} } }
+func (fi *funcInfo) generateCloseInitIfStat(node *IfStat, i int) {
+	sub := node.SubList[i]
+	rest := &IfStat{SubList: append([]*SubIfStat{{Exp: sub.Exp, Block: sub.Block}}, node.SubList[i+1:]...)}
+	lastLine := sub.Block.LastLine
+	for _, sub := range node.SubList[i+1:] {
+		lastLine = sub.Block.LastLine
+	}
+	block := &Block{
+		LastLine:   lastLine,
+		Statements: append(sub.InitList[:len(sub.InitList):len(sub.InitList)], rest),
+	}
+	if i == 0 {
+		fi.generateBlockStat(&BlockStat{Block: block})
+		return
+	}
+	fi.generateIfStat(&IfStat{SubList: append(node.SubList[:i:i], &SubIfStat{
+		Exp:   &TrueExp{Line: lineOf(sub.Exp)},
+		Block: &Block{LastLine: lastLine, Statements: []Statement{&BlockStat{Block: block}}},
+	})})
+}
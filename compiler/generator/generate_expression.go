@@ -67,6 +67,10 @@ func (fi *funcInfo) generateVarargExp(node *VarargExp, a, n int) {
 func (fi *funcInfo) generateFuncDefExp(node *FuncDefExp, a int) {
 	subFI := newFuncInfo(fi, node)
 	fi.subFuncs = append(fi.subFuncs, subFI)
+	if node == fi.closeBody {
+		subFI.exits = map[int]bool{}
+		fi.closeBody = nil
+	}
 
 	for _, param := range node.ParList {
 		subFI.addLocVar(param, 0)
@@ -91,6 +95,15 @@ func (fi *funcInfo) generateTableConstructorExp(node *TableConstructorExp, a int
 	multRet := nExps > 0 &&
 		isVarargOrFuncCall(node.ValExps[nExps-1])
 
+	oldRegs := fi.usedRegs
+	if a < oldRegs-1 { // SETLIST needs the values right above the table
+		tmp := fi.allocReg()
+		fi.generateTableConstructorExp(node, tmp)
+		fi.emitMove(node.LastLine, a, tmp)
+		fi.usedRegs = oldRegs
+		return
+	}
+	fi.checkAllocReg(a)
 	fi.emitNewTable(node.Line, a, nArr, nExps-nArr)
 
 	arrIdx := 0
@@ -136,6 +149,7 @@ func (fi *funcInfo) generateTableConstructorExp(node *TableConstructorExp, a int
 		line := lastLineOf(valExp)
 		fi.emitSetTable(line, a, b, c)
 	}
+	fi.usedRegs = oldRegs
 }
 
 // r[a] := op exp
@@ -165,12 +179,12 @@ func (fi *funcInfo) generateLogicalExp(node *LogicalExp, a int) {
 		b, _ = fi.expToOpArg(exp, ARG_REG)
 		fi.usedRegs = oldRegs
 	}
+	if b != a { // before where the jumps land, which have r[a] set
+		fi.emitMove(node.Op.Line, a, b)
+	}
 	for _, pcOfJmp := range Jmps {
 		fi.fixSbx(pcOfJmp, fi.pc()-pcOfJmp)
 	}
-	if b != a {
-		fi.emitMove(node.Op.Line, a, b)
-	}
 }
 
 // r[a] := exp1 op exp2
@@ -249,15 +263,15 @@ func (fi *funcInfo) prepFuncCall(node *FuncCallExp, a int) int {
 	lastArgIsVarargOrFuncCall := false
 
 	fi.generateExpression(node.PrefixExp, a, 1)
+	fi.checkAllocReg(a)
 	if node.NameExp != nil {
-		fi.allocReg()
+		fi.allocReg() // r[a+1] := self
 		c, k := fi.expToOpArg(node.NameExp, ARG_RK)
 		fi.emitSelf(node.Line, a, a, c)
 		if k == ARG_REG {
 			fi.freeRegs(1)
 		}
 	}
-	fi.checkAllocReg(a)
 	for i, arg := range node.Args {
 		tmp := fi.preAllocReg()
 		if i == nArgs-1 && isVarargOrFuncCall(arg) {
@@ -14,6 +14,8 @@ func (fi *funcInfo) generateStatement(node Statement) {
 		fi.generateContinueStat(stat)
 	case *LoopStat:
 		fi.generateLoopStat(stat)
+	case *ForNumStat:
+		fi.generateForNumStat(stat)
 	case *IfStat:
 		fi.generateIfStat(stat)
 	case *ForInStat:
@@ -30,16 +32,25 @@ func (fi *funcInfo) generateStatement(node Statement) {
 func (fi *funcInfo) generateBlockStat(node *BlockStat) {
 	fi.enterScope(false)
 	fi.generateBlock(node.Block)
+	fi.closeOpenUpvals(node.Block.LastLine)
 	fi.exitScope(fi.pc() + 1)
 }
 
 func (fi *funcInfo) generateBreakStat(node *BreakStat) {
-	pc := fi.emitJmp(node.Line, 0, 0)
+	if fi.exits != nil && !fi.inLoop() {
+		fi.generateExit(exitBreak, node.Line)
+		return
+	}
+	pc := fi.emitJmp(node.Line, fi.getLoopJmpArgA(), 0)
 	fi.addBreakJmp(pc)
 }
 
 func (fi *funcInfo) generateContinueStat(node *ContinueStat) {
-	pc := fi.emitJmp(node.Line, 0, 0)
+	if fi.exits != nil && !fi.inLoop() {
+		fi.generateExit(exitContinue, node.Line)
+		return
+	}
+	pc := fi.emitJmp(node.Line, fi.getLoopJmpArgA(), 0)
 	fi.addContinueJmp(pc)
 }
 
@@ -53,6 +64,15 @@ while exp { block } <-'
            jmp
 */
 func (fi *funcInfo) generateLoopStat(node *LoopStat) {
+	if !fi.lua54 && declaresCloseVar(node.InitList) { // { init; while exp { block } }
+		fi.generateBlockStat(&BlockStat{Block: &Block{
+			LastLine: node.Block.LastLine,
+			Statements: append(node.InitList[:len(node.InitList):len(node.InitList)],
+				&LoopStat{Exp: node.Exp, StepStat: node.StepStat, Block: node.Block}),
+		}})
+		return
+	}
+
 	fi.enterScope(true)
 
 	for _, stat := range node.InitList {
@@ -81,6 +101,82 @@ func (fi *funcInfo) generateLoopStat(node *LoopStat) {
 	fi.fixSbx(pcJmpToEnd, fi.pc()-pcJmpToEnd)
 }
 
+/*
+        ____________________________________
+       /  forprep                           V
+for i := a; i < n; i++ { block }         forloop
+                         ^                  /
+                         |_________________/
+                          i <= n-1? jmp
+*/
+func (fi *funcInfo) generateForNumStat(node *ForNumStat) {
+	if !fi.isLoopInvariant(node.LimitExp) {
+		fi.generateLoopStat(node.LoopStat)
+		return
+	}
+
+	pcJmpToEnd := -1
+	if node.Guard != nil { // a < n? or else jmp past the loop
+		oldRegs := fi.usedRegs
+		a, _ := fi.expToOpArg(node.Guard, ARG_REG)
+		fi.usedRegs = oldRegs
+
+		line := lastLineOf(node.Guard)
+		fi.emitTest(line, a, 0)
+		pcJmpToEnd = fi.emitJmp(line, 0, 0)
+	}
+
+	forIndexVar := "(for index)"
+	forLimitVar := "(for limit)"
+	forStepVar := "(for step)"
+
+	fi.enterScope(true)
+
+	fi.generateLocVarDeclStat(&LocVarDeclStat{
+		//LastLine: 0,
+		NameList: []string{forIndexVar, forLimitVar, forStepVar},
+		ExpList:  []Expression{node.InitExp, node.LimitExp, node.StepExp},
+	})
+	fi.addLocVar(node.VarName, fi.pc()+2)
+
+	a := fi.usedRegs - 4
+	pcForPrep := fi.emitForPrep(node.LineOfDo, a, 0)
+	fi.generateBlock(node.Block)
+	fi.setContinueJmp()
+	fi.closeOpenUpvals(node.Block.LastLine)
+	pcForLoop := fi.emitForLoop(node.LineOfFor, a, 0)
+
+	fi.fixSbx(pcForPrep, pcForLoop-pcForPrep-1)
+	fi.fixSbx(pcForLoop, pcForPrep-pcForLoop)
+
+	fi.exitScope(fi.pc())
+	fi.fixEndPC(forIndexVar, 1)
+	fi.fixEndPC(forLimitVar, 1)
+	fi.fixEndPC(forStepVar, 1)
+	if pcJmpToEnd >= 0 {
+		fi.fixSbx(pcJmpToEnd, fi.pc()-pcJmpToEnd)
+	}
+}
+
+// the limit of a numeric for is evaluated once, so it may only
+// read locals that no closure can change behind the loop's back
+func (fi *funcInfo) isLoopInvariant(exp Expression) bool {
+	switch x := exp.(type) {
+	case *IntegerExp, *FloatExp:
+		return true
+	case *NameExp:
+		locVar, ok := fi.locNames[x.Name]
+		return ok && !locVar.captured
+	case *ParensExp:
+		return fi.isLoopInvariant(x.Exp)
+	case *UnopExp:
+		return fi.isLoopInvariant(x.Exp)
+	case *BinopExp:
+		return fi.isLoopInvariant(x.Exp1) && fi.isLoopInvariant(x.Exp2)
+	}
+	return false
+}
+
 /*
          _________________       _________________       _____________
         / false? jmp      |     / false? jmp      |     / false? jmp  |
@@ -91,6 +187,15 @@ if exp1 then block1 elseif exp2 then block2 elseif true then block3 end <-.
                     jmp                     jmp                     jmp
 */
 func (fi *funcInfo) generateIfStat(node *IfStat) {
+	if !fi.lua54 {
+		for i, sub := range node.SubList {
+			if declaresCloseVar(sub.InitList) {
+				fi.generateCloseInitIfStat(node, i)
+				return
+			}
+		}
+	}
+
 	pcJmpToEnds := make([]int, len(node.SubList))
 	pcJmpToNextExp := -1
 
@@ -129,6 +234,10 @@ func (fi *funcInfo) generateIfStat(node *IfStat) {
 	}
 }
 
+// the closing value of a generic for, a fourth hidden variable that
+// only Lua 5.4 has
+const forClosingVar = "(for closing)"
+
 func (fi *funcInfo) generateForInStat(node *ForInStat) {
 	forGeneratorVar := "(for generator)"
 	forStateVar := "(for state)"
@@ -136,9 +245,13 @@ func (fi *funcInfo) generateForInStat(node *ForInStat) {
 
 	fi.enterScope(true)
 
+	nameList := []string{forGeneratorVar, forStateVar, forControlVar}
+	if fi.lua54 {
+		nameList = append(nameList, forClosingVar)
+	}
 	fi.generateLocVarDeclStat(&LocVarDeclStat{
 		//LastLine: 0,
-		NameList: []string{forGeneratorVar, forStateVar, forControlVar},
+		NameList: nameList,
 		ExpList:  node.ExpList,
 	})
 	for _, name := range node.NameList {
@@ -160,6 +273,10 @@ func (fi *funcInfo) generateForInStat(node *ForInStat) {
 	fi.fixEndPC(forGeneratorVar, 2)
 	fi.fixEndPC(forStateVar, 2)
 	fi.fixEndPC(forControlVar, 2)
+	if fi.lua54 { // close the closing value, breaks jump here too
+		fi.fixEndPC(forClosingVar, 2)
+		fi.emitJmp(line, rGenerator+4, 0)
+	}
 }
 
 func (fi *funcInfo) generateFuncCallStat(node *FuncCallStat) {
@@ -214,8 +331,11 @@ func (fi *funcInfo) generateLocVarDeclStat(node *LocVarDeclStat) {
 
 	fi.usedRegs = oldRegs
 	startPC := fi.pc() + 1
-	for _, name := range node.NameList {
+	for i, name := range node.NameList {
 		fi.addLocVar(name, startPC)
+		if i < len(node.AttribList) && node.AttribList[i] == "close" {
+			fi.setCloseVar(name)
+		}
 	}
 }
 
@@ -0,0 +1,555 @@
+package generator
+
+import (
+	. "lxa/binchunk"
+	. "lxa/vm"
+)
+
+/*
+** Lua 5.4 code is made by rewriting the 5.3 code of each function,
+** as their instructions mostly map one to one: 5.4 splits the RK
+** operands into register, constant and immediate forms, follows each
+** arithmetic instruction with a MMBIN for its metamethod, closes
+** upvalues with CLOSE instead of JMP and marks to-be-closed variables
+** with TBC. An operand 5.4 wants in a register is loaded into one of
+** two scratch registers above the function's own, and the jumps are
+** fixed once every instruction has its new position.
+**
+** The generator itself only differs for the generic for, which has a
+** fourth hidden variable in 5.4 (see generateForInStat).
+ */
+
+type arithOp54 struct {
+	op  int // register form
+	opK int // constant form, -1 if none
+	tm  int // metamethod event
+}
+
+var arithOps54 = map[int]arithOp54{
+	OP_ADD:  {OP54_ADD, OP54_ADDK, TM54_ADD},
+	OP_SUB:  {OP54_SUB, OP54_SUBK, TM54_SUB},
+	OP_MUL:  {OP54_MUL, OP54_MULK, TM54_MUL},
+	OP_MOD:  {OP54_MOD, OP54_MODK, TM54_MOD},
+	OP_POW:  {OP54_POW, OP54_POWK, TM54_POW},
+	OP_DIV:  {OP54_DIV, OP54_DIVK, TM54_DIV},
+	OP_IDIV: {OP54_IDIV, OP54_IDIVK, TM54_IDIV},
+	OP_BAND: {OP54_BAND, OP54_BANDK, TM54_BAND},
+	OP_BOR:  {OP54_BOR, OP54_BORK, TM54_BOR},
+	OP_BXOR: {OP54_BXOR, OP54_BXORK, TM54_BXOR},
+	OP_SHL:  {OP54_SHL, -1, TM54_SHL},
+	OP_SHR:  {OP54_SHR, -1, TM54_SHR},
+}
+
+type lowering54 struct {
+	proto     *Prototype
+	code      []uint32
+	lineNums  []uint32
+	entries   []int         // 5.3 pc -> 5.4 pc, before the TBCs placed there
+	pcs       []int         // 5.3 pc -> 5.4 pc of its first instruction
+	jumps     []jump54      // to be fixed
+	tbcs      map[int][]int // 5.3 pc -> to-be-closed variables starting there
+	tforPreps map[int]bool  // JMPs that start a generic for
+	needClose bool          // returns must close upvalues
+	maxRegs   int
+	pc        int // 5.3 instruction being lowered
+	line      uint32
+}
+
+type jump54 struct {
+	pc     int // of the 5.4 instruction
+	from   int // 5.3 pc of the jump
+	target int // 5.3 pc
+}
+
+func (fi *funcInfo) toProto54() *Prototype {
+	var protos []*Prototype
+	for _, fi := range fi.subFuncs {
+		protos = append(protos, fi.toProto54())
+	}
+
+	proto := fi.newProto(protos)
+	l := &lowering54{
+		proto:     proto,
+		entries:   make([]int, len(proto.Code)+1),
+		pcs:       make([]int, len(proto.Code)+1),
+		tbcs:      map[int][]int{},
+		tforPreps: map[int]bool{},
+		maxRegs:   int(proto.MaxStackSize),
+	}
+	l.lower()
+	return proto
+}
+
+func (l *lowering54) lower() {
+	proto := l.proto
+	l.scan()
+
+	if proto.IsVararg != 0 {
+		if len(proto.LineInfo) > 0 {
+			l.line = proto.LineInfo[0]
+		}
+		l.emitABCk(OP54_VARARGPREP, int(proto.NumParams), 0, 0, 0)
+	}
+	for l.pc = 0; l.pc < len(proto.Code); l.pc++ {
+		l.entries[l.pc] = len(l.code)
+		for _, a := range l.tbcs[l.pc] {
+			l.emitABCk(OP54_TBC, a, 0, 0, 0)
+		}
+		l.pcs[l.pc] = len(l.code)
+		l.line = proto.LineInfo[l.pc]
+		l.lowerInst(Instruction(proto.Code[l.pc]))
+	}
+	l.entries[l.pc] = len(l.code)
+	l.pcs[l.pc] = len(l.code)
+
+	for _, j := range l.jumps {
+		l.fixJump(j)
+	}
+
+	locVars := make([]LocVar, 0, len(proto.LocVars))
+	for _, locVar := range proto.LocVars {
+		if locVar.VarName != "(close)" { // marks are for the 5.3 vm
+			locVar.StartPC = uint32(l.entries[locVar.StartPC])
+			locVar.EndPC = uint32(l.entries[locVar.EndPC])
+			locVars = append(locVars, locVar)
+		}
+	}
+
+	if l.maxRegs > REG_SIZE {
+		panic("function or expression needs too many registers")
+	}
+	proto.Code = l.code
+	proto.LineInfo = l.lineNums
+	proto.LocVars = locVars
+	proto.MaxStackSize = byte(l.maxRegs)
+}
+
+// finds the to-be-closed variables, the generic fors and whether the
+// function has anything to close when it returns
+func (l *lowering54) scan() {
+	proto := l.proto
+	for i, locVar := range proto.LocVars {
+		if locVar.VarName == "(close)" && i+1 < len(proto.LocVars) {
+			/* its register is the number of variables active before it */
+			startPC := proto.LocVars[i+1].StartPC
+			a := 0
+			for _, v := range proto.LocVars[:i] {
+				if v.StartPC <= startPC && startPC < v.EndPC {
+					a++
+				}
+			}
+			l.tbcs[int(startPC)] = append(l.tbcs[int(startPC)], a)
+			l.needClose = true
+		}
+	}
+	for pc, code := range proto.Code {
+		i := Instruction(code)
+		if i.Opcode() == OP_TFORLOOP {
+			_, sBx := i.AsBx()
+			l.tforPreps[pc+sBx] = true // the JMP before the loop body
+			l.needClose = true         // the closing value
+		}
+	}
+	for _, p := range proto.Protos {
+		for _, upval := range p.Upvalues {
+			if upval.Instack == 1 {
+				l.needClose = true
+			}
+		}
+	}
+}
+
+func (l *lowering54) lowerInst(i Instruction) {
+	proto := l.proto
+	nParams1 := 0 /* number of parameters plus one, if vararg */
+	if proto.IsVararg != 0 {
+		nParams1 = int(proto.NumParams) + 1
+	}
+
+	switch op := i.Opcode(); op {
+	case OP_MOVE:
+		a, b, _ := i.ABC()
+		l.emitABCk(OP54_MOVE, a, b, 0, 0)
+	case OP_LOADK:
+		a, bx := i.ABx()
+		l.emitLoadK(a, bx)
+	case OP_LOADKX:
+		a, _ := i.ABx()
+		l.emitLoadK(a, l.extraArg())
+	case OP_LOADBOOL:
+		a, b, c := i.ABC()
+		if c == 0 && b != 0 {
+			l.emitABCk(OP54_LOADTRUE, a, 0, 0, 0)
+		} else if c == 0 {
+			l.emitABCk(OP54_LOADFALSE, a, 0, 0, 0)
+		} else if b == 0 && l.nextIsLoadBool() {
+			l.emitABCk(OP54_LFALSESKIP, a, 0, 0, 0)
+		} else {
+			if b != 0 {
+				l.emitABCk(OP54_LOADTRUE, a, 0, 0, 0)
+			} else {
+				l.emitABCk(OP54_LOADFALSE, a, 0, 0, 0)
+			}
+			l.emitJump(OP54_JMP, 0, l.pc+2)
+		}
+	case OP_LOADNIL:
+		a, b, _ := i.ABC()
+		l.emitABCk(OP54_LOADNIL, a, b, 0, 0)
+	case OP_GETUPVAL:
+		a, b, _ := i.ABC()
+		l.emitABCk(OP54_GETUPVAL, a, b, 0, 0)
+	case OP_SETUPVAL:
+		a, b, _ := i.ABC()
+		l.emitABCk(OP54_SETUPVAL, a, b, 0, 0)
+	case OP_GETTABUP:
+		a, b, c := i.ABC()
+		if l.isShortStr(c) {
+			l.emitABCk(OP54_GETTABUP, a, b, c&0xFF, 0)
+		} else {
+			t := l.scratch(0)
+			l.emitABCk(OP54_GETUPVAL, t, b, 0, 0)
+			l.emitGetTable(a, t, c)
+		}
+	case OP_GETTABLE:
+		a, b, c := i.ABC()
+		l.emitGetTable(a, b, c)
+	case OP_SETTABUP:
+		a, b, c := i.ABC()
+		if l.isShortStr(b) {
+			c, k := rk54(c)
+			l.emitABCk(OP54_SETTABUP, a, b&0xFF, c, k)
+		} else {
+			t := l.scratch(0)
+			l.emitABCk(OP54_GETUPVAL, t, a, 0, 0)
+			l.emitSetTable(t, b, c)
+		}
+	case OP_SETTABLE:
+		a, b, c := i.ABC()
+		l.emitSetTable(a, b, c)
+	case OP_NEWTABLE:
+		a, b, c := i.ABC()
+		nArr, nRec := Fb2int(b), Fb2int(c)
+		if nRec > 0 {
+			nRec = ceilLog2(nRec) + 1
+		}
+		extra := nArr >> 8
+		l.emitABCk(OP54_NEWTABLE, a, nRec, nArr&0xFF, b2i(extra > 0))
+		l.emitAx(OP54_EXTRAARG, extra)
+	case OP_SELF:
+		a, b, c := i.ABC()
+		c, k := rk54(c)
+		l.emitABCk(OP54_SELF, a, b, c, k)
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		a, b, c := i.ABC()
+		l.lowerArith(op, a, b, c)
+	case OP_UNM, OP_BNOT, OP_NOT, OP_LEN:
+		a, b, _ := i.ABC()
+		l.emitABCk(op-OP_UNM+OP54_UNM, a, b, 0, 0)
+	case OP_CONCAT:
+		a, b, c := i.ABC()
+		l.emitABCk(OP54_CONCAT, b, c-b+1, 0, 0)
+		if a != b {
+			l.emitABCk(OP54_MOVE, a, b, 0, 0)
+		}
+	case OP_JMP:
+		a, sBx := i.AsBx()
+		if l.tforPreps[l.pc] {
+			base, _, _ := Instruction(proto.Code[l.pc+1+sBx]).ABC()
+			l.emitJump(OP54_TFORPREP, base, l.pc+1+sBx)
+			break
+		}
+		if a > 0 {
+			l.emitABCk(OP54_CLOSE, a-1, 0, 0, 0)
+		}
+		if a == 0 || sBx != 0 {
+			l.emitJump(OP54_JMP, 0, l.pc+1+sBx)
+		}
+	case OP_EQ, OP_LT, OP_LE:
+		a, b, c := i.ABC()
+		l.lowerCompare(op, a, b, c)
+	case OP_TEST:
+		a, _, c := i.ABC()
+		l.checkCondJump()
+		l.emitABCk(OP54_TEST, a, 0, 0, c)
+	case OP_TESTSET:
+		a, b, c := i.ABC()
+		l.checkCondJump()
+		l.emitABCk(OP54_TESTSET, a, b, 0, c)
+	case OP_CALL:
+		a, b, c := i.ABC()
+		l.emitABCk(OP54_CALL, a, b, c, 0)
+	case OP_TAILCALL:
+		a, b, _ := i.ABC()
+		l.emitABCk(OP54_TAILCALL, a, b, nParams1, b2i(l.needClose))
+	case OP_RETURN:
+		a, b, _ := i.ABC()
+		if nParams1 == 0 && !l.needClose && b == 1 {
+			l.emitABCk(OP54_RETURN0, a, 0, 0, 0)
+		} else if nParams1 == 0 && !l.needClose && b == 2 {
+			l.emitABCk(OP54_RETURN1, a, 0, 0, 0)
+		} else {
+			l.emitABCk(OP54_RETURN, a, b, nParams1, b2i(l.needClose))
+		}
+	case OP_FORLOOP:
+		a, sBx := i.AsBx()
+		l.emitJump(OP54_FORLOOP, a, l.pc+1+sBx)
+	case OP_FORPREP:
+		a, sBx := i.AsBx()
+		l.emitJump(OP54_FORPREP, a, l.pc+1+sBx)
+	case OP_TFORCALL:
+		a, _, c := i.ABC()
+		l.emitABCk(OP54_TFORCALL, a, 0, c, 0)
+		if a+7 > l.maxRegs { /* room to call the generator */
+			l.maxRegs = a + 7
+		}
+	case OP_TFORLOOP:
+		a, sBx := i.AsBx()
+		l.emitJump(OP54_TFORLOOP, a-2, l.pc+1+sBx)
+	case OP_SETLIST:
+		a, b, c := i.ABC()
+		if c == 0 {
+			c = l.extraArg()
+		}
+		last := (c - 1) * LFIELDS_PER_FLUSH /* number of items already stored */
+		extra := last >> 8
+		l.emitABCk(OP54_SETLIST, a, b, last&0xFF, b2i(extra > 0))
+		if extra > 0 {
+			l.emitAx(OP54_EXTRAARG, extra)
+		}
+	case OP_CLOSURE:
+		a, bx := i.ABx()
+		l.emitABx(OP54_CLOSURE, a, bx)
+	case OP_VARARG:
+		a, b, _ := i.ABC()
+		l.emitABCk(OP54_VARARG, a, 0, b, 0)
+	case OP_EXTRAARG:
+		// lowered with the instruction before it
+	default:
+		panic("unreachable!")
+	}
+}
+
+// R(A) := RK(B) op RK(C), and the metamethod fallback
+func (l *lowering54) lowerArith(op, a, b, c int) {
+	arith := arithOps54[op]
+	flip := 0
+	if isK(b) && !isK(c) && l.fitsArithK(op, b) &&
+		(op == OP_ADD || op == OP_MUL || op == OP_BAND || op == OP_BOR || op == OP_BXOR) {
+		b, c, flip = c, b, 1 /* commutative: the constant goes right */
+	}
+	b = l.toReg(b, 0)
+	if isK(c) {
+		if v, ok := l.proto.Constants[c&0xFF].(int64); ok && op == OP_ADD && fitsC(v) {
+			l.emitABCk(OP54_ADDI, a, b, int(v)+OFFSET_sC54, 0)
+			l.emitABCk(OP54_MMBINI, b, int(v)+OFFSET_sC54, arith.tm, flip)
+			return
+		}
+		if l.fitsArithK(op, c) {
+			l.emitABCk(arith.opK, a, b, c&0xFF, 0)
+			l.emitABCk(OP54_MMBINK, b, c&0xFF, arith.tm, flip)
+			return
+		}
+		c = l.toReg(c, 1)
+	}
+	l.emitABCk(arith.op, a, b, c, 0)
+	l.emitABCk(OP54_MMBIN, b, c, arith.tm, 0)
+}
+
+// if ((RK(B) op RK(C)) ~= A) then pc++
+func (l *lowering54) lowerCompare(op, k, b, c int) {
+	l.checkCondJump()
+	if isK(b) && !isK(c) {
+		if op == OP_EQ {
+			b, c = c, b
+		} else if v, ok := l.proto.Constants[b&0xFF].(int64); ok && fitsC(v) {
+			/* k < x is x > k, k <= x is x >= k */
+			l.emitABCk(OP54_GTI+op-OP_LT, c, int(v)+OFFSET_sC54, 0, k)
+			return
+		}
+	}
+	b = l.toReg(b, 0)
+	if isK(c) {
+		v, isInt := l.proto.Constants[c&0xFF].(int64)
+		if op == OP_EQ {
+			l.emitABCk(OP54_EQK, b, c&0xFF, 0, k)
+			return
+		} else if isInt && fitsC(v) {
+			l.emitABCk(OP54_LTI+op-OP_LT, b, int(v)+OFFSET_sC54, 0, k)
+			return
+		}
+		c = l.toReg(c, 1)
+	}
+	l.emitABCk(OP54_EQ+op-OP_EQ, b, c, 0, k)
+}
+
+// the instruction after a test is a JMP, which 5.4 executes right
+// away, so it must still be a single instruction
+func (l *lowering54) checkCondJump() {
+	next := Instruction(l.proto.Code[l.pc+1])
+	if a, _ := next.AsBx(); next.Opcode() != OP_JMP || a != 0 {
+		panic("unreachable!")
+	}
+}
+
+func (l *lowering54) nextIsLoadBool() bool {
+	next := Instruction(l.proto.Code[l.pc+1])
+	_, _, c := next.ABC()
+	return next.Opcode() == OP_LOADBOOL && c == 0
+}
+
+func (l *lowering54) extraArg() int {
+	return Instruction(l.proto.Code[l.pc+1]).Ax()
+}
+
+// R(A) := R(B)[RK(C)]
+func (l *lowering54) emitGetTable(a, b, c int) {
+	if !isK(c) {
+		l.emitABCk(OP54_GETTABLE, a, b, c, 0)
+	} else if l.isShortStr(c) {
+		l.emitABCk(OP54_GETFIELD, a, b, c&0xFF, 0)
+	} else if v, ok := l.proto.Constants[c&0xFF].(int64); ok && v >= 0 && v <= 0xFF {
+		l.emitABCk(OP54_GETI, a, b, int(v), 0)
+	} else {
+		l.emitABCk(OP54_GETTABLE, a, b, l.toReg(c, 1), 0)
+	}
+}
+
+// R(A)[RK(B)] := RK(C)
+func (l *lowering54) emitSetTable(a, b, c int) {
+	c, k := rk54(c)
+	if !isK(b) {
+		l.emitABCk(OP54_SETTABLE, a, b, c, k)
+	} else if l.isShortStr(b) {
+		l.emitABCk(OP54_SETFIELD, a, b&0xFF, c, k)
+	} else if v, ok := l.proto.Constants[b&0xFF].(int64); ok && v >= 0 && v <= 0xFF {
+		l.emitABCk(OP54_SETI, a, int(v), c, k)
+	} else {
+		l.emitABCk(OP54_SETTABLE, a, l.toReg(b, 1), c, k)
+	}
+}
+
+func (l *lowering54) emitLoadK(a, idx int) {
+	if idx <= MAXARG_Bx54 {
+		l.emitABx(OP54_LOADK, a, idx)
+	} else {
+		l.emitABx(OP54_LOADKX, a, 0)
+		l.emitAx(OP54_EXTRAARG, idx)
+	}
+}
+
+// returns the register of an RK operand, loading a constant into
+// the n-th scratch register
+func (l *lowering54) toReg(rk, n int) int {
+	if !isK(rk) {
+		return rk
+	}
+	r := l.scratch(n)
+	l.emitABx(OP54_LOADK, r, rk&0xFF)
+	return r
+}
+
+func (l *lowering54) scratch(n int) int {
+	r := int(l.proto.MaxStackSize) + n
+	if r+1 > l.maxRegs {
+		l.maxRegs = r + 1
+	}
+	return r
+}
+
+func (l *lowering54) isShortStr(rk int) bool {
+	if !isK(rk) {
+		return false
+	}
+	s, ok := l.proto.Constants[rk&0xFF].(string)
+	return ok && len(s) <= LUAI_MAXSHORTLEN_54
+}
+
+func (l *lowering54) fitsArithK(op, rk int) bool {
+	if arithOps54[op].opK < 0 {
+		return false
+	}
+	switch l.proto.Constants[rk&0xFF].(type) {
+	case int64:
+		return true
+	case float64:
+		return op != OP_BAND && op != OP_BOR && op != OP_BXOR
+	}
+	return false
+}
+
+// code
+
+func (l *lowering54) emit(i int) {
+	l.code = append(l.code, uint32(i))
+	l.lineNums = append(l.lineNums, l.line)
+}
+
+func (l *lowering54) emitABCk(opcode, a, b, c, k int) {
+	l.emit(c<<24 | b<<16 | k<<15 | a<<7 | opcode)
+}
+
+func (l *lowering54) emitABx(opcode, a, bx int) {
+	l.emit(bx<<15 | a<<7 | opcode)
+}
+
+func (l *lowering54) emitAx(opcode, ax int) {
+	l.emit(ax<<7 | opcode)
+}
+
+// emits a jump to the 5.3 pc 'target', whose offset is fixed later
+func (l *lowering54) emitJump(opcode, a, target int) {
+	l.jumps = append(l.jumps, jump54{len(l.code), l.pc, target})
+	l.emitABx(opcode, a, 0)
+}
+
+func (l *lowering54) fixJump(j jump54) {
+	/* a jump back stays in the scope of the variables marked there */
+	target := l.entries[j.target]
+	if j.target <= j.from {
+		target = l.pcs[j.target]
+	}
+
+	i := l.code[j.pc]
+	switch opcode := int(i & 0x7F); opcode {
+	case OP54_JMP:
+		l.code[j.pc] = uint32((target-j.pc-1+OFFSET_sJ54)<<7 | opcode)
+	case OP54_FORPREP, OP54_TFORPREP:
+		l.code[j.pc] = i | uint32(target-j.pc-1)<<15
+	case OP54_FORLOOP, OP54_TFORLOOP:
+		l.code[j.pc] = i | uint32(j.pc+1-target)<<15
+	}
+}
+
+func isK(rk int) bool {
+	return rk > 0xFF
+}
+
+// splits an RK operand into C and the k flag
+func rk54(rk int) (int, int) {
+	if isK(rk) {
+		return rk & 0xFF, 1
+	}
+	return rk, 0
+}
+
+// whether an integer fits the signed sB and sC arguments
+func fitsC(v int64) bool {
+	return v >= -OFFSET_sC54 && v <= 0xFF-OFFSET_sC54
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ceil(log2(x))
+func ceilLog2(x int) int {
+	l := 0
+	for x--; x > 0; x >>= 1 {
+		l++
+	}
+	return l
+}
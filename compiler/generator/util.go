@@ -53,6 +53,10 @@ func lineOf(exp Expression) int {
 		return lineOf(x.Exp1)
 	case *LogicalExp:
 		return lineOf(x.ExpList[0])
+	case *ConcatExp:
+		return lineOf(x.ExpList[0])
+	case *ParensExp:
+		return lineOf(x.Exp)
 	default:
 		panic("unreachable!")
 	}
@@ -90,6 +94,10 @@ func lastLineOf(exp Expression) int {
 		return lastLineOf(x.Exp)
 	case *LogicalExp:
 		return lastLineOf(x.ExpList[len(x.ExpList)-1])
+	case *ConcatExp:
+		return lastLineOf(x.ExpList[len(x.ExpList)-1])
+	case *ParensExp:
+		return lastLineOf(x.Exp)
 	default:
 		panic("unreachable!")
 	}
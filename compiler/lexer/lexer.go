@@ -3,7 +3,6 @@ package lexer
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -70,7 +69,7 @@ func (l *Lexer) NextIdentifier() *Token {
 func (l *Lexer) NextTokenOfType(tokenType ...TokenType) *Token {
 	token := l.NextToken()
 	if !token.Is(tokenType...) {
-		l.Error("unexpected symbol near '%s', expect '%s', but got '%s'",
+		l.error(token.Is(TOKEN_EOF), "unexpected symbol near '%s', expect '%s', but got '%s'",
 			token.Literal, tokenTypeString(tokenType), token.Literal)
 	}
 	return token
@@ -90,7 +89,7 @@ func (l *Lexer) PeekTokenOfType(tokenType ...TokenType) []*Token {
 		token = l.PeekTokenN(i)
 	}
 	if token.Is(TOKEN_EOF) && !token.Is(tokenType...) {
-		l.Error("unexpected symbol near '%s', expect '%s', but got '%s'",
+		l.eofError("unexpected symbol near '%s', expect '%s', but got '%s'",
 			token.Literal, tokenTypeString(tokenType), token.Literal)
 	}
 	return l.tokenCache[0:i]
@@ -340,7 +339,7 @@ func (l *Lexer) nextToken(useCache bool) *Token {
 			return &Token{l.line, TOKEN_OP_GT, ">"}
 		}
 	case '.':
-		if l.peekChar() == '.' {
+		if next := l.peekChar(); next == '.' {
 			if l.peekChar() == '.' { // peek: ...
 				l.read(3)
 				return &Token{l.line, TOKEN_VARARG, "..."}
@@ -348,7 +347,7 @@ func (l *Lexer) nextToken(useCache bool) *Token {
 				l.read(2)
 				return &Token{l.line, TOKEN_OP_CONCAT, ".."}
 			}
-		} else if len(l.chunk) == 1 || !unicode.IsDigit(l.peekChar()) { // peek: .
+		} else if !unicode.IsDigit(next) { // peek: .
 			l.read(1)
 			return &Token{l.line, TOKEN_SEP_DOT, "."}
 		}
@@ -430,19 +429,20 @@ func (l *Lexer) skipLine() {
 func (l *Lexer) skipLongComment() {
 	closingIdx := strings.Index(l.chunk, "*/")
 	if closingIdx < 0 {
-		l.Error("unfinished comment")
+		l.eofError("unfinished comment")
 	}
 	s := l.chunk[0:closingIdx]
 	l.readRaw(closingIdx + 2)
 	l.line += strings.Count(s, "\n")
 }
 
+// the next char not peeked yet, 0 past the end of the chunk
 func (l *Lexer) peekChar() rune {
 	c, n := utf8.DecodeRuneInString(l.chunk[l.peekPos:])
 	if n == 0 {
-		l.Error("invalid character!")
+		return 0
 	}
-	l.peekPos++
+	l.peekPos += n
 	return c
 }
 
@@ -464,7 +464,7 @@ func (l *Lexer) readRaw(n int) {
 func (l *Lexer) readChar() rune {
 	c, n := utf8.DecodeRuneInString(l.chunk)
 	if n == 0 {
-		l.Error("invalid character!")
+		l.eofError("invalid character!")
 	}
 	l.readRaw(n)
 	return c
@@ -474,7 +474,7 @@ func (l *Lexer) readLongString() string {
 	l.readRaw(1)
 	closingIdx := strings.Index(l.chunk, "`")
 	if closingIdx < 0 {
-		l.Error("unfinished long string")
+		l.eofError("unfinished long string")
 	}
 	s := l.chunk[0:closingIdx]
 	l.readRaw(closingIdx + 1)
@@ -609,11 +609,38 @@ func isWhiteSpace(c byte) bool {
 	return false
 }
 
+// SyntaxError is what the lexer and the parser panic with
+type SyntaxError struct {
+	ChunkName string
+	Line      int
+	Msg       string
+	AtEOF     bool // the chunk ended too early, more input may complete it
+}
+
+func (e *SyntaxError) Error() string {
+	chunkName := e.ChunkName
+	if chunkName != "" && (chunkName[0] == '@' || chunkName[0] == '=') {
+		chunkName = chunkName[1:]
+	}
+	return fmt.Sprintf("%s:%d: %s", chunkName, e.Line, e.Msg)
+}
+
 func (l *Lexer) Error(f string, a ...interface{}) {
-	err := fmt.Sprintf(f, a...)
-	fmt.Fprintln(os.Stderr, "Syntax Error Occurred:")
-	fmt.Fprintln(os.Stderr, fmt.Sprintf("Error @ %s:%d: %s", l.ChunkName(), l.Line(), err))
-	os.Exit(0)
+	l.error(false, f, a...)
+}
+
+// an error found at the end of the chunk
+func (l *Lexer) eofError(f string, a ...interface{}) {
+	l.error(true, f, a...)
+}
+
+func (l *Lexer) error(atEOF bool, f string, a ...interface{}) {
+	panic(&SyntaxError{
+		ChunkName: l.ChunkName(),
+		Line:      l.Line(),
+		Msg:       fmt.Sprintf(f, a...),
+		AtEOF:     atEOF,
+	})
 }
 
 func tokenTypeString(tokenType []TokenType) string {
@@ -282,3 +282,280 @@ func isVarargOrFuncCall(exp Expression) bool {
 		return false
 	}
 }
+
+/*
+** 'for i := a; i < n; i++ { block }' becomes a numeric for if
+** 'a' is an integer, 'i' is compared with a limit made of numbers,
+** names and arithmetic, the step is a constant going towards the
+** limit, and neither 'i' nor the names of the limit are assigned
+** in the block. Whether those names are locals is only known by
+** the generator, which falls back to the LoopStat otherwise.
+ */
+func OptimizeForNum(loop *LoopStat, lineOfFor, lineOfDo int) Statement {
+	decl, ok := loop.InitList[0].(*LocVarDeclStat)
+	if !ok || len(decl.NameList) != 1 || len(decl.ExpList) != 1 || decl.AttribList != nil {
+		return loop
+	}
+	name := decl.NameList[0]
+	initExp, ok := decl.ExpList[0].(*IntegerExp)
+	if !ok {
+		return loop
+	}
+	step, ok := forNumStep(loop.StepStat, name)
+	if !ok {
+		return loop
+	}
+	cond, ok := loop.Exp.(*BinopExp)
+	if !ok {
+		return loop
+	}
+	op, limitExp := cond.Op, cond.Exp2
+	if !isName(cond.Exp1, name) {
+		if !isName(cond.Exp2, name) {
+			return loop
+		}
+		op, limitExp = swapComparison(cond.Op), cond.Exp1 // n > i => i < n
+	}
+	names, ok := limitNames(limitExp, nil)
+	if !ok || assigns(loop.Block, name) {
+		return loop
+	}
+	for _, n := range names {
+		if n == name || assigns(loop.Block, n) {
+			return loop
+		}
+	}
+
+	// i < n => i <= ceil(n) - 1 and i > n => i >= floor(n) + 1,
+	// since the counter only takes integer values. A constant limit
+	// is worked out here; any other is worked out when the loop
+	// starts, behind a guard testing the condition as written, so
+	// that n is known not to be the integer the adjustment wraps at.
+	var guard Expression
+	switch {
+	case op.Is(TOKEN_OP_LE) && step > 0, op.Is(TOKEN_OP_GE) && step < 0:
+	case op.Is(TOKEN_OP_LT) && step > 0, op.Is(TOKEN_OP_GT) && step < 0:
+		if limitExp, ok = forNumLimit(op, limitExp); !ok {
+			return loop
+		}
+		if !isNumeral(limitExp) {
+			guard = &BinopExp{Op: cond.Op, Exp1: initExp, Exp2: cond.Exp2}
+			if !isName(cond.Exp1, name) {
+				guard = &BinopExp{Op: cond.Op, Exp1: cond.Exp1, Exp2: initExp}
+			}
+		}
+	default: // not a comparison, or counting away from the limit
+		return loop
+	}
+
+	return &ForNumStat{
+		LineOfFor: lineOfFor,
+		LineOfDo:  lineOfDo,
+		VarName:   name,
+		InitExp:   initExp,
+		LimitExp:  limitExp,
+		StepExp:   &IntegerExp{Line: lineOfFor, Val: step},
+		Block:     loop.Block,
+		Guard:     guard,
+		LoopStat:  loop,
+	}
+}
+
+// the inclusive limit for i < n (ceil(n) - 1) or i > n (floor(n) + 1),
+// false if n is a constant whose limit isn't an integer
+func forNumLimit(op *Token, n Expression) (Expression, bool) {
+	line := op.Line
+	up := op.Is(TOKEN_OP_LT)
+	switch x := n.(type) {
+	case *IntegerExp:
+		if up && x.Val != math.MinInt64 {
+			return &IntegerExp{Line: x.Line, Val: x.Val - 1}, true
+		} else if !up && x.Val != math.MaxInt64 {
+			return &IntegerExp{Line: x.Line, Val: x.Val + 1}, true
+		}
+		return nil, false
+	case *FloatExp:
+		f := math.Floor(x.Val)
+		if up {
+			f = math.Ceil(x.Val)
+		}
+		if i, ok := number.FloatToInteger(f); ok {
+			return forNumLimit(op, &IntegerExp{Line: x.Line, Val: i})
+		}
+		return nil, false
+	}
+
+	one := &IntegerExp{Line: line, Val: 1}
+	if up { // -(-n ~/ 1) - 1
+		return &BinopExp{
+			Op: &Token{line, TOKEN_OP_SUB, "-"},
+			Exp1: &UnopExp{
+				Op: &Token{line, TOKEN_OP_UNM, "-"},
+				Exp: &BinopExp{
+					Op:   &Token{line, TOKEN_OP_IDIV, "~/"},
+					Exp1: &UnopExp{Op: &Token{line, TOKEN_OP_UNM, "-"}, Exp: n},
+					Exp2: one,
+				},
+			},
+			Exp2: one,
+		}, true
+	}
+	return &BinopExp{ // n ~/ 1 + 1
+		Op: &Token{line, TOKEN_OP_ADD, "+"},
+		Exp1: &BinopExp{
+			Op:   &Token{line, TOKEN_OP_IDIV, "~/"},
+			Exp1: n,
+			Exp2: one,
+		},
+		Exp2: one,
+	}, true
+}
+
+func isNumeral(exp Expression) bool {
+	switch exp.(type) {
+	case *IntegerExp, *FloatExp:
+		return true
+	}
+	return false
+}
+
+// i++, i--, i += k, i -= k => k or -k
+func forNumStep(stat Statement, name string) (int64, bool) {
+	assign, ok := stat.(*AssignmentStat)
+	if !ok || len(assign.VarList) != 1 || len(assign.ExpList) != 1 ||
+		!isName(assign.VarList[0], name) {
+		return 0, false
+	}
+	binop, ok := assign.ExpList[0].(*BinopExp)
+	if !ok || !isName(binop.Exp1, name) {
+		return 0, false
+	}
+	k, ok := binop.Exp2.(*IntegerExp)
+	if !ok || k.Val == 0 {
+		return 0, false
+	}
+	switch binop.Op.Type {
+	case TOKEN_OP_ADD:
+		return k.Val, true
+	case TOKEN_OP_SUB:
+		return -k.Val, true
+	}
+	return 0, false
+}
+
+// names read by an expression made of numbers, names and arithmetic
+func limitNames(exp Expression, names []string) ([]string, bool) {
+	switch x := exp.(type) {
+	case *IntegerExp, *FloatExp:
+		return names, true
+	case *NameExp:
+		return append(names, x.Name), true
+	case *ParensExp:
+		return limitNames(x.Exp, names)
+	case *UnopExp:
+		if x.Op.Is(TOKEN_OP_UNM) {
+			return limitNames(x.Exp, names)
+		}
+	case *BinopExp:
+		switch x.Op.Type {
+		case TOKEN_OP_ADD, TOKEN_OP_SUB, TOKEN_OP_MUL, TOKEN_OP_DIV,
+			TOKEN_OP_IDIV, TOKEN_OP_MOD, TOKEN_OP_POW:
+			if names, ok := limitNames(x.Exp1, names); ok {
+				return limitNames(x.Exp2, names)
+			}
+		}
+	}
+	return nil, false
+}
+
+func swapComparison(op *Token) *Token {
+	switch op.Type {
+	case TOKEN_OP_LT:
+		return &Token{op.Line, TOKEN_OP_GT, ">"}
+	case TOKEN_OP_LE:
+		return &Token{op.Line, TOKEN_OP_GE, ">="}
+	case TOKEN_OP_GT:
+		return &Token{op.Line, TOKEN_OP_LT, "<"}
+	case TOKEN_OP_GE:
+		return &Token{op.Line, TOKEN_OP_LE, "<="}
+	}
+	return op
+}
+
+func isName(exp Expression, name string) bool {
+	nameExp, ok := exp.(*NameExp)
+	return ok && nameExp.Name == name
+}
+
+// reports whether 'name' is the target of an assignment anywhere
+// in node, nested functions included
+func assigns(node interface{}, name string) bool {
+	switch x := node.(type) {
+	case *Block:
+		return assignsInStats(x.Statements, name) || assignsInExps(x.ReturnExps, name)
+	case *Statements:
+		return assignsInStats(x.StatList, name)
+	case *BlockStat:
+		return assigns(x.Block, name)
+	case *LoopStat:
+		return assignsInStats(x.InitList, name) || assigns(x.Exp, name) ||
+			assigns(x.StepStat, name) || assigns(x.Block, name)
+	case *ForNumStat:
+		return assigns(x.LoopStat, name)
+	case *IfStat:
+		for _, sub := range x.SubList {
+			if assignsInStats(sub.InitList, name) || assigns(sub.Exp, name) ||
+				assigns(sub.Block, name) {
+				return true
+			}
+		}
+	case *ForInStat:
+		return assignsInExps(x.ExpList, name) || assigns(x.Block, name)
+	case *AssignmentStat:
+		for _, v := range x.VarList {
+			if isName(v, name) || assigns(v, name) {
+				return true
+			}
+		}
+		return assignsInExps(x.ExpList, name)
+	case *LocVarDeclStat:
+		return assignsInExps(x.ExpList, name)
+	case *FuncCallExp:
+		return assigns(x.PrefixExp, name) || assignsInExps(x.Args, name)
+	case *FuncDefExp:
+		return assigns(x.Block, name)
+	case *UnopExp:
+		return assigns(x.Exp, name)
+	case *BinopExp:
+		return assigns(x.Exp1, name) || assigns(x.Exp2, name)
+	case *LogicalExp:
+		return assignsInExps(x.ExpList, name)
+	case *ConcatExp:
+		return assignsInExps(x.ExpList, name)
+	case *TableConstructorExp:
+		return assignsInExps(x.KeyExps, name) || assignsInExps(x.ValExps, name)
+	case *ParensExp:
+		return assigns(x.Exp, name)
+	case *TableAccessExp:
+		return assigns(x.PrefixExp, name) || assigns(x.KeyExp, name)
+	}
+	return false
+}
+
+func assignsInStats(stats []Statement, name string) bool {
+	for _, stat := range stats {
+		if assigns(stat, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func assignsInExps(exps []Expression, name string) bool {
+	for _, exp := range exps {
+		if assigns(exp, name) {
+			return true
+		}
+	}
+	return false
+}
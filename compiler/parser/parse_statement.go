@@ -172,24 +172,25 @@ func (p *Parser) parseForStat() Statement {
 
 // for for assignment ';' exp ';' assignment '{' block '}'
 // => while assignment ';' exp {' block assignment '}'
-func (p *Parser) parseForNumStat() *LoopStat {
-	p.lexer.NextTokenOfType(TOKEN_KW_FOR)                 // for
-	initStat := p.parseAssignOrLocVarDeclOrFuncCallStat() // assignment
-	p.lexer.NextTokenOfType(TOKEN_SEP_SEMI)               // ;
-	limitExp := p.parseExp()                              // exp
-	p.lexer.NextTokenOfType(TOKEN_SEP_SEMI)               // ;
-	stepStat := p.parseAssignOrLocVarDeclOrFuncCallStat() // assignment
-
-	p.lexer.NextTokenOfType(TOKEN_SEP_LCURLY) // {
-	block := p.parseBlock()                   // block
-	p.lexer.NextTokenOfType(TOKEN_SEP_RCURLY) // }
-
-	return &LoopStat{
+// or ForNumStat if it counts an integer up or down to a limit
+func (p *Parser) parseForNumStat() Statement {
+	lineOfFor := p.lexer.NextTokenOfType(TOKEN_KW_FOR).Line // for
+	initStat := p.parseAssignOrLocVarDeclOrFuncCallStat()   // assignment
+	p.lexer.NextTokenOfType(TOKEN_SEP_SEMI)                 // ;
+	limitExp := p.parseExp()                                // exp
+	p.lexer.NextTokenOfType(TOKEN_SEP_SEMI)                 // ;
+	stepStat := p.parseAssignOrLocVarDeclOrFuncCallStat()   // assignment
+
+	lineOfDo := p.lexer.NextTokenOfType(TOKEN_SEP_LCURLY).Line // {
+	block := p.parseBlock()                                    // block
+	p.lexer.NextTokenOfType(TOKEN_SEP_RCURLY)                  // }
+
+	return OptimizeForNum(&LoopStat{
 		InitList: []Statement{initStat},
 		Exp:      limitExp,
 		StepStat: stepStat,
 		Block:    block,
-	}
+	}, lineOfFor, lineOfDo)
 }
 
 // for namelist in explist '{' block '}'
@@ -355,10 +356,10 @@ func (p *Parser) parseAssignOrFuncCallStat() Statement {
 	}
 }
 
-// local namelist ['=' explist]
+// local attnamelist ['=' explist]
 func (p *Parser) parseLocVarDeclStat() *LocVarDeclStat {
 	p.lexer.NextTokenOfType(TOKEN_KW_LOCAL) // local
-	names := p.parseNameList()              // namelist
+	names, attribs := p.parseAttNameList()  // attnamelist
 	var exps []Expression
 	if p.lexer.PeekToken().Is(TOKEN_OP_ASSIGN) {
 		p.lexer.NextToken()     // =
@@ -366,10 +367,43 @@ func (p *Parser) parseLocVarDeclStat() *LocVarDeclStat {
 	}
 	lastLine := p.lexer.Line()
 	return &LocVarDeclStat{
-		LastLine: lastLine,
-		NameList: names,
-		ExpList:  exps,
+		LastLine:   lastLine,
+		NameList:   names,
+		AttribList: attribs,
+		ExpList:    exps,
+	}
+}
+
+// attnamelist ::= Name attrib {',' Name attrib}
+// attrib ::= ['<' Name '>']
+func (p *Parser) parseAttNameList() ([]string, []string) {
+	var names, attribs []string
+	nClose := 0
+	for {
+		names = append(names, p.lexer.NextIdentifier().Literal) // Name
+		attrib := ""
+		if p.lexer.PeekToken().Is(TOKEN_OP_LT) {
+			p.lexer.NextToken()                       // <
+			attrib = p.lexer.NextIdentifier().Literal // Name
+			p.lexer.NextTokenOfType(TOKEN_OP_GT)      // >
+			if attrib != "close" {
+				p.Error("unknown attribute '%s'", attrib)
+			}
+			nClose++
+		}
+		attribs = append(attribs, attrib)
+		if !p.lexer.PeekToken().Is(TOKEN_SEP_COMMA) {
+			break
+		}
+		p.lexer.NextToken() // ,
+	}
+	if nClose > 1 {
+		p.Error("multiple to-be-closed variables in local list")
+	}
+	if nClose == 0 {
+		attribs = nil
 	}
+	return names, attribs
 }
 
 // varlist ('+=' | '-=' | '*=' | '/=' | '~/=' | '%='
@@ -0,0 +1,189 @@
+package transpiler
+
+import (
+	"fmt"
+	. "lxa/compiler/ast"
+	"lxa/compiler/lexer"
+	"strconv"
+	"strings"
+)
+
+// lua versions the source can be written for
+const (
+	LUA51 = 51 // Lua 5.1 and LuaJIT: no goto, no integer division, bit library
+	LUA53 = 53
+	LUA54 = 54
+)
+
+// `x?` is false for nil, false, 0 and "", the same as the constant
+// folding in the parser
+const qstHelper = `local function __lxa_qst(v) return v ~= nil and v ~= false and v ~= 0 and v ~= "" end`
+
+type localVar struct {
+	name     string // name in the lua source
+	captured bool
+}
+
+type loopInfo struct {
+	hasContinue bool
+	hasBreak    bool
+}
+
+type funcState struct {
+	parent   *funcState
+	scopes   []map[string]*localVar
+	loops    []*loopInfo
+	isVararg bool
+}
+
+type transpiler struct {
+	chunkName string
+	version   int
+	buf       *strings.Builder
+	indent    int
+	fs        *funcState
+	useQst    bool
+	nRename   int
+}
+
+// Transpile writes the chunk as readable Lua source. Each statement
+// carries a `-- @line` marker whenever the lxa line changes, so that
+// errors raised by the Lua code can be mapped back. What can't be
+// written for the version panics with a *lexer.SyntaxError.
+func Transpile(chunk *Block, chunkName string, version int) string {
+	t := &transpiler{
+		chunkName: chunkName,
+		version:   version,
+		buf:       &strings.Builder{},
+		fs:        &funcState{isVararg: true},
+	}
+	t.enterScope()
+	t.block(chunk)
+	t.exitScope()
+	return t.output()
+}
+
+func (t *transpiler) output() string {
+	var b strings.Builder
+	if t.useQst {
+		b.WriteString(qstHelper + "\n")
+	}
+	lastLine := 0
+	for _, s := range strings.SplitAfter(t.buf.String(), "\n") {
+		if i := strings.IndexByte(s, 0); i >= 0 {
+			line, _ := strconv.Atoi(strings.TrimSuffix(s[i+1:], "\n"))
+			if line != lastLine {
+				fmt.Fprintf(&b, "%s -- @%d\n", s[:i], line)
+				lastLine = line
+			} else {
+				b.WriteString(s[:i] + "\n")
+			}
+		} else {
+			b.WriteString(s)
+		}
+	}
+	return b.String()
+}
+
+func (t *transpiler) indentation() string {
+	return strings.Repeat("  ", t.indent)
+}
+
+// writes a statement, marking its first line with the lxa line (if any)
+func (t *transpiler) stat(line int, text string) {
+	if strings.HasPrefix(text, "(") { // would continue the previous statement
+		text = "do " + text + " end"
+	}
+	if line > 0 {
+		mark := "\x00" + strconv.Itoa(line)
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			text = text[:i] + mark + text[i:]
+		} else {
+			text += mark
+		}
+	}
+	t.buf.WriteString(t.indentation() + text + "\n")
+}
+
+func (t *transpiler) enterScope() {
+	t.fs.scopes = append(t.fs.scopes, map[string]*localVar{})
+}
+
+func (t *transpiler) exitScope() {
+	t.fs.scopes = t.fs.scopes[:len(t.fs.scopes)-1]
+}
+
+// declares a local, returning its name in the lua source
+func (t *transpiler) declare(name string) string {
+	v := &localVar{name: mangle(name)}
+	t.fs.scopes[len(t.fs.scopes)-1][name] = v
+	return v.name
+}
+
+// declares a local that lua keeps visible longer than lxa does, renamed
+// if the code it stays visible to mentions the same name
+func (t *transpiler) declareHidden(name string, later []*SubIfStat) string {
+	for _, sub := range later {
+		if mentions(sub, name) {
+			t.nRename++
+			v := &localVar{name: fmt.Sprintf("%s_%d", mangle(name), t.nRename)}
+			t.fs.scopes[len(t.fs.scopes)-1][name] = v
+			return v.name
+		}
+	}
+	return t.declare(name)
+}
+
+// finds a local of this or an enclosing function, which is captured
+// if it belongs to an enclosing one
+func (t *transpiler) lookup(name string) *localVar {
+	for fs := t.fs; fs != nil; fs = fs.parent {
+		for i := len(fs.scopes) - 1; i >= 0; i-- {
+			if v, ok := fs.scopes[i][name]; ok {
+				if fs != t.fs {
+					v.captured = true
+				}
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// a local of this function only, without capturing anything
+func (t *transpiler) localOf(name string) *localVar {
+	for i := len(t.fs.scopes) - 1; i >= 0; i-- {
+		if v, ok := t.fs.scopes[i][name]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (t *transpiler) name(name string) string {
+	if v := t.lookup(name); v != nil {
+		return v.name
+	}
+	if isIdentifier(name) {
+		return name
+	}
+	if t.version == LUA51 {
+		return fmt.Sprintf("getfenv(1)[%s]", quote(name))
+	}
+	return fmt.Sprintf("_ENV[%s]", quote(name))
+}
+
+func (t *transpiler) loop(line int, what string) *loopInfo {
+	if len(t.fs.loops) == 0 {
+		t.error(line, "%s not inside a loop", what)
+	}
+	return t.fs.loops[len(t.fs.loops)-1]
+}
+
+func (t *transpiler) error(line int, f string, a ...interface{}) {
+	panic(&lexer.SyntaxError{
+		ChunkName: t.chunkName,
+		Line:      line,
+		Msg:       fmt.Sprintf(f, a...),
+	})
+}
@@ -0,0 +1,311 @@
+package transpiler
+
+import (
+	"fmt"
+	. "lxa/compiler/ast"
+	. "lxa/compiler/token"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// lua operator precedence, from lower to higher
+const (
+	precOr = iota + 1
+	precAnd
+	precCompare // < > <= >= ~= ==
+	precBor     // |
+	precBxor    // ~
+	precBand    // &
+	precShift   // << >>
+	precConcat  // .. (right associative)
+	precAdd     // + -
+	precMul     // * / // %
+	precUnary   // not # - ~
+	precPow     // ^ (right associative)
+	precPrimary
+)
+
+var binops = map[TokenType]struct {
+	op   string
+	prec int
+}{
+	TOKEN_OP_EQ:   {"==", precCompare},
+	TOKEN_OP_NE:   {"~=", precCompare},
+	TOKEN_OP_LT:   {"<", precCompare},
+	TOKEN_OP_LE:   {"<=", precCompare},
+	TOKEN_OP_GT:   {">", precCompare},
+	TOKEN_OP_GE:   {">=", precCompare},
+	TOKEN_OP_BOR:  {"|", precBor},
+	TOKEN_OP_BXOR: {"~", precBxor},
+	TOKEN_OP_BAND: {"&", precBand},
+	TOKEN_OP_SHL:  {"<<", precShift},
+	TOKEN_OP_SHR:  {">>", precShift},
+	TOKEN_OP_ADD:  {"+", precAdd},
+	TOKEN_OP_SUB:  {"-", precAdd},
+	TOKEN_OP_MUL:  {"*", precMul},
+	TOKEN_OP_DIV:  {"/", precMul},
+	TOKEN_OP_IDIV: {"//", precMul},
+	TOKEN_OP_MOD:  {"%", precMul},
+	TOKEN_OP_POW:  {"^", precPow},
+}
+
+// Lua 5.1 has no bitwise operators, LuaJIT has them in its bit library
+var bitops51 = map[TokenType]string{
+	TOKEN_OP_BOR:  "bit.bor",
+	TOKEN_OP_BXOR: "bit.bxor",
+	TOKEN_OP_BAND: "bit.band",
+	TOKEN_OP_SHL:  "bit.lshift",
+	TOKEN_OP_SHR:  "bit.rshift",
+}
+
+func paren(s string, prec, minPrec int) string {
+	if prec < minPrec {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// the source of an expression, in parentheses if it binds weaker
+// than minPrec
+func (t *transpiler) expAt(node Expression, minPrec int) string {
+	s, prec := t.exp(node)
+	return paren(s, prec, minPrec)
+}
+
+func (t *transpiler) expList(exps []Expression) string {
+	list := make([]string, len(exps))
+	for i, exp := range exps {
+		list[i] = t.expAt(exp, 0)
+	}
+	return strings.Join(list, ", ")
+}
+
+// the source of an expression and the precedence it binds with
+func (t *transpiler) exp(node Expression) (string, int) {
+	switch exp := node.(type) {
+	case *NilExp:
+		return "nil", precPrimary
+	case *FalseExp:
+		return "false", precPrimary
+	case *TrueExp:
+		return "true", precPrimary
+	case *IntegerExp:
+		return integer(exp.Val)
+	case *FloatExp:
+		return float(exp.Val)
+	case *StringExp:
+		return quote(exp.Str), precPrimary
+	case *VarargExp:
+		if !t.fs.isVararg {
+			t.error(exp.Line, "cannot use '...' outside a vararg function")
+		}
+		return "...", precPrimary
+	case *ParensExp:
+		return "(" + t.expAt(exp.Exp, 0) + ")", precPrimary
+	case *FuncDefExp:
+		return t.funcDefExp(exp, "", false), precPrimary
+	case *ConcatExp:
+		list := make([]string, len(exp.ExpList))
+		for i, e := range exp.ExpList {
+			list[i] = t.expAt(e, precConcat+1)
+		}
+		return strings.Join(list, " .. "), precConcat
+	case *TableConstructorExp:
+		return t.tableConstructorExp(exp), precPrimary
+	case *UnopExp:
+		return t.unopExp(exp)
+	case *LogicalExp:
+		return t.logicalExp(exp)
+	case *BinopExp:
+		x, xPrec := t.exp(exp.Exp1)
+		y, yPrec := t.exp(exp.Exp2)
+		return t.binopText(exp.Op.Type, x, xPrec, y, yPrec)
+	case *NameExp:
+		return t.name(exp.Name), precPrimary
+	case NameExp:
+		return t.name(exp.Name), precPrimary
+	case *TableAccessExp:
+		return t.tableAccessExp(exp), precPrimary
+	case *FuncCallExp:
+		return t.funcCallExp(exp), precPrimary
+	default:
+		panic("unreachable!")
+	}
+}
+
+func integer(i int64) (string, int) {
+	switch {
+	case i == math.MinInt64: // has no literal
+		return "(-9223372036854775807 - 1)", precPrimary
+	case i < 0:
+		return strconv.FormatInt(i, 10), precUnary
+	default:
+		return strconv.FormatInt(i, 10), precPrimary
+	}
+}
+
+func float(f float64) (string, int) {
+	switch {
+	case math.IsInf(f, 1):
+		return "1/0", precMul
+	case math.IsInf(f, -1):
+		return "-1/0", precMul
+	case math.IsNaN(f):
+		return "0/0", precMul
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") { // keep it a float
+		s += ".0"
+	}
+	if f < 0 || math.Signbit(f) {
+		return s, precUnary
+	}
+	return s, precPrimary
+}
+
+func (t *transpiler) binopText(op TokenType, x string, xPrec int, y string, yPrec int) (string, int) {
+	if t.version == LUA51 {
+		if fn, ok := bitops51[op]; ok {
+			return fmt.Sprintf("%s(%s, %s)", fn, x, y), precPrimary
+		}
+		if op == TOKEN_OP_IDIV {
+			return fmt.Sprintf("math.floor(%s / %s)", paren(x, xPrec, precMul), paren(y, yPrec, precMul+1)), precPrimary
+		}
+	}
+
+	bin := binops[op]
+	if op == TOKEN_OP_POW { // right associative, and a unary operator binds weaker on its left
+		return fmt.Sprintf("%s ^ %s", paren(x, xPrec, precPrimary), paren(y, yPrec, precUnary)), precPow
+	}
+	return fmt.Sprintf("%s %s %s", paren(x, xPrec, bin.prec), bin.op, paren(y, yPrec, bin.prec+1)), bin.prec
+}
+
+func (t *transpiler) unopExp(node *UnopExp) (string, int) {
+	x := t.expAt(node.Exp, precUnary)
+	switch node.Op.Type {
+	case TOKEN_OP_NOT:
+		return "not " + x, precUnary
+	case TOKEN_OP_LEN:
+		return "#" + x, precUnary
+	case TOKEN_OP_UNM:
+		if strings.HasPrefix(x, "-") { // not a comment
+			return "- " + x, precUnary
+		}
+		return "-" + x, precUnary
+	case TOKEN_OP_BNOT:
+		if t.version == LUA51 {
+			return fmt.Sprintf("bit.bnot(%s)", t.expAt(node.Exp, 0)), precPrimary
+		}
+		if strings.HasPrefix(x, "~") {
+			return "~ " + x, precUnary
+		}
+		return "~" + x, precUnary
+	case TOKEN_OP_QST:
+		t.useQst = true
+		return fmt.Sprintf("__lxa_qst(%s)", t.expAt(node.Exp, 0)), precPrimary
+	default:
+		panic("unreachable!")
+	}
+}
+
+func (t *transpiler) logicalExp(node *LogicalExp) (string, int) {
+	op, prec := " or ", precOr
+	if node.Op.Is(TOKEN_OP_AND) {
+		op, prec = " and ", precAnd
+	}
+	list := make([]string, len(node.ExpList))
+	for i, exp := range node.ExpList {
+		if i == 0 {
+			list[i] = t.expAt(exp, prec)
+		} else {
+			list[i] = t.expAt(exp, prec+1)
+		}
+	}
+	return strings.Join(list, op), prec
+}
+
+func (t *transpiler) tableConstructorExp(node *TableConstructorExp) string {
+	fields := make([]string, len(node.ValExps))
+	for i, keyExp := range node.KeyExps {
+		val := t.expAt(node.ValExps[i], 0)
+		if keyExp == nil {
+			fields[i] = val
+		} else if key, ok := keyExp.(*StringExp); ok && isIdentifier(key.Str) {
+			fields[i] = key.Str + " = " + val
+		} else {
+			fields[i] = fmt.Sprintf("[%s] = %s", t.expAt(keyExp, 0), val)
+		}
+	}
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// an expression that can be indexed or called without parentheses
+func (t *transpiler) prefixExp(node Expression) string {
+	switch exp := node.(type) {
+	case *NameExp, NameExp, *TableAccessExp, *FuncCallExp:
+		return t.expAt(exp, 0)
+	case *ParensExp: // (f)() => f(), but (...)() keeps them
+		switch exp.Exp.(type) {
+		case *NameExp, *TableAccessExp, *FuncCallExp:
+			return t.prefixExp(exp.Exp)
+		}
+	}
+	return "(" + t.expAt(node, 0) + ")"
+}
+
+func (t *transpiler) tableAccessExp(node *TableAccessExp) string {
+	prefix := t.prefixExp(node.PrefixExp)
+	if key, ok := node.KeyExp.(*StringExp); ok && isIdentifier(key.Str) {
+		return prefix + "." + key.Str
+	}
+	return fmt.Sprintf("%s[%s]", prefix, t.expAt(node.KeyExp, 0))
+}
+
+func (t *transpiler) funcCallExp(node *FuncCallExp) string {
+	prefix := t.prefixExp(node.PrefixExp)
+	args := t.expList(node.Args)
+	if node.NameExp == nil {
+		return fmt.Sprintf("%s(%s)", prefix, args)
+	}
+	if isIdentifier(node.NameExp.Str) {
+		return fmt.Sprintf("%s:%s(%s)", prefix, node.NameExp.Str, args)
+	}
+	// a method named by a lua keyword, evaluating the object only once
+	if args != "" {
+		args = ", " + args
+	}
+	return fmt.Sprintf("(function(o, ...) return o[%s](o, ...) end)(%s%s)",
+		quote(node.NameExp.Str), prefix, args)
+}
+
+// name is " f" or " t.a.f" for a function statement, "" for a function
+// expression. A method leaves self out of its parameters.
+func (t *transpiler) funcDefExp(node *FuncDefExp, name string, isMethod bool) string {
+	fs := &funcState{parent: t.fs, isVararg: node.IsVararg}
+	t.fs = fs
+	t.enterScope()
+
+	params := make([]string, 0, len(node.ParList)+1)
+	for i, param := range node.ParList {
+		param = t.declare(param)
+		if i > 0 || !isMethod {
+			params = append(params, param)
+		}
+	}
+	if node.IsVararg {
+		params = append(params, "...")
+	}
+
+	buf := t.buf
+	t.buf = &strings.Builder{}
+	t.indent++
+	t.block(node.Block)
+	body := t.buf.String()
+	t.indent--
+	t.buf = buf
+
+	t.exitScope()
+	t.fs = fs.parent
+	return fmt.Sprintf("function%s(%s)\n%s%send", name, strings.Join(params, ", "), body, t.indentation())
+}
@@ -0,0 +1,422 @@
+package transpiler
+
+import (
+	"fmt"
+	. "lxa/compiler/ast"
+	"strings"
+)
+
+func (t *transpiler) block(node *Block) {
+	stats := node.Statements
+	for i := 0; i < len(stats); i++ {
+		if decl, assign, ok := localFuncStat(stats, i); ok {
+			t.localFuncStat(decl, assign)
+			i++
+			continue
+		}
+		last := i == len(stats)-1 && node.ReturnExps == nil
+		t.statement(stats[i], last)
+	}
+
+	if node.ReturnExps != nil {
+		line := node.LastLine
+		if len(node.ReturnExps) > 0 {
+			line = lineOf(node.ReturnExps[0])
+		}
+		if exps := t.expList(node.ReturnExps); exps != "" {
+			t.stat(line, "return "+exps)
+		} else {
+			t.stat(line, "return")
+		}
+	}
+}
+
+// last tells if nothing follows the statement in its block
+func (t *transpiler) statement(node Statement, last bool) {
+	switch stat := node.(type) {
+	case *BlockStat:
+		t.blockStat(stat)
+	case *BreakStat:
+		t.breakStat(stat, last)
+	case *ContinueStat:
+		t.continueStat(stat, last)
+	case *LoopStat:
+		t.loopStat(stat)
+	case *ForNumStat:
+		t.forNumStat(stat)
+	case *IfStat:
+		t.ifStat(stat)
+	case *ForInStat:
+		t.forInStat(stat)
+	case *AssignmentStat:
+		t.assignmentStat(stat)
+	case *FuncCallStat:
+		t.stat(stat.Line, t.funcCallExp(stat))
+	case *LocVarDeclStat:
+		t.locVarDeclStat(stat, nil)
+	}
+}
+
+func (t *transpiler) blockStat(node *BlockStat) {
+	t.stat(0, "do")
+	t.indent++
+	t.enterScope()
+	t.block(node.Block)
+	t.exitScope()
+	t.indent--
+	t.stat(0, "end")
+}
+
+// Lua 5.1 only allows break as the last statement of a block
+func (t *transpiler) jump(line int, text string, last bool) {
+	if t.version == LUA51 && !last {
+		text = "do " + text + " end"
+	}
+	t.stat(line, text)
+}
+
+func (t *transpiler) breakStat(node *BreakStat, last bool) {
+	loop := t.loop(node.Line, "break")
+	if t.version == LUA51 && loop.hasContinue { // leave the repeat, then the loop
+		t.jump(node.Line, "__lxa_break = true; break", last)
+	} else {
+		t.jump(node.Line, "break", last)
+	}
+}
+
+// continue => goto continue, or a break out of the repeat the loop body
+// is wrapped in on Lua 5.1
+func (t *transpiler) continueStat(node *ContinueStat, last bool) {
+	t.loop(node.Line, "continue")
+	if t.version == LUA51 {
+		t.jump(node.Line, "break", last)
+	} else {
+		t.stat(node.Line, "goto continue")
+	}
+}
+
+/*
+while exp { block }         while exp do
+                      =>      do block end
+                              ::continue::
+                              step
+                            end
+
+or on Lua 5.1               while exp do
+                              local __lxa_break = false
+                              repeat block until true
+                              if __lxa_break then break end
+                              step
+                            end
+*/
+func (t *transpiler) loopStat(node *LoopStat) {
+	hasInit := len(node.InitList) > 0
+	if hasInit {
+		t.stat(0, "do")
+		t.indent++
+	}
+	t.enterScope()
+	for _, stat := range node.InitList {
+		t.statement(stat, false)
+	}
+
+	t.stat(lineOf(node.Exp), fmt.Sprintf("while %s do", t.expAt(node.Exp, 0)))
+	t.loopBody(node.Block, node.StepStat)
+	t.stat(0, "end")
+
+	t.exitScope()
+	if hasInit {
+		t.indent--
+		t.stat(0, "end")
+	}
+}
+
+func (t *transpiler) loopBody(block *Block, step Statement) {
+	loop := &loopInfo{}
+	loop.hasContinue, loop.hasBreak = scanLoop(block)
+	t.fs.loops = append(t.fs.loops, loop)
+	t.indent++
+	t.enterScope()
+
+	switch {
+	case !loop.hasContinue:
+		t.block(block)
+	case t.version == LUA51:
+		if loop.hasBreak {
+			t.stat(0, "local __lxa_break = false")
+		}
+		t.stat(0, "repeat")
+		t.nestedBlock(block)
+		t.stat(0, "until true")
+		if loop.hasBreak {
+			t.stat(0, "if __lxa_break then break end")
+		}
+	case step != nil || block.ReturnExps != nil: // the label has to end the body
+		t.stat(0, "do")
+		t.nestedBlock(block)
+		t.stat(0, "end")
+		t.stat(0, "::continue::")
+	default:
+		t.block(block)
+		t.stat(0, "::continue::")
+	}
+	if step != nil {
+		t.statement(step, true)
+	}
+
+	t.exitScope()
+	t.indent--
+	t.fs.loops = t.fs.loops[:len(t.fs.loops)-1]
+}
+
+func (t *transpiler) nestedBlock(block *Block) {
+	t.indent++
+	t.enterScope()
+	t.block(block)
+	t.exitScope()
+	t.indent--
+}
+
+// a numeric for, unless the limit may change while the loop runs
+func (t *transpiler) forNumStat(node *ForNumStat) {
+	if !t.isLoopInvariant(node.LimitExp) {
+		t.loopStat(node.LoopStat)
+		return
+	}
+
+	head := fmt.Sprintf("%s, %s", t.expAt(node.InitExp, 0), t.expAt(node.LimitExp, 0))
+	if step, ok := node.StepExp.(*IntegerExp); !ok || step.Val != 1 {
+		head += ", " + t.expAt(node.StepExp, 0)
+	}
+
+	if node.Guard != nil {
+		t.stat(node.LineOfFor, fmt.Sprintf("if %s then", t.expAt(node.Guard, 0)))
+		t.indent++
+	}
+	t.enterScope()
+	name := t.declare(node.VarName)
+	t.stat(node.LineOfFor, fmt.Sprintf("for %s = %s do", name, head))
+	t.loopBody(node.Block, nil)
+	t.stat(0, "end")
+	t.exitScope()
+	if node.Guard != nil {
+		t.indent--
+		t.stat(0, "end")
+	}
+}
+
+// the same check the code generator makes to pick FORPREP/FORLOOP
+func (t *transpiler) isLoopInvariant(exp Expression) bool {
+	switch x := exp.(type) {
+	case *IntegerExp, *FloatExp:
+		return true
+	case *NameExp:
+		v := t.localOf(x.Name)
+		return v != nil && !v.captured
+	case *ParensExp:
+		return t.isLoopInvariant(x.Exp)
+	case *UnopExp:
+		return t.isLoopInvariant(x.Exp)
+	case *BinopExp:
+		return t.isLoopInvariant(x.Exp1) && t.isLoopInvariant(x.Exp2)
+	}
+	return false
+}
+
+func (t *transpiler) forInStat(node *ForInStat) {
+	exps := t.expList(node.ExpList)
+
+	t.enterScope()
+	names := make([]string, len(node.NameList))
+	for i, name := range node.NameList {
+		names[i] = t.declare(name)
+	}
+	t.stat(node.LineBlock, fmt.Sprintf("for %s in %s do", strings.Join(names, ", "), exps))
+	t.loopBody(node.Block, nil)
+	t.stat(0, "end")
+	t.exitScope()
+}
+
+/*
+if a := f(); a > 0 { b1 }         do
+else if g() { b2 }                  local a = f()
+else if c := h(); c { b3 }          if a > 0 then b1
+else { b4 }                   =>    elseif g() then b2
+                                    else
+                                      local c = h()
+                                      if c then b3 else b4 end
+                                    end
+                                  end
+*/
+func (t *transpiler) ifStat(node *IfStat) {
+	hasInit := len(node.SubList[0].InitList) > 0
+	if hasInit {
+		t.stat(0, "do")
+		t.indent++
+	}
+	t.subIfStats(node.SubList)
+	if hasInit {
+		t.indent--
+		t.stat(0, "end")
+	}
+}
+
+func (t *transpiler) subIfStats(subs []*SubIfStat) {
+	for i, sub := range subs {
+		if i > 0 && len(sub.InitList) > 0 {
+			t.stat(0, "else")
+			t.indent++
+			t.subIfStats(subs[i:])
+			t.indent--
+			break
+		}
+
+		t.enterScope()
+		t.initList(sub.InitList, subs[i+1:])
+		switch {
+		case i == 0:
+			t.stat(lineOf(sub.Exp), fmt.Sprintf("if %s then", t.expAt(sub.Exp, 0)))
+		case i == len(subs)-1 && isTrueExp(sub.Exp): // else '{' block '}'
+			t.stat(0, "else")
+		default:
+			t.stat(lineOf(sub.Exp), fmt.Sprintf("elseif %s then", t.expAt(sub.Exp, 0)))
+		}
+		t.nestedBlock(sub.Block)
+		t.exitScope()
+	}
+	t.stat(0, "end")
+}
+
+// the statements before the condition of an if, whose locals lua keeps
+// visible to the later branches too
+func (t *transpiler) initList(stats []Statement, later []*SubIfStat) {
+	for _, stat := range stats {
+		if decl, ok := stat.(*LocVarDeclStat); ok {
+			t.locVarDeclStat(decl, later)
+		} else {
+			t.statement(stat, false)
+		}
+	}
+}
+
+func (t *transpiler) locVarDeclStat(node *LocVarDeclStat, later []*SubIfStat) {
+	exps := t.expList(node.ExpList)
+
+	names := make([]string, len(node.NameList))
+	for i, name := range node.NameList {
+		names[i] = t.declareHidden(name, later)
+		if i < len(node.AttribList) && node.AttribList[i] == "close" {
+			if t.version != LUA54 {
+				t.error(node.LastLine, "to-be-closed variable '%s' needs -target lua54", name)
+			}
+			names[i] += " <close>"
+		}
+	}
+
+	text := "local " + strings.Join(names, ", ")
+	if exps != "" {
+		text += " = " + exps
+	}
+	t.stat(node.LastLine, text)
+}
+
+// local func f() {} => local f; f = func() {} => local function f() end
+func localFuncStat(stats []Statement, i int) (*LocVarDeclStat, *AssignmentStat, bool) {
+	if i+1 >= len(stats) {
+		return nil, nil, false
+	}
+	decl, ok := stats[i].(*LocVarDeclStat)
+	if !ok || len(decl.NameList) != 1 || len(decl.ExpList) != 0 || decl.AttribList != nil {
+		return nil, nil, false
+	}
+	assign, ok := stats[i+1].(*AssignmentStat)
+	if !ok || len(assign.VarList) != 1 || len(assign.ExpList) != 1 {
+		return nil, nil, false
+	}
+	if name, ok := assign.VarList[0].(NameExp); !ok || name.Name != decl.NameList[0] {
+		return nil, nil, false
+	}
+	if _, ok := assign.ExpList[0].(*FuncDefExp); !ok {
+		return nil, nil, false
+	}
+	return decl, assign, true
+}
+
+func (t *transpiler) localFuncStat(decl *LocVarDeclStat, assign *AssignmentStat) {
+	name := t.declare(decl.NameList[0])
+	fd := assign.ExpList[0].(*FuncDefExp)
+	t.stat(decl.LastLine, "local "+t.funcDefExp(fd, " "+name, false))
+}
+
+func (t *transpiler) assignmentStat(node *AssignmentStat) {
+	if len(node.VarList) == 1 && len(node.ExpList) == 1 {
+		if fd, ok := node.ExpList[0].(*FuncDefExp); ok {
+			if name, isMethod, ok := t.funcName(node.VarList[0], fd); ok {
+				t.stat(node.LastLine, t.funcDefExp(fd, " "+name, isMethod))
+				return
+			}
+		}
+		if bin, ok := compoundAssignment(node); ok {
+			t.compoundAssignmentStat(node, bin)
+			return
+		}
+	}
+
+	vars := make([]string, len(node.VarList))
+	for i, v := range node.VarList {
+		vars[i] = t.expAt(v, 0)
+	}
+	t.stat(node.LastLine, fmt.Sprintf("%s = %s", strings.Join(vars, ", "), t.expList(node.ExpList)))
+}
+
+// t.a.b = func(self) {} => function t.a:b() end, if every part of the
+// target is a name
+func (t *transpiler) funcName(exp Expression, fd *FuncDefExp) (string, bool, bool) {
+	switch x := exp.(type) {
+	case *NameExp:
+		name := t.name(x.Name)
+		return name, false, isIdentifier(name)
+	case *TableAccessExp:
+		key, ok := x.KeyExp.(*StringExp)
+		if !ok || !isIdentifier(key.Str) {
+			return "", false, false
+		}
+		prefix, isMethod, ok := t.funcName(x.PrefixExp, nil)
+		if !ok || isMethod {
+			return "", false, false
+		}
+		if fd != nil && len(fd.ParList) > 0 && fd.ParList[0] == "self" {
+			return prefix + ":" + key.Str, true, true
+		}
+		return prefix + "." + key.Str, false, true
+	}
+	return "", false, false
+}
+
+// the parser expands `v op= e` to `v = v op e`, with the same node on
+// both sides
+func compoundAssignment(node *AssignmentStat) (*BinopExp, bool) {
+	bin, ok := node.ExpList[0].(*BinopExp)
+	if ok && bin.Exp1 == node.VarList[0] {
+		return bin, true
+	}
+	return nil, false
+}
+
+// evaluates the table and key of the target only once
+func (t *transpiler) compoundAssignmentStat(node *AssignmentStat, bin *BinopExp) {
+	ta, ok := node.VarList[0].(*TableAccessExp)
+	if !ok || isPure(ta.PrefixExp) && isPure(ta.KeyExp) {
+		target, prec := t.exp(node.VarList[0])
+		y, yPrec := t.exp(bin.Exp2)
+		value, _ := t.binopText(bin.Op.Type, target, prec, y, yPrec)
+		t.stat(node.LastLine, fmt.Sprintf("%s = %s", target, value))
+		return
+	}
+
+	prefix, key := t.expAt(ta.PrefixExp, 0), t.expAt(ta.KeyExp, 0)
+	y, yPrec := t.exp(bin.Exp2)
+	value, _ := t.binopText(bin.Op.Type, "__lxa_t[__lxa_k]", precPrimary, y, yPrec)
+	t.stat(node.LastLine, fmt.Sprintf("do local __lxa_t, __lxa_k = %s, %s; __lxa_t[__lxa_k] = %s end",
+		prefix, key, value))
+}
@@ -0,0 +1,31 @@
+package transpiler_test
+
+import (
+	"io/ioutil"
+	"lxa/compiler"
+	"lxa/compiler/transpiler"
+	"strings"
+	"testing"
+)
+
+// what the lua 5.1 lowering gives is in lua51.lua, next to the source
+func TestLua51(t *testing.T) {
+	src, err := ioutil.ReadFile("../../testdata/transpile/lua51.lxa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("../../testdata/transpile/lua51.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := compiler.TryTranspile(string(src), "lua51.lxa", transpiler.LUA51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gl, wl := strings.Split(got, "\n"), strings.Split(string(want), "\n")
+	for i := 0; i < len(gl) || i < len(wl); i++ {
+		if i >= len(gl) || i >= len(wl) || gl[i] != wl[i] {
+			t.Fatalf("line %d differs from lua51.lua:\n%s", i+1, got)
+		}
+	}
+}
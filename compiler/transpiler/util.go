@@ -0,0 +1,242 @@
+package transpiler
+
+import (
+	"fmt"
+	. "lxa/compiler/ast"
+	"strings"
+)
+
+// words lxa lets a name be, but lua doesn't
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "goto": true,
+	"if": true, "in": true, "local": true, "nil": true, "not": true,
+	"or": true, "repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+func isIdentifier(name string) bool {
+	if name == "" || luaKeywords[name] {
+		return false
+	}
+	for i, c := range []byte(name) {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// end => end_, and non-ascii letters spelled out in hex
+func mangle(name string) string {
+	if isIdentifier(name) {
+		return name
+	}
+	if luaKeywords[name] {
+		return name + "_"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+			b.WriteRune(r)
+		case '0' <= r && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			fmt.Fprintf(&b, "_%X", r)
+		}
+	}
+	return b.String()
+}
+
+// a string literal every lua version reads back the same
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7F {
+				fmt.Fprintf(&b, `\%03d`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// evaluating it twice does no harm
+func isPure(exp Expression) bool {
+	switch exp.(type) {
+	case *NameExp, NameExp, *StringExp, *IntegerExp, *FloatExp,
+		*NilExp, *TrueExp, *FalseExp:
+		return true
+	}
+	return false
+}
+
+func isTrueExp(exp Expression) bool {
+	_, ok := exp.(*TrueExp)
+	return ok
+}
+
+// whether a loop body continues or breaks the loop itself, rather than
+// a loop nested in it
+func scanLoop(block *Block) (hasContinue, hasBreak bool) {
+	for _, stat := range block.Statements {
+		c, b := false, false
+		switch x := stat.(type) {
+		case *ContinueStat:
+			c = true
+		case *BreakStat:
+			b = true
+		case *BlockStat:
+			c, b = scanLoop(x.Block)
+		case *IfStat:
+			for _, sub := range x.SubList {
+				sc, sb := scanLoop(sub.Block)
+				c, b = c || sc, b || sb
+			}
+		}
+		hasContinue, hasBreak = hasContinue || c, hasBreak || b
+	}
+	return
+}
+
+// whether a name appears anywhere in the node
+func mentions(node interface{}, name string) bool {
+	switch x := node.(type) {
+	case *NameExp:
+		return x.Name == name
+	case NameExp:
+		return x.Name == name
+	case *ParensExp:
+		return mentions(x.Exp, name)
+	case *UnopExp:
+		return mentions(x.Exp, name)
+	case *BinopExp:
+		return mentions(x.Exp1, name) || mentions(x.Exp2, name)
+	case *LogicalExp:
+		return mentionsAny(x.ExpList, name)
+	case *ConcatExp:
+		return mentionsAny(x.ExpList, name)
+	case *TableConstructorExp:
+		for _, k := range x.KeyExps {
+			if k != nil && mentions(k, name) {
+				return true
+			}
+		}
+		return mentionsAny(x.ValExps, name)
+	case *FuncDefExp:
+		return mentions(x.Block, name)
+	case *TableAccessExp:
+		return mentions(x.PrefixExp, name) || mentions(x.KeyExp, name)
+	case *FuncCallExp:
+		return mentions(x.PrefixExp, name) || mentionsAny(x.Args, name)
+	case *Block:
+		for _, stat := range x.Statements {
+			if mentions(stat, name) {
+				return true
+			}
+		}
+		return mentionsAny(x.ReturnExps, name)
+	case *BlockStat:
+		return mentions(x.Block, name)
+	case *LoopStat:
+		for _, stat := range x.InitList {
+			if mentions(stat, name) {
+				return true
+			}
+		}
+		return mentions(x.Exp, name) || mentions(x.StepStat, name) || mentions(x.Block, name)
+	case *ForNumStat:
+		return mentions(x.LoopStat, name)
+	case *ForInStat:
+		return mentionsAny(x.ExpList, name) || mentions(x.Block, name)
+	case *IfStat:
+		for _, sub := range x.SubList {
+			if mentions(sub, name) {
+				return true
+			}
+		}
+	case *SubIfStat:
+		for _, stat := range x.InitList {
+			if mentions(stat, name) {
+				return true
+			}
+		}
+		return mentions(x.Exp, name) || mentions(x.Block, name)
+	case *AssignmentStat:
+		return mentionsAny(x.VarList, name) || mentionsAny(x.ExpList, name)
+	case *LocVarDeclStat:
+		return mentionsAny(x.ExpList, name)
+	}
+	return false
+}
+
+func mentionsAny(exps []Expression, name string) bool {
+	for _, exp := range exps {
+		if mentions(exp, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func lineOf(exp Expression) int {
+	switch x := exp.(type) {
+	case *NilExp:
+		return x.Line
+	case *TrueExp:
+		return x.Line
+	case *FalseExp:
+		return x.Line
+	case *IntegerExp:
+		return x.Line
+	case *FloatExp:
+		return x.Line
+	case *StringExp:
+		return x.Line
+	case *VarargExp:
+		return x.Line
+	case *NameExp:
+		return x.Line
+	case NameExp:
+		return x.Line
+	case *FuncDefExp:
+		return x.Line
+	case *FuncCallExp:
+		return x.Line
+	case *TableConstructorExp:
+		return x.Line
+	case *UnopExp:
+		return x.Op.Line
+	case *ParensExp:
+		return lineOf(x.Exp)
+	case *ConcatExp:
+		return lineOf(x.ExpList[0])
+	case *TableAccessExp:
+		return lineOf(x.PrefixExp)
+	case *BinopExp:
+		return lineOf(x.Exp1)
+	case *LogicalExp:
+		return lineOf(x.ExpList[0])
+	default:
+		panic("unreachable!")
+	}
+}
@@ -1,3 +1,3 @@
 module lxa
 
-go 1.14
+go 1.16
@@ -0,0 +1,162 @@
+// Package lxa embeds lxa scripts in go programs: a VM runs sources and
+// files, evaluates expressions and calls functions, trading go values
+// for lxa ones and back.
+//
+//	vm := lxa.NewVM()
+//	if err := vm.DoString(`func add(a, b) { return a + b }`); err != nil {
+//		return err
+//	}
+//	res, err := vm.Call("add", 1, 2)
+//	fmt.Println(res[0].Int()) // 3
+package lxa
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"lxa/api"
+	"lxa/state"
+)
+
+// VM is a golua state to run lxa code on. It is not safe for concurrent
+// use: give each goroutine a VM of its own.
+type VM struct {
+	ls api.LuaState
+}
+
+type options struct {
+	debug  bool
+	noLibs bool
+}
+
+// Option changes how NewVM makes a VM
+type Option func(*options)
+
+// WithDebug logs and traces everything the vm does
+func WithDebug() Option {
+	return func(o *options) { o.debug = true }
+}
+
+// WithoutLibs leaves out the standard libraries, print and require too
+func WithoutLibs() Option {
+	return func(o *options) { o.noLibs = true }
+}
+
+// NewVM makes a VM with the standard libraries open
+func NewVM(opts ...Option) *VM {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	ls := state.NewState(o.debug)
+	if !o.noLibs {
+		ls.OpenLibs()
+	}
+	return &VM{ls}
+}
+
+// Run runs lxa source on a new VM
+func Run(src string) error {
+	return NewVM().DoString(src)
+}
+
+// Eval evaluates an lxa expression on a new VM
+func Eval(expr string) (Value, error) {
+	return NewVM().Eval(expr)
+}
+
+// State is the underlying state, for what the VM doesn't do
+func (vm *VM) State() api.LuaState {
+	return vm.ls
+}
+
+// DoString runs lxa source, or a binary chunk
+func (vm *VM) DoString(src string) error {
+	_, err := vm.do([]byte(src), "=(string)", 0)
+	return err
+}
+
+// DoFile runs an lxa source file, or a binary chunk
+func (vm *VM) DoFile(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	_, err = vm.do(data, "@"+filename, 0)
+	return err
+}
+
+// Eval evaluates an lxa expression, returning its first value
+func (vm *VM) Eval(expr string) (Value, error) {
+	values, err := vm.do([]byte("return "+expr+"\n"), "=(eval)", 1)
+	if err != nil {
+		return Value{}, err
+	}
+	return values[0], nil
+}
+
+// Call calls the global function name with args, converted as SetGlobal
+// does, and returns all its results
+func (vm *VM) Call(name string, args ...interface{}) ([]Value, error) {
+	ls := vm.ls
+	base := ls.GetTop()
+	if ls.GetGlobal(name) != api.LUA_TFUNCTION {
+		if ls.GetMetafield(-1, "__call") == api.LUA_TNIL {
+			ls.SetTop(base)
+			return nil, fmt.Errorf("%s is not a function", name)
+		}
+		ls.Pop(1) // the __call
+	}
+	for _, arg := range args {
+		push(ls, arg)
+	}
+	return vm.call(base, len(args), api.LUA_MULTRET)
+}
+
+// SetGlobal sets the global name to v. Booleans, numbers, strings and
+// []byte become the lxa ones, nil nil, slices, arrays and maps tables,
+// a Value or Function itself, and anything else a userdata.
+func (vm *VM) SetGlobal(name string, v interface{}) {
+	push(vm.ls, v)
+	vm.ls.SetGlobal(name)
+}
+
+// Global is the value of the global name
+func (vm *VM) Global(name string) Value {
+	ls := vm.ls
+	ls.GetGlobal(name)
+	defer ls.Pop(1)
+	return toValue(ls, -1)
+}
+
+// loads the chunk and calls it, keeping nResults of what it returns
+func (vm *VM) do(chunk []byte, chunkName string, nResults int) ([]Value, error) {
+	ls := vm.ls
+	base := ls.GetTop()
+	if ls.Load(chunk, chunkName, "bt") != api.LUA_OK {
+		return nil, vm.error(base)
+	}
+	return vm.call(base, 0, nResults)
+}
+
+// calls the function above base with the nArgs above it, taking its
+// results off the stack
+func (vm *VM) call(base, nArgs, nResults int) ([]Value, error) {
+	ls := vm.ls
+	if ls.PCall(nArgs, nResults, 0) != api.LUA_OK {
+		return nil, vm.error(base)
+	}
+	values := make([]Value, ls.GetTop()-base)
+	for i := range values {
+		values[i] = toValue(ls, base+i+1)
+	}
+	ls.SetTop(base)
+	return values, nil
+}
+
+// the error on top of the stack
+func (vm *VM) error(base int) error {
+	msg := vm.ls.ToString2(-1)
+	vm.ls.SetTop(base)
+	return errors.New(msg)
+}
@@ -0,0 +1,60 @@
+package lxa
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCall(t *testing.T) {
+	vm := NewVM()
+	if err := vm.DoString(`func add(a, b) { return a + b, a * b }`); err != nil {
+		t.Fatal(err)
+	}
+	res, err := vm.Call("add", 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Int() != 7 || res[1].Int() != 12 {
+		t.Errorf("add(3, 4) = %v, want [7 12]", res)
+	}
+	if _, err := vm.Call("nope"); err == nil {
+		t.Error("calling a nil global didn't fail")
+	}
+}
+
+func TestEval(t *testing.T) {
+	vm := NewVM()
+	vm.SetGlobal("m", map[string]interface{}{"a": 1, "b": "two"})
+	for _, c := range []struct {
+		expr, want string
+	}{
+		{"1 + 2", "3"},
+		{"m.a", "1"},
+		{"m.b .. '!'", "two!"},
+		{"#m.b // the length", "3"},
+		{"m.c", "nil"},
+		{"1 / 2", "0.5"},
+	} {
+		v, err := vm.Eval(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+		} else if v.String() != c.want {
+			t.Errorf("%s = %s, want %s", c.expr, v, c.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	vm := NewVM()
+	src := strings.Repeat("x := 1\n", 50) + "error('boom')"
+	err := vm.DoString(src)
+	if err == nil || err.Error() != "(string):51: boom" {
+		t.Errorf("runtime error = %v, want (string):51: boom", err)
+	}
+	if _, err := vm.Eval("1 +"); err == nil || !strings.HasPrefix(err.Error(), "(eval):") {
+		t.Errorf("syntax error = %v, want it in (eval)", err)
+	}
+	if err := vm.DoString("for { break }\nbreak"); err == nil {
+		t.Error("a break outside a loop didn't fail")
+	}
+}
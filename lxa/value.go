@@ -0,0 +1,413 @@
+package lxa
+
+import (
+	"fmt"
+	"lxa/api"
+	"lxa/number"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Value is a copy of an lxa value, taken when it left the VM, or made by
+// ValueOf. Tables are copied with everything in them; functions, threads
+// and userdata only keep their type, and the data of a userdata.
+type Value struct {
+	typ api.LuaType
+	v   interface{} // nil, bool, int64, float64, string, *Table, a userdata's data, or a go function
+}
+
+// Function is a go function lxa code can call. Returning an error raises
+// it as an lxa error. Its results are made with ValueOf.
+type Function func(args []Value) ([]Value, error)
+
+// ValueOf converts a go value as VM.SetGlobal does: booleans, numbers,
+// strings and []byte become the lxa ones, nil nil, slices, arrays and
+// maps tables, a Function or api.GoFunction a function, a Value itself,
+// and anything else a userdata.
+func ValueOf(v interface{}) Value {
+	switch x := v.(type) {
+	case nil:
+		return Value{}
+	case Value:
+		return x
+	case *Table:
+		return Value{api.LUA_TTABLE, x}
+	case Function:
+		return Value{api.LUA_TFUNCTION, x}
+	case func(args []Value) ([]Value, error):
+		return Value{api.LUA_TFUNCTION, Function(x)}
+	case api.GoFunction:
+		return Value{api.LUA_TFUNCTION, x}
+	case func(api.LuaState) int:
+		return Value{api.LUA_TFUNCTION, api.GoFunction(x)}
+	case []byte:
+		return Value{api.LUA_TSTRING, string(x)}
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return Value{api.LUA_TBOOLEAN, rv.Bool()}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Value{api.LUA_TNUMBER, rv.Int()}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return Value{api.LUA_TNUMBER, int64(rv.Uint())}
+	case reflect.Float32, reflect.Float64:
+		return Value{api.LUA_TNUMBER, rv.Float()}
+	case reflect.String:
+		return Value{api.LUA_TSTRING, rv.String()}
+	case reflect.Slice, reflect.Array:
+		t := &Table{fields: map[interface{}]Value{}}
+		for i := 0; i < rv.Len(); i++ {
+			t.set(int64(i+1), ValueOf(rv.Index(i).Interface()))
+		}
+		return Value{api.LUA_TTABLE, t}
+	case reflect.Map:
+		t := &Table{fields: map[interface{}]Value{}}
+		iter := rv.MapRange()
+		for iter.Next() {
+			t.set(iter.Key().Interface(), ValueOf(iter.Value().Interface()))
+		}
+		return Value{api.LUA_TTABLE, t}
+	}
+	return Value{api.LUA_TUSERDATA, v}
+}
+
+// Type is the type of the value, api.LUA_TNIL for the zero Value
+func (v Value) Type() api.LuaType {
+	return v.typ
+}
+
+// TypeName is the name of the type, as type() tells it
+func (v Value) TypeName() string {
+	switch v.typ {
+	case api.LUA_TNIL:
+		return "nil"
+	case api.LUA_TBOOLEAN:
+		return "boolean"
+	case api.LUA_TNUMBER:
+		return "number"
+	case api.LUA_TSTRING:
+		return "string"
+	case api.LUA_TTABLE:
+		return "table"
+	case api.LUA_TFUNCTION:
+		return "function"
+	case api.LUA_TTHREAD:
+		return "thread"
+	default:
+		return "userdata"
+	}
+}
+
+// IsNil tells whether the value is nil
+func (v Value) IsNil() bool {
+	return v.typ == api.LUA_TNIL
+}
+
+// Bool is false for nil and false, and true for anything else
+func (v Value) Bool() bool {
+	if b, ok := v.v.(bool); ok {
+		return b
+	}
+	return v.typ != api.LUA_TNIL
+}
+
+// Int is the value as an integer, if it is a number or a string with an
+// integral value, or else 0
+func (v Value) Int() int64 {
+	switch x := v.v.(type) {
+	case int64:
+		return x
+	case float64:
+		i, _ := number.FloatToInteger(x)
+		return i
+	case string:
+		if i, ok := number.ParseInteger(strings.TrimSpace(x)); ok {
+			return i
+		}
+		f, _ := number.ParseFloat(strings.TrimSpace(x))
+		i, _ := number.FloatToInteger(f)
+		return i
+	}
+	return 0
+}
+
+// Float is the value as a float, if it is a number or a numeric string,
+// or else 0
+func (v Value) Float() float64 {
+	switch x := v.v.(type) {
+	case int64:
+		return float64(x)
+	case float64:
+		return x
+	case string:
+		if i, ok := number.ParseInteger(strings.TrimSpace(x)); ok {
+			return float64(i)
+		}
+		f, _ := number.ParseFloat(strings.TrimSpace(x))
+		return f
+	}
+	return 0
+}
+
+// String is the value as tostring() writes it, without metamethods, and
+// only the type name for tables, functions, threads and userdata
+func (v Value) String() string {
+	switch x := v.v.(type) {
+	case nil:
+		return v.TypeName()
+	case bool:
+		return strconv.FormatBool(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			return strings.ToLower(strings.TrimPrefix(fmt.Sprint(x), "+"))
+		}
+		s := fmt.Sprintf("%.14g", x)
+		if !strings.ContainsAny(s, ".e") { // looks like an int
+			s += ".0"
+		}
+		return s
+	case string:
+		return x
+	}
+	return v.TypeName()
+}
+
+// Table is the table, nil if the value isn't one
+func (v Value) Table() *Table {
+	t, _ := v.v.(*Table)
+	return t
+}
+
+// UserData is the data of a userdata, nil if the value isn't one
+func (v Value) UserData() interface{} {
+	if v.typ != api.LUA_TUSERDATA {
+		return nil
+	}
+	return v.v
+}
+
+// Table is a copy of an lxa table
+type Table struct {
+	keys   []Value
+	fields map[interface{}]Value
+}
+
+// Get is the value at key, nil if there is none. Go integers and
+// integral floats are the same key, as they are in lxa.
+func (t *Table) Get(key interface{}) Value {
+	return t.fields[tableKey(key)]
+}
+
+// Len is the length of the sequence from 1, as # gives it when there
+// are no holes
+func (t *Table) Len() int {
+	n := 0
+	for !t.Get(n + 1).IsNil() {
+		n++
+	}
+	return n
+}
+
+// Array is the sequence from 1 to Len
+func (t *Table) Array() []Value {
+	values := make([]Value, t.Len())
+	for i := range values {
+		values[i] = t.Get(i + 1)
+	}
+	return values
+}
+
+// Keys are all the keys, in the order next() gave them
+func (t *Table) Keys() []Value {
+	return t.keys
+}
+
+// sets key to v, leaving out nil and NaN keys and nil values, as lxa does
+func (t *Table) set(key interface{}, v Value) {
+	k := ValueOf(key)
+	if f, ok := k.v.(float64); ok {
+		if i, ok := number.FloatToInteger(f); ok {
+			k.v = i
+		} else if f != f {
+			return
+		}
+	}
+	if k.IsNil() || v.IsNil() {
+		return
+	}
+	if _, ok := t.fields[k.v]; !ok {
+		t.keys = append(t.keys, k)
+	}
+	t.fields[k.v] = v
+}
+
+func tableKey(key interface{}) interface{} {
+	switch x := key.(type) {
+	case Value:
+		return x.v
+	case float64:
+		if i, ok := number.FloatToInteger(x); ok {
+			return i
+		}
+		return x
+	case float32:
+		return tableKey(float64(x))
+	}
+	rv := reflect.ValueOf(key)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int64(rv.Uint())
+	}
+	return key
+}
+
+// copies the value at idx out of the state
+func toValue(ls api.LuaState, idx int) Value {
+	return copyValue(ls, ls.AbsIndex(idx), map[interface{}]*Table{})
+}
+
+// tables already copied are in seen, so that cycles stay cycles
+func copyValue(ls api.LuaState, idx int, seen map[interface{}]*Table) Value {
+	typ := ls.Type(idx)
+	switch typ {
+	case api.LUA_TBOOLEAN:
+		return Value{typ, ls.ToBoolean(idx)}
+	case api.LUA_TNUMBER:
+		if ls.IsInteger(idx) {
+			return Value{typ, ls.ToInteger(idx)}
+		}
+		return Value{typ, ls.ToNumber(idx)}
+	case api.LUA_TSTRING:
+		return Value{typ, ls.ToString(idx)}
+	case api.LUA_TTABLE:
+		p := ls.ToPointer(idx)
+		if t, ok := seen[p]; ok {
+			return Value{typ, t}
+		}
+		t := &Table{fields: map[interface{}]Value{}}
+		seen[p] = t
+		ls.PushNil()
+		for ls.Next(idx) {
+			k := copyValue(ls, ls.AbsIndex(-2), seen)
+			t.keys = append(t.keys, k)
+			t.fields[k.v] = copyValue(ls, ls.AbsIndex(-1), seen)
+			ls.Pop(1)
+		}
+		return Value{typ, t}
+	case api.LUA_TUSERDATA, api.LUA_TLIGHTUSERDATA:
+		return Value{typ, ls.ToUserData(idx)}
+	case api.LUA_TNONE:
+		return Value{}
+	}
+	return Value{typ, nil}
+}
+
+// pushes a go value, as SetGlobal describes
+func push(ls api.LuaState, v interface{}) {
+	pushValue(ls, v, map[*Table]int{})
+}
+
+// tables being pushed are in pushing with their stack index, so that
+// cycles stay cycles
+func pushValue(ls api.LuaState, v interface{}, pushing map[*Table]int) {
+	switch x := v.(type) {
+	case nil:
+		ls.PushNil()
+		return
+	case Value:
+		if x.typ == api.LUA_TUSERDATA || x.typ == api.LUA_TLIGHTUSERDATA {
+			ls.NewUserData(x.v)
+		} else if x.typ == api.LUA_TTHREAD || x.typ == api.LUA_TFUNCTION && x.v == nil {
+			ls.PushNil() // not copied
+		} else {
+			pushValue(ls, x.v, pushing)
+		}
+		return
+	case *Table:
+		if idx, ok := pushing[x]; ok {
+			ls.PushValue(idx)
+			return
+		}
+		ls.CreateTable(0, len(x.keys))
+		pushing[x] = ls.GetTop()
+		for _, k := range x.keys {
+			pushValue(ls, k, pushing)
+			pushValue(ls, x.fields[k.v], pushing)
+			ls.RawSet(-3)
+		}
+		delete(pushing, x)
+		return
+	case Function:
+		ls.PushGoFunction(goFunction(x))
+		return
+	case func(args []Value) ([]Value, error):
+		ls.PushGoFunction(goFunction(x))
+		return
+	case api.GoFunction:
+		ls.PushGoFunction(x)
+		return
+	case func(api.LuaState) int:
+		ls.PushGoFunction(x)
+		return
+	case []byte:
+		ls.PushString(string(x))
+		return
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		ls.PushBoolean(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		ls.PushInteger(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		ls.PushInteger(int64(rv.Uint()))
+	case reflect.Float32, reflect.Float64:
+		ls.PushNumber(rv.Float())
+	case reflect.String:
+		ls.PushString(rv.String())
+	case reflect.Slice, reflect.Array:
+		ls.CreateTable(rv.Len(), 0)
+		for i := 0; i < rv.Len(); i++ {
+			pushValue(ls, rv.Index(i).Interface(), pushing)
+			ls.RawSetI(-2, int64(i+1))
+		}
+	case reflect.Map:
+		ls.CreateTable(0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			pushValue(ls, iter.Key().Interface(), pushing)
+			pushValue(ls, iter.Value().Interface(), pushing)
+			ls.RawSet(-3)
+		}
+	default:
+		ls.NewUserData(v)
+	}
+}
+
+// a go function calling f with copies of its arguments
+func goFunction(f Function) api.GoFunction {
+	return func(ls api.LuaState) int {
+		args := make([]Value, ls.GetTop())
+		for i := range args {
+			args[i] = toValue(ls, i+1)
+		}
+		results, err := f(args)
+		if err != nil {
+			ls.PushString(err.Error())
+			return ls.Error()
+		}
+		for _, r := range results {
+			push(ls, r)
+		}
+		return len(results)
+	}
+}
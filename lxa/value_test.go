@@ -0,0 +1,67 @@
+package lxa_test
+
+import (
+	"errors"
+	"lxa/lxa"
+	"strings"
+	"testing"
+)
+
+func TestGlobals(t *testing.T) {
+	vm := lxa.NewVM()
+	vm.SetGlobal("list", []int{10, 20, 30})
+	vm.SetGlobal("half", lxa.Function(func(args []lxa.Value) ([]lxa.Value, error) {
+		if len(args) != 1 {
+			return nil, errors.New("half takes one number")
+		}
+		return []lxa.Value{lxa.ValueOf(args[0].Float() / 2)}, nil
+	}))
+	vm.SetGlobal("pair", lxa.Function(func(args []lxa.Value) ([]lxa.Value, error) {
+		return []lxa.Value{lxa.ValueOf(map[string]interface{}{"first": args[0], "second": []string{"a", "b"}})}, nil
+	}))
+	if err := vm.DoString(`
+		sum := 0
+		for i := 1; i <= #list; i++ { sum += list[i] }
+		p := pair(sum)
+		result = {sum = sum, half = half(sum), first = p.first, second = p.second[2]}
+	`); err != nil {
+		t.Fatal(err)
+	}
+	tbl := vm.Global("result").Table()
+	if tbl == nil {
+		t.Fatal("result is not a table")
+	}
+	if tbl.Get("sum").Int() != 60 || tbl.Get("half").Float() != 30 {
+		t.Errorf("result = {sum = %v, half = %v}, want {sum = 60, half = 30.0}", tbl.Get("sum"), tbl.Get("half"))
+	}
+	if tbl.Get("first").Int() != 60 || tbl.Get("second").String() != "b" {
+		t.Errorf("result = {first = %v, second = %v}, want {first = 60, second = b}", tbl.Get("first"), tbl.Get("second"))
+	}
+	if err := vm.DoString("half()"); err == nil || !strings.Contains(err.Error(), "half takes one number") {
+		t.Errorf("go error = %v, want half takes one number", err)
+	}
+}
+
+func TestValueOf(t *testing.T) {
+	for _, c := range []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, "nil"},
+		{true, "true"},
+		{uint8(7), "7"},
+		{2.0, "2.0"},
+		{[]byte("bytes"), "bytes"},
+		{[]int{1}, "table"},
+		{lxa.Function(nil), "function"},
+		{struct{}{}, "userdata"},
+	} {
+		if got := lxa.ValueOf(c.v).String(); got != c.want {
+			t.Errorf("ValueOf(%#v) = %s, want %s", c.v, got, c.want)
+		}
+	}
+	tbl := lxa.ValueOf(map[interface{}]interface{}{1.0: "one", "two": 2, "none": nil}).Table()
+	if tbl.Get(1).String() != "one" || tbl.Get("two").Int() != 2 || len(tbl.Keys()) != 2 {
+		t.Errorf("ValueOf(map) has keys %v", tbl.Keys())
+	}
+}
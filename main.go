@@ -3,73 +3,151 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"lxa/binchunk"
 	"lxa/compiler"
 	"lxa/runner"
 	"os"
+	"strings"
 )
 
+const version = "Lxa " + compiler.Version + " 2020.04.03 Copyright (C) 2020 xaxys."
+
 var (
-	CLUA     bool
-	GOLUA    bool
-	DEBUG    bool
-	PARSE    bool
-	COMPILE  bool
 	PROGNAME string
+	PRELUDE  []*runner.Chunk // -e and -l, in the order they were given
+	HASCODE  bool            // whether there was a -e
 )
 
+// -e stat
+type codeFlag struct{}
+
+func (codeFlag) String() string { return "" }
+
+func (codeFlag) Set(code string) error {
+	PRELUDE = append(PRELUDE, &runner.Chunk{Name: "(command line)", Reader: strings.NewReader(code)})
+	HASCODE = true
+	return nil
+}
+
+// -l name
+type moduleFlag struct{}
+
+func (moduleFlag) String() string { return "" }
+
+func (moduleFlag) Set(name string) error {
+	PRELUDE = append(PRELUDE, &runner.Chunk{Name: name, Module: name})
+	return nil
+}
+
+type command struct {
+	name  string
+	args  string // what it takes, for the usage line
+	short string
+	run   func(args []string) int
+}
+
+var commands []*command
+
 func init() {
 	PROGNAME = os.Args[0]
-	flag.BoolVar(&COMPILE, "c", false, "compile lxa file to lua bytecode")
-	flag.BoolVar(&DEBUG, "g", false, "enable verbose logging and tracing")
-	flag.BoolVar(&PARSE, "p", false, "parse and print lua bytecode only")
-	flag.BoolVar(&GOLUA, "golua", false, "use inner golua vm for excuting")
-	flag.BoolVar(&CLUA, "clua", false, "use inner official clua 5.3.5 vm for excuting")
-	flag.Parse()
+	commands = []*command{
+		{"run", "[options] [script [args]]", "run a script, the default", cmdRun},
+		{"build", "[-o out] [-target t] files", "compile to lua bytecode, or to lua source", cmdBuild},
+		{"disasm", "[-json] [-target t] files", "list the bytecode of sources or binary chunks", cmdDisasm},
+		{"asm", "[-o out] files", "assemble bytecode listings, as disasm writes them", cmdAsm},
+		{"decompile", "[-o out] files", "write binary chunks, or what sources compile to, back as lxa source", cmdDecompile},
+		{"check", "files", "parse and compile only, reporting errors", cmdCheck},
+		{"fmt", "[-w] [-l] files", "re-indent lxa sources, changing only leading whitespace and blank lines", cmdFmt},
+		{"test", "[-v] [files or dirs]", "run the test functions in *_test.lxa files", cmdTest},
+		{"difftest", "files or dirs", "run .lxa programs on both vms, telling where they differ", cmdDifftest},
+		{"cache", "clean | dir", "remove the compiled chunks kept by run and require, or tell where they are", cmdCache},
+	}
 }
 
 func main() {
 	if len(os.Args) > 1 {
-		for _, filename := range flag.Args() {
-			chunk, err := ioutil.ReadFile(filename)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "reading %s: %s", filename, err)
-			}
-			if PARSE {
-				if binchunk.IsBinaryChunk(chunk) {
-					runner.ParseBinary(chunk)
-				} else {
-					fmt.Fprintf(os.Stderr, "parsinging %s: %s", filename, "is not a lua bytecode file")
-				}
-				continue
+		name := os.Args[1]
+		for _, cmd := range commands {
+			if cmd.name == name {
+				os.Exit(cmd.run(os.Args[2:]))
 			}
-			var data []byte
-			if binchunk.IsBinaryChunk(chunk) {
-				data = chunk
-			} else {
-				proto := compiler.Compile(string(chunk), filename)
-				data = binchunk.Dump(proto)
-			}
-			if COMPILE {
-				ioutil.WriteFile(filename+".luac", data, 0666)
-			} else {
-				if GOLUA && !CLUA || DEBUG {
-					runner.GoRunBinary(data, filename, DEBUG)
-				} else {
-					runner.CRunBinary(data, PROGNAME)
-				}
+		}
+		if name == "help" {
+			usage()
+			os.Exit(0)
+		}
+	}
+	os.Exit(legacy(os.Args[1:]))
+}
+
+// a flag set for a command, whose --help tells its usage and flags
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	for _, cmd := range commands {
+		if cmd := cmd; cmd.name == name {
+			fs.Usage = func() {
+				fmt.Fprintf(fs.Output(), "usage: %s %s %s\n%s\n", PROGNAME, name, cmd.args, cmd.short)
+				fs.PrintDefaults()
 			}
 		}
-	} else {
-		fmt.Println("Oops! No input files given.")
-		fmt.Println("Lxa 0.2.6 2020.04.03 Copyright (C) 2020 xaxys.")
-		fmt.Println("usage:", PROGNAME, "[options] [script]")
-		fmt.Println("avaliable options are:")
-		fmt.Println("  -c    ", "Compile a lxa file to lua bytecode without running")
-		fmt.Println("  -g    ", "Enable verbose logging and tracing (golua vm only)")
-		fmt.Println("  -p    ", "Parse and Print lua bytecode without running")
-		fmt.Println("  -golua", "Use inner golua vm for excuting (several stdlib unsupported yet)")
-		fmt.Println("  -clua ", "Use inner official clua 5.3.5 vm for excuting (default vm)")
 	}
+	return fs
+}
+
+// the flags lxa had before the commands, kept working: -c builds, -p
+// lists, -target lua5x writes lua source, and anything else runs
+func legacy(args []string) int {
+	opts := &runOptions{}
+	var compile, parse bool
+	var target string
+	fs := flag.NewFlagSet(PROGNAME, flag.ExitOnError)
+	fs.Usage = usage
+	opts.flags(fs)
+	fs.BoolVar(&compile, "c", false, "compile lxa file to lua bytecode")
+	fs.BoolVar(&parse, "p", false, "parse and print lua bytecode only")
+	fs.StringVar(&target, "target", "5.3", "lua version of the bytecode compiled with -c (5.3 or 5.4), or lua51, lua53, lua54 for lua source")
+	fs.Parse(args)
+
+	t, ok := parseTarget(target)
+	if !ok {
+		return 1
+	}
+	switch {
+	case t.isSource && !compile: // printed
+		return build(fs.Args(), "-", t)
+	case compile:
+		return build(fs.Args(), "", t)
+	case parse:
+		return disasm(fs.Args(), t, false)
+	case target == "5.4":
+		fmt.Fprintf(os.Stderr, "%s: lua 5.4 bytecode can only be compiled (-c), there is no 5.4 vm to run it\n", PROGNAME)
+		return 1
+	}
+	return opts.run(fs)
+}
+
+func usage() {
+	fmt.Println(version)
+	fmt.Println("usage:", PROGNAME, "<command> [arguments]")
+	fmt.Println("the commands are:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-9s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Println("use", PROGNAME, "<command> --help for more about a command.")
+	fmt.Println()
+	fmt.Println("without a command, lxa runs a script, and still takes the old options:")
+	fmt.Println("usage:", PROGNAME, "[options] [script [args]]")
+	fmt.Println("  -e stat", "Execute string 'stat'")
+	fmt.Println("  -l name", "Require library 'name' into global 'name'")
+	fmt.Println("  -i    ", "Enter interactive mode after running the script (golua vm)")
+	fmt.Println("  -c    ", "Compile a lxa file to lua bytecode without running (lxa build)")
+	fmt.Println("  -g    ", "Enable verbose logging and tracing (golua vm only)")
+	fmt.Println("  -p    ", "Parse and Print lua bytecode without running (lxa disasm)")
+	fmt.Println("  -golua", "Use inner golua vm for excuting (several stdlib unsupported yet)")
+	fmt.Println("  -clua ", "Use inner official clua 5.3.5 vm for excuting (default vm, if built with -tags clua)")
+	fmt.Println("  -target", "Lua version of the bytecode written by -c, 5.3 (default) or 5.4")
+	fmt.Println("         ", "or lua51 (also LuaJIT), lua53, lua54 to write lua source (to script.lua with -c)")
+	fmt.Println("  -no-cache", "Compile the script and required modules again, without the chunk cache")
+	fmt.Println("  -     ", "Stop handling options and execute stdin")
+	fmt.Println("the script gets its arguments in the table arg and as ...")
+	fmt.Println("without a script, lxa starts an interactive session, or runs stdin if it is not a terminal")
 }
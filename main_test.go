@@ -0,0 +1,83 @@
+package main
+
+import (
+	"lxa/runner"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the differential test runs the test binary as lxa, with this set
+const childEnv = "LXA_DIFFTEST_CHILD"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(childEnv) != "" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// every program in testdata/difftest must do the same on both vms
+func TestDiff(t *testing.T) {
+	if !runner.HasClua {
+		t.Skip("the clua vm is not compiled in, test with -tags clua")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := runner.DiffFiles("testdata/difftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(childEnv, "1")
+	defer os.Unsetenv(childEnv)
+	for _, filename := range files {
+		filename := filename
+		t.Run(filename, func(t *testing.T) {
+			c, golua, err := runner.DiffFile(exe, filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := runner.Diff(c, golua); diff != "" {
+				t.Errorf("the vms differ on %s:\n%s", filename, diff)
+			}
+		})
+	}
+}
+
+// what the programs transpile to with -target lua53 must do on the clua
+// vm what they do on golua, but for those using the libraries only
+// golua has, and to-be-closed variables, which only lua54 source has
+func TestTranspile(t *testing.T) {
+	if !runner.HasClua {
+		t.Skip("the clua vm is not compiled in, test with -tags clua")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := runner.DiffFiles("testdata/difftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(childEnv, "1")
+	defer os.Unsetenv(childEnv)
+	for _, filename := range files {
+		filename := filename
+		t.Run(filename, func(t *testing.T) {
+			base := strings.TrimSuffix(filename, ".lxa")
+			if _, err := os.Stat(base + ".out"); err == nil || filepath.Base(base) == "close" {
+				t.Skip("not for lua 5.3")
+			}
+			c, golua, err := runner.DiffLuaFile(exe, filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := runner.Diff(c, golua); diff != "" {
+				t.Errorf("the transpiled source differs on %s:\n%s", filename, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package runner
+
+import (
+	"io"
+	"io/ioutil"
+	"lxa/binchunk"
+	"lxa/cache"
+	"lxa/compiler"
+)
+
+// Chunk is one of the things a command line runs, in order: the chunks
+// given with -e, the modules given with -l, then the script
+type Chunk struct {
+	Name   string    // chunk name, for error messages
+	Reader io.Reader // lxa source or a binary chunk, nil if it couldn't be opened
+	Module string    // require(Module) instead, for -l
+	Args   []string  // the script arguments, passed as ...
+	Cached bool      // compiled through the chunk cache, for files
+}
+
+// reads the chunk as a binary chunk, compiling it if it is source
+func (c *Chunk) binary() ([]byte, error) {
+	data, err := ioutil.ReadAll(c.Reader)
+	if err != nil || binchunk.IsBinaryChunk(data) {
+		return data, err
+	}
+	if c.Cached {
+		return cache.Binary(data, c.Name)
+	}
+	proto, err := compiler.TryCompile(string(data), c.Name)
+	if err != nil {
+		return nil, err
+	}
+	return binchunk.Dump(proto), nil
+}
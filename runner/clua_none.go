@@ -0,0 +1,19 @@
+//go:build !clua
+// +build !clua
+
+package runner
+
+import (
+	"fmt"
+	"os"
+)
+
+// HasClua tells whether the official c vm is compiled in, which takes
+// the clua build tag (and cgo)
+const HasClua = false
+
+// CRun only tells that the c vm is not compiled in
+func CRun(chunks []*Chunk, argv []string, script int) int {
+	fmt.Fprintf(os.Stderr, "%s: the clua vm is not compiled in (build lxa with -tags clua)\n", argv[0])
+	return 1
+}
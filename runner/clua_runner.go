@@ -1,3 +1,6 @@
+//go:build clua
+// +build clua
+
 package runner
 
 /*
@@ -57,7 +60,7 @@ static int report (lua_State *L, int status) {
 	return status;
 }
 
-void run_binaryscript (const char *s, const int len, const char *pname) {
+static lua_State *new_state (const char *pname) {
 #ifdef _WIN32
 	SetConsoleOutputCP(65001); // utf8 output support
 #endif
@@ -65,28 +68,135 @@ void run_binaryscript (const char *s, const int len, const char *pname) {
 	lua_State *L = luaL_newstate();
 	if (L == NULL) {
 		l_message(progname, "cannot create state: not enough memory");
+		return NULL;
 	}
 	luaL_openlibs(L);
+	return L;
+}
+
+// arg[0] is the script, arg[1..n] its arguments, and the interpreter
+// with its options go to negative indices
+static void create_arg_table (lua_State *L, char **argv, int argc, int script) {
+	int i;
+	lua_createtable(L, argc - script - 1, script + 1);
+	for (i = 0; i < argc; i++) {
+		lua_pushstring(L, argv[i]);
+		lua_rawseti(L, -2, i - script);
+	}
+	lua_setglobal(L, "arg");
+}
+
+// Runs a binary chunk with the message handler, passing it its
+// arguments as ...
+static int run_chunk (lua_State *L, const char *s, int len, const char *name, char **args, int nargs) {
+	int i, status;
+	int base = lua_gettop(L) + 1;
+	lua_pushcfunction(L, msghandler);
+	status = luaL_loadbuffer(L, s, len, name);
+	if (status == LUA_OK) {
+		for (i = 0; i < nargs; i++) {
+			lua_pushstring(L, args[i]);
+		}
+		status = lua_pcall(L, nargs, LUA_MULTRET, base);
+	}
+	report(L, status);
+	lua_settop(L, base - 1);
+	return status;
+}
+
+// Calls 'require(name)' and stores the result in a global variable
+// with the given name.
+static int require_module (lua_State *L, const char *name) {
+	int status;
+	int base = lua_gettop(L) + 1;
 	lua_pushcfunction(L, msghandler);
-	int status = luaL_loadbuffer(L, s, len, s);
+	lua_getglobal(L, "require");
+	lua_pushstring(L, name);
+	status = lua_pcall(L, 1, 1, base);
 	if (status == LUA_OK) {
-		status = lua_pcall(L, 0, LUA_MULTRET, 0);
+		lua_setglobal(L, name);
 	}
 	report(L, status);
-	lua_close(L);
+	lua_settop(L, base - 1);
+	return status;
 }
 */
 import "C"
 import (
+	"fmt"
+	"os"
 	"unsafe"
 )
 
-func CRunBinary(b []byte, name string) {
-	len := C.int(len(b))
-	data := *(*string)(unsafe.Pointer(&b))
-	cdata := C.CString(data)
-	pname := C.CString(name)
-	defer C.free(unsafe.Pointer(cdata))
+// HasClua tells whether the official c vm is compiled in, which takes
+// the clua build tag (and cgo)
+const HasClua = true
+
+// CRun runs the chunks in order on the official c vm, stopping at the
+// first that fails, and returns the exit status like GoRun
+func CRun(chunks []*Chunk, argv []string, script int) int {
+	pname := C.CString(argv[0])
 	defer C.free(unsafe.Pointer(pname))
-	C.run_binaryscript(cdata, len, pname)
+	L := C.new_state(pname)
+	if L == nil {
+		return 1
+	}
+	defer C.lua_close(L)
+
+	cargv, free := cStrings(argv)
+	C.create_arg_table(L, cargv, C.int(len(argv)), C.int(script))
+	free()
+
+	for _, c := range chunks {
+		if c.Module != "" {
+			name := C.CString(c.Module)
+			status := C.require_module(L, name)
+			C.free(unsafe.Pointer(name))
+			if status != C.LUA_OK {
+				return 1
+			}
+			continue
+		}
+		if c.Reader == nil {
+			fmt.Fprintf(os.Stderr, "%s: cannot open %s\n", argv[0], c.Name)
+			return 1
+		}
+		data, err := c.binary()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Syntax Error Occurred:")
+			fmt.Fprintln(os.Stderr, "Error @", err)
+			return 1
+		}
+		if cRunChunk(L, data, c.Name, c.Args) != C.LUA_OK {
+			return 1
+		}
+	}
+	return 0
+}
+
+func cRunChunk(L *C.lua_State, data []byte, name string, args []string) C.int {
+	cdata := C.CBytes(data)
+	cname := C.CString("@" + name)
+	cargs, free := cStrings(args)
+	defer C.free(cdata)
+	defer C.free(unsafe.Pointer(cname))
+	defer free()
+	return C.run_chunk(L, (*C.char)(cdata), C.int(len(data)), cname, cargs, C.int(len(args)))
+}
+
+// a C array of C strings, and a function to free them
+func cStrings(list []string) (**C.char, func()) {
+	ptrSize := unsafe.Sizeof((*C.char)(nil))
+	array := (**C.char)(C.malloc(C.size_t(len(list)+1) * C.size_t(ptrSize)))
+	strs := (*[1 << 28]*C.char)(unsafe.Pointer(array))[: len(list)+1 : len(list)+1]
+	for i, s := range list {
+		strs[i] = C.CString(s)
+	}
+	strs[len(list)] = nil
+	return array, func() {
+		for _, p := range strs {
+			C.free(unsafe.Pointer(p))
+		}
+		C.free(unsafe.Pointer(array))
+	}
 }
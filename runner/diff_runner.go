@@ -0,0 +1,278 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"lxa/binchunk"
+	"lxa/compiler"
+	"lxa/compiler/transpiler"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiffTimeout bounds each run of a program in a differential test
+var DiffTimeout = 10 * time.Second
+
+// RunResult is what running a program on one vm left behind
+type RunResult struct {
+	VM     string // clua, golua, or the .out file it is to match
+	Stdout string
+	Stderr string
+	Status int
+}
+
+// the addresses in "table: 0x..." differ from vm to vm, and from run to run
+var addrPattern = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+
+// the clua vm appends a traceback to runtime errors, golua doesn't
+func (r *RunResult) normalize() {
+	r.Stdout = addrPattern.ReplaceAllString(r.Stdout, "0x?")
+	if i := strings.Index(r.Stderr, "stack traceback:"); i >= 0 {
+		r.Stderr = strings.TrimRight(r.Stderr[:i], "\n") + "\n"
+	}
+	r.Stderr = addrPattern.ReplaceAllString(r.Stderr, "0x?")
+}
+
+// DiffFile compiles the file once and runs the binary chunk with exe (a
+// lxa binary) on the clua vm and on the golua vm, returning both results.
+// err is set if the file doesn't compile or exe can't be run. A program
+// that is not to compile has the error it gives in a .err file next to
+// it, without its directory; it runs on neither vm and has no results.
+// A program using the libraries only golua has (json, fs, regex) has
+// what it prints in a .out file next to it, which stands for clua.
+func DiffFile(exe, filename string) (c, golua *RunResult, err error) {
+	data, err := compileFile(filename)
+	if err != nil {
+		return nil, nil, expectedError(filename, err)
+	}
+	base := strings.TrimSuffix(filename, ".lxa")
+	if out, err := ioutil.ReadFile(base + ".out"); err == nil {
+		c = &RunResult{VM: filepath.Base(base) + ".out", Stdout: string(out)}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	tmp, err := writeTemp("lxa-difftest-*.luac", data)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(tmp)
+	if c == nil {
+		if c, err = runVM(exe, "-clua", tmp, filename); err != nil {
+			return nil, nil, err
+		}
+	}
+	if golua, err = runVM(exe, "-golua", tmp, filename); err != nil {
+		return nil, nil, err
+	}
+	return c, golua, nil
+}
+
+// the lines of the transpiled source are not those of the file, which
+// has comments
+var linePattern = regexp.MustCompile(`(\.lxa):[0-9]+:`)
+
+// DiffLuaFile transpiles the file to lua 5.3 source and runs it with exe
+// on the clua vm, through dofile, and the file compiled on the golua vm,
+// returning both results with the lines in messages left out. err is
+// set if the file doesn't transpile, or compile, or exe can't be run.
+func DiffLuaFile(exe, filename string) (c, golua *RunResult, err error) {
+	chunk, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := compiler.TryTranspile(string(chunk), filename, transpiler.LUA53)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := compileFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	luaFile, err := writeTemp("lxa-difftest-*.lua", []byte(src))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(luaFile)
+	luacFile, err := writeTemp("lxa-difftest-*.luac", data)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(luacFile)
+	if c, err = runLxa(exe, "clua", luaFile, filename, "run", "-clua", "-e", "dofile("+strconv.Quote(luaFile)+")"); err != nil {
+		return nil, nil, err
+	}
+	if golua, err = runVM(exe, "-golua", luacFile, filename); err != nil {
+		return nil, nil, err
+	}
+	for _, r := range []*RunResult{c, golua} {
+		r.Stdout = linePattern.ReplaceAllString(r.Stdout, "$1:?:")
+		r.Stderr = linePattern.ReplaceAllString(r.Stderr, "$1:?:")
+	}
+	return c, golua, nil
+}
+
+// writes data to a new temporary file, returning its name
+func writeTemp(pattern string, data []byte) (string, error) {
+	tmp, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func compileFile(filename string) ([]byte, error) {
+	chunk, err := ioutil.ReadFile(filename)
+	if err != nil || binchunk.IsBinaryChunk(chunk) {
+		return chunk, err
+	}
+	proto, err := compiler.TryCompile(string(chunk), filename)
+	if err != nil {
+		return nil, err
+	}
+	return binchunk.Dump(proto), nil
+}
+
+// nil if the compile error is the one the .err file of the program has
+func expectedError(filename string, err error) error {
+	want, rerr := ioutil.ReadFile(strings.TrimSuffix(filename, ".lxa") + ".err")
+	if rerr != nil {
+		return err
+	}
+	got := strings.Replace(err.Error(), filename, filepath.Base(filename), 1)
+	if got != strings.TrimSpace(string(want)) {
+		return fmt.Errorf("compile error:\n\twant: %s\n\tgot:  %s", strings.TrimSpace(string(want)), got)
+	}
+	return nil
+}
+
+// runs `lxa run vm chunk` with no stdin, calling itself lxa and the
+// chunk by its source name, so that messages don't depend on the paths
+func runVM(exe, vm, chunk, name string) (*RunResult, error) {
+	return runLxa(exe, vm[1:], chunk, name, "run", vm, chunk)
+}
+
+// runs exe with args as runVM does, on vm
+func runLxa(exe, vm, chunk, name string, args ...string) (*RunResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DiffTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Args[0] = "lxa"
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%s: timed out on %s after %s", name, vm, DiffTimeout)
+	}
+	r := &RunResult{VM: vm, Stdout: stdout.String(), Stderr: stderr.String()}
+	if exit, ok := err.(*exec.ExitError); ok {
+		r.Status = exit.ExitCode()
+	} else if err != nil {
+		return nil, err
+	}
+	r.Stdout = strings.Replace(r.Stdout, chunk, name, -1)
+	r.Stderr = strings.Replace(r.Stderr, chunk, name, -1)
+	r.normalize()
+	return r, nil
+}
+
+// Diff tells how the results of the two vms differ, "" if they don't
+// or if neither ran
+func Diff(c, golua *RunResult) string {
+	if c == nil && golua == nil {
+		return ""
+	}
+	var b strings.Builder
+	if c.Status != golua.Status {
+		fmt.Fprintf(&b, "exit status: %s %d, %s %d\n", c.VM, c.Status, golua.VM, golua.Status)
+	}
+	diffOutput(&b, "stdout", c, golua, c.Stdout, golua.Stdout)
+	diffOutput(&b, "stderr", c, golua, c.Stderr, golua.Stderr)
+	return b.String()
+}
+
+// the first line where the outputs differ
+func diffOutput(b *strings.Builder, what string, c, golua *RunResult, cOut, gOut string) {
+	if cOut == gOut {
+		return
+	}
+	cl, gl := strings.Split(cOut, "\n"), strings.Split(gOut, "\n")
+	width := len(c.VM)
+	if len(golua.VM) > width {
+		width = len(golua.VM)
+	}
+	for i := 0; ; i++ {
+		if i < len(cl) && i < len(gl) && cl[i] == gl[i] {
+			continue
+		}
+		fmt.Fprintf(b, "%s line %d:\n", what, i+1)
+		fmt.Fprintf(b, "\t%-*s %s\n", width+1, c.VM+":", lineAt(cl, i))
+		fmt.Fprintf(b, "\t%-*s %s\n", width+1, golua.VM+":", lineAt(gl, i))
+		return
+	}
+}
+
+func lineAt(lines []string, i int) string {
+	if i >= len(lines) {
+		return "(end of output)"
+	}
+	return fmt.Sprintf("%q", lines[i])
+}
+
+// DiffTest runs every file with DiffFile, telling for each whether both
+// vms agreed, and how they didn't. It returns the exit status: 0 if they
+// agreed on every file, or 1.
+func DiffTest(exe string, filenames []string) int {
+	status := 0
+	for _, filename := range filenames {
+		start := time.Now()
+		c, golua, err := DiffFile(exe, filename)
+		diff := ""
+		if err != nil {
+			diff = err.Error() + "\n"
+		} else {
+			diff = Diff(c, golua)
+		}
+		if diff == "" {
+			fmt.Printf("ok  \t%s\t%.3fs\n", filename, time.Since(start).Seconds())
+			continue
+		}
+		fmt.Printf("FAIL\t%s\t%.3fs\n", filename, time.Since(start).Seconds())
+		for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+		status = 1
+	}
+	return status
+}
+
+// DiffFiles lists the .lxa files in dir and below, sorted, or dir itself
+// if it is a file
+func DiffFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (p == dir || filepath.Ext(p) == ".lxa") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
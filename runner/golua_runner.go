@@ -1,12 +1,89 @@
 package runner
 
 import (
+	"bytes"
+	"fmt"
+	"lxa/api"
 	"lxa/state"
+	"os"
 )
 
-func GoRunBinary(b []byte, name string, debug bool) {
+// GoRun runs the chunks in order on one golua state, stopping at the
+// first that fails. With interactive set, the repl takes over the state
+// afterwards. It returns the exit status: 0, or 1 after an error.
+func GoRun(chunks []*Chunk, argv []string, script int, debug, interactive bool) int {
 	ls := state.NewState(debug)
 	ls.OpenLibs()
-	ls.Load(b, name, "b")
-	ls.Call(0, -1)
+	createArgTable(ls, argv, script)
+	for _, c := range chunks {
+		if !goRunChunk(ls, c, argv[0]) {
+			return 1
+		}
+	}
+	if interactive {
+		GoRunREPL(ls, debug)
+	}
+	return 0
+}
+
+func goRunChunk(ls api.LuaState, c *Chunk, progname string) bool {
+	if c.Module != "" { // require(Module), as lua.c#dolibrary
+		ls.GetGlobal("require")
+		ls.PushString(c.Module)
+		if ls.PCall(1, 1, 0) != api.LUA_OK {
+			return report(ls, progname)
+		}
+		ls.SetGlobal(c.Module)
+		return true
+	}
+	if c.Reader == nil {
+		fmt.Fprintf(os.Stderr, "%s: cannot open %s\n", progname, c.Name)
+		return false
+	}
+	r := c.Reader
+	if c.Cached {
+		data, err := c.binary()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Syntax Error Occurred:")
+			fmt.Fprintln(os.Stderr, "Error @", err)
+			return false
+		}
+		r = bytes.NewReader(data)
+	}
+	switch ls.LoadReader(r, c.Name, "bt") {
+	case api.LUA_OK:
+	case api.LUA_ERRSYNTAX:
+		fmt.Fprintln(os.Stderr, "Syntax Error Occurred:")
+		fmt.Fprintln(os.Stderr, "Error @", ls.ToString(-1))
+		return false
+	default:
+		return report(ls, progname)
+	}
+	for _, arg := range c.Args {
+		ls.PushString(arg)
+	}
+	if ls.PCall(len(c.Args), api.LUA_MULTRET, 0) != api.LUA_OK {
+		return report(ls, progname)
+	}
+	ls.SetTop(0)
+	return true
+}
+
+// prints the error on top of the stack, returning false
+func report(ls api.LuaState, progname string) bool {
+	fmt.Fprintf(os.Stderr, "%s: %s\n", progname, ls.ToString2(-1))
+	ls.SetTop(0)
+	return false
+}
+
+// arg[0] is the script, arg[1..n] its arguments, and the interpreter
+// with its options go to negative indices
+// lua-5.3.4/src/lua.c#createargtable()
+func createArgTable(ls api.LuaState, argv []string, script int) {
+	ls.CreateTable(len(argv)-script-1, script+1)
+	for i, arg := range argv {
+		ls.PushString(arg)
+		ls.RawSetI(-2, int64(i-script))
+	}
+	ls.SetGlobal("arg")
 }
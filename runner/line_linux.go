@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package runner
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// edits lines on a terminal switched to raw mode: arrow keys move the
+// cursor and walk the history, Ctrl-A/E jump to either end, Ctrl-K/U
+// cut after/before the cursor, Ctrl-C drops the line, Ctrl-D leaves
+type termReader struct {
+	in      *bufio.Reader
+	old     syscall.Termios
+	history *[]string
+}
+
+func newLineReader(history *[]string) lineReader {
+	var old syscall.Termios
+	if ioctl(0, syscall.TCGETS, &old) != nil {
+		return newPlainReader()
+	}
+	return &termReader{in: bufio.NewReader(os.Stdin), old: old, history: history}
+}
+
+// StdinIsTerminal tells whether stdin is a terminal rather than a file
+// or a pipe
+func StdinIsTerminal() bool {
+	var t syscall.Termios
+	return ioctl(0, syscall.TCGETS, &t) == nil
+}
+
+func ioctl(fd, req uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cfmakeraw, but output processing is kept for "\n"
+func (t *termReader) rawMode() {
+	raw := t.old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	ioctl(0, syscall.TCSETS, &raw)
+}
+
+func (t *termReader) Close() error {
+	return ioctl(0, syscall.TCSETS, &t.old)
+}
+
+func (t *termReader) ReadLine(prompt string) (string, error) {
+	t.rawMode()
+	defer ioctl(0, syscall.TCSETS, &t.old)
+
+	var line []rune
+	pos := 0
+	hist := len(*t.history) // the line being typed is one past the history
+	saved := ""             // which it is saved as while walking the history
+
+	refresh := func() {
+		os.Stdout.WriteString("\r\x1b[K" + prompt + string(line))
+		if n := len(line) - pos; n > 0 {
+			os.Stdout.WriteString("\x1b[" + strconv.Itoa(n) + "D")
+		}
+	}
+	setLine := func(s string) {
+		line = []rune(s)
+		pos = len(line)
+		refresh()
+	}
+
+	os.Stdout.WriteString(prompt)
+	for {
+		r, _, err := t.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				break
+			}
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			os.Stdout.WriteString("\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			os.Stdout.WriteString("^C\r\n")
+			line, pos = line[:0], 0
+			os.Stdout.WriteString(prompt)
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+				refresh()
+			}
+		case 127, 8: // backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+				refresh()
+			}
+		case 1: // Ctrl-A
+			pos = 0
+			refresh()
+		case 5: // Ctrl-E
+			pos = len(line)
+			refresh()
+		case 11: // Ctrl-K
+			line = line[:pos]
+			refresh()
+		case 21: // Ctrl-U
+			line = append(line[:0], line[pos:]...)
+			pos = 0
+			refresh()
+		case 12: // Ctrl-L
+			os.Stdout.WriteString("\x1b[H\x1b[2J")
+			refresh()
+		case 27: // escape sequence
+			seq := t.escape()
+			switch seq {
+			case "[A", "OA": // up
+				if hist > 0 {
+					if hist == len(*t.history) {
+						saved = string(line)
+					}
+					hist--
+					setLine((*t.history)[hist])
+				}
+			case "[B", "OB": // down
+				if hist < len(*t.history) {
+					hist++
+					if hist == len(*t.history) {
+						setLine(saved)
+					} else {
+						setLine((*t.history)[hist])
+					}
+				}
+			case "[C", "OC": // right
+				if pos < len(line) {
+					pos++
+					refresh()
+				}
+			case "[D", "OD": // left
+				if pos > 0 {
+					pos--
+					refresh()
+				}
+			case "[H", "OH", "[1~", "[7~": // home
+				pos = 0
+				refresh()
+			case "[F", "OF", "[4~", "[8~": // end
+				pos = len(line)
+				refresh()
+			case "[3~": // delete
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+					refresh()
+				}
+			}
+		default:
+			if r == '\t' {
+				r = ' '
+			}
+			if r < 0x20 {
+				continue
+			}
+			line = append(line, 0)
+			copy(line[pos+1:], line[pos:])
+			line[pos] = r
+			pos++
+			refresh()
+		}
+	}
+	os.Stdout.WriteString("\r\n")
+	return string(line), nil
+}
+
+// the rest of an escape sequence, such as "[A" for the up arrow
+func (t *termReader) escape() string {
+	b, err := t.in.ReadByte()
+	if err != nil || b != '[' && b != 'O' {
+		return ""
+	}
+	seq := []byte{b}
+	for {
+		c, err := t.in.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7E { // final byte
+			return string(seq)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package runner
+
+func newLineReader(history *[]string) lineReader {
+	return newPlainReader()
+}
+
+// StdinIsTerminal can't tell here, and says yes so that lxa without a
+// script still starts the repl
+func StdinIsTerminal() bool {
+	return true
+}
@@ -0,0 +1,30 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// reads stdin as it is, when it is not a terminal
+type plainReader struct {
+	r *bufio.Reader
+}
+
+func newPlainReader() *plainReader {
+	return &plainReader{r: bufio.NewReader(os.Stdin)}
+}
+
+func (p *plainReader) ReadLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := p.r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (p *plainReader) Close() error {
+	return nil
+}
@@ -1,68 +1,394 @@
 package runner
 
 import (
+	"encoding/json"
 	"fmt"
 	"lxa/binchunk"
 	"lxa/vm"
+	"math"
+	"strconv"
+	"strings"
 )
 
+// ParseBinary lists a binary chunk the way `luac -l -l` does: every
+// function with its code, constants, locals and upvalues, the nested
+// ones after the function they are in. Lua 5.4 chunks are listed as
+// luac 5.4 does.
 func ParseBinary(chunk []byte) {
-	proto := binchunk.Undump(chunk)
-	fmt.Println("Source:", proto.Source)
-	fmt.Println()
-
-	params := uint8(proto.NumParams)
-	isVararg := bool(proto.IsVararg == 0)
-	slots := uint8(proto.MaxStackSize)
-	upvals := len(proto.Upvalues) - 1
-	locals := len(proto.LocVars)
-	constants := len(proto.Constants) - 1
-	functions := len(proto.Protos)
-	fmt.Println(params, "params,", "Vararg[", isVararg, "],", slots, "slots,", upvals, "upvalue,", locals, "locals,", constants, "constants", functions, "functions")
-	fmt.Println()
-
-	for i, code := range proto.Code {
-		inst := vm.Instruction(code)
-		switch inst.OpMode() {
-		case vm.IABC:
-			a, b, c := inst.ABC()
-			fmt.Println("vm @", i, inst.OpName(), "A =", a, "B =", b, "C =", c)
-		case vm.IABx:
-			a, bx := inst.ABx()
-			if inst.Opcode() == vm.OP_LOADK {
-				fmt.Println("vm @", i, inst.OpName(), "A =", a, "BX =", bx, "		;", proto.Constants[bx])
-			} else {
-				fmt.Println("vm @", i, inst.OpName(), "A =", a, "BX =", bx)
+	printFunction(chunkListing(chunk))
+}
+
+// ParseBinaryJSON lists a binary chunk like ParseBinary, as json
+func ParseBinaryJSON(chunk []byte) {
+	data, _ := json.MarshalIndent(chunkListing(chunk), "", "  ")
+	fmt.Println(string(data))
+}
+
+func chunkListing(chunk []byte) *listing {
+	if binchunk.Version(chunk) == binchunk.LUAC_VERSION_54 {
+		return newListing54(binchunk.Undump54(chunk))
+	}
+	return newListing(binchunk.Undump(chunk))
+}
+
+type listing struct {
+	proto           *binchunk.Prototype
+	Source          string        `json:"source"`
+	LineDefined     int           `json:"linedefined"`
+	LastLineDefined int           `json:"lastlinedefined"`
+	NumParams       int           `json:"numparams"`
+	IsVararg        bool          `json:"is_vararg"`
+	MaxStackSize    int           `json:"maxstacksize"`
+	Code            []instListing `json:"code"`
+	Constants       []constant    `json:"constants"`
+	Locals          []local       `json:"locals"`
+	Upvalues        []upvalue     `json:"upvalues"`
+	Functions       []*listing    `json:"functions"`
+}
+
+type instListing struct {
+	PC       int    `json:"pc"`   // from 1, as luac counts
+	Line     int    `json:"line"` // 0 if unknown
+	Op       string `json:"op"`
+	Args     []int  `json:"args"`               // constants are -1, -2, ... but for lua 5.4
+	K        bool   `json:"k,omitempty"`        // lua 5.4's k flag, when luac prints it as a k after them
+	Comment  string `json:"comment,omitempty"`  // luac's, but for closures
+	Target   int    `json:"target,omitempty"`   // pc a jump goes to
+	Function *int   `json:"function,omitempty"` // nested function a closure makes
+}
+
+type constant struct {
+	Type  string      `json:"type"` // nil, boolean, integer, number or string
+	Value interface{} `json:"value"`
+}
+
+type local struct {
+	Name    string `json:"name"`
+	StartPC int    `json:"startpc"`
+	EndPC   int    `json:"endpc"`
+}
+
+type upvalue struct {
+	Name    string `json:"name"`
+	Instack int    `json:"instack"`
+	Idx     int    `json:"idx"`
+}
+
+func newListing(f *binchunk.Prototype) *listing {
+	l := newFuncListing(f)
+	for pc := 0; pc < len(f.Code); pc++ {
+		inst := listInstruction(f, pc)
+		if inst.Op == "SETLIST" && inst.Args[2] == 0 { // the count is in the next word
+			pc++
+		}
+		l.Code = append(l.Code, inst)
+	}
+	for _, p := range f.Protos {
+		l.Functions = append(l.Functions, newListing(p))
+	}
+	return l
+}
+
+// the listing of a function but for its code and nested functions
+func newFuncListing(f *binchunk.Prototype) *listing {
+	l := &listing{
+		proto:           f,
+		Source:          sourceName(f.Source),
+		LineDefined:     int(f.LineDefined),
+		LastLineDefined: int(f.LastLineDefined),
+		NumParams:       int(f.NumParams),
+		IsVararg:        f.IsVararg != 0,
+		MaxStackSize:    int(f.MaxStackSize),
+		Code:            []instListing{},
+		Constants:       []constant{},
+		Locals:          []local{},
+		Upvalues:        []upvalue{},
+		Functions:       []*listing{},
+	}
+	for _, k := range f.Constants {
+		l.Constants = append(l.Constants, constant{constantType(k), k})
+	}
+	for _, v := range f.LocVars {
+		l.Locals = append(l.Locals, local{v.VarName, int(v.StartPC) + 1, int(v.EndPC) + 1})
+	}
+	for i, u := range f.Upvalues {
+		l.Upvalues = append(l.Upvalues, upvalue{upvalName(f, i), int(u.Instack), int(u.Idx)})
+	}
+	return l
+}
+
+// lua-5.3.4/src/luac.c#PrintCode()
+func listInstruction(f *binchunk.Prototype, pc int) instListing {
+	i := vm.Instruction(f.Code[pc])
+	op := i.Opcode()
+	a, b, c := i.ABC()
+	_, bx := i.ABx()
+	_, sbx := i.AsBx()
+	ax := i.Ax()
+	inst := instListing{PC: pc + 1, Op: strings.TrimSpace(i.OpName())}
+	if pc < len(f.LineInfo) {
+		inst.Line = int(f.LineInfo[pc])
+	}
+
+	switch i.OpMode() {
+	case vm.IABC:
+		inst.Args = []int{a}
+		if i.BMode() != vm.OpArgN {
+			inst.Args = append(inst.Args, rk(b))
+		}
+		if i.CMode() != vm.OpArgN {
+			inst.Args = append(inst.Args, rk(c))
+		}
+	case vm.IABx:
+		inst.Args = []int{a}
+		if i.BMode() == vm.OpArgK {
+			inst.Args = append(inst.Args, -1-bx)
+		}
+		if i.BMode() == vm.OpArgU {
+			inst.Args = append(inst.Args, bx)
+		}
+	case vm.IAsBx:
+		inst.Args = []int{a, sbx}
+	case vm.IAx:
+		inst.Args = []int{-1 - ax}
+	}
+
+	switch op {
+	case vm.OP_LOADK:
+		inst.Comment = constantString(f, bx)
+	case vm.OP_GETUPVAL, vm.OP_SETUPVAL:
+		inst.Comment = upvalName(f, b)
+	case vm.OP_GETTABUP:
+		inst.Comment = upvalName(f, b)
+		if isK(c) {
+			inst.Comment += " " + constantString(f, c&0xFF)
+		}
+	case vm.OP_SETTABUP:
+		inst.Comment = upvalName(f, a)
+		if isK(b) {
+			inst.Comment += " " + constantString(f, b&0xFF)
+		}
+		if isK(c) {
+			inst.Comment += " " + constantString(f, c&0xFF)
+		}
+	case vm.OP_GETTABLE, vm.OP_SELF:
+		if isK(c) {
+			inst.Comment = constantString(f, c&0xFF)
+		}
+	case vm.OP_SETTABLE, vm.OP_ADD, vm.OP_SUB, vm.OP_MUL, vm.OP_MOD, vm.OP_POW,
+		vm.OP_DIV, vm.OP_IDIV, vm.OP_BAND, vm.OP_BOR, vm.OP_BXOR, vm.OP_SHL, vm.OP_SHR,
+		vm.OP_EQ, vm.OP_LT, vm.OP_LE:
+		if isK(b) || isK(c) {
+			x, y := "-", "-"
+			if isK(b) {
+				x = constantString(f, b&0xFF)
 			}
-		case vm.IAsBx:
-			a, sbx := inst.AsBx()
-			if inst.Opcode() == vm.OP_JMP {
-				fmt.Println("vm @", i, inst.OpName(), "A =", a, "SBX =", sbx, "		;", "to", i+sbx+1)
-			} else {
-				fmt.Println("vm @", i, inst.OpName(), "A =", a, "SBX =", sbx)
+			if isK(c) {
+				y = constantString(f, c&0xFF)
 			}
-		case vm.IAx:
-			ax := inst.Ax()
-			fmt.Println("vm @", i, inst.OpName(), "AX =", ax)
+			inst.Comment = x + " " + y
 		}
+	case vm.OP_JMP, vm.OP_FORLOOP, vm.OP_FORPREP, vm.OP_TFORLOOP:
+		inst.Target = sbx + pc + 2
+		inst.Comment = "to " + strconv.Itoa(inst.Target)
+	case vm.OP_CLOSURE:
+		inst.Function = &bx
+	case vm.OP_SETLIST:
+		if c == 0 && pc+1 < len(f.Code) {
+			inst.Comment = strconv.Itoa(int(f.Code[pc+1]))
+		} else {
+			inst.Comment = strconv.Itoa(c)
+		}
+	case vm.OP_EXTRAARG:
+		inst.Comment = constantString(f, ax)
 	}
-	fmt.Println()
+	return inst
+}
 
-	fmt.Println(constants, "Constants:")
-	for i := 1; i <= constants; i++ {
-		fmt.Println("[", i, "]", proto.Constants[i])
+// lua-5.3.4/src/luac.c#PrintFunction()
+func printFunction(l *listing) {
+	f := l.proto
+	kind := "function"
+	if f.LineDefined == 0 {
+		kind = "main"
+	}
+	fmt.Printf("\n%s <%s:%d,%d> (%d instruction%s at %p)\n",
+		kind, l.Source, l.LineDefined, l.LastLineDefined, len(f.Code), plural(len(f.Code)), f)
+	vararg := ""
+	if l.IsVararg {
+		vararg = "+"
 	}
-	fmt.Println()
+	fmt.Printf("%d%s param%s, %d slot%s, %d upvalue%s, ",
+		l.NumParams, vararg, plural(l.NumParams), l.MaxStackSize, plural(l.MaxStackSize),
+		len(l.Upvalues), plural(len(l.Upvalues)))
+	fmt.Printf("%d local%s, %d constant%s, %d function%s\n",
+		len(l.Locals), plural(len(l.Locals)), len(l.Constants), plural(len(l.Constants)),
+		len(l.Functions), plural(len(l.Functions)))
 
-	fmt.Println(locals, "Locals:")
-	for i := 0; i < locals; i++ {
-		fmt.Println("[", i, "]", proto.LocVars[i])
+	for _, inst := range l.Code {
+		line := "-"
+		if inst.Line > 0 {
+			line = strconv.Itoa(inst.Line)
+		}
+		args := make([]string, len(inst.Args))
+		for i, arg := range inst.Args {
+			args[i] = strconv.Itoa(arg)
+		}
+		if inst.K {
+			args[len(args)-1] += "k"
+		}
+		fmt.Printf("\t%d\t[%s]\t%-9s\t%s", inst.PC, line, inst.Op, strings.Join(args, " "))
+		if inst.Function != nil {
+			fmt.Printf("\t; %p", f.Protos[*inst.Function])
+		} else if inst.Comment != "" {
+			fmt.Printf("\t; %s", inst.Comment)
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("constants (%d) for %p:\n", len(l.Constants), f)
+	for i := range l.Constants {
+		fmt.Printf("\t%d\t%s\n", i+1, constantString(f, i))
+	}
+	fmt.Printf("locals (%d) for %p:\n", len(l.Locals), f)
+	for i, v := range l.Locals {
+		fmt.Printf("\t%d\t%s\t%d\t%d\n", i, v.Name, v.StartPC, v.EndPC)
+	}
+	fmt.Printf("upvalues (%d) for %p:\n", len(l.Upvalues), f)
+	for i, u := range l.Upvalues {
+		fmt.Printf("\t%d\t%s\t%d\t%d\n", i, u.Name, u.Instack, u.Idx)
 	}
-	fmt.Println()
 
-	fmt.Println(upvals, "Upvalues:")
-	for i := 1; i <= upvals; i++ {
-		fmt.Println("[", i, "]", proto.Upvalues[i])
+	for _, sub := range l.Functions {
+		printFunction(sub)
+	}
+}
+
+// lua-5.3.4/src/luac.c#PrintHeader()
+func sourceName(source string) string {
+	switch {
+	case source == "":
+		return "?"
+	case source[0] == '@' || source[0] == '=':
+		return source[1:]
+	case source[0] == binchunk.LUA_SIGNATURE[0]:
+		return "(bstring)"
+	default:
+		return "(string)"
+	}
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+func isK(x int) bool {
+	return x&0x100 != 0
+}
+
+// a register, or -1-index for a constant
+func rk(x int) int {
+	if isK(x) {
+		return -1 - x&0xFF
+	}
+	return x
+}
+
+func upvalName(f *binchunk.Prototype, i int) string {
+	if i < len(f.UpvalueNames) && f.UpvalueNames[i] != "" {
+		return f.UpvalueNames[i]
+	}
+	return "-"
+}
+
+func constantType(k interface{}) string {
+	switch k.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	default:
+		return "?"
+	}
+}
+
+// lua-5.3.4/src/luac.c#PrintConstant()
+func constantString(f *binchunk.Prototype, i int) string {
+	if i >= len(f.Constants) {
+		return "?"
+	}
+	switch k := f.Constants[i].(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(k)
+	case int64:
+		return strconv.FormatInt(k, 10)
+	case float64:
+		switch {
+		case math.IsInf(k, 1):
+			return "inf"
+		case math.IsInf(k, -1):
+			return "-inf"
+		case math.IsNaN(k):
+			return "nan"
+		}
+		s := fmt.Sprintf("%.14g", k)
+		if f, _ := strconv.ParseFloat(s, 64); f != k { // all the digits, for lxa asm
+			s = strconv.FormatFloat(k, 'g', -1, 64)
+		}
+		if strings.Trim(s, "-0123456789") == "" { // looks like an integer
+			s += ".0"
+		}
+		return s
+	case string:
+		return quoteString(k)
+	default:
+		return "?"
+	}
+}
+
+// lua-5.3.4/src/luac.c#PrintString()
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\v':
+			b.WriteString(`\v`)
+		default:
+			if c >= 0x20 && c < 0x7F {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, `\%03d`, c)
+			}
+		}
 	}
-	fmt.Println()
+	b.WriteByte('"')
+	return b.String()
 }
@@ -0,0 +1,203 @@
+package runner
+
+import (
+	"lxa/binchunk"
+	"lxa/vm"
+	"strconv"
+	"strings"
+)
+
+// metamethod events by the C argument of MMBIN, MMBINI and MMBINK
+// lua-5.4.6/src/ltm.c#luaT_init()
+var eventNames54 = []string{
+	"__index", "__newindex", "__gc", "__mode", "__len", "__eq",
+	"__add", "__sub", "__mul", "__mod", "__pow", "__div", "__idiv",
+	"__band", "__bor", "__bxor", "__shl", "__shr",
+	"__unm", "__bnot", "__lt", "__le", "__concat", "__call", "__close",
+}
+
+// lists a function compiled with -target 5.4: the arguments are the
+// fields of the instruction as luac 5.4 prints them, with no negative
+// constant indices
+func newListing54(f *binchunk.Prototype) *listing {
+	l := newFuncListing(f)
+	for pc := range f.Code {
+		l.Code = append(l.Code, listInstruction54(f, pc))
+	}
+	for _, p := range f.Protos {
+		l.Functions = append(l.Functions, newListing54(p))
+	}
+	return l
+}
+
+// lua-5.4.6/src/luac.c#PrintCode()
+func listInstruction54(f *binchunk.Prototype, pc int) instListing {
+	i := vm.Instruction54(f.Code[pc])
+	inst := instListing{PC: pc + 1, Op: "???"}
+	if pc < len(f.LineInfo) {
+		inst.Line = int(f.LineInfo[pc])
+	}
+	if !i.IsValid() {
+		inst.Args = []int{int(i)}
+		return inst
+	}
+	inst.Op = strings.TrimSpace(i.OpName())
+	a, b, c, k := i.ABCk()
+	_, bx := i.ABx()
+	_, sbx := i.AsBx()
+	sb, sc := b-vm.OFFSET_sC54, c-vm.OFFSET_sC54
+	isk := k != 0
+
+	switch op := i.Opcode(); op {
+	case vm.OP54_MOVE, vm.OP54_UNM, vm.OP54_BNOT, vm.OP54_NOT, vm.OP54_LEN, vm.OP54_CONCAT:
+		inst.Args = []int{a, b}
+	case vm.OP54_LOADI, vm.OP54_LOADF:
+		inst.Args = []int{a, sbx}
+	case vm.OP54_LOADK:
+		inst.Args = []int{a, bx}
+		inst.Comment = constantString(f, bx)
+	case vm.OP54_LOADKX:
+		inst.Args = []int{a}
+		inst.Comment = constantString(f, extraArg54(f, pc))
+	case vm.OP54_LOADFALSE, vm.OP54_LFALSESKIP, vm.OP54_LOADTRUE, vm.OP54_CLOSE, vm.OP54_TBC,
+		vm.OP54_RETURN1, vm.OP54_VARARGPREP:
+		inst.Args = []int{a}
+	case vm.OP54_LOADNIL:
+		inst.Args = []int{a, b}
+		inst.Comment = strconv.Itoa(b+1) + " out"
+	case vm.OP54_GETUPVAL, vm.OP54_SETUPVAL:
+		inst.Args = []int{a, b}
+		inst.Comment = upvalName(f, b)
+	case vm.OP54_GETTABUP:
+		inst.Args = []int{a, b, c}
+		inst.Comment = upvalName(f, b) + " " + constantString(f, c)
+	case vm.OP54_GETTABLE, vm.OP54_GETI, vm.OP54_ADD, vm.OP54_SUB, vm.OP54_MUL, vm.OP54_MOD,
+		vm.OP54_POW, vm.OP54_DIV, vm.OP54_IDIV, vm.OP54_BAND, vm.OP54_BOR, vm.OP54_BXOR,
+		vm.OP54_SHL, vm.OP54_SHR:
+		inst.Args = []int{a, b, c}
+	case vm.OP54_GETFIELD, vm.OP54_ADDK, vm.OP54_SUBK, vm.OP54_MULK, vm.OP54_MODK, vm.OP54_POWK,
+		vm.OP54_DIVK, vm.OP54_IDIVK, vm.OP54_BANDK, vm.OP54_BORK, vm.OP54_BXORK:
+		inst.Args = []int{a, b, c}
+		inst.Comment = constantString(f, c)
+	case vm.OP54_SETTABUP:
+		inst.Args, inst.K = []int{a, b, c}, isk
+		inst.Comment = upvalName(f, a) + " " + constantString(f, b)
+		if isk {
+			inst.Comment += " " + constantString(f, c)
+		}
+	case vm.OP54_SETTABLE, vm.OP54_SETI, vm.OP54_SELF:
+		inst.Args, inst.K = []int{a, b, c}, isk
+		if isk {
+			inst.Comment = constantString(f, c)
+		}
+	case vm.OP54_SETFIELD:
+		inst.Args, inst.K = []int{a, b, c}, isk
+		inst.Comment = constantString(f, b)
+		if isk {
+			inst.Comment += " " + constantString(f, c)
+		}
+	case vm.OP54_NEWTABLE:
+		inst.Args = []int{a, b, c}
+		inst.Comment = strconv.Itoa(c + extraArgC54(f, pc, isk))
+	case vm.OP54_ADDI, vm.OP54_SHRI, vm.OP54_SHLI:
+		inst.Args = []int{a, b, sc}
+	case vm.OP54_MMBIN:
+		inst.Args = []int{a, b, c}
+		inst.Comment = eventName54(c)
+	case vm.OP54_MMBINI:
+		inst.Args = []int{a, sb, c, k}
+		inst.Comment = eventName54(c)
+		if isk {
+			inst.Comment += " flip"
+		}
+	case vm.OP54_MMBINK:
+		inst.Args = []int{a, b, c, k}
+		inst.Comment = eventName54(c) + " " + constantString(f, b)
+		if isk {
+			inst.Comment += " flip"
+		}
+	case vm.OP54_JMP:
+		inst.Args = []int{i.SJ()}
+		inst.Target = i.SJ() + pc + 2
+		inst.Comment = "to " + strconv.Itoa(inst.Target)
+	case vm.OP54_EQ, vm.OP54_LT, vm.OP54_LE, vm.OP54_TESTSET:
+		inst.Args = []int{a, b, k}
+	case vm.OP54_EQK:
+		inst.Args = []int{a, b, k}
+		inst.Comment = constantString(f, b)
+	case vm.OP54_EQI, vm.OP54_LTI, vm.OP54_LEI, vm.OP54_GTI, vm.OP54_GEI:
+		inst.Args = []int{a, sb, k}
+	case vm.OP54_TEST:
+		inst.Args = []int{a, k}
+	case vm.OP54_CALL:
+		inst.Args = []int{a, b, c}
+		inst.Comment = count54(b, "in") + " " + count54(c, "out")
+	case vm.OP54_TAILCALL:
+		inst.Args, inst.K = []int{a, b, c}, isk
+		inst.Comment = strconv.Itoa(b-1) + " in"
+	case vm.OP54_RETURN:
+		inst.Args, inst.K = []int{a, b, c}, isk
+		inst.Comment = count54(b, "out")
+	case vm.OP54_RETURN0:
+		inst.Args = []int{}
+	case vm.OP54_FORLOOP, vm.OP54_TFORLOOP:
+		inst.Args = []int{a, bx}
+		inst.Target = pc - bx + 2
+		inst.Comment = "to " + strconv.Itoa(inst.Target)
+	case vm.OP54_FORPREP:
+		inst.Args = []int{a, bx}
+		inst.Target = pc + bx + 3
+		inst.Comment = "exit to " + strconv.Itoa(inst.Target)
+	case vm.OP54_TFORPREP:
+		inst.Args = []int{a, bx}
+		inst.Target = pc + bx + 2
+		inst.Comment = "to " + strconv.Itoa(inst.Target)
+	case vm.OP54_TFORCALL:
+		inst.Args = []int{a, c}
+	case vm.OP54_SETLIST:
+		inst.Args = []int{a, b, c}
+		if isk {
+			inst.Comment = strconv.Itoa(c + extraArgC54(f, pc, isk))
+		}
+	case vm.OP54_CLOSURE:
+		inst.Args = []int{a, bx}
+		inst.Function = &bx
+	case vm.OP54_VARARG:
+		inst.Args = []int{a, c}
+		inst.Comment = count54(c, "out")
+	case vm.OP54_EXTRAARG:
+		inst.Args = []int{i.Ax()}
+	}
+	return inst
+}
+
+// the argument in the EXTRAARG after pc
+func extraArg54(f *binchunk.Prototype, pc int) int {
+	if pc+1 < len(f.Code) {
+		return vm.Instruction54(f.Code[pc+1]).Ax()
+	}
+	return 0
+}
+
+// what the EXTRAARG after pc adds to a C argument, if k says there is one
+func extraArgC54(f *binchunk.Prototype, pc int, isk bool) int {
+	if !isk {
+		return 0
+	}
+	return extraArg54(f, pc) * (0xFF + 1)
+}
+
+func eventName54(c int) string {
+	if c < len(eventNames54) {
+		return eventNames54[c]
+	}
+	return "?"
+}
+
+// "all in" for 0, or else n-1 values
+func count54(n int, what string) string {
+	if n == 0 {
+		return "all " + what
+	}
+	return strconv.Itoa(n-1) + " " + what
+}
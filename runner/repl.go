@@ -0,0 +1,233 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lxa/api"
+	"lxa/binchunk"
+	"lxa/compiler"
+	"lxa/compiler/lexer"
+	"lxa/state"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	replPrompt  = "> "
+	replPrompt2 = ">> "
+	replName    = "stdin"
+	historyFile = ".lxa_history"
+	historySize = 1000
+)
+
+const replHelp = `  :load file   run a lxa or lua bytecode file in this session
+  :dis expr    show the bytecode a line compiles to
+  :reset       start again with a new lua state
+  :help        show this message
+  :quit        leave (or Ctrl-D)`
+
+type repl struct {
+	ls      api.LuaState
+	debug   bool
+	history []string
+	lr      lineReader
+}
+
+// GoRunREPL reads lines from stdin and runs them on the golua vm, one
+// lua state for the whole session (ls, or a new one if it is nil).
+// Expressions print their values.
+func GoRunREPL(ls api.LuaState, debug bool) {
+	r := &repl{ls: ls, debug: debug}
+	if ls == nil {
+		r.reset()
+	}
+	r.loadHistory()
+	r.lr = newLineReader(&r.history)
+	defer r.lr.Close()
+
+	fmt.Println("Lxa 0.2.6 2020.04.03 Copyright (C) 2020 xaxys.")
+	fmt.Println("type :help for help")
+	for {
+		src, ok := r.readChunk()
+		if !ok {
+			fmt.Println()
+			break
+		}
+		if strings.TrimSpace(src) == "" {
+			continue
+		}
+		r.addHistory(src)
+		if strings.HasPrefix(strings.TrimSpace(src), ":") {
+			if !r.command(strings.TrimSpace(src)) {
+				break
+			}
+			continue
+		}
+		if proto, err := r.compile(src); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			r.run(proto)
+		}
+	}
+	r.saveHistory()
+}
+
+func (r *repl) reset() {
+	r.ls = state.NewState(r.debug)
+	r.ls.OpenLibs()
+}
+
+// reads one line, and more lines as long as what was typed so far
+// ends in the middle of something. An empty line gives up waiting.
+func (r *repl) readChunk() (string, bool) {
+	src, err := r.lr.ReadLine(replPrompt)
+	if err != nil {
+		return "", false
+	}
+	if strings.HasPrefix(strings.TrimSpace(src), ":") {
+		return src, true
+	}
+	for {
+		_, err := r.compile(src)
+		if e, ok := err.(*lexer.SyntaxError); !ok || !e.AtEOF {
+			return src, true
+		}
+		line, err := r.lr.ReadLine(replPrompt2)
+		if err != nil {
+			return "", false
+		}
+		if strings.TrimSpace(line) == "" {
+			return src, true
+		}
+		src += "\n" + line
+	}
+}
+
+// compiles a line as an expression to print if it is one, or else as
+// statements
+func (r *repl) compile(src string) (*binchunk.Prototype, error) {
+	if proto, err := compiler.CompileLine("return "+src, replName); err == nil {
+		return proto, nil
+	}
+	return compiler.CompileLine(src, replName)
+}
+
+func (r *repl) run(proto *binchunk.Prototype) {
+	ls := r.ls
+	if ls.Load(binchunk.Dump(proto), replName, "b") != api.LUA_OK {
+		r.printError()
+		return
+	}
+	r.call(0)
+}
+
+// calls the function on top of the stack, printing what it returns
+func (r *repl) call(nArgs int) {
+	ls := r.ls
+	if ls.PCall(nArgs, api.LUA_MULTRET, 0) != api.LUA_OK {
+		r.printError()
+		return
+	}
+	if n := ls.GetTop(); n > 0 {
+		ls.GetGlobal("print")
+		ls.Insert(1)
+		if ls.PCall(n, 0, 0) != api.LUA_OK {
+			r.printError()
+		}
+	}
+	ls.SetTop(0)
+}
+
+func (r *repl) printError() {
+	fmt.Fprintln(os.Stderr, r.ls.ToString2(-1))
+	r.ls.SetTop(0)
+}
+
+// runs a :command, false to leave the repl
+func (r *repl) command(line string) bool {
+	name, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch name {
+	case ":q", ":quit", ":exit":
+		return false
+	case ":h", ":help":
+		fmt.Println(replHelp)
+	case ":reset":
+		r.reset()
+	case ":load":
+		if arg == "" {
+			fmt.Fprintln(os.Stderr, "usage: :load file")
+			break
+		}
+		switch r.ls.LoadFile(arg) {
+		case api.LUA_OK:
+			r.call(0)
+		case api.LUA_ERRFILE:
+			fmt.Fprintf(os.Stderr, "cannot open %s\n", arg)
+		default:
+			r.printError()
+		}
+	case ":dis":
+		if arg == "" {
+			fmt.Fprintln(os.Stderr, "usage: :dis expr")
+			break
+		}
+		if proto, err := r.compile(arg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			ParseBinary(binchunk.Dump(proto))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s, try :help\n", name)
+	}
+	return true
+}
+
+func (r *repl) addHistory(src string) {
+	src = strings.Replace(src, "\n", " ", -1)
+	if n := len(r.history); n > 0 && r.history[n-1] == src {
+		return
+	}
+	r.history = append(r.history, src)
+}
+
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, historyFile)
+}
+
+func (r *repl) loadHistory() {
+	if path := historyPath(); path != "" {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line != "" {
+					r.history = append(r.history, line)
+				}
+			}
+		}
+	}
+}
+
+func (r *repl) saveHistory() {
+	path := historyPath()
+	if path == "" {
+		return
+	}
+	if len(r.history) > historySize {
+		r.history = r.history[len(r.history)-historySize:]
+	}
+	ioutil.WriteFile(path, []byte(strings.Join(r.history, "\n")+"\n"), 0600)
+}
+
+// reads lines of input, letting them be edited on a terminal
+type lineReader interface {
+	ReadLine(prompt string) (string, error)
+	io.Closer
+}
@@ -0,0 +1,81 @@
+package runner
+
+import (
+	"fmt"
+	"lxa/api"
+	"lxa/state"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GoRunTests runs each file on a golua state of its own: the main chunk
+// first, then every global function whose name starts with "test", in
+// order of their names. A test fails if it raises an error. It returns
+// the exit status: 0 if everything passed, or 1.
+func GoRunTests(filenames []string, verbose bool) int {
+	status := 0
+	for _, filename := range filenames {
+		start := time.Now()
+		if goRunTestFile(filename, verbose) {
+			fmt.Printf("ok  \t%s\t%.3fs\n", filename, time.Since(start).Seconds())
+		} else {
+			fmt.Printf("FAIL\t%s\t%.3fs\n", filename, time.Since(start).Seconds())
+			status = 1
+		}
+	}
+	return status
+}
+
+func goRunTestFile(filename string, verbose bool) bool {
+	ls := state.NewState(false)
+	ls.OpenLibs()
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("    %s\n", err)
+		return false
+	}
+	defer file.Close()
+	if ls.LoadReader(file, filename, "bt") != api.LUA_OK ||
+		ls.PCall(0, 0, 0) != api.LUA_OK {
+		fmt.Printf("    %s\n", ls.ToString2(-1))
+		return false
+	}
+
+	passed := true
+	for _, name := range testNames(ls) {
+		if verbose {
+			fmt.Printf("=== RUN   %s\n", name)
+		}
+		start := time.Now()
+		ls.GetGlobal(name)
+		if ls.PCall(0, 0, 0) != api.LUA_OK {
+			fmt.Printf("--- FAIL: %s (%.3fs)\n", name, time.Since(start).Seconds())
+			fmt.Printf("    %s\n", ls.ToString2(-1))
+			ls.SetTop(0)
+			passed = false
+		} else if verbose {
+			fmt.Printf("--- PASS: %s (%.3fs)\n", name, time.Since(start).Seconds())
+		}
+	}
+	return passed
+}
+
+// the global functions named test*, sorted
+func testNames(ls api.LuaState) []string {
+	var names []string
+	ls.PushGlobalTable()
+	ls.PushNil()
+	for ls.Next(-2) {
+		if ls.Type(-2) == api.LUA_TSTRING && ls.IsFunction(-1) {
+			if name := ls.ToString(-2); strings.HasPrefix(name, "test") {
+				names = append(names, name)
+			}
+		}
+		ls.Pop(1)
+	}
+	ls.Pop(1)
+	sort.Strings(names)
+	return names
+}
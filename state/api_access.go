@@ -90,6 +90,12 @@ func (self *luaState) IsFunction(idx int) bool {
 	return self.Type(idx) == LUA_TFUNCTION
 }
 
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_isuserdata
+func (self *luaState) IsUserData(idx int) bool {
+	return self.Type(idx) == LUA_TUSERDATA
+}
+
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_isthread
 func (self *luaState) IsThread(idx int) bool {
@@ -185,6 +191,15 @@ func (self *luaState) ToStringX(idx int) (string, bool) {
 	}
 }
 
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_touserdata
+func (self *luaState) ToUserData(idx int) interface{} {
+	if u, ok := self.stack.get(idx).(*userdata); ok {
+		return u.data
+	}
+	return nil
+}
+
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_tocfunction
 func (self *luaState) ToGoFunction(idx int) GoFunction {
@@ -1,35 +1,105 @@
 package state
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	. "lxa/api"
 	"lxa/binchunk"
 	"lxa/compiler"
 	"lxa/vm"
+	"strings"
+	"sync/atomic"
 )
 
 // [-0, +1, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_load
 func (self *luaState) Load(chunk []byte, chunkName, mode string) int {
+	return self.LoadReader(bytes.NewReader(chunk), chunkName, mode)
+}
+
+// [-0, +1, –]
+// lua-5.3.4/src/ldo.c#f_parser()
+// Only the first byte is peeked to tell a binary chunk from source;
+// the rest of r is then read fully into memory before it is undumped
+// or compiled, so nothing is gained from streaming a large input.
+func (self *luaState) LoadReader(r io.Reader, chunkName, mode string) int {
+	br := bufio.NewReader(r)
+	sig, _ := br.Peek(1)
+	binary := len(sig) > 0 && sig[0] == binchunk.LUA_SIGNATURE[0]
+	if binary && !checkMode(mode, "binary") ||
+		!binary && !checkMode(mode, "text") {
+		x := "text"
+		if binary {
+			x = "binary"
+		}
+		self.stack.push(fmt.Sprintf("attempt to load a %s chunk (mode is '%s')", x, mode))
+		return LUA_ERRSYNTAX
+	}
+
 	var proto *binchunk.Prototype
-	if binchunk.IsBinaryChunk(chunk) {
-		proto = binchunk.Undump(chunk)
+	if binary {
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			self.stack.push(err.Error())
+			return LUA_ERRFILE
+		}
+		if proto, err = binchunk.TryUndump(data); err == nil {
+			err = vm.Verify(proto)
+		}
+		if err != nil {
+			self.stack.push(fmt.Sprintf("%s: %s", undumpName(chunkName), err))
+			return LUA_ERRSYNTAX
+		}
 	} else {
-		proto = compiler.Compile(string(chunk), chunkName)
+		var chunk strings.Builder
+		if _, err := io.Copy(&chunk, br); err != nil {
+			self.stack.push(err.Error())
+			return LUA_ERRFILE
+		}
+		var err error
+		if proto, err = compiler.TryCompile(chunk.String(), chunkName); err != nil {
+			self.stack.push(err.Error())
+			return LUA_ERRSYNTAX
+		}
 	}
 
 	c := newLuaClosure(proto)
+	self.global.alloc(c)
 	self.stack.push(c)
 	if len(proto.Upvalues) > 0 {
 		env := self.registry.get(LUA_RIDX_GLOBALS)
 		c.upvals[0] = &upvalue{&env}
 	}
+	for i := 1; i < len(c.upvals); i++ { /* other upvalues start as nil */
+		c.upvals[i] = &upvalue{new(luaValue)}
+	}
 	return LUA_OK
 }
 
+// lua-5.3.4/src/lundump.c#luaU_undump()
+func undumpName(chunkName string) string {
+	if chunkName != "" && (chunkName[0] == '@' || chunkName[0] == '=') {
+		return chunkName[1:]
+	} else if chunkName != "" && chunkName[0] == binchunk.LUA_SIGNATURE[0] {
+		return "binary string"
+	}
+	return chunkName
+}
+
+// lua-5.3.4/src/ldo.c#checkmode()
+func checkMode(mode, x string) bool {
+	return mode == "" || strings.IndexByte(mode, x[0]) >= 0
+}
+
 // [-(nargs+1), +nresults, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_call
 func (self *luaState) Call(nArgs, nResults int) {
+	if g := self.global; g.gcDebt > 0 || atomic.LoadInt32(&g.nTobefnz) > 0 {
+		self.checkGC()
+	}
 	val := self.stack.get(-(nArgs + 1))
 
 	c, ok := val.(*closure)
@@ -85,51 +155,82 @@ func (self *luaState) callLuaClosure(nArgs, nResults int, c *closure) {
 	isVararg := c.proto.IsVararg == 1
 
 	// create new lua stack
-	newStack := newLuaStack(nRegs+LUA_MINSTACK, self)
+	newStack := self.allocLuaStack(nRegs + LUA_MINSTACK)
 	newStack.closure = c
 
 	// pass args, pop func
-	funcAndArgs := self.stack.popN(nArgs + 1)
-	newStack.pushN(funcAndArgs[1:], nParams)
-	newStack.top = nRegs
-	if nArgs > nParams && isVararg {
-		newStack.varargs = funcAndArgs[nParams+1:]
+	caller := self.stack
+	base := caller.top - nArgs - 1
+	args := caller.slots[base+1 : caller.top]
+	if nArgs > nParams {
+		copy(newStack.slots, args[:nParams])
+		if isVararg {
+			newStack.varargs = append([]luaValue(nil), args[nParams:]...)
+		}
+	} else {
+		copy(newStack.slots, args)
+	}
+	for i := base; i < caller.top; i++ {
+		caller.slots[i] = nil
 	}
+	caller.top = base
+	newStack.top = nRegs
 
 	// run closure
 	self.pushLuaStack(newStack)
 	self.runLuaClosure()
 	self.popLuaStack()
 
-	// return results
+	// return results, the frame may now belong to a tail called function
 	if nResults != 0 {
-		results := newStack.popN(newStack.top - nRegs)
-		self.stack.check(len(results))
-		self.stack.pushN(results, nResults)
+		nRegs = int(newStack.closure.proto.MaxStackSize)
+		results := newStack.slots[nRegs:newStack.top]
+		if nResults < 0 {
+			nResults = len(results)
+		}
+		caller.check(nResults)
+		for i := 0; i < nResults; i++ {
+			if i < len(results) {
+				caller.push(results[i])
+			} else {
+				caller.push(nil)
+			}
+		}
 	}
+	self.freeLuaStack(newStack)
 }
 
 func (self *luaState) runLuaClosure() {
+	stack := self.stack
+	proto := stack.closure.proto
 	for {
-		inst := vm.Instruction(self.Fetch())
+		inst := vm.Instruction(proto.Code[stack.pc])
+		stack.pc++
 
 		if self.debug {
 			switch inst.OpMode() {
 			case vm.IABC:
 				a, b, c := inst.ABC()
-				fmt.Println("vm @", self.stack.pc-1, inst.OpName(), "A =", a, "B =", b, "C =", c)
+				fmt.Println("vm @", stack.pc-1, inst.OpName(), "A =", a, "B =", b, "C =", c)
 			case vm.IABx:
 				a, bx := inst.ABx()
-				fmt.Println("vm @", self.stack.pc-1, inst.OpName(), "A =", a, "BX =", bx)
+				fmt.Println("vm @", stack.pc-1, inst.OpName(), "A =", a, "BX =", bx)
 			case vm.IAsBx:
 				a, sbx := inst.AsBx()
-				fmt.Println("vm @", self.stack.pc-1, inst.OpName(), "A =", a, "SBX =", sbx)
+				fmt.Println("vm @", stack.pc-1, inst.OpName(), "A =", a, "SBX =", sbx)
 			case vm.IAx:
 				ax := inst.Ax()
-				fmt.Println("vm @", self.stack.pc-1, inst.OpName(), "AX =", ax)
+				fmt.Println("vm @", stack.pc-1, inst.OpName(), "AX =", ax)
 			}
 		}
 
+		if self.execute(stack, proto, inst) {
+			continue
+		}
+		if inst.Opcode() == vm.OP_TAILCALL && self.tailCallLuaClosure(inst) {
+			proto = stack.closure.proto
+			continue
+		}
 		inst.Execute(self)
 		if inst.Opcode() == vm.OP_RETURN {
 			break
@@ -137,6 +238,56 @@ func (self *luaState) runLuaClosure() {
 	}
 }
 
+// return R(A)(R(A+1), ... ,R(A+B-1))
+// If R(A) is a Lua function, the running frame is reused for it:
+// its upvalues are closed, the arguments moved down to the first
+// registers and the loop of runLuaClosure goes on with the callee,
+// whose results are returned straight to the caller of this frame.
+// lua-5.3.4/src/lvm.c#OP_TAILCALL
+func (self *luaState) tailCallLuaClosure(i vm.Instruction) bool {
+	a, b, _ := i.ABC()
+	stack := self.stack
+	c, ok := stack.slots[a].(*closure)
+	if !ok || c.proto == nil {
+		return false /* let vm.tailCall do a regular call */
+	}
+
+	self.CloseUpvalues(1)
+
+	// move args to the bottom of the frame
+	nArgs := b - 1
+	if b == 0 { /* results of a call or vararg are above the registers */
+		nRegs := int(stack.closure.proto.MaxStackSize)
+		x := int(stack.slots[stack.top-1].(int64)) /* 1-based, pushed by _popResults */
+		n := copy(stack.slots, stack.slots[a+1:x-1])
+		nArgs = n + copy(stack.slots[n:], stack.slots[nRegs:stack.top-1])
+	} else {
+		copy(stack.slots, stack.slots[a+1:a+b])
+	}
+
+	nRegs := int(c.proto.MaxStackSize)
+	nParams := int(c.proto.NumParams)
+	stack.varargs = nil
+	if nArgs > nParams {
+		if c.proto.IsVararg == 1 {
+			stack.varargs = append([]luaValue(nil), stack.slots[nParams:nArgs]...)
+		}
+		nArgs = nParams
+	}
+	for j := nArgs; j < len(stack.slots); j++ {
+		stack.slots[j] = nil
+	}
+	if size := nRegs + LUA_MINSTACK; size > len(stack.slots) {
+		stack.slots = append(stack.slots, make([]luaValue, size-len(stack.slots))...)
+	}
+
+	stack.closure = c
+	stack.top = nRegs
+	stack.pc = 0
+	stack.tailcall = true
+	return true
+}
+
 // Calls a function in protected mode.
 // http://www.lua.org/manual/5.3/manual.html#lua_pcall
 func (self *luaState) PCall(nArgs, nResults, msgh int) (status int) {
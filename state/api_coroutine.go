@@ -2,51 +2,77 @@ package state
 
 import . "lxa/api"
 
+/*
+** Coroutine status machine (see lcorolib.c#auxstatus):
+**   suspended: coStatus == LUA_YIELD, or not started yet (function on stack)
+**   running:   the thread that is calling the 'coroutine' library
+**   normal:    coStatus == LUA_OK and has frames (it resumed another one)
+**   dead:      finished normally (no frames, empty stack) or with an error
+ */
+
 // [-0, +1, m]
 // http://www.lua.org/manual/5.3/manual.html#lua_newthread
 // lua-5.3.4/src/lstate.c#lua_newthread()
 func (self *luaState) NewThread() LuaState {
-	t := &luaState{registry: self.registry}
+	t := &luaState{registry: self.registry, global: self.global}
 	t.pushLuaStack(newLuaStack(LUA_MINSTACK, t))
+	self.global.alloc(t)
 	self.stack.push(t)
 	return t
 }
 
 // [-?, +?, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_resume
+// lua-5.3.4/src/ldo.c#lua_resume()
 func (self *luaState) Resume(from LuaState, nArgs int) int {
 	lsFrom := from.(*luaState)
 	if lsFrom.coChan == nil {
 		lsFrom.coChan = make(chan int)
 	}
 
-	if self.coChan == nil {
-		// start coroutine
+	switch {
+	case self.coStatus == LUA_YIELD: // resume coroutine
+		self.coCaller = lsFrom
+		self.coStatus = LUA_OK
+		self.coChan <- 1
+	case self.coStatus != LUA_OK: // coroutine finished with an error
+		return self.resumeError("cannot resume dead coroutine", nArgs)
+	case self.GetStack() || self.isMainThread(): // running or normal
+		return self.resumeError("cannot resume non-suspended coroutine", nArgs)
+	case self.coChan != nil || self.GetTop() == nArgs: // no function to call
+		return self.resumeError("cannot resume dead coroutine", nArgs)
+	default: // start coroutine
 		self.coChan = make(chan int)
 		self.coCaller = lsFrom
 		go func() {
-			self.coStatus = self.PCall(nArgs, -1, 0)
-			lsFrom.coChan <- 1
+			status := self.PCall(nArgs, LUA_MULTRET, 0)
+			self.coStatus = status
+			self.coCaller.coChan <- 1
 		}()
-	} else {
-		// resume coroutine
-		if self.coStatus != LUA_YIELD { // todo
-			self.stack.push("cannot resume non-suspended coroutine")
-			return LUA_ERRRUN
-		}
-		self.coStatus = LUA_OK
-		self.coChan <- 1
 	}
 
 	<-lsFrom.coChan // wait coroutine to finish or yield
+	if self.coStatus != LUA_YIELD {
+		self.coCaller = nil
+	}
 	return self.coStatus
 }
 
+// lua-5.3.4/src/ldo.c#resume_error()
+func (self *luaState) resumeError(msg string, nArgs int) int {
+	self.stack.top -= nArgs /* remove args from the stack */
+	self.stack.push(msg)    /* push error message */
+	return LUA_ERRRUN
+}
+
 // [-?, +?, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_yield
 func (self *luaState) Yield(nResults int) int {
-	if self.coCaller == nil { // todo
-		panic("attempt to yield from outside a coroutine")
+	if self.coCaller == nil {
+		if self.isMainThread() {
+			return self.Error2("attempt to yield from outside a coroutine")
+		}
+		return self.Error2("attempt to yield across a Go-call boundary")
 	}
 	self.coStatus = LUA_YIELD
 	self.coCaller.coChan <- 1
@@ -57,10 +83,7 @@ func (self *luaState) Yield(nResults int) int {
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_isyieldable
 func (self *luaState) IsYieldable() bool {
-	if self.isMainThread() {
-		return false
-	}
-	return self.coStatus != LUA_YIELD // todo
+	return !self.isMainThread() && self.coCaller != nil
 }
 
 // [-0, +0, –]
@@ -12,9 +12,18 @@ func (self *luaState) NewTable() {
 // http://www.lua.org/manual/5.3/manual.html#lua_createtable
 func (self *luaState) CreateTable(nArr, nRec int) {
 	t := newLuaTable(nArr, nRec)
+	self.global.alloc(t)
 	self.stack.push(t)
 }
 
+// [-0, +1, m]
+// http://www.lua.org/manual/5.3/manual.html#lua_newuserdata
+func (self *luaState) NewUserData(data interface{}) {
+	u := &userdata{data: data}
+	self.global.alloc(u)
+	self.stack.push(u)
+}
+
 // [-1, +1, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_gettable
 func (self *luaState) GetTable(idx int) LuaType {
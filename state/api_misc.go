@@ -1,6 +1,9 @@
 package state
 
-import "lxa/number"
+import (
+	. "lxa/api"
+	"lxa/number"
+)
 
 // [-0, +1, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_len
@@ -30,7 +33,9 @@ func (self *luaState) Concat(n int) {
 				s1 := self.ToString(-2)
 				self.stack.pop()
 				self.stack.pop()
-				self.stack.push(s1 + s2)
+				s := s1 + s2
+				self.global.alloc(s)
+				self.stack.push(s)
 				continue
 			}
 
@@ -47,15 +52,69 @@ func (self *luaState) Concat(n int) {
 	// n == 1, do nothing
 }
 
+// [-0, +0, e]
+// http://www.lua.org/manual/5.3/manual.html#lua_gc
+// lua-5.3.4/src/lapi.c#lua_gc()
+func (self *luaState) GC(what, data int) int {
+	res := 0
+	g := self.global
+	switch what {
+	case LUA_GCSTOP:
+		g.gcRunning = false
+	case LUA_GCRESTART:
+		g.setDebt(0)
+		g.gcRunning = true
+	case LUA_GCCOLLECT:
+		self.fullGC()
+	case LUA_GCCOUNT:
+		/* GC values are expressed in Kbytes: #bytes/2^10 */
+		res = g.getTotalBytes() >> 10
+	case LUA_GCCOUNTB:
+		res = g.getTotalBytes() & 0x3ff
+	case LUA_GCSTEP:
+		/* there are no incremental steps: a step that pays the
+		   debt off is a whole cycle */
+		oldRunning := g.gcRunning
+		g.gcRunning = true /* allow GC to run */
+		if data == 0 {
+			g.setDebt(1)
+		} else {
+			g.setDebt(data*1024 + g.gcDebt)
+		}
+		if g.gcDebt > 0 {
+			self.gcCycle()
+			self.callAllPendingFinalizers()
+			res = 1 /* signal it */
+		}
+		g.gcRunning = oldRunning
+	case LUA_GCSETPAUSE:
+		res = g.gcPause
+		g.gcPause = data
+	case LUA_GCSETSTEPMUL:
+		res = g.gcStepMul
+		if data < 40 {
+			data = 40 /* avoid ridiculous low values (and 0) */
+		}
+		g.gcStepMul = data
+	case LUA_GCISRUNNING:
+		if g.gcRunning {
+			res = 1
+		}
+	default:
+		res = -1 /* invalid option */
+	}
+	return res
+}
+
 // [-1, +(2|0), e]
 // http://www.lua.org/manual/5.3/manual.html#lua_next
 func (self *luaState) Next(idx int) bool {
 	val := self.stack.get(idx)
 	if t, ok := val.(*luaTable); ok {
 		key := self.stack.pop()
-		if nextKey := t.nextKey(key); nextKey != nil {
+		if nextKey, nextVal := t.next(key); nextKey != nil {
 			self.stack.push(nextKey)
-			self.stack.push(t.get(nextKey))
+			self.stack.push(nextVal)
 			return true
 		}
 		return false
@@ -45,13 +45,16 @@ func (self *luaState) PushFString(fmtStr string, a ...interface{}) {
 // [-0, +1, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_pushcfunction
 func (self *luaState) PushGoFunction(f GoFunction) {
-	self.stack.push(newGoClosure(f, 0))
+	closure := newGoClosure(f, 0)
+	self.global.alloc(closure)
+	self.stack.push(closure)
 }
 
 // [-n, +1, m]
 // http://www.lua.org/manual/5.3/manual.html#lua_pushcclosure
 func (self *luaState) PushGoClosure(f GoFunction, n int) {
 	closure := newGoClosure(f, n)
+	self.global.alloc(closure)
 	for i := n; i > 0; i-- {
 		val := self.stack.pop()
 		closure.upvals[i-1] = &upvalue{&val}
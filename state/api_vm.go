@@ -44,6 +44,7 @@ func (self *luaState) LoadProto(idx int) {
 	stack := self.stack
 	subProto := stack.closure.proto.Protos[idx]
 	closure := newLuaClosure(subProto)
+	self.global.alloc(closure)
 	stack.push(closure)
 
 	for i, uvInfo := range subProto.Upvalues {
@@ -3,15 +3,20 @@ package state
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	. "lxa/api"
+	"lxa/binchunk"
+	"lxa/cache"
 	"lxa/stdlib"
 )
 
 // [-0, +0, v]
 // http://www.lua.org/manual/5.3/manual.html#luaL_error
 func (self *luaState) Error2(fmt string, a ...interface{}) int {
-	self.PushFString(fmt, a...) // todo
+	self.Where(1)
+	self.PushFString(fmt, a...)
+	self.Concat(2)
 	return self.Error()
 }
 
@@ -89,6 +94,33 @@ func (self *luaState) CheckString(arg int) string {
 	return s
 }
 
+// [-0, +0, v]
+// http://www.lua.org/manual/5.3/manual.html#luaL_checkudata
+func (self *luaState) CheckUserData(arg int, tname string) interface{} {
+	p := self.TestUserData(arg, tname)
+	if p == nil {
+		self.typeError(arg, tname)
+	}
+	return p
+}
+
+// [-0, +0, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_testudata
+func (self *luaState) TestUserData(arg int, tname string) interface{} {
+	p := self.ToUserData(arg)
+	if p != nil { /* value is a userdata? */
+		if self.GetMetatable(arg) { /* does it have a metatable? */
+			self.GetMetatable2(tname)   /* get correct metatable */
+			if !self.RawEqual(-1, -2) { /* not the same? */
+				p = nil /* value is a userdata with wrong metatable */
+			}
+			self.Pop(2) /* remove both metatables */
+			return p
+		}
+	}
+	return nil /* value is not a userdata with a metatable */
+}
+
 // [-0, +0, v]
 // http://www.lua.org/manual/5.3/manual.html#luaL_optinteger
 func (self *luaState) OptInteger(arg int, def int64) int64 {
@@ -138,11 +170,20 @@ func (self *luaState) LoadFile(filename string) int {
 
 // [-0, +1, m]
 // http://www.lua.org/manual/5.3/manual.html#luaL_loadfilex
+// sources are compiled through the chunk cache
 func (self *luaState) LoadFileX(filename, mode string) int {
-	if data, err := ioutil.ReadFile(filename); err == nil {
-		return self.Load(data, "@"+filename, mode)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return LUA_ERRFILE
+	}
+	if !binchunk.IsBinaryChunk(data) && checkMode(mode, "text") {
+		if data, err = cache.Binary(data, "@"+filename); err != nil {
+			self.stack.push(err.Error())
+			return LUA_ERRSYNTAX
+		}
+		return self.Load(data, "@"+filename, "b")
 	}
-	return LUA_ERRFILE
+	return self.Load(data, "@"+filename, mode)
 }
 
 // [-0, +1, –]
@@ -151,6 +192,73 @@ func (self *luaState) LoadString(s string) int {
 	return self.Load([]byte(s), s, "bt")
 }
 
+// [-0, +1, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_where
+// lua-5.3.4/src/lauxlib.c#luaL_where()
+func (self *luaState) Where(lvl int) {
+	stack := self.stack
+	for ; lvl > 0 && stack != nil; lvl-- {
+		stack = stack.prev
+	}
+	if stack != nil && stack.closure != nil && stack.closure.proto != nil {
+		if line := stack.currentLine(); line > 0 { /* is there info? */
+			self.PushFString("%s:%d: ", chunkID(stack.closure.proto.Source), line)
+			return
+		}
+	}
+	self.PushString("") /* else, no information available... */
+}
+
+const (
+	LEVELS1 = 10 /* size of the first part of the stack */
+	LEVELS2 = 11 /* size of the second part of the stack */
+)
+
+// [-0, +1, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_traceback
+// lua-5.3.4/src/lauxlib.c#luaL_traceback()
+func (self *luaState) Traceback(l1 LuaState, msg string, level int) {
+	var frames []*luaStack
+	for stack := l1.(*luaState).stack; stack.prev != nil; stack = stack.prev {
+		frames = append(frames, stack) /* the bottom frame runs nothing */
+	}
+	if level < len(frames) {
+		frames = frames[level:]
+	} else {
+		frames = nil
+	}
+
+	var b strings.Builder
+	if msg != "" {
+		b.WriteString(msg)
+		b.WriteByte('\n')
+	}
+	b.WriteString("stack traceback:")
+	for i := 0; i < len(frames); i++ {
+		if i == LEVELS1 && len(frames) > LEVELS1+LEVELS2 {
+			n := len(frames) - LEVELS1 - LEVELS2 /* number of levels to skip */
+			fmt.Fprintf(&b, "\n\t...\t(skipping %d levels)", n)
+			i += n - 1 /* and skip to last ones */
+			continue
+		}
+		stack := frames[i]
+		if proto := stack.closure.proto; proto == nil {
+			b.WriteString("\n\t[C]: in ?")
+		} else {
+			fmt.Fprintf(&b, "\n\t%s:%d: in ", chunkID(proto.Source), stack.currentLine())
+			if proto.LineDefined == 0 {
+				b.WriteString("main chunk")
+			} else {
+				fmt.Fprintf(&b, "function <%s:%d>", chunkID(proto.Source), proto.LineDefined)
+			}
+		}
+		if stack.tailcall {
+			b.WriteString("\n\t(...tail calls...)")
+		}
+	}
+	self.PushString(b.String())
+}
+
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#luaL_typename
 func (self *luaState) TypeName2(idx int) string {
@@ -212,6 +320,34 @@ func (self *luaState) ToString2(idx int) string {
 	return self.CheckString(-1)
 }
 
+// [-0, +1, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_newmetatable
+func (self *luaState) NewMetatable(tname string) bool {
+	if self.GetMetatable2(tname) != LUA_TNIL { /* name already in use? */
+		return false /* leave previous value on top, but return false */
+	}
+	self.Pop(1)
+	self.CreateTable(0, 2) /* create metatable */
+	self.PushString(tname)
+	self.SetField(-2, "__name") /* metatable.__name = tname */
+	self.PushValue(-1)
+	self.SetField(LUA_REGISTRYINDEX, tname) /* registry.name = metatable */
+	return true
+}
+
+// [-0, +1, –]
+// http://www.lua.org/manual/5.3/manual.html#luaL_getmetatable
+func (self *luaState) GetMetatable2(tname string) LuaType {
+	return self.GetField(LUA_REGISTRYINDEX, tname)
+}
+
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#luaL_setmetatable
+func (self *luaState) SetMetatable2(tname string) {
+	self.GetMetatable2(tname)
+	self.SetMetatable(-2)
+}
+
 // [-0, +1, e]
 // http://www.lua.org/manual/5.3/manual.html#luaL_getsubtable
 func (self *luaState) GetSubTable(idx int, fname string) bool {
@@ -268,6 +404,10 @@ func (self *luaState) OpenLibs() {
 		"os":        stdlib.OpenOSLib,
 		"package":   stdlib.OpenPackageLib,
 		"coroutine": stdlib.OpenCoroutineLib,
+		"json":      stdlib.OpenJSONLib,
+		"fs":        stdlib.OpenFSLib,
+		"regex":     stdlib.OpenRegexLib,
+		"debug":     stdlib.OpenDebugLib,
 	}
 
 	for name, fun := range libs {
@@ -349,3 +489,19 @@ func (self *luaState) typeError(arg int, tname string) int {
 	self.PushString(msg)
 	return self.ArgError(arg, msg)
 }
+
+// lua-5.3.4/src/lobject.c#luaO_chunkid()
+func chunkID(source string) string {
+	if source == "" {
+		return "?"
+	}
+	switch source[0] {
+	case '=', '@': /* 'literal' or file name */
+		return source[1:]
+	default: /* string; format as [string "source"] */
+		if i := strings.IndexByte(source, '\n'); i >= 0 {
+			source = source[:i] + "..."
+		}
+		return "[string \"" + source + "\"]"
+	}
+}
@@ -13,6 +13,7 @@ type closure struct {
 	proto  *binchunk.Prototype // lua closure
 	goFunc GoFunction          // go closure
 	upvals []*upvalue
+	gcMark uint32 // last cycle that marked it
 }
 
 func newLuaClosure(proto *binchunk.Prototype) *closure {
@@ -0,0 +1,518 @@
+package state
+
+import (
+	"fmt"
+	. "lxa/api"
+	"lxa/binchunk"
+	"lxa/vm"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+** Memory is managed by the Go runtime, so the collector here only
+** deals with weak tables: a mark phase, like lua-5.3.4/src/lgc.c,
+** finds the objects reachable from the registry and the running
+** thread, then entries of weak tables that refer to unmarked objects
+** are removed and the Go GC is left to reclaim them.
+**
+** Tables with weak keys are ephemerons: a value is only marked once
+** its key is, so the mark phase is repeated over them until nothing
+** changes. Strings are values, not objects, and are never removed.
+**
+** Lua values held only by Go code (and not on a Lua stack, in an
+** upvalue or in the registry) are invisible to the mark phase.
+**
+** The mark phase also adds up the sizes of the objects it reaches,
+** which is what collectgarbage("count") reports, plus what the state
+** has allocated since. Once that total reaches 'gcpause' percent of
+** the last measure, the next call runs a cycle, as Lua would.
+**
+** Finalizers are left to the Go GC as well: a table or userdata whose
+** metatable has a __gc field gets a runtime finalizer, which only
+** queues the object, resurrecting it, as the runtime runs finalizers
+** on a goroutine of its own. The __gc metamethods are then called by
+** the state itself, before its next call or at a full collection.
+** Like any Go finalizer, it never runs for an object in a cycle that
+** goes through the object itself.
+ */
+type gcState struct {
+	epoch      uint32 /* number of the cycle */
+	protos     map[*binchunk.Prototype]bool
+	bytes      int /* size of the marked objects */
+	gray       []luaValue
+	weak       []*luaTable /* tables with weak values */
+	ephemerons []*luaTable /* tables with weak keys */
+	allWeak    []*luaTable /* tables with weak keys and values */
+}
+
+/* state shared by all the threads of a Lua state */
+// lua-5.3.4/src/lstate.h#global_State
+type globalState struct {
+	mu         sync.Mutex
+	tobefnz    []luaValue /* objects whose __gc is to be called */
+	nTobefnz   int32      /* len(tobefnz), read without the lock */
+	finalizing bool       /* running the pending finalizers? */
+	totalBytes int        /* number of bytes currently allocated - gcDebt */
+	gcDebt     int        /* bytes allocated not yet compensated by the collector */
+	gcEstimate int        /* an estimate of the bytes in use at the last cycle */
+	gcRunning  bool       /* true if GC is running */
+	gcPause    int        /* size of pause between successive GCs */
+	gcStepMul  int        /* GC 'granularity' */
+	gcEpoch    uint32     /* number of the last cycle */
+}
+
+const (
+	LUAI_GCPAUSE = 200 /* 200% */
+	LUAI_GCMUL   = 200 /* GC runs 'twice the speed' of memory allocation */
+	PAUSEADJ     = 100
+	GCINITIAL    = 1 << 20 /* bytes allocated before the first cycle */
+)
+
+func newGlobalState() *globalState {
+	return &globalState{
+		totalBytes: GCINITIAL,
+		gcDebt:     -GCINITIAL,
+		gcRunning:  true,
+		gcPause:    LUAI_GCPAUSE,
+		gcStepMul:  LUAI_GCMUL,
+	}
+}
+
+// lua-5.3.4/src/lstate.h#gettotalbytes()
+func (g *globalState) getTotalBytes() int {
+	return g.totalBytes + g.gcDebt
+}
+
+// lua-5.3.4/src/lstate.c#luaE_setdebt()
+func (g *globalState) setDebt(debt int) {
+	tb := g.getTotalBytes()
+	g.totalBytes = tb - debt
+	g.gcDebt = debt
+}
+
+// counts 'val' as allocated by the state
+func (g *globalState) alloc(val luaValue) {
+	g.gcDebt += sizeOf(val)
+}
+
+// Set a reasonable "time" to wait before starting a new GC cycle;
+// cycle will start when memory use hits threshold.
+// lua-5.3.4/src/lgc.c#setpause()
+func (g *globalState) setPause() {
+	estimate := g.gcEstimate / PAUSEADJ /* adjust 'estimate' */
+	threshold := estimate * g.gcPause
+	g.setDebt(g.getTotalBytes() - threshold)
+}
+
+/*
+** Rough sizes in bytes of the objects and of what they own: they
+** are what the state counts, the Go runtime only knows the size of
+** the whole process.
+ */
+func sizeOf(val luaValue) int {
+	switch x := val.(type) {
+	case string:
+		return 16 + len(x)
+	case *luaTable:
+		return 64 + cap(x.arr)*16 + cap(x.nodes)*32 + len(x.index)*48
+	case *closure:
+		return 48 + len(x.upvals)*24
+	case *userdata:
+		return 32
+	case *luaState:
+		n := 128
+		for stack := x.stack; stack != nil; stack = stack.prev {
+			n += 96 + cap(stack.slots)*16 + len(stack.varargs)*16
+		}
+		return n
+	default:
+		return 0
+	}
+}
+
+func sizeOfProto(proto *binchunk.Prototype) int {
+	n := 128 + len(proto.Code)*4 + len(proto.Constants)*16 +
+		len(proto.LineInfo)*4 + len(proto.LocVars)*32 + len(proto.Upvalues)*2
+	for _, k := range proto.Constants {
+		if s, ok := k.(string); ok {
+			n += len(s)
+		}
+	}
+	for _, p := range proto.Protos {
+		n += sizeOfProto(p)
+	}
+	return n
+}
+
+/*
+** Instead of a color, a collectable object keeps the number of the
+** last cycle that marked it, so marks need no clearing.
+ */
+// lua-5.3.4/src/lgc.c#iscollectable()
+func markOf(val luaValue) *uint32 {
+	switch x := val.(type) {
+	case *luaTable:
+		return &x.gcMark
+	case *closure:
+		return &x.gcMark
+	case *userdata:
+		return &x.gcMark
+	case *luaState:
+		return &x.gcMark
+	default:
+		return nil
+	}
+}
+
+// lua-5.3.4/src/lgc.c#fullinc()
+func (self *luaState) fullGC() {
+	self.gcCycle()
+	waitFinalizers()
+	self.callAllPendingFinalizers()
+}
+
+/*
+** A cycle marks, clears the weak tables and measures what is left,
+** which sets the threshold of the next one; reclaiming memory is up
+** to the Go GC, which runs on its own.
+ */
+// lua-5.3.4/src/lgc.c#atomic()
+func (self *luaState) gcCycle() {
+	self.global.gcEpoch++
+	g := &gcState{
+		epoch:  self.global.gcEpoch,
+		protos: map[*binchunk.Prototype]bool{},
+	}
+	g.markValue(self.registry)
+	g.markValue(self)
+	self.global.mu.Lock()
+	for _, o := range self.global.tobefnz { /* being finalized */
+		g.markValue(o)
+	}
+	self.global.mu.Unlock()
+	g.propagateAll()
+	g.convergeEphemerons()
+
+	for _, t := range g.weak {
+		g.clearByValues(t)
+	}
+	for _, t := range g.ephemerons {
+		g.clearByKeys(t)
+	}
+	for _, t := range g.allWeak {
+		g.clearByKeys(t)
+		g.clearByValues(t)
+	}
+
+	global := self.global
+	global.gcEstimate = g.bytes
+	global.totalBytes, global.gcDebt = g.bytes, 0
+	global.setPause()
+}
+
+// lua-5.3.4/src/lgc.c#luaC_checkGC()
+func (self *luaState) checkGC() {
+	if g := self.global; g.gcRunning && !g.finalizing {
+		if g.gcDebt > 0 {
+			self.gcCycle()
+		}
+		self.callAllPendingFinalizers()
+	}
+}
+
+/*
+** runtime.GC queues the finalizers of the objects it finds
+** unreachable, and the runtime runs each queue it takes in full
+** before taking the next one: once the finalizer of a sentinel
+** queued by a second collection has run, so have all the finalizers
+** queued by the first one.
+ */
+func waitFinalizers() {
+	for i := 0; i < 2; i++ {
+		done := make(chan bool)
+		sentinel := &struct{ _ *int }{}
+		runtime.SetFinalizer(sentinel, func(interface{}) { close(done) })
+		sentinel = nil
+		runtime.GC()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			return
+		}
+	}
+}
+
+// registers 'o' for finalization if its new metatable has a __gc field
+// lua-5.3.4/src/lgc.c#luaC_checkfinalizer()
+func (self *luaState) checkFinalizer(o luaValue, mt *luaTable) {
+	if mt == nil || mt.get("__gc") == nil {
+		return
+	}
+	g := self.global
+	switch x := o.(type) {
+	case *luaTable:
+		runtime.SetFinalizer(x, nil)
+		runtime.SetFinalizer(x, func(t *luaTable) { g.separate(t) })
+	case *userdata:
+		runtime.SetFinalizer(x, nil)
+		runtime.SetFinalizer(x, func(u *userdata) { g.separate(u) })
+	}
+}
+
+// queues an unreachable object, called by the Go runtime
+// lua-5.3.4/src/lgc.c#separatetobefnz()
+func (g *globalState) separate(o luaValue) {
+	g.mu.Lock()
+	g.tobefnz = append(g.tobefnz, o)
+	atomic.StoreInt32(&g.nTobefnz, int32(len(g.tobefnz)))
+	g.mu.Unlock()
+}
+
+// lua-5.3.4/src/lgc.c#udata2finalize()
+func (g *globalState) udata2finalize() luaValue {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.tobefnz) == 0 {
+		return nil
+	}
+	o := g.tobefnz[0]
+	g.tobefnz[0] = nil
+	g.tobefnz = g.tobefnz[1:]
+	atomic.StoreInt32(&g.nTobefnz, int32(len(g.tobefnz)))
+	return o
+}
+
+// lua-5.3.4/src/lgc.c#callallpendingfinalizers()
+func (self *luaState) callAllPendingFinalizers() {
+	g := self.global
+	if g.finalizing { /* called from a finalizer? */
+		return
+	}
+	g.finalizing = true
+	defer func() { g.finalizing = false }()
+	for o := g.udata2finalize(); o != nil; o = g.udata2finalize() {
+		self.gctm(o)
+	}
+}
+
+// lua-5.3.4/src/lgc.c#GCTM()
+func (self *luaState) gctm(o luaValue) {
+	tm := getMetafield(o, "__gc", self)
+	if tm == nil { /* metatable changed since? */
+		return
+	}
+	self.stack.check(2)
+	self.stack.push(tm)
+	self.stack.push(o)
+	if status := self.PCall(1, 0, 0); status != LUA_OK { /* error while running __gc? */
+		msg, ok := self.stack.pop().(string)
+		if !ok {
+			msg = "no message"
+		}
+		self.stack.push(fmt.Sprintf("error in __gc metamethod (%s)", msg))
+		self.Error()
+	}
+}
+
+func (g *gcState) markValue(val luaValue) {
+	if s, ok := val.(string); ok {
+		g.bytes += sizeOf(s)
+		return
+	}
+	mark := markOf(val)
+	if mark == nil || *mark == g.epoch {
+		return
+	}
+	*mark = g.epoch
+	g.bytes += sizeOf(val)
+	g.gray = append(g.gray, val)
+}
+
+func (g *gcState) isMarked(val luaValue) bool {
+	mark := markOf(val)
+	return mark == nil || *mark == g.epoch
+}
+
+// lua-5.3.4/src/lgc.c#propagateall()
+func (g *gcState) propagateAll() {
+	for len(g.gray) > 0 {
+		val := g.gray[len(g.gray)-1]
+		g.gray = g.gray[:len(g.gray)-1]
+		switch x := val.(type) {
+		case *luaTable:
+			g.traverseTable(x)
+		case *closure:
+			if x.proto != nil && !g.protos[x.proto] {
+				g.protos[x.proto] = true
+				g.bytes += sizeOfProto(x.proto)
+			}
+			for _, uv := range x.upvals {
+				if uv != nil {
+					g.markValue(*uv.val)
+				}
+			}
+		case *userdata:
+			if x.metatable != nil {
+				g.markValue(x.metatable)
+			}
+		case *luaState:
+			g.traverseThread(x)
+		}
+	}
+}
+
+// lua-5.3.4/src/lgc.c#traversetable()
+func (g *gcState) traverseTable(t *luaTable) {
+	weakKey, weakValue := false, false
+	if t.metatable != nil {
+		g.markValue(t.metatable)
+		if mode, ok := t.metatable.get("__mode").(string); ok {
+			weakKey = strings.IndexByte(mode, 'k') >= 0
+			weakValue = strings.IndexByte(mode, 'v') >= 0
+		}
+	}
+
+	switch {
+	case weakKey && weakValue: /* nothing to traverse now */
+		g.allWeak = append(g.allWeak, t)
+	case weakKey: /* is table an ephemeron? */
+		g.ephemerons = append(g.ephemerons, t)
+		g.traverseEphemeron(t)
+	case weakValue: /* mark the keys only */
+		g.weak = append(g.weak, t)
+		for _, node := range t.nodes {
+			if node.val != nil {
+				g.markValue(node.key)
+			}
+		}
+	default: /* strong table */
+		for _, v := range t.arr {
+			g.markValue(v)
+		}
+		for _, node := range t.nodes {
+			if node.val != nil {
+				g.markValue(node.key)
+				g.markValue(node.val)
+			}
+		}
+	}
+}
+
+// marks the values whose keys are marked,
+// reports whether anything was marked
+// lua-5.3.4/src/lgc.c#traverseephemeron()
+func (g *gcState) traverseEphemeron(t *luaTable) bool {
+	marked := false
+	for _, v := range t.arr { /* integer keys are never collected */
+		if !g.isMarked(v) {
+			g.markValue(v)
+			marked = true
+		}
+	}
+	for _, node := range t.nodes {
+		if node.val != nil && g.isMarked(node.key) && !g.isMarked(node.val) {
+			g.markValue(node.val)
+			marked = true
+		}
+	}
+	return marked
+}
+
+// lua-5.3.4/src/lgc.c#convergeephemerons()
+func (g *gcState) convergeEphemerons() {
+	for changed := true; changed; {
+		changed = false
+		for _, t := range g.ephemerons {
+			if g.traverseEphemeron(t) {
+				g.propagateAll()
+				changed = true
+			}
+		}
+	}
+}
+
+// lua-5.3.4/src/lgc.c#traversethread()
+func (g *gcState) traverseThread(ls *luaState) {
+	for stack := ls.stack; stack != nil; stack = stack.prev {
+		if stack.closure != nil {
+			g.markValue(stack.closure)
+		}
+		regs, pushed := liveSlots(stack)
+		for _, v := range regs {
+			g.markValue(v)
+		}
+		for i := len(regs); i < stack.top-len(pushed); i++ {
+			stack.slots[i] = nil /* dead, or the Go GC would keep its value */
+		}
+		for _, v := range pushed {
+			g.markValue(v)
+		}
+		for _, v := range stack.varargs {
+			g.markValue(v)
+		}
+	}
+	if ls.coCaller != nil {
+		g.markValue(ls.coCaller)
+	}
+}
+
+/*
+** In Lua the frame of a function called by a CALL starts at R(A), so
+** the registers from there on are dead while the caller waits, and
+** their stale values would keep garbage alive: only the registers
+** below and the values pushed above them are live. traverseThread
+** clears the dead ones, as traversethread() clears the stack above
+** the top, since the Go GC still sees the values left in them.
+ */
+func liveSlots(stack *luaStack) ([]luaValue, []luaValue) {
+	slots := stack.slots[:stack.top]
+	c := stack.closure
+	if c == nil || c.proto == nil || stack.pc == 0 {
+		return slots, nil
+	}
+	nRegs := int(c.proto.MaxStackSize)
+	if nRegs > len(slots) {
+		return slots, nil
+	}
+	i := vm.Instruction(c.proto.Code[stack.pc-1])
+	switch i.Opcode() {
+	case vm.OP_CALL, vm.OP_TAILCALL:
+		a, _, _ := i.ABC()
+		return slots[:a], slots[nRegs:]
+	case vm.OP_TFORCALL:
+		a, _, _ := i.ABC()
+		return slots[:a+3], slots[nRegs:]
+	}
+	return slots, nil
+}
+
+// removes the entries with unmarked values
+// lua-5.3.4/src/lgc.c#clearvalues()
+func (g *gcState) clearByValues(t *luaTable) {
+	for i, v := range t.arr {
+		if !g.isMarked(v) {
+			t.arr[i] = nil
+		}
+	}
+	for i := range t.nodes {
+		if !g.isMarked(t.nodes[i].val) {
+			t.nodes[i].val = nil
+		}
+	}
+}
+
+// removes the entries with unmarked keys; as nothing can reach those
+// keys any more, not even a traversal, their nodes are forgotten
+// lua-5.3.4/src/lgc.c#clearkeys()
+func (g *gcState) clearByKeys(t *luaTable) {
+	for i := range t.nodes {
+		if node := &t.nodes[i]; node.key != nil && !g.isMarked(node.key) {
+			delete(t.index, node.key)
+			node.key, node.val = nil, nil
+		}
+	}
+}
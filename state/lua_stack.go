@@ -7,11 +7,12 @@ type luaStack struct {
 	slots []luaValue
 	top   int
 	/* call info */
-	state   *luaState
-	closure *closure
-	varargs []luaValue
-	openuvs map[int]*upvalue
-	pc      int
+	state    *luaState
+	closure  *closure
+	varargs  []luaValue
+	openuvs  map[int]*upvalue
+	pc       int
+	tailcall bool // frame reused by a tail call
 	/* linked list */
 	prev *luaStack
 }
@@ -144,3 +145,15 @@ func (self *luaStack) reverse(from, to int) {
 		to--
 	}
 }
+
+// line of the instruction being executed, or -1 if there is no line info
+func (self *luaStack) currentLine() int {
+	if self.closure == nil || self.closure.proto == nil {
+		return -1
+	}
+	lineInfo := self.closure.proto.LineInfo
+	if pc := self.pc - 1; pc >= 0 && pc < len(lineInfo) {
+		return int(lineInfo[pc])
+	}
+	return -1
+}
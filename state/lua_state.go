@@ -7,7 +7,10 @@ import (
 type luaState struct {
 	debug    bool
 	registry *luaTable
+	global   *globalState
 	stack    *luaStack
+	frees    []*luaStack // call frames ready for reuse
+	gcMark   uint32      // last cycle that marked it
 	/* coroutine */
 	coStatus int
 	coCaller *luaState
@@ -19,7 +22,7 @@ func New() LuaState {
 }
 
 func NewState(debug bool) LuaState {
-	ls := &luaState{debug: debug}
+	ls := &luaState{debug: debug, global: newGlobalState()}
 
 	registry := newLuaTable(8, 0)
 	registry.put(LUA_RIDX_MAINTHREAD, ls)
@@ -44,3 +47,39 @@ func (self *luaState) popLuaStack() {
 	self.stack = stack.prev
 	stack.prev = nil
 }
+
+/*
+** Frames of Lua functions are recycled once they return, unless an
+** upvalue still points into their slots.
+ */
+const maxFreeStacks = 64
+
+func (self *luaState) allocLuaStack(size int) *luaStack {
+	n := len(self.frees)
+	if n == 0 {
+		return newLuaStack(size, self)
+	}
+	stack := self.frees[n-1]
+	self.frees = self.frees[:n-1]
+	if cap(stack.slots) >= size {
+		stack.slots = stack.slots[:size]
+	} else {
+		stack.slots = make([]luaValue, size)
+	}
+	return stack
+}
+
+func (self *luaState) freeLuaStack(stack *luaStack) {
+	if stack.openuvs != nil || len(self.frees) >= maxFreeStacks {
+		return
+	}
+	for i := range stack.slots {
+		stack.slots[i] = nil
+	}
+	stack.top = 0
+	stack.closure = nil
+	stack.varargs = nil
+	stack.pc = 0
+	stack.tailcall = false
+	self.frees = append(self.frees, stack)
+}
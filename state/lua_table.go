@@ -5,13 +5,30 @@ import (
 	"math"
 )
 
+/*
+** A table keeps positive integer keys in an array part when it is
+** dense enough, like lua-5.3.4/src/ltable.c, and all other keys in a
+** hash part whose nodes are kept in insertion order. The map 'index'
+** only locates a key's node, so 'next' walks the array part and then
+** the nodes, without building anything.
+**
+** Removing a field leaves its slot (or node) in place with a nil
+** value, which keeps traversals valid while fields are cleared. Dead
+** nodes are dropped and integer keys moved to the array part by
+** 'rehash', which only runs when a new key does not fit: adding keys
+** during a traversal is undefined, as in Lua.
+ */
 type luaTable struct {
 	metatable *luaTable
-	arr       []luaValue
-	_map      map[luaValue]luaValue
-	keys      map[luaValue]luaValue // used by next()
-	lastKey   luaValue              // used by next()
-	changed   bool                  // used by next()
+	arr       []luaValue       // t[1] .. t[len(arr)], may contain nils
+	nodes     []luaNode        // hash part, in insertion order
+	index     map[luaValue]int // key -> position in nodes
+	gcMark    uint32           // last cycle that marked it
+}
+
+type luaNode struct {
+	key luaValue
+	val luaValue // nil if the field was removed
 }
 
 func newLuaTable(nArr, nRec int) *luaTable {
@@ -20,7 +37,8 @@ func newLuaTable(nArr, nRec int) *luaTable {
 		t.arr = make([]luaValue, 0, nArr)
 	}
 	if nRec > 0 {
-		t._map = make(map[luaValue]luaValue, nRec)
+		t.nodes = make([]luaNode, 0, nRec)
+		t.index = make(map[luaValue]int, nRec)
 	}
 	return t
 }
@@ -30,8 +48,58 @@ func (self *luaTable) hasMetafield(fieldName string) bool {
 		self.metatable.get(fieldName) != nil
 }
 
+// Try to find a boundary in table 't'. A 'boundary' is an integer index
+// such that t[i] is non-nil and t[i+1] is nil (and 0 if t[1] is nil).
+// lua-5.3.4/src/ltable.c#luaH_getn()
 func (self *luaTable) len() int {
-	return len(self.arr)
+	j := len(self.arr)
+	if j > 0 && self.arr[j-1] == nil {
+		/* there is a boundary in the array part: (binary) search for it */
+		i := 0
+		for j-i > 1 {
+			m := (i + j) / 2
+			if self.arr[m-1] == nil {
+				j = m
+			} else {
+				i = m
+			}
+		}
+		return i
+	}
+	/* else must find a boundary in hash part */
+	if len(self.index) == 0 { /* hash part is empty? */
+		return j /* that is easy... */
+	}
+	return self.unboundSearch(j)
+}
+
+// lua-5.3.4/src/ltable.c#unbound_search()
+func (self *luaTable) unboundSearch(j int) int {
+	i := j /* i is zero or a present index */
+	j++
+	/* find 'i' and 'j' such that i is present and j is not */
+	for self.get(int64(j)) != nil {
+		i = j
+		if j > math.MaxInt32/2 { /* overflow? */
+			/* table was built with bad purposes: resort to linear search */
+			i = 1
+			for self.get(int64(i)) != nil {
+				i++
+			}
+			return i - 1
+		}
+		j *= 2
+	}
+	/* now do a binary search between them */
+	for j-i > 1 {
+		m := (i + j) / 2
+		if self.get(int64(m)) == nil {
+			j = m
+		} else {
+			i = m
+		}
+	}
+	return i
 }
 
 func (self *luaTable) get(key luaValue) luaValue {
@@ -41,7 +109,10 @@ func (self *luaTable) get(key luaValue) luaValue {
 			return self.arr[idx-1]
 		}
 	}
-	return self._map[key]
+	if pos, ok := self.index[key]; ok {
+		return self.nodes[pos].val
+	}
+	return nil
 }
 
 func _floatToInteger(key luaValue) luaValue {
@@ -61,83 +132,157 @@ func (self *luaTable) put(key, val luaValue) {
 		panic("table index is NaN!")
 	}
 
-	self.changed = true
 	key = _floatToInteger(key)
-	if idx, ok := key.(int64); ok && idx >= 1 {
-		arrLen := int64(len(self.arr))
-		if idx <= arrLen {
-			self.arr[idx-1] = val
-			if idx == arrLen && val == nil {
-				self._shrinkArray()
-			}
-			return
+	idx, isInt := key.(int64)
+	if isInt && idx >= 1 && idx <= int64(len(self.arr)) {
+		self.arr[idx-1] = val
+		return
+	}
+	if pos, ok := self.index[key]; ok {
+		self.nodes[pos].val = val
+		return
+	}
+	if val == nil { /* removing an absent key */
+		return
+	}
+	if isInt && idx == int64(len(self.arr))+1 {
+		self.arr = append(self.arr, val)
+		self._expandArray()
+		return
+	}
+	if len(self.nodes) == cap(self.nodes) { /* no free node? */
+		self.rehash(key)
+		self.put(key, val) /* the array part may have grown */
+		return
+	}
+	if self.index == nil {
+		self.index = make(map[luaValue]int, cap(self.nodes))
+	}
+	self.index[key] = len(self.nodes)
+	self.nodes = append(self.nodes, luaNode{key, val})
+}
+
+// moves the keys following the array part from the hash part
+func (self *luaTable) _expandArray() {
+	for {
+		key := int64(len(self.arr)) + 1
+		pos, ok := self.index[key]
+		if !ok || self.nodes[pos].val == nil {
+			break
 		}
-		if idx == arrLen+1 {
-			delete(self._map, key)
-			if val != nil {
-				self.arr = append(self.arr, val)
-				self._expandArray()
-			}
-			return
+		self.arr = append(self.arr, self.nodes[pos].val)
+		self.nodes[pos].val = nil /* the node is dead now */
+	}
+}
+
+/*
+** Computes the new size of the array part, the largest power of 2
+** 'n' such that more than half of the slots 1..n would be in use,
+** then rebuilds both parts without the dead nodes.
+ */
+// lua-5.3.4/src/ltable.c#rehash()
+func (self *luaTable) rehash(extraKey luaValue) {
+	var nums [64]int /* nums[i] = number of keys k where 2^(i-1) < k <= 2^i */
+	nInts := 0       /* number of integer keys that can go to the array part */
+	nLive := 0       /* number of live nodes */
+	for i, v := range self.arr {
+		if v != nil {
+			nums[_ceilLog2(i+1)]++
+			nInts++
 		}
 	}
-	if val != nil {
-		if self._map == nil {
-			self._map = make(map[luaValue]luaValue, 8)
+	countInt := func(key luaValue) {
+		if idx, ok := key.(int64); ok && idx >= 1 && idx <= math.MaxInt32 {
+			nums[_ceilLog2(int(idx))]++
+			nInts++
 		}
-		self._map[key] = val
-	} else {
-		delete(self._map, key)
 	}
-}
+	for _, node := range self.nodes {
+		if node.val != nil {
+			countInt(node.key)
+			nLive++
+		}
+	}
+	countInt(extraKey)
 
-func (self *luaTable) _shrinkArray() {
-	for i := len(self.arr) - 1; i >= 0; i-- {
-		if self.arr[i] == nil {
-			self.arr = self.arr[0:i]
+	/* compute new size for array part */
+	// lua-5.3.4/src/ltable.c#computesizes()
+	sizeArr, a := 0, 0
+	for i, twotoi := 0, 1; twotoi > 0 && nInts > twotoi/2; i, twotoi = i+1, twotoi*2 {
+		if nums[i] > 0 {
+			a += nums[i]
+			if a > twotoi/2 { /* more than half elements present? */
+				sizeArr = twotoi /* optimal size (till now) */
+			}
 		}
 	}
-}
 
-func (self *luaTable) _expandArray() {
-	for idx := int64(len(self.arr)) + 1; true; idx++ {
-		if val, found := self._map[idx]; found {
-			delete(self._map, idx)
-			self.arr = append(self.arr, val)
-		} else {
-			break
+	/* resize the array part */
+	oldArr, oldNodes := self.arr, self.nodes
+	self.arr = make([]luaValue, sizeArr)
+	copy(self.arr, oldArr)
+
+	/* re-insert the remaining elements */
+	size := 4
+	for size < nLive+1 {
+		size *= 2
+	}
+	self.nodes = make([]luaNode, 0, size)
+	self.index = make(map[luaValue]int, size)
+	for i := sizeArr; i < len(oldArr); i++ { /* array part shrank? */
+		if oldArr[i] != nil {
+			self._reinsert(int64(i+1), oldArr[i])
+		}
+	}
+	for _, node := range oldNodes {
+		if node.val != nil {
+			self._reinsert(node.key, node.val)
 		}
 	}
 }
 
-func (self *luaTable) nextKey(key luaValue) luaValue {
-	if self.keys == nil || (key == nil && self.changed) {
-		self.initKeys()
-		self.changed = false
+func (self *luaTable) _reinsert(key, val luaValue) {
+	if idx, ok := key.(int64); ok && idx >= 1 && idx <= int64(len(self.arr)) {
+		self.arr[idx-1] = val
+		return
 	}
+	self.index[key] = len(self.nodes)
+	self.nodes = append(self.nodes, luaNode{key, val})
+}
 
-	nextKey := self.keys[key]
-	if nextKey == nil && key != nil && key != self.lastKey {
-		panic("invalid key to 'next'")
+// ceil(log2(x))
+func _ceilLog2(x int) int {
+	l := 0
+	for x--; x > 0; x >>= 1 {
+		l++
 	}
-
-	return nextKey
+	return l
 }
 
-func (self *luaTable) initKeys() {
-	self.keys = make(map[luaValue]luaValue)
-	var key luaValue = nil
-	for i, v := range self.arr {
-		if v != nil {
-			self.keys[key] = int64(i + 1)
-			key = int64(i + 1)
+// returns the key following 'key' and its value, or nil when the
+// traversal is over
+// lua-5.3.4/src/ltable.c#luaH_next()
+func (self *luaTable) next(key luaValue) (luaValue, luaValue) {
+	i := 0 /* position in the array part, then in the nodes */
+	if key != nil {
+		key = _floatToInteger(key)
+		if idx, ok := key.(int64); ok && idx >= 1 && idx <= int64(len(self.arr)) {
+			i = int(idx)
+		} else if pos, ok := self.index[key]; ok {
+			i = len(self.arr) + pos + 1
+		} else {
+			panic("invalid key to 'next'")
 		}
 	}
-	for k, v := range self._map {
-		if v != nil {
-			self.keys[key] = k
-			key = k
+	for ; i < len(self.arr); i++ {
+		if self.arr[i] != nil {
+			return int64(i + 1), self.arr[i]
+		}
+	}
+	for i -= len(self.arr); i < len(self.nodes); i++ {
+		if node := self.nodes[i]; node.val != nil {
+			return node.key, node.val
 		}
 	}
-	self.lastKey = key
+	return nil, nil
 }
@@ -24,6 +24,8 @@ func typeOf(val luaValue) LuaType {
 		return LUA_TFUNCTION
 	case *luaState:
 		return LUA_TTHREAD
+	case *userdata:
+		return LUA_TUSERDATA
 	default:
 		panic("todo!")
 	}
@@ -84,6 +86,9 @@ func getMetatable(val luaValue, ls *luaState) *luaTable {
 	if t, ok := val.(*luaTable); ok {
 		return t.metatable
 	}
+	if u, ok := val.(*userdata); ok {
+		return u.metatable
+	}
 	key := fmt.Sprintf("_MT%d", typeOf(val))
 	if mt := ls.registry.get(key); mt != nil {
 		return mt.(*luaTable)
@@ -94,6 +99,12 @@ func getMetatable(val luaValue, ls *luaState) *luaTable {
 func setMetatable(val luaValue, mt *luaTable, ls *luaState) {
 	if t, ok := val.(*luaTable); ok {
 		t.metatable = mt
+		ls.checkFinalizer(t, mt)
+		return
+	}
+	if u, ok := val.(*userdata); ok {
+		u.metatable = mt
+		ls.checkFinalizer(u, mt)
 		return
 	}
 	key := fmt.Sprintf("_MT%d", typeOf(val))
@@ -0,0 +1,259 @@
+package state
+
+import (
+	. "lxa/api"
+	"lxa/binchunk"
+	"lxa/vm"
+)
+
+/*
+** Fast path of the interpreter loop: the most frequent instructions
+** are executed directly on the registers of the running frame, R(x)
+** being 'stack.slots[x]', with inlined integer/float arithmetic and
+** raw table access. Whenever an operand needs a conversion or a
+** metamethod, 'execute' gives up and the instruction is run by its
+** generic implementation in package vm, through the LuaVM API.
+ */
+
+// returns false if the instruction was not executed
+func (self *luaState) execute(stack *luaStack, proto *binchunk.Prototype, i vm.Instruction) bool {
+	slots := stack.slots
+	switch i.Opcode() {
+	case vm.OP_MOVE: // R(A) := R(B)
+		a, b, _ := i.ABC()
+		slots[a] = slots[b]
+	case vm.OP_LOADK: // R(A) := Kst(Bx)
+		a, bx := i.ABx()
+		slots[a] = proto.Constants[bx]
+	case vm.OP_LOADBOOL: // R(A) := (bool)B; if (C) pc++
+		a, b, c := i.ABC()
+		slots[a] = b != 0
+		if c != 0 {
+			stack.pc++
+		}
+	case vm.OP_GETUPVAL: // R(A) := UpValue[B]
+		a, b, _ := i.ABC()
+		slots[a] = *(stack.closure.upvals[b].val)
+	case vm.OP_GETTABUP: // R(A) := UpValue[B][RK(C)]
+		a, b, c := i.ABC()
+		t := *(stack.closure.upvals[b].val)
+		if v, ok := _rawIndex(t, _rk(stack, proto, c)); ok {
+			slots[a] = v
+			return true
+		}
+		return false
+	case vm.OP_GETTABLE: // R(A) := R(B)[RK(C)]
+		a, b, c := i.ABC()
+		if v, ok := _rawIndex(slots[b], _rk(stack, proto, c)); ok {
+			slots[a] = v
+			return true
+		}
+		return false
+	case vm.OP_SETTABUP: // UpValue[A][RK(B)] := RK(C)
+		a, b, c := i.ABC()
+		t := *(stack.closure.upvals[a].val)
+		return _rawSetIndex(t, _rk(stack, proto, b), _rk(stack, proto, c))
+	case vm.OP_SETTABLE: // R(A)[RK(B)] := RK(C)
+		a, b, c := i.ABC()
+		return _rawSetIndex(slots[a], _rk(stack, proto, b), _rk(stack, proto, c))
+	case vm.OP_ADD, vm.OP_SUB, vm.OP_MUL, vm.OP_MOD, vm.OP_DIV, vm.OP_IDIV:
+		a, b, c := i.ABC()
+		x, y := _rk(stack, proto, b), _rk(stack, proto, c)
+		if v := _arithNumbers(i.Opcode(), x, y); v != nil {
+			slots[a] = v
+			return true
+		}
+		return false
+	case vm.OP_UNM: // R(A) := -R(B)
+		a, b, _ := i.ABC()
+		switch x := slots[b].(type) {
+		case int64:
+			slots[a] = -x
+		case float64:
+			slots[a] = -x
+		default:
+			return false
+		}
+	case vm.OP_NOT: // R(A) := not R(B)
+		a, b, _ := i.ABC()
+		slots[a] = !convertToBoolean(slots[b])
+	case vm.OP_JMP: // pc+=sBx; if (A) close all upvalues >= R(A - 1)
+		a, sBx := i.AsBx()
+		if a != 0 {
+			return false
+		}
+		stack.pc += sBx
+	case vm.OP_EQ: // if ((RK(B) == RK(C)) ~= A) then pc++
+		a, b, c := i.ABC()
+		if _eq(_rk(stack, proto, b), _rk(stack, proto, c), self) != (a != 0) {
+			stack.pc++
+		}
+	case vm.OP_LT: // if ((RK(B) <  RK(C)) ~= A) then pc++
+		a, b, c := i.ABC()
+		if _lt(_rk(stack, proto, b), _rk(stack, proto, c), self) != (a != 0) {
+			stack.pc++
+		}
+	case vm.OP_LE: // if ((RK(B) <= RK(C)) ~= A) then pc++
+		a, b, c := i.ABC()
+		if _le(_rk(stack, proto, b), _rk(stack, proto, c), self) != (a != 0) {
+			stack.pc++
+		}
+	case vm.OP_TEST: // if not (R(A) <=> C) then pc++
+		a, _, c := i.ABC()
+		if convertToBoolean(slots[a]) != (c != 0) {
+			stack.pc++
+		}
+	case vm.OP_TESTSET: // if (R(B) <=> C) then R(A) := R(B) else pc++
+		a, b, c := i.ABC()
+		if convertToBoolean(slots[b]) == (c != 0) {
+			slots[a] = slots[b]
+		} else {
+			stack.pc++
+		}
+	case vm.OP_CALL: // R(A), ... ,R(A+C-2) := R(A)(R(A+1), ... ,R(A+B-1))
+		a, b, c := i.ABC()
+		if b == 0 || c == 0 { // variable number of arguments or results
+			return false
+		}
+		stack.check(b)
+		for j := a; j < a+b; j++ {
+			stack.push(stack.slots[j])
+		}
+		self.Call(b-1, c-1)
+		for j := a + c - 2; j >= a; j-- {
+			stack.slots[j] = stack.pop()
+		}
+	case vm.OP_FORPREP: // R(A)-=R(A+2); pc+=sBx
+		a, sBx := i.AsBx()
+		init, ok1 := slots[a].(int64)
+		_, ok2 := slots[a+1].(int64)
+		step, ok3 := slots[a+2].(int64)
+		if !ok1 || !ok2 || !ok3 {
+			return false
+		}
+		slots[a] = init - step
+		stack.pc += sBx
+	case vm.OP_FORLOOP: // R(A)+=R(A+2); if R(A) <?= R(A+1) then { pc+=sBx; R(A+3)=R(A) }
+		a, sBx := i.AsBx()
+		switch idx := slots[a].(type) {
+		case int64:
+			limit, ok1 := slots[a+1].(int64)
+			step, ok2 := slots[a+2].(int64)
+			if !ok1 || !ok2 {
+				return false
+			}
+			idx += step
+			slots[a] = idx
+			if step >= 0 && idx <= limit || step < 0 && limit <= idx {
+				stack.pc += sBx
+				slots[a+3] = idx
+			}
+		case float64:
+			limit, ok1 := slots[a+1].(float64)
+			step, ok2 := slots[a+2].(float64)
+			if !ok1 || !ok2 {
+				return false
+			}
+			idx += step
+			slots[a] = idx
+			if step >= 0 && idx <= limit || step < 0 && limit <= idx {
+				stack.pc += sBx
+				slots[a+3] = idx
+			}
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// RK(x): constant or register
+func _rk(stack *luaStack, proto *binchunk.Prototype, x int) luaValue {
+	if x > 0xFF { // constant
+		return proto.Constants[x&0xFF]
+	}
+	return stack.slots[x]
+}
+
+// t[k] if no metamethod is involved
+func _rawIndex(t, k luaValue) (luaValue, bool) {
+	if tbl, ok := t.(*luaTable); ok {
+		v := tbl.get(k)
+		if v != nil || tbl.metatable == nil || !tbl.hasMetafield("__index") {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// t[k]=v if no metamethod is involved
+func _rawSetIndex(t, k, v luaValue) bool {
+	if tbl, ok := t.(*luaTable); ok {
+		if tbl.metatable == nil || tbl.get(k) != nil || !tbl.hasMetafield("__newindex") {
+			tbl.put(k, v)
+			return true
+		}
+	}
+	return false
+}
+
+// x op y if both operands are numbers, nil otherwise
+func _arithNumbers(op int, x, y luaValue) luaValue {
+	var operator operator
+	switch op {
+	case vm.OP_ADD:
+		if i, ok := x.(int64); ok {
+			if j, ok := y.(int64); ok {
+				return i + j
+			}
+		} else if f, ok := x.(float64); ok {
+			if g, ok := y.(float64); ok {
+				return f + g
+			}
+		}
+		operator = operators[LUA_OPADD]
+	case vm.OP_SUB:
+		if i, ok := x.(int64); ok {
+			if j, ok := y.(int64); ok {
+				return i - j
+			}
+		} else if f, ok := x.(float64); ok {
+			if g, ok := y.(float64); ok {
+				return f - g
+			}
+		}
+		operator = operators[LUA_OPSUB]
+	case vm.OP_MUL:
+		if i, ok := x.(int64); ok {
+			if j, ok := y.(int64); ok {
+				return i * j
+			}
+		} else if f, ok := x.(float64); ok {
+			if g, ok := y.(float64); ok {
+				return f * g
+			}
+		}
+		operator = operators[LUA_OPMUL]
+	case vm.OP_MOD:
+		operator = operators[LUA_OPMOD]
+	case vm.OP_DIV:
+		operator = operators[LUA_OPDIV]
+	case vm.OP_IDIV:
+		operator = operators[LUA_OPIDIV]
+	}
+
+	// mixed integer/float operands
+	switch x.(type) {
+	case int64, float64:
+	default:
+		return nil
+	}
+	switch y.(type) {
+	case int64, float64:
+	default:
+		return nil
+	}
+	return _arith(x, y, operator)
+}
@@ -0,0 +1,8 @@
+package state
+
+// full userdata: an arbitrary Go value with its own metatable
+type userdata struct {
+	metatable *luaTable
+	data      interface{}
+	gcMark    uint32 // last cycle that marked it
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package stdlib
+
+import "syscall"
+
+// the processor time used by the program, in seconds, as clock() counts it
+func cpuTime() float64 {
+	var ru syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &ru) != nil {
+		return 0
+	}
+	return float64(ru.Utime.Nano()+ru.Stime.Nano()) / 1e9
+}
@@ -0,0 +1,22 @@
+package stdlib
+
+import "syscall"
+
+// the processor time used by the program, in seconds, as clock() counts it
+func cpuTime() float64 {
+	var creation, exit, kernel, user syscall.Filetime
+	h, err := syscall.GetCurrentProcess()
+	if err == nil {
+		err = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user)
+	}
+	if err != nil {
+		return 0
+	}
+	return float64(duration(kernel)+duration(user)) / 1e9
+}
+
+// a filetime holding a duration, in nanoseconds. Filetime.Nanoseconds
+// takes it for a date and counts from 1970, not from 0.
+func duration(ft syscall.Filetime) int64 {
+	return (int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)) * 100
+}
@@ -1,7 +1,9 @@
 package stdlib
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 
@@ -9,27 +11,28 @@ import (
 )
 
 var baseFuncs = map[string]GoFunction{
-	"print":        basePrint,
-	"assert":       baseAssert,
-	"error":        baseError,
-	"select":       baseSelect,
-	"ipairs":       baseIPairs,
-	"pairs":        basePairs,
-	"next":         baseNext,
-	"load":         baseLoad,
-	"loadfile":     baseLoadFile,
-	"dofile":       baseDoFile,
-	"pcall":        basePCall,
-	"xpcall":       baseXPCall,
-	"getmetatable": baseGetMetatable,
-	"setmetatable": baseSetMetatable,
-	"rawequal":     baseRawEqual,
-	"rawlen":       baseRawLen,
-	"rawget":       baseRawGet,
-	"rawset":       baseRawSet,
-	"type":         baseType,
-	"tostring":     baseToString,
-	"tonumber":     baseToNumber,
+	"print":          basePrint,
+	"assert":         baseAssert,
+	"error":          baseError,
+	"select":         baseSelect,
+	"ipairs":         baseIPairs,
+	"pairs":          basePairs,
+	"next":           baseNext,
+	"load":           baseLoad,
+	"loadfile":       baseLoadFile,
+	"dofile":         baseDoFile,
+	"pcall":          basePCall,
+	"xpcall":         baseXPCall,
+	"getmetatable":   baseGetMetatable,
+	"setmetatable":   baseSetMetatable,
+	"rawequal":       baseRawEqual,
+	"rawlen":         baseRawLen,
+	"rawget":         baseRawGet,
+	"rawset":         baseRawSet,
+	"type":           baseType,
+	"tostring":       baseToString,
+	"tonumber":       baseToNumber,
+	"collectgarbage": baseCollectGarbage,
 	/* placeholders */
 	"_G":       nil,
 	"_VERSION": nil,
@@ -95,9 +98,9 @@ func baseError(ls LuaState) int {
 	level := int(ls.OptInteger(2, 1))
 	ls.SetTop(1)
 	if ls.Type(1) == LUA_TSTRING && level > 0 {
-		// ls.Where(level) /* add extra information */
-		// ls.PushValue(1)
-		// ls.Concat(2)
+		ls.Where(level) /* add extra information */
+		ls.PushValue(1)
+		ls.Concat(2)
 	}
 	return ls.Error()
 }
@@ -188,11 +191,52 @@ func baseLoad(ls LuaState) int {
 		chunkname := ls.OptString(2, chunk)
 		status = ls.Load([]byte(chunk), chunkname, mode)
 	} else { /* loading from a reader function */
-		panic("loading from a reader function") // todo
+		chunkname := ls.OptString(2, "=(load)")
+		ls.CheckType(1, LUA_TFUNCTION)
+		status = ls.LoadReader(&genericReader{ls: ls}, chunkname, mode)
 	}
 	return loadAux(ls, status, env)
 }
 
+/*
+** Reader for generic 'load' function: 'lua_load' uses the
+** stack for internal stuff, so the reader keeps the current
+** piece in a Go buffer instead of a reserved slot.
+ */
+// lua-5.3.4/src/lbaselib.c#generic_reader()
+type genericReader struct {
+	ls  LuaState
+	buf string
+}
+
+func (self *genericReader) Read(p []byte) (int, error) {
+	ls := self.ls
+	for len(self.buf) == 0 {
+		ls.CheckStack2(2, "too many nested functions")
+		ls.PushValue(1) /* get function */
+		if ls.PCall(0, 1, 0) != LUA_OK {
+			msg := ls.ToString(-1)
+			ls.Pop(1)
+			return 0, errors.New(msg)
+		}
+		if ls.IsNil(-1) {
+			ls.Pop(1) /* pop result */
+			return 0, io.EOF
+		} else if !ls.IsString(-1) {
+			ls.Pop(1)
+			return 0, errors.New("reader function must return a string")
+		}
+		self.buf = ls.ToString(-1)
+		ls.Pop(1)
+		if len(self.buf) == 0 { /* empty piece ends the chunk */
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, self.buf)
+	self.buf = self.buf[n:]
+	return n, nil
+}
+
 // lua-5.3.4/src/lbaselib.c#load_aux()
 func loadAux(ls LuaState, status, envIdx int) int {
 	if status == LUA_OK {
@@ -234,6 +278,40 @@ func baseDoFile(ls LuaState) int {
 	return ls.GetTop() - 1
 }
 
+// collectgarbage ([opt [, arg]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-collectgarbage
+// lua-5.3.4/src/lbaselib.c#luaB_collectgarbage()
+func baseCollectGarbage(ls LuaState) int {
+	opt := ls.OptString(1, "collect")
+	o, ok := _gcOpts[opt]
+	if !ok {
+		return ls.ArgError(1, "invalid option '"+opt+"'")
+	}
+	ex := int(ls.OptInteger(2, 0))
+	res := ls.GC(o, ex)
+	switch o {
+	case LUA_GCCOUNT:
+		b := ls.GC(LUA_GCCOUNTB, 0)
+		ls.PushNumber(float64(res) + float64(b)/1024)
+	case LUA_GCSTEP, LUA_GCISRUNNING:
+		ls.PushBoolean(res != 0)
+	default:
+		ls.PushInteger(int64(res))
+	}
+	return 1
+}
+
+var _gcOpts = map[string]int{
+	"stop":       LUA_GCSTOP,
+	"restart":    LUA_GCRESTART,
+	"collect":    LUA_GCCOLLECT,
+	"count":      LUA_GCCOUNT,
+	"step":       LUA_GCSTEP,
+	"setpause":   LUA_GCSETPAUSE,
+	"setstepmul": LUA_GCSETSTEPMUL,
+	"isrunning":  LUA_GCISRUNNING,
+}
+
 // pcall (f [, arg1, ···])
 // http://www.lua.org/manual/5.3/manual.html#pdf-pcall
 func basePCall(ls LuaState) int {
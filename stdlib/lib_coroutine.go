@@ -109,6 +109,7 @@ func coStatus(ls LuaState) int {
 
 // coroutine.isyieldable ()
 // http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.isyieldable
+// lua-5.3.4/src/lcorolib.c#luaB_yieldable()
 func coYieldable(ls LuaState) int {
 	ls.PushBoolean(ls.IsYieldable())
 	return 1
@@ -116,6 +117,7 @@ func coYieldable(ls LuaState) int {
 
 // coroutine.running ()
 // http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.running
+// lua-5.3.4/src/lcorolib.c#luaB_corunning()
 func coRunning(ls LuaState) int {
 	isMain := ls.PushThread()
 	ls.PushBoolean(isMain)
@@ -124,6 +126,24 @@ func coRunning(ls LuaState) int {
 
 // coroutine.wrap (f)
 // http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.wrap
+// lua-5.3.4/src/lcorolib.c#luaB_cowrap()
 func coWrap(ls LuaState) int {
-	panic("todo: coWrap!")
+	coCreate(ls)
+	ls.PushGoClosure(_auxWrap, 1)
+	return 1
+}
+
+// lua-5.3.4/src/lcorolib.c#auxwrap()
+func _auxWrap(ls LuaState) int {
+	co := ls.ToThread(LuaUpvalueIndex(1))
+	if r := _auxResume(ls, co, ls.GetTop()); r < 0 {
+		if ls.Type(-1) == LUA_TSTRING { /* error object is a string? */
+			ls.Where(1) /* get extra info */
+			ls.Insert(-2)
+			ls.Concat(2)
+		}
+		return ls.Error() /* propagate error */
+	} else {
+		return r
+	}
 }
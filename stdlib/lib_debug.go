@@ -0,0 +1,45 @@
+package stdlib
+
+import . "lxa/api"
+
+var dbLib = map[string]GoFunction{
+	"traceback": dbTraceback,
+}
+
+func OpenDebugLib(ls LuaState) int {
+	ls.NewLib(dbLib)
+	return 1
+}
+
+/*
+** Auxiliary function used by several library functions: check for
+** an optional thread as function's first argument and set 'arg' with
+** 1 if this argument is present (so that functions can skip it to
+** access their other arguments)
+ */
+// lua-5.3.4/src/ldblib.c#getthread()
+func _getThread(ls LuaState) (LuaState, int) {
+	if ls.IsThread(1) {
+		return ls.ToThread(1), 1
+	}
+	return ls, 0 /* function will operate over current thread */
+}
+
+// debug.traceback ([thread,] [message [, level]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.traceback
+// lua-5.3.4/src/ldblib.c#db_traceback()
+func dbTraceback(ls LuaState) int {
+	l1, arg := _getThread(ls)
+	msg, ok := ls.ToStringX(arg + 1)
+	if !ok && !ls.IsNoneOrNil(arg+1) { /* non-string 'msg'? */
+		ls.PushValue(arg + 1) /* return it untouched */
+	} else {
+		level := 0
+		if l1 == ls {
+			level = 1
+		}
+		level = int(ls.OptInteger(arg+2, int64(level)))
+		ls.Traceback(l1, msg, level)
+	}
+	return 1
+}
@@ -0,0 +1,285 @@
+package stdlib
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "lxa/api"
+)
+
+var fsLib = map[string]GoFunction{
+	"dir":        fsDir,
+	"stat":       fsStat,
+	"lstat":      fsLStat,
+	"mkdir":      fsMkdir,
+	"mkdirall":   fsMkdirAll,
+	"rmdir":      fsRmdir,
+	"glob":       fsGlob,
+	"walk":       fsWalk,
+	"chdir":      fsChdir,
+	"currentdir": fsCurrentDir,
+	"link":       fsLink,
+	"readlink":   fsReadLink,
+	"touch":      fsTouch,
+}
+
+func OpenFSLib(ls LuaState) int {
+	ls.NewLib(fsLib)
+	return 1
+}
+
+/*
+** Functions that can fail return 'nil, message, code' on error,
+** where code is the system error number (0 if there is none).
+ */
+// lua-5.3.4/src/lauxlib.c#luaL_fileresult()
+func _fsResult(ls LuaState, err error, fname string) int {
+	if err == nil {
+		ls.PushBoolean(true)
+		return 1
+	}
+	return _fsError(ls, err, fname)
+}
+
+func _fsError(ls LuaState, err error, fname string) int {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	} else if errors.As(err, &linkErr) {
+		err = linkErr.Err
+	}
+	ls.PushNil()
+	if fname != "" {
+		ls.PushFString("%s: %s", fname, err.Error())
+	} else {
+		ls.PushString(err.Error())
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		ls.PushInteger(int64(errno))
+	} else {
+		ls.PushInteger(0)
+	}
+	return 3
+}
+
+// fs.dir (path)
+// returns an iterator over the names of the entries in 'path'
+func fsDir(ls LuaState) int {
+	path := ls.CheckString(1)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return _fsError(ls, err, path)
+	}
+	i := 0
+	ls.PushGoFunction(func(ls LuaState) int {
+		if i >= len(entries) {
+			return 0
+		}
+		ls.PushString(entries[i].Name())
+		i++
+		return 1
+	})
+	return 1
+}
+
+// fs.stat (path [, field])
+func fsStat(ls LuaState) int {
+	return _pushStat(ls, os.Stat)
+}
+
+// fs.lstat (path [, field])
+// like fs.stat, but describes a symbolic link itself
+func fsLStat(ls LuaState) int {
+	return _pushStat(ls, os.Lstat)
+}
+
+func _pushStat(ls LuaState, stat func(string) (os.FileInfo, error)) int {
+	path := ls.CheckString(1)
+	info, err := stat(path)
+	if err != nil {
+		return _fsError(ls, err, path)
+	}
+	if ls.IsString(2) { /* only one field? */
+		switch field := ls.ToString(2); field {
+		case "mode":
+			ls.PushString(_fileMode(info.Mode()))
+		case "size":
+			ls.PushInteger(info.Size())
+		case "modification":
+			ls.PushInteger(info.ModTime().Unix())
+		case "permissions":
+			ls.PushString(info.Mode().Perm().String()[1:])
+		case "name":
+			ls.PushString(info.Name())
+		default:
+			return ls.ArgError(2, "invalid attribute name '"+field+"'")
+		}
+		return 1
+	}
+	ls.CreateTable(0, 5)
+	ls.PushString(_fileMode(info.Mode()))
+	ls.SetField(-2, "mode")
+	ls.PushInteger(info.Size())
+	ls.SetField(-2, "size")
+	ls.PushInteger(info.ModTime().Unix())
+	ls.SetField(-2, "modification")
+	ls.PushString(info.Mode().Perm().String()[1:]) /* skip the type letter */
+	ls.SetField(-2, "permissions")
+	ls.PushString(info.Name())
+	ls.SetField(-2, "name")
+	return 1
+}
+
+func _fileMode(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "link"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeCharDevice != 0:
+		return "char device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	default:
+		return "other"
+	}
+}
+
+// fs.mkdir (path [, perm])
+func fsMkdir(ls LuaState) int {
+	path := ls.CheckString(1)
+	perm := ls.OptInteger(2, 0777)
+	return _fsResult(ls, os.Mkdir(path, os.FileMode(perm)), path)
+}
+
+// fs.mkdirall (path [, perm])
+// creates 'path' along with any missing parents
+func fsMkdirAll(ls LuaState) int {
+	path := ls.CheckString(1)
+	perm := ls.OptInteger(2, 0777)
+	return _fsResult(ls, os.MkdirAll(path, os.FileMode(perm)), path)
+}
+
+// fs.rmdir (path)
+// removes an empty directory
+func fsRmdir(ls LuaState) int {
+	path := ls.CheckString(1)
+	info, err := os.Lstat(path)
+	if err == nil && !info.IsDir() {
+		err = syscall.ENOTDIR
+	}
+	if err == nil {
+		err = os.Remove(path)
+	}
+	return _fsResult(ls, err, path)
+}
+
+// fs.glob (pattern)
+// returns a sorted list of the paths matching 'pattern'
+func fsGlob(ls LuaState) int {
+	pattern := ls.CheckString(1)
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return _fsError(ls, err, pattern)
+	}
+	ls.CreateTable(len(matches), 0)
+	for i, match := range matches {
+		ls.PushString(match)
+		ls.RawSetI(-2, int64(i+1))
+	}
+	return 1
+}
+
+// fs.walk (root, f)
+// calls 'f(path, mode)' for every file under 'root' in lexical
+// order; if 'f' returns false for a directory it is not entered
+func fsWalk(ls LuaState) int {
+	root := ls.CheckString(1)
+	ls.CheckType(2, LUA_TFUNCTION)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ls.PushValue(2)
+		ls.PushString(path)
+		ls.PushString(_fileMode(d.Type()))
+		ls.Call(2, 1)
+		skip := ls.IsBoolean(-1) && !ls.ToBoolean(-1)
+		ls.Pop(1)
+		if skip && d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return _fsResult(ls, err, "")
+}
+
+// fs.chdir (path)
+func fsChdir(ls LuaState) int {
+	path := ls.CheckString(1)
+	return _fsResult(ls, os.Chdir(path), path)
+}
+
+// fs.currentdir ()
+func fsCurrentDir(ls LuaState) int {
+	dir, err := os.Getwd()
+	if err != nil {
+		return _fsError(ls, err, "")
+	}
+	ls.PushString(dir)
+	return 1
+}
+
+// fs.link (old, new [, symlink])
+// creates a hard link, or a symbolic link if 'symlink' is true
+func fsLink(ls LuaState) int {
+	oldName := ls.CheckString(1)
+	newName := ls.CheckString(2)
+	if ls.ToBoolean(3) {
+		return _fsResult(ls, os.Symlink(oldName, newName), newName)
+	}
+	return _fsResult(ls, os.Link(oldName, newName), newName)
+}
+
+// fs.readlink (path)
+// returns the target of a symbolic link
+func fsReadLink(ls LuaState) int {
+	path := ls.CheckString(1)
+	target, err := os.Readlink(path)
+	if err != nil {
+		return _fsError(ls, err, path)
+	}
+	ls.PushString(target)
+	return 1
+}
+
+// fs.touch (path [, atime [, mtime]])
+// sets the access and modification times of 'path' (default now),
+// creating an empty file if it does not exist
+func fsTouch(ls LuaState) int {
+	path := ls.CheckString(1)
+	now := time.Now().Unix()
+	atime := ls.OptInteger(2, now)
+	mtime := ls.OptInteger(3, atime)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return _fsError(ls, err, path)
+		}
+		f.Close()
+	}
+	err := os.Chtimes(path, time.Unix(atime, 0), time.Unix(mtime, 0))
+	return _fsResult(ls, err, path)
+}
@@ -0,0 +1,559 @@
+package stdlib
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	. "lxa/api"
+)
+
+var jsonLib = map[string]GoFunction{
+	"encode": jsonEncode,
+	"decode": jsonDecode,
+}
+
+/*
+** The 'json.null' sentinel is an empty read-only table shared by
+** every function of the library as its first upvalue, so that
+** 'json.decode(json.encode(json.null)) == json.null'.
+ */
+func OpenJSONLib(ls LuaState) int {
+	ls.NewLibTable(jsonLib)
+	_createJSONNull(ls)
+	ls.PushValue(-1)
+	ls.SetField(-3, "null")
+	ls.SetFuncs(jsonLib, 1)
+	return 1
+}
+
+func _createJSONNull(ls LuaState) {
+	ls.NewTable() /* the sentinel */
+	ls.NewTable() /* its metatable */
+	ls.PushGoFunction(func(ls LuaState) int {
+		ls.PushString("null")
+		return 1
+	})
+	ls.SetField(-2, "__tostring")
+	ls.PushGoFunction(func(ls LuaState) int {
+		return ls.Error2("attempt to modify json.null")
+	})
+	ls.SetField(-2, "__newindex")
+	ls.PushString("json.null")
+	ls.SetField(-2, "__metatable")
+	ls.SetMetatable(-2)
+}
+
+/* encoder */
+
+// json.encode (value [, options])
+// options: indent (string or boolean), sort_keys (boolean, default true),
+// empty_table ("object" or "array", default "object")
+func jsonEncode(ls LuaState) int {
+	ls.CheckAny(1)
+	enc := &jsonEncoder{
+		ls:       ls,
+		sortKeys: true,
+		visited:  map[interface{}]bool{},
+	}
+	if !ls.IsNoneOrNil(2) {
+		ls.CheckType(2, LUA_TTABLE)
+		enc.readOptions(2)
+	}
+	ls.SetTop(1)
+	enc.encode(1, 0)
+	ls.PushString(enc.buf.String())
+	return 1
+}
+
+type jsonEncoder struct {
+	ls         LuaState
+	buf        bytes.Buffer
+	indent     string
+	sortKeys   bool
+	emptyArray bool
+	visited    map[interface{}]bool
+}
+
+func (self *jsonEncoder) readOptions(idx int) {
+	ls := self.ls
+	switch ls.GetField(idx, "indent") {
+	case LUA_TBOOLEAN:
+		if ls.ToBoolean(-1) {
+			self.indent = "  "
+		}
+	case LUA_TNUMBER:
+		n := ls.ToInteger(-1)
+		for i := int64(0); i < n; i++ {
+			self.indent += " "
+		}
+	case LUA_TSTRING:
+		self.indent = ls.ToString(-1)
+	}
+	if ls.GetField(idx, "sort_keys") != LUA_TNIL {
+		self.sortKeys = ls.ToBoolean(-1)
+	}
+	if ls.GetField(idx, "empty_table") != LUA_TNIL {
+		switch et := ls.ToString(-1); et {
+		case "array":
+			self.emptyArray = true
+		case "object":
+			self.emptyArray = false
+		default:
+			ls.ArgError(idx, "invalid option 'empty_table' (\""+et+"\")")
+		}
+	}
+	ls.Pop(3)
+}
+
+func (self *jsonEncoder) encode(idx, depth int) {
+	ls := self.ls
+	switch ls.Type(idx) {
+	case LUA_TNIL:
+		self.buf.WriteString("null")
+	case LUA_TBOOLEAN:
+		if ls.ToBoolean(idx) {
+			self.buf.WriteString("true")
+		} else {
+			self.buf.WriteString("false")
+		}
+	case LUA_TNUMBER:
+		self.encodeNumber(idx)
+	case LUA_TSTRING:
+		self.encodeString(ls.ToString(idx))
+	case LUA_TTABLE:
+		if ls.RawEqual(idx, LuaUpvalueIndex(1)) { /* json.null? */
+			self.buf.WriteString("null")
+		} else {
+			self.encodeTable(idx, depth)
+		}
+	default:
+		ls.Error2("json: cannot encode a %s value", ls.TypeName2(idx))
+	}
+}
+
+func (self *jsonEncoder) encodeNumber(idx int) {
+	ls := self.ls
+	if ls.IsInteger(idx) {
+		self.buf.WriteString(strconv.FormatInt(ls.ToInteger(idx), 10))
+		return
+	}
+	f := ls.ToNumber(idx)
+	switch {
+	case math.IsNaN(f) || math.IsInf(f, 0):
+		ls.Error2("json: cannot encode number '%v'", f)
+	case f == math.Trunc(f) && math.Abs(f) < 1e15:
+		/* keep the '.0' so that it decodes back to a float */
+		self.buf.WriteString(strconv.FormatFloat(f, 'f', 1, 64))
+	default:
+		self.buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+}
+
+func (self *jsonEncoder) encodeString(s string) {
+	const hex = "0123456789abcdef"
+	self.buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			self.buf.WriteByte('\\')
+			self.buf.WriteByte(c)
+		case '\b':
+			self.buf.WriteString(`\b`)
+		case '\f':
+			self.buf.WriteString(`\f`)
+		case '\n':
+			self.buf.WriteString(`\n`)
+		case '\r':
+			self.buf.WriteString(`\r`)
+		case '\t':
+			self.buf.WriteString(`\t`)
+		default:
+			if c < 0x20 {
+				self.buf.WriteString(`\u00`)
+				self.buf.WriteByte(hex[c>>4])
+				self.buf.WriteByte(hex[c&0xf])
+			} else {
+				self.buf.WriteByte(c)
+			}
+		}
+	}
+	self.buf.WriteByte('"')
+}
+
+/*
+** A table whose keys are exactly 1..n is encoded as an array,
+** any other non-empty table as an object.
+ */
+func (self *jsonEncoder) encodeTable(idx, depth int) {
+	ls := self.ls
+	ls.CheckStack2(4, "json: table is too deeply nested")
+	idx = ls.AbsIndex(idx)
+	p := ls.ToPointer(idx)
+	if self.visited[p] {
+		ls.Error2("json: cannot encode a table with cycles")
+	}
+	self.visited[p] = true
+	defer delete(self.visited, p)
+
+	keys, isArray := self.scanTable(idx)
+	n := len(keys)
+	if n == 0 {
+		if self.emptyArray {
+			self.buf.WriteString("[]")
+		} else {
+			self.buf.WriteString("{}")
+		}
+		return
+	}
+
+	if isArray {
+		self.buf.WriteByte('[')
+		for i := int64(1); i <= int64(n); i++ {
+			self.separator(i > 1, depth+1)
+			ls.RawGetI(idx, i)
+			self.encode(-1, depth+1)
+			ls.Pop(1)
+		}
+		self.newline(depth)
+		self.buf.WriteByte(']')
+		return
+	}
+
+	if self.sortKeys {
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].name < keys[j].name
+		})
+	}
+	self.buf.WriteByte('{')
+	for i, key := range keys {
+		self.separator(i > 0, depth+1)
+		self.encodeString(key.name)
+		self.buf.WriteByte(':')
+		if self.indent != "" {
+			self.buf.WriteByte(' ')
+		}
+		if key.isNum {
+			ls.StringToNumber(key.name)
+		} else {
+			ls.PushString(key.name)
+		}
+		ls.RawGet(idx)
+		self.encode(-1, depth+1)
+		ls.Pop(1)
+	}
+	self.newline(depth)
+	self.buf.WriteByte('}')
+}
+
+type jsonKey struct {
+	name  string
+	isNum bool
+}
+
+// returns the keys of the table and whether it is a proper sequence
+func (self *jsonEncoder) scanTable(idx int) ([]jsonKey, bool) {
+	ls := self.ls
+	isArray := true
+	keys := make([]jsonKey, 0, 8)
+	ls.PushNil()
+	for ls.Next(idx) {
+		switch ls.Type(-2) {
+		case LUA_TNUMBER:
+			var name string
+			if i, ok := ls.ToIntegerX(-2); ok && ls.IsInteger(-2) {
+				name = strconv.FormatInt(i, 10)
+				isArray = isArray && i >= 1 && uint(i) <= ls.RawLen(idx)
+			} else {
+				name = strconv.FormatFloat(ls.ToNumber(-2), 'g', -1, 64)
+				isArray = false
+			}
+			keys = append(keys, jsonKey{name, true})
+		case LUA_TSTRING:
+			isArray = false
+			keys = append(keys, jsonKey{ls.ToString(-2), false})
+		default:
+			ls.Error2("json: cannot encode a table with %s keys", ls.TypeName2(-2))
+		}
+		ls.Pop(1) /* remove value */
+	}
+	return keys, isArray && uint(len(keys)) == ls.RawLen(idx)
+}
+
+func (self *jsonEncoder) separator(comma bool, depth int) {
+	if comma {
+		self.buf.WriteByte(',')
+	}
+	self.newline(depth)
+}
+
+func (self *jsonEncoder) newline(depth int) {
+	if self.indent != "" {
+		self.buf.WriteByte('\n')
+		for i := 0; i < depth; i++ {
+			self.buf.WriteString(self.indent)
+		}
+	}
+}
+
+/* decoder */
+
+// json.decode (s [, null])
+// JSON nulls are decoded to the 'null' argument if given,
+// otherwise to json.null
+func jsonDecode(ls LuaState) int {
+	dec := &jsonDecoder{
+		ls:   ls,
+		data: ls.CheckString(1),
+	}
+	if ls.IsNone(2) {
+		ls.PushValue(LuaUpvalueIndex(1))
+	} else {
+		ls.PushValue(2)
+	}
+	dec.nullIdx = ls.GetTop()
+	dec.skipSpace()
+	dec.decode()
+	dec.skipSpace()
+	if dec.pos < len(dec.data) {
+		dec.error("unexpected trailing character")
+	}
+	return 1
+}
+
+type jsonDecoder struct {
+	ls      LuaState
+	data    string
+	pos     int
+	nullIdx int
+}
+
+func (self *jsonDecoder) error(msg string) {
+	if self.pos < len(self.data) {
+		self.ls.Error2("json: %s near '%c' at position %d", msg, self.data[self.pos], self.pos+1)
+	} else {
+		self.ls.Error2("json: %s at end of input", msg)
+	}
+}
+
+func (self *jsonDecoder) skipSpace() {
+	for self.pos < len(self.data) {
+		switch self.data[self.pos] {
+		case ' ', '\t', '\n', '\r':
+			self.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (self *jsonDecoder) expect(lit string) bool {
+	if len(self.data)-self.pos >= len(lit) &&
+		self.data[self.pos:self.pos+len(lit)] == lit {
+		self.pos += len(lit)
+		return true
+	}
+	return false
+}
+
+// decodes a value and pushes it onto the stack
+func (self *jsonDecoder) decode() {
+	ls := self.ls
+	ls.CheckStack2(3, "json: too many nested values")
+	if self.pos >= len(self.data) {
+		self.error("unexpected end of input")
+	}
+	switch c := self.data[self.pos]; {
+	case c == '{':
+		self.decodeObject()
+	case c == '[':
+		self.decodeArray()
+	case c == '"':
+		ls.PushString(self.decodeString())
+	case c == '-' || c >= '0' && c <= '9':
+		self.decodeNumber()
+	case self.expect("true"):
+		ls.PushBoolean(true)
+	case self.expect("false"):
+		ls.PushBoolean(false)
+	case self.expect("null"):
+		ls.PushValue(self.nullIdx)
+	default:
+		self.error("unexpected character")
+	}
+}
+
+func (self *jsonDecoder) decodeObject() {
+	ls := self.ls
+	ls.NewTable()
+	self.pos++ /* skip '{' */
+	self.skipSpace()
+	if self.expect("}") {
+		return
+	}
+	for {
+		if self.pos >= len(self.data) || self.data[self.pos] != '"' {
+			self.error("expected string key")
+		}
+		ls.PushString(self.decodeString())
+		self.skipSpace()
+		if !self.expect(":") {
+			self.error("expected ':'")
+		}
+		self.skipSpace()
+		self.decode()
+		if ls.IsNil(-1) { /* null decoded to nil: key is absent */
+			ls.Pop(2)
+		} else {
+			ls.RawSet(-3)
+		}
+		self.skipSpace()
+		if self.expect("}") {
+			return
+		} else if !self.expect(",") {
+			self.error("expected ',' or '}'")
+		}
+		self.skipSpace()
+	}
+}
+
+func (self *jsonDecoder) decodeArray() {
+	ls := self.ls
+	ls.NewTable()
+	self.pos++ /* skip '[' */
+	self.skipSpace()
+	if self.expect("]") {
+		return
+	}
+	for i := int64(1); ; i++ {
+		self.decode()
+		ls.RawSetI(-2, i)
+		self.skipSpace()
+		if self.expect("]") {
+			return
+		} else if !self.expect(",") {
+			self.error("expected ',' or ']'")
+		}
+		self.skipSpace()
+	}
+}
+
+/*
+** Numbers without fraction or exponent that fit in an int64 are
+** decoded as integers, everything else as floats.
+ */
+func (self *jsonDecoder) decodeNumber() {
+	start := self.pos
+	isFloat := false
+	if self.data[self.pos] == '-' {
+		self.pos++
+	}
+	self.digits()
+	if self.pos < len(self.data) && self.data[self.pos] == '.' {
+		isFloat = true
+		self.pos++
+		self.digits()
+	}
+	if self.pos < len(self.data) && (self.data[self.pos] == 'e' || self.data[self.pos] == 'E') {
+		isFloat = true
+		self.pos++
+		if self.pos < len(self.data) && (self.data[self.pos] == '+' || self.data[self.pos] == '-') {
+			self.pos++
+		}
+		self.digits()
+	}
+
+	s := self.data[start:self.pos]
+	if !isFloat {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			self.ls.PushInteger(i)
+			return
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && f == 0 {
+		self.pos = start
+		self.error("malformed number")
+	}
+	self.ls.PushNumber(f)
+}
+
+func (self *jsonDecoder) digits() {
+	start := self.pos
+	for self.pos < len(self.data) && self.data[self.pos] >= '0' && self.data[self.pos] <= '9' {
+		self.pos++
+	}
+	if self.pos == start {
+		self.error("malformed number")
+	}
+}
+
+func (self *jsonDecoder) decodeString() string {
+	var buf bytes.Buffer
+	self.pos++ /* skip '"' */
+	for self.pos < len(self.data) {
+		c := self.data[self.pos]
+		switch {
+		case c == '"':
+			self.pos++
+			return buf.String()
+		case c < 0x20:
+			self.error("control character in string")
+		case c != '\\':
+			buf.WriteByte(c)
+			self.pos++
+			continue
+		}
+		self.pos++ /* skip '\\' */
+		if self.pos >= len(self.data) {
+			break
+		}
+		switch self.data[self.pos] {
+		case '"', '\\', '/':
+			buf.WriteByte(self.data[self.pos])
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'u':
+			r := self.hex4()
+			if utf16.IsSurrogate(r) {
+				r2 := utf8.RuneError
+				if self.expect(`\u`) {
+					self.pos-- /* hex4 skips the 'u' */
+					r2 = self.hex4()
+				}
+				r = utf16.DecodeRune(r, r2)
+			}
+			buf.WriteRune(r)
+			continue
+		default:
+			self.error("invalid escape sequence")
+		}
+		self.pos++
+	}
+	self.error("unfinished string")
+	return ""
+}
+
+// reads 'uXXXX' and returns the code point
+func (self *jsonDecoder) hex4() rune {
+	if len(self.data)-self.pos < 5 {
+		self.error("invalid unicode escape")
+	}
+	r, err := strconv.ParseUint(self.data[self.pos+1:self.pos+5], 16, 16)
+	if err != nil {
+		self.error("invalid unicode escape")
+	}
+	self.pos += 5
+	return rune(r)
+}
@@ -1,8 +1,5 @@
 package stdlib
 
-//#include <time.h>
-import "C"
-
 import (
 	"os"
 	"time"
@@ -33,8 +30,7 @@ func OpenOSLib(ls LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.clock
 // lua-5.3.4/src/loslib.c#os_clock()
 func osClock(ls LuaState) int {
-	c := float64(C.clock()) / float64(C.CLOCKS_PER_SEC)
-	ls.PushNumber(c)
+	ls.PushNumber(cpuTime())
 	return 1
 }
 
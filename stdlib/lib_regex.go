@@ -0,0 +1,279 @@
+package stdlib
+
+import (
+	"regexp"
+
+	. "lxa/api"
+)
+
+/*
+** The 'regex' library exposes Go's RE2 engine (package regexp),
+** independently of the Lua patterns used by the 'string' library.
+** Compiled expressions are userdata with the methods below.
+ */
+
+const REGEX_TYPE = "regex"
+
+var regexLib = map[string]GoFunction{
+	"compile": regexCompile,
+	"quote":   regexQuote,
+}
+
+var regexMethods = map[string]GoFunction{
+	"match":   regexMatch,
+	"find":    regexFind,
+	"groups":  regexGroups,
+	"findall": regexFindAll,
+	"gsub":    regexGsub,
+	"split":   regexSplit,
+	/* metamethods */
+	"__tostring": regexToString,
+	"__index":    nil,
+}
+
+func OpenRegexLib(ls LuaState) int {
+	ls.NewLib(regexLib)
+	_createRegexMetatable(ls)
+	return 1
+}
+
+func _createRegexMetatable(ls LuaState) {
+	ls.NewMetatable(REGEX_TYPE) /* metatable for regex objects */
+	ls.SetFuncs(regexMethods, 0)
+	ls.PushValue(-1)           /* push metatable */
+	ls.SetField(-2, "__index") /* metatable.__index = metatable */
+	ls.Pop(1)                  /* pop metatable */
+}
+
+func _checkRegex(ls LuaState) *regexp.Regexp {
+	return ls.CheckUserData(1, REGEX_TYPE).(*regexp.Regexp)
+}
+
+// regex.compile (pattern)
+// returns a regex object, or nil plus an error message
+func regexCompile(ls LuaState) int {
+	pattern := ls.CheckString(1)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		ls.PushNil()
+		ls.PushString(err.Error())
+		return 2
+	}
+	ls.NewUserData(re)
+	ls.SetMetatable2(REGEX_TYPE)
+	return 1
+}
+
+// regex.quote (s)
+// escapes all regular expression metacharacters in 's'
+func regexQuote(ls LuaState) int {
+	ls.PushString(regexp.QuoteMeta(ls.CheckString(1)))
+	return 1
+}
+
+// re:match (s [, init])
+// returns the captures of the first match (or the whole match
+// if there are none), like string.match
+func regexMatch(ls LuaState) int {
+	re := _checkRegex(ls)
+	s, init, ok := _regexSubject(ls)
+	if !ok {
+		ls.PushNil()
+		return 1
+	}
+	loc := re.FindStringSubmatchIndex(s[init:])
+	if loc == nil {
+		ls.PushNil()
+		return 1
+	}
+	return _pushCaptures(ls, s[init:], loc, true)
+}
+
+// re:find (s [, init])
+// returns the start and end of the first match followed by its
+// captures, like string.find
+func regexFind(ls LuaState) int {
+	re := _checkRegex(ls)
+	s, init, ok := _regexSubject(ls)
+	if !ok {
+		ls.PushNil()
+		return 1
+	}
+	loc := re.FindStringSubmatchIndex(s[init:])
+	if loc == nil {
+		ls.PushNil()
+		return 1
+	}
+	ls.PushInteger(int64(init + loc[0] + 1))
+	ls.PushInteger(int64(init + loc[1]))
+	return 2 + _pushCaptures(ls, s[init:], loc, false)
+}
+
+// re:groups (s [, init])
+// returns the first match as a table: [0] is the whole match,
+// 1..n the numbered captures and named captures by name
+func regexGroups(ls LuaState) int {
+	re := _checkRegex(ls)
+	s, init, ok := _regexSubject(ls)
+	if !ok {
+		ls.PushNil()
+		return 1
+	}
+	loc := re.FindStringSubmatchIndex(s[init:])
+	if loc == nil {
+		ls.PushNil()
+		return 1
+	}
+	_pushGroups(ls, re, s[init:], loc)
+	return 1
+}
+
+// re:findall (s [, n])
+// returns a list with at most 'n' matches; each element is the
+// matched string, or a table like re:groups if there are captures
+func regexFindAll(ls LuaState) int {
+	re := _checkRegex(ls)
+	s := ls.CheckString(2)
+	n := int(ls.OptInteger(3, -1))
+	all := re.FindAllStringSubmatchIndex(s, n)
+	ls.CreateTable(len(all), 0)
+	for i, loc := range all {
+		if re.NumSubexp() == 0 {
+			ls.PushString(s[loc[0]:loc[1]])
+		} else {
+			_pushGroups(ls, re, s, loc)
+		}
+		ls.RawSetI(-2, int64(i+1))
+	}
+	return 1
+}
+
+// re:gsub (s, repl [, n])
+// 'repl' is either a template where $1 or ${name} stand for captures,
+// a table indexed by the first capture, or a function called with
+// the captures; returns the new string and the number of matches
+func regexGsub(ls LuaState) int {
+	re := _checkRegex(ls)
+	s := ls.CheckString(2)
+	tr := ls.Type(3)
+	ls.ArgCheck(tr == LUA_TNUMBER || tr == LUA_TSTRING ||
+		tr == LUA_TFUNCTION || tr == LUA_TTABLE, 3,
+		"string/function/table expected")
+	n := int(ls.OptInteger(4, -1))
+
+	var template string
+	if tr == LUA_TSTRING || tr == LUA_TNUMBER {
+		template = ls.ToString(3)
+	}
+	var b []byte
+	last, count := 0, 0
+	for _, loc := range re.FindAllStringSubmatchIndex(s, n) {
+		b = append(b, s[last:loc[0]]...)
+		last = loc[1]
+		count++
+		switch tr {
+		case LUA_TFUNCTION:
+			ls.PushValue(3)
+			nCaps := _pushCaptures(ls, s, loc, true)
+			ls.Call(nCaps, 1)
+		case LUA_TTABLE:
+			if re.NumSubexp() == 0 {
+				ls.PushString(s[loc[0]:loc[1]])
+			} else {
+				_pushSubmatch(ls, s, loc, 1) /* first capture */
+			}
+			ls.GetTable(3)
+		default:
+			b = re.ExpandString(b, template, s, loc)
+			continue
+		}
+		if !ls.ToBoolean(-1) { /* nil or false? */
+			b = append(b, s[loc[0]:loc[1]]...) /* keep original text */
+		} else if str, ok := ls.ToStringX(-1); ok {
+			b = append(b, str...)
+		} else {
+			return ls.Error2("invalid replacement value (a %s)", ls.TypeName2(-1))
+		}
+		ls.Pop(1)
+	}
+	b = append(b, s[last:]...)
+	ls.PushString(string(b))
+	ls.PushInteger(int64(count))
+	return 2
+}
+
+// re:split (s [, n])
+// returns a list of the substrings between matches; if 'n' is
+// given, at most 'n' substrings are returned
+func regexSplit(ls LuaState) int {
+	re := _checkRegex(ls)
+	s := ls.CheckString(2)
+	n := int(ls.OptInteger(3, -1))
+	parts := re.Split(s, n)
+	ls.CreateTable(len(parts), 0)
+	for i, part := range parts {
+		ls.PushString(part)
+		ls.RawSetI(-2, int64(i+1))
+	}
+	return 1
+}
+
+func regexToString(ls LuaState) int {
+	re := _checkRegex(ls)
+	ls.PushFString("regex: %q", re.String())
+	return 1
+}
+
+/* helper */
+
+// returns the subject string and the 0-based start position
+// given by the optional 'init' argument
+func _regexSubject(ls LuaState) (string, int, bool) {
+	s := ls.CheckString(2)
+	init := posRelat(ls.OptInteger(3, 1), len(s))
+	if init < 1 {
+		init = 1
+	} else if init > len(s)+1 { /* start after string's end? */
+		return s, 0, false
+	}
+	return s, init - 1, true
+}
+
+// pushes the captures of a match (nil for those that did not
+// participate); if there are none and 'whole' is set, pushes
+// the whole match instead
+func _pushCaptures(ls LuaState, s string, loc []int, whole bool) int {
+	nCaps := len(loc)/2 - 1
+	if nCaps == 0 {
+		if !whole {
+			return 0
+		}
+		ls.PushString(s[loc[0]:loc[1]])
+		return 1
+	}
+	ls.CheckStack2(nCaps, "too many captures")
+	for i := 1; i <= nCaps; i++ {
+		_pushSubmatch(ls, s, loc, i)
+	}
+	return nCaps
+}
+
+func _pushGroups(ls LuaState, re *regexp.Regexp, s string, loc []int) {
+	ls.CreateTable(re.NumSubexp(), 1)
+	for i, name := range re.SubexpNames() {
+		_pushSubmatch(ls, s, loc, i)
+		if name != "" {
+			ls.PushValue(-1)
+			ls.SetField(-3, name)
+		}
+		ls.RawSetI(-2, int64(i))
+	}
+}
+
+func _pushSubmatch(ls LuaState, s string, loc []int, i int) {
+	if loc[2*i] < 0 {
+		ls.PushNil()
+	} else {
+		ls.PushString(s[loc[2*i]:loc[2*i+1]])
+	}
+}
@@ -0,0 +1,17 @@
+local x, y = 6, 3 -- @5
+print(bit.band(x, y), bit.bor(x, y), bit.bxor(x, y), bit.bnot(x), bit.lshift(x, 1), bit.rshift(x, 1), math.floor(x / y)) -- @6
+getfenv(1)["end"] = 1 -- @7
+print(getfenv(1)["end"]) -- @8
+for i = 1, 5 do -- @9
+  local __lxa_break = false
+  repeat
+    if i == 2 then -- @10
+      break -- @11
+    end
+    if i == 4 then -- @13
+      __lxa_break = true; break -- @14
+    end
+    print(i) -- @16
+  until true
+  if __lxa_break then break end
+end
@@ -49,7 +49,8 @@ func tailCall(i Instruction, vm LuaVM) {
 	a, b, _ := i.ABC()
 	a += 1
 
-	// todo: optimize tail call!
+	// Lua functions never get here: the state reuses the running
+	// frame for them, other callables get a regular call
 	c := 0
 	nArgs := _pushFuncAndArgs(a, b, vm)
 	vm.Call(nArgs, c-1)
@@ -0,0 +1,64 @@
+package vm
+
+const MAXARG_Bx54 = 1<<17 - 1         // 131071
+const OFFSET_sBx54 = MAXARG_Bx54 >> 1 // 65535
+const MAXARG_Ax54 = 1<<25 - 1         // 33554431
+const OFFSET_sJ54 = MAXARG_Ax54 >> 1  // 16777215
+const OFFSET_sC54 = 0xFF >> 1         // 127
+
+/*
+ 31      23      15 14      6     0
+  +-------+-------+-+-------+------+
+  |c=8bits|b=8bits|k|a=8bits|op=7  |
+  +-------+-------+-+-------+------+
+  |      bx=17bits  |a=8bits|op=7  |
+  +-------+-------+-+-------+------+
+  |     sbx=17bits  |a=8bits|op=7  |
+  +-------+-------+-+-------+------+
+  |      ax=25bits (sj)     |op=7  |
+  +-------+-------+-+-------+------+
+*/
+type Instruction54 uint32
+
+func (self Instruction54) Opcode() int {
+	return int(self & 0x7F)
+}
+
+func (self Instruction54) ABCk() (a, b, c, k int) {
+	a = int(self >> 7 & 0xFF)
+	k = int(self >> 15 & 0x1)
+	b = int(self >> 16 & 0xFF)
+	c = int(self >> 24 & 0xFF)
+	return
+}
+
+func (self Instruction54) ABx() (a, bx int) {
+	a = int(self >> 7 & 0xFF)
+	bx = int(self >> 15)
+	return
+}
+
+func (self Instruction54) AsBx() (a, sbx int) {
+	a, bx := self.ABx()
+	return a, bx - OFFSET_sBx54
+}
+
+func (self Instruction54) Ax() int {
+	return int(self >> 7)
+}
+
+func (self Instruction54) SJ() int {
+	return int(self>>7) - OFFSET_sJ54
+}
+
+func (self Instruction54) OpName() string {
+	return opcodes54[self.Opcode()].name
+}
+
+func (self Instruction54) OpMode() byte {
+	return opcodes54[self.Opcode()].opMode
+}
+
+func (self Instruction54) IsValid() bool {
+	return self.Opcode() < len(opcodes54)
+}
@@ -1,6 +1,9 @@
 package vm
 
-import "lxa/api"
+import (
+	"lxa/api"
+	"strings"
+)
 
 /* OpMode */
 /* basic instruction format */
@@ -130,3 +133,14 @@ var opcodes = []opcode{
 	opcode{0, 1, OpArgU, OpArgN, IABC /* */, "VARARG  ", vararg},   // R(A), R(A+1), ..., R(A+B-2) = vararg
 	opcode{0, 0, OpArgU, OpArgU, IAx /*  */, "EXTRAARG", nil},      // extra (larger) argument for previous opcode
 }
+
+// OpcodeByName finds an opcode by the name the disassembler lists it
+// with, such as "GETTABUP"
+func OpcodeByName(name string) (int, bool) {
+	for op, info := range opcodes {
+		if strings.TrimSpace(info.name) == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
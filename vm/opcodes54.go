@@ -0,0 +1,213 @@
+package vm
+
+/*
+** Lua 5.4 instructions, which lxa only produces (see -target 5.4):
+** there is no 5.4 vm here, so the table below is what the generator
+** and the disassembler need to know about each opcode.
+ */
+
+/* OpMode */
+/* basic instruction format */
+const (
+	IABC54  = iota // [ C:8  ][ B:8  ][k:1][ A:8  ][OP:7]
+	IABx54         // [      Bx:17       ][ A:8  ][OP:7]
+	IAsBx54        // [     sBx:17       ][ A:8  ][OP:7]
+	IAx54          // [           Ax:25          ][OP:7]
+	IsJ54          // [           sJ:25          ][OP:7]
+)
+
+/* OpCode */
+const (
+	OP54_MOVE = iota
+	OP54_LOADI
+	OP54_LOADF
+	OP54_LOADK
+	OP54_LOADKX
+	OP54_LOADFALSE
+	OP54_LFALSESKIP
+	OP54_LOADTRUE
+	OP54_LOADNIL
+	OP54_GETUPVAL
+	OP54_SETUPVAL
+	OP54_GETTABUP
+	OP54_GETTABLE
+	OP54_GETI
+	OP54_GETFIELD
+	OP54_SETTABUP
+	OP54_SETTABLE
+	OP54_SETI
+	OP54_SETFIELD
+	OP54_NEWTABLE
+	OP54_SELF
+	OP54_ADDI
+	OP54_ADDK
+	OP54_SUBK
+	OP54_MULK
+	OP54_MODK
+	OP54_POWK
+	OP54_DIVK
+	OP54_IDIVK
+	OP54_BANDK
+	OP54_BORK
+	OP54_BXORK
+	OP54_SHRI
+	OP54_SHLI
+	OP54_ADD
+	OP54_SUB
+	OP54_MUL
+	OP54_MOD
+	OP54_POW
+	OP54_DIV
+	OP54_IDIV
+	OP54_BAND
+	OP54_BOR
+	OP54_BXOR
+	OP54_SHL
+	OP54_SHR
+	OP54_MMBIN
+	OP54_MMBINI
+	OP54_MMBINK
+	OP54_UNM
+	OP54_BNOT
+	OP54_NOT
+	OP54_LEN
+	OP54_CONCAT
+	OP54_CLOSE
+	OP54_TBC
+	OP54_JMP
+	OP54_EQ
+	OP54_LT
+	OP54_LE
+	OP54_EQK
+	OP54_EQI
+	OP54_LTI
+	OP54_LEI
+	OP54_GTI
+	OP54_GEI
+	OP54_TEST
+	OP54_TESTSET
+	OP54_CALL
+	OP54_TAILCALL
+	OP54_RETURN
+	OP54_RETURN0
+	OP54_RETURN1
+	OP54_FORLOOP
+	OP54_FORPREP
+	OP54_TFORPREP
+	OP54_TFORCALL
+	OP54_TFORLOOP
+	OP54_SETLIST
+	OP54_CLOSURE
+	OP54_VARARG
+	OP54_VARARGPREP
+	OP54_EXTRAARG
+)
+
+/* metamethod events, the C argument of MMBIN, MMBINI and MMBINK */
+// lua-5.4.6/src/ltm.h#TMS
+const (
+	TM54_ADD  = 6
+	TM54_SUB  = 7
+	TM54_MUL  = 8
+	TM54_MOD  = 9
+	TM54_POW  = 10
+	TM54_DIV  = 11
+	TM54_IDIV = 12
+	TM54_BAND = 13
+	TM54_BOR  = 14
+	TM54_BXOR = 15
+	TM54_SHL  = 16
+	TM54_SHR  = 17
+)
+
+type opcode54 struct {
+	opMode byte // op mode
+	name   string
+}
+
+var opcodes54 = []opcode54{
+	/*          mode          name */
+	opcode54{IABC54 /*  */, "MOVE      "}, // R[A] := R[B]
+	opcode54{IAsBx54 /* */, "LOADI     "}, // R[A] := sBx
+	opcode54{IAsBx54 /* */, "LOADF     "}, // R[A] := (lua_Number)sBx
+	opcode54{IABx54 /*  */, "LOADK     "}, // R[A] := K[Bx]
+	opcode54{IABx54 /*  */, "LOADKX    "}, // R[A] := K[extra arg]
+	opcode54{IABC54 /*  */, "LOADFALSE "}, // R[A] := false
+	opcode54{IABC54 /*  */, "LFALSESKIP"}, // R[A] := false; pc++
+	opcode54{IABC54 /*  */, "LOADTRUE  "}, // R[A] := true
+	opcode54{IABC54 /*  */, "LOADNIL   "}, // R[A], R[A+1], ..., R[A+B] := nil
+	opcode54{IABC54 /*  */, "GETUPVAL  "}, // R[A] := UpValue[B]
+	opcode54{IABC54 /*  */, "SETUPVAL  "}, // UpValue[B] := R[A]
+	opcode54{IABC54 /*  */, "GETTABUP  "}, // R[A] := UpValue[B][K[C]:shortstring]
+	opcode54{IABC54 /*  */, "GETTABLE  "}, // R[A] := R[B][R[C]]
+	opcode54{IABC54 /*  */, "GETI      "}, // R[A] := R[B][C]
+	opcode54{IABC54 /*  */, "GETFIELD  "}, // R[A] := R[B][K[C]:shortstring]
+	opcode54{IABC54 /*  */, "SETTABUP  "}, // UpValue[A][K[B]:shortstring] := RK(C)
+	opcode54{IABC54 /*  */, "SETTABLE  "}, // R[A][R[B]] := RK(C)
+	opcode54{IABC54 /*  */, "SETI      "}, // R[A][B] := RK(C)
+	opcode54{IABC54 /*  */, "SETFIELD  "}, // R[A][K[B]:shortstring] := RK(C)
+	opcode54{IABC54 /*  */, "NEWTABLE  "}, // R[A] := {}
+	opcode54{IABC54 /*  */, "SELF      "}, // R[A+1] := R[B]; R[A] := R[B][RK(C):string]
+	opcode54{IABC54 /*  */, "ADDI      "}, // R[A] := R[B] + sC
+	opcode54{IABC54 /*  */, "ADDK      "}, // R[A] := R[B] + K[C]:number
+	opcode54{IABC54 /*  */, "SUBK      "}, // R[A] := R[B] - K[C]:number
+	opcode54{IABC54 /*  */, "MULK      "}, // R[A] := R[B] * K[C]:number
+	opcode54{IABC54 /*  */, "MODK      "}, // R[A] := R[B] % K[C]:number
+	opcode54{IABC54 /*  */, "POWK      "}, // R[A] := R[B] ^ K[C]:number
+	opcode54{IABC54 /*  */, "DIVK      "}, // R[A] := R[B] / K[C]:number
+	opcode54{IABC54 /*  */, "IDIVK     "}, // R[A] := R[B] // K[C]:number
+	opcode54{IABC54 /*  */, "BANDK     "}, // R[A] := R[B] & K[C]:integer
+	opcode54{IABC54 /*  */, "BORK      "}, // R[A] := R[B] | K[C]:integer
+	opcode54{IABC54 /*  */, "BXORK     "}, // R[A] := R[B] ~ K[C]:integer
+	opcode54{IABC54 /*  */, "SHRI      "}, // R[A] := R[B] >> sC
+	opcode54{IABC54 /*  */, "SHLI      "}, // R[A] := sC << R[B]
+	opcode54{IABC54 /*  */, "ADD       "}, // R[A] := R[B] + R[C]
+	opcode54{IABC54 /*  */, "SUB       "}, // R[A] := R[B] - R[C]
+	opcode54{IABC54 /*  */, "MUL       "}, // R[A] := R[B] * R[C]
+	opcode54{IABC54 /*  */, "MOD       "}, // R[A] := R[B] % R[C]
+	opcode54{IABC54 /*  */, "POW       "}, // R[A] := R[B] ^ R[C]
+	opcode54{IABC54 /*  */, "DIV       "}, // R[A] := R[B] / R[C]
+	opcode54{IABC54 /*  */, "IDIV      "}, // R[A] := R[B] // R[C]
+	opcode54{IABC54 /*  */, "BAND      "}, // R[A] := R[B] & R[C]
+	opcode54{IABC54 /*  */, "BOR       "}, // R[A] := R[B] | R[C]
+	opcode54{IABC54 /*  */, "BXOR      "}, // R[A] := R[B] ~ R[C]
+	opcode54{IABC54 /*  */, "SHL       "}, // R[A] := R[B] << R[C]
+	opcode54{IABC54 /*  */, "SHR       "}, // R[A] := R[B] >> R[C]
+	opcode54{IABC54 /*  */, "MMBIN     "}, // call C metamethod over R[A] and R[B]
+	opcode54{IABC54 /*  */, "MMBINI    "}, // call C metamethod over R[A] and sB
+	opcode54{IABC54 /*  */, "MMBINK    "}, // call C metamethod over R[A] and K[B]
+	opcode54{IABC54 /*  */, "UNM       "}, // R[A] := -R[B]
+	opcode54{IABC54 /*  */, "BNOT      "}, // R[A] := ~R[B]
+	opcode54{IABC54 /*  */, "NOT       "}, // R[A] := not R[B]
+	opcode54{IABC54 /*  */, "LEN       "}, // R[A] := #R[B] (length operator)
+	opcode54{IABC54 /*  */, "CONCAT    "}, // R[A] := R[A].. ... ..R[A + B - 1]
+	opcode54{IABC54 /*  */, "CLOSE     "}, // close all upvalues >= R[A]
+	opcode54{IABC54 /*  */, "TBC       "}, // mark variable A "to be closed"
+	opcode54{IsJ54 /*   */, "JMP       "}, // pc += sJ
+	opcode54{IABC54 /*  */, "EQ        "}, // if ((R[A] == R[B]) ~= k) then pc++
+	opcode54{IABC54 /*  */, "LT        "}, // if ((R[A] <  R[B]) ~= k) then pc++
+	opcode54{IABC54 /*  */, "LE        "}, // if ((R[A] <= R[B]) ~= k) then pc++
+	opcode54{IABC54 /*  */, "EQK       "}, // if ((R[A] == K[B]) ~= k) then pc++
+	opcode54{IABC54 /*  */, "EQI       "}, // if ((R[A] == sB) ~= k) then pc++
+	opcode54{IABC54 /*  */, "LTI       "}, // if ((R[A] < sB) ~= k) then pc++
+	opcode54{IABC54 /*  */, "LEI       "}, // if ((R[A] <= sB) ~= k) then pc++
+	opcode54{IABC54 /*  */, "GTI       "}, // if ((R[A] > sB) ~= k) then pc++
+	opcode54{IABC54 /*  */, "GEI       "}, // if ((R[A] >= sB) ~= k) then pc++
+	opcode54{IABC54 /*  */, "TEST      "}, // if (not R[A] == k) then pc++
+	opcode54{IABC54 /*  */, "TESTSET   "}, // if (not R[B] == k) then pc++ else R[A] := R[B]
+	opcode54{IABC54 /*  */, "CALL      "}, // R[A], ... ,R[A+C-2] := R[A](R[A+1], ... ,R[A+B-1])
+	opcode54{IABC54 /*  */, "TAILCALL  "}, // return R[A](R[A+1], ... ,R[A+B-1])
+	opcode54{IABC54 /*  */, "RETURN    "}, // return R[A], ... ,R[A+B-2]
+	opcode54{IABC54 /*  */, "RETURN0   "}, // return
+	opcode54{IABC54 /*  */, "RETURN1   "}, // return R[A]
+	opcode54{IABx54 /*  */, "FORLOOP   "}, // update counters; if loop continues then pc-=Bx;
+	opcode54{IABx54 /*  */, "FORPREP   "}, // <check values and prepare counters>; if not to run then pc+=Bx+1;
+	opcode54{IABx54 /*  */, "TFORPREP  "}, // create upvalue for R[A + 3]; pc+=Bx
+	opcode54{IABC54 /*  */, "TFORCALL  "}, // R[A+4], ... ,R[A+3+C] := R[A](R[A+1], R[A+2]);
+	opcode54{IABx54 /*  */, "TFORLOOP  "}, // if R[A+4] ~= nil then { R[A+2]=R[A+4]; pc -= Bx }
+	opcode54{IABC54 /*  */, "SETLIST   "}, // R[A][C+i] := R[A+i], 1 <= i <= B
+	opcode54{IABx54 /*  */, "CLOSURE   "}, // R[A] := closure(KPROTO[Bx])
+	opcode54{IABC54 /*  */, "VARARG    "}, // R[A], R[A+1], ..., R[A+C-2] = vararg
+	opcode54{IABC54 /*  */, "VARARGPREP"}, // (adjust vararg parameters)
+	opcode54{IAx54 /*   */, "EXTRAARG  "}, // extra (larger) argument for previous opcode
+}
@@ -0,0 +1,245 @@
+package vm
+
+import (
+	"fmt"
+	"lxa/binchunk"
+)
+
+/*
+** The VM trusts its code: registers, constants, upvalues and jumps
+** are used without bounds checks, so a malformed precompiled chunk
+** would crash the process instead of failing to load. Verify checks
+** them once, after binchunk.Undump, as Lua 5.1 did before running a
+** precompiled chunk.
+ */
+type verifier struct {
+	proto *binchunk.Prototype
+	pc    int
+}
+
+type badCode string
+
+// lua-5.1.5/src/ldebug.c#luaG_checkcode()
+func Verify(proto *binchunk.Prototype) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, ok := r.(badCode)
+			if !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("bad code in precompiled chunk (%s)", msg)
+		}
+	}()
+	verifyProto(proto, nil)
+	return nil
+}
+
+func (v *verifier) check(cond bool, f string, a ...interface{}) {
+	if !cond {
+		msg := fmt.Sprintf(f, a...)
+		if v.pc >= 0 {
+			msg = fmt.Sprintf("pc %d: %s", v.pc+1, msg)
+		}
+		panic(badCode(fmt.Sprintf("function at line %d, %s",
+			v.proto.LineDefined, msg)))
+	}
+}
+
+// lua-5.1.5/src/ldebug.c#precheck()
+func verifyProto(proto, parent *binchunk.Prototype) {
+	v := &verifier{proto: proto, pc: -1}
+	code := proto.Code
+	v.check(int(proto.NumParams) <= int(proto.MaxStackSize), "too many parameters")
+	v.check(len(code) > 0 && Instruction(code[len(code)-1]).Opcode() == OP_RETURN,
+		"missing final return")
+	v.check(len(proto.LineInfo) == len(code) || len(proto.LineInfo) == 0,
+		"bad line info")
+	v.check(len(proto.UpvalueNames) <= len(proto.Upvalues), "bad upvalue names")
+	if parent != nil { /* the upvalues of the main function are set by Load */
+		for i, uv := range proto.Upvalues {
+			if uv.Instack == 1 {
+				v.check(int(uv.Idx) < int(parent.MaxStackSize),
+					"upvalue %d refers to register %d", i, uv.Idx)
+			} else {
+				v.check(int(uv.Idx) < len(parent.Upvalues),
+					"upvalue %d refers to upvalue %d", i, uv.Idx)
+			}
+		}
+	}
+
+	for v.pc = range code {
+		v.checkInstruction(Instruction(code[v.pc]))
+	}
+	for _, p := range proto.Protos {
+		verifyProto(p, proto)
+	}
+}
+
+// lua-5.1.5/src/ldebug.c#symbexec()
+func (v *verifier) checkInstruction(i Instruction) {
+	op := i.Opcode()
+	v.check(op <= OP_EXTRAARG, "invalid opcode %d", op)
+
+	a, b, c := i.ABC()
+	switch op {
+	case OP_SETTABUP, OP_JMP, OP_EQ, OP_LT, OP_LE, OP_EXTRAARG:
+		/* A is not a register */
+	default:
+		v.checkReg(a)
+	}
+	if i.OpMode() == IABC {
+		v.checkArg(b, i.BMode())
+		v.checkArg(c, i.CMode())
+	}
+	if opcodes[op].testFlag == 1 {
+		v.check(v.next() == OP_JMP, "test not followed by a jump")
+	}
+	if v.isOpen(i) {
+		code := v.proto.Code
+		v.check(v.pc+1 < len(code) && v.takesOpen(code[v.pc+1]),
+			"open call not consumed")
+	}
+	if v.takesOpen(uint32(i)) {
+		v.check(v.pc > 0 && v.isOpen(Instruction(v.proto.Code[v.pc-1])),
+			"no open call to consume")
+	}
+
+	switch op {
+	case OP_LOADK:
+		_, bx := i.ABx()
+		v.checkConstant(bx)
+	case OP_LOADKX:
+		v.check(v.next() == OP_EXTRAARG, "missing extra argument")
+		v.checkConstant(Instruction(v.proto.Code[v.pc+1]).Ax())
+	case OP_LOADBOOL:
+		if c != 0 {
+			v.checkJump(1)
+		}
+	case OP_LOADNIL:
+		v.checkReg(a + b)
+	case OP_GETUPVAL, OP_SETUPVAL, OP_GETTABUP:
+		v.checkUpvalue(b)
+	case OP_SETTABUP:
+		v.checkUpvalue(a)
+	case OP_SELF:
+		v.checkReg(a + 1)
+	case OP_CONCAT:
+		v.check(b <= c, "bad concatenation")
+	case OP_JMP:
+		if a != 0 {
+			v.checkReg(a - 1)
+		}
+		_, sBx := i.AsBx()
+		v.checkJump(sBx)
+	case OP_CALL, OP_TAILCALL:
+		if b > 0 {
+			v.checkReg(a + b - 1)
+		}
+		if c >= 2 {
+			v.checkReg(a + c - 2)
+		}
+	case OP_RETURN:
+		if b > 1 {
+			v.checkReg(a + b - 2)
+		}
+	case OP_FORLOOP, OP_FORPREP:
+		v.checkReg(a + 3)
+		_, sBx := i.AsBx()
+		v.checkJump(sBx)
+	case OP_TFORCALL:
+		v.check(c >= 1, "no loop variables")
+		v.checkReg(a + 2 + c)
+		v.check(v.next() == OP_TFORLOOP, "missing loop")
+	case OP_TFORLOOP:
+		v.checkReg(a + 1)
+		_, sBx := i.AsBx()
+		v.checkJump(sBx)
+	case OP_SETLIST:
+		if b > 0 {
+			v.checkReg(a + b)
+		}
+		if c == 0 {
+			v.check(v.next() == OP_EXTRAARG, "missing extra argument")
+		}
+	case OP_CLOSURE:
+		_, bx := i.ABx()
+		v.check(bx < len(v.proto.Protos), "function %d out of range", bx)
+	case OP_VARARG:
+		if b > 1 {
+			v.checkReg(a + b - 2)
+		}
+	case OP_EXTRAARG:
+		prev := -1
+		if v.pc > 0 {
+			prev = Instruction(v.proto.Code[v.pc-1]).Opcode()
+		}
+		v.check(prev == OP_LOADKX || prev == OP_SETLIST, "misplaced extra argument")
+	}
+}
+
+func (v *verifier) checkReg(r int) {
+	v.check(r < int(v.proto.MaxStackSize), "register %d out of range", r)
+}
+
+func (v *verifier) checkConstant(k int) {
+	v.check(k < len(v.proto.Constants), "constant %d out of range", k)
+}
+
+func (v *verifier) checkUpvalue(idx int) {
+	v.check(idx < len(v.proto.Upvalues), "upvalue %d out of range", idx)
+}
+
+func (v *verifier) checkArg(x int, mode byte) {
+	switch mode {
+	case OpArgR:
+		v.checkReg(x)
+	case OpArgK:
+		if x&0x100 != 0 { /* ISK(x) */
+			v.checkConstant(x & 0xFF)
+		} else {
+			v.checkReg(x)
+		}
+	}
+}
+
+// a jump may not land on an instruction that needs the one before it
+func (v *verifier) checkJump(sBx int) {
+	dest := v.pc + 1 + sBx
+	code := v.proto.Code
+	v.check(dest >= 0 && dest < len(code), "jump to %d out of range", dest+1)
+	op := Instruction(code[dest]).Opcode()
+	v.check(op != OP_EXTRAARG && !v.takesOpen(code[dest]),
+		"jump into an instruction sequence")
+}
+
+// opcode of the next instruction
+func (v *verifier) next() int {
+	if v.pc+1 < len(v.proto.Code) {
+		return Instruction(v.proto.Code[v.pc+1]).Opcode()
+	}
+	return -1
+}
+
+// leaves a variable number of values on the stack?
+// lua-5.1.5/src/ldebug.c#checkopenop()
+func (v *verifier) isOpen(i Instruction) bool {
+	_, b, c := i.ABC()
+	switch i.Opcode() {
+	case OP_CALL, OP_TAILCALL:
+		return c == 0
+	case OP_VARARG:
+		return b == 0
+	}
+	return false
+}
+
+// takes the values left by the instruction before it?
+func (v *verifier) takesOpen(inst uint32) bool {
+	i := Instruction(inst)
+	_, b, _ := i.ABC()
+	switch i.Opcode() {
+	case OP_CALL, OP_TAILCALL, OP_RETURN, OP_SETLIST:
+		return b == 0
+	}
+	return false
+}